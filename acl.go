@@ -1,157 +1,181 @@
 package users
 
 import (
-	"github.com/gorilla/mux"
+	"fmt"
 	"github.com/sogko/slumber/domain"
 	"net/http"
 )
 
-func (resource *Resource) HandleListUsersACL(req *http.Request, user domain.IUser) (bool, string) {
-	if user == nil {
-		// enforce authenticated access
-		return false, ""
+// ACL denial reasons
+const (
+	ACLReasonUnauthenticated   = "unauthenticated"
+	ACLReasonInactiveAccount   = "inactive_account"
+	ACLReasonMissingPermission = "missing_permission"
+	ACLReasonNotOwner          = "not_owner"
+	ACLReasonNotMember         = "not_member"
+	ACLReasonNotImpersonating  = "not_impersonating"
+	ACLReasonForbidden         = "forbidden"
+)
+
+// ACLDecision is the outcome of evaluating the ACL rule of a route
+type ACLDecision struct {
+	Route       string `json:"route"`
+	Allowed     bool   `json:"allowed"`
+	Reason      string `json:"reason,omitempty"`
+	Rule        string `json:"rule,omitempty"`
+	Explanation string `json:"explanation,omitempty"`
+}
+
+// Status returns the HTTP status code for a denied decision:
+// 401 if the request is unauthenticated, 403 otherwise
+func (decision *ACLDecision) Status() int {
+	if decision.Reason == ACLReasonUnauthenticated {
+		return http.StatusUnauthorized
 	}
-	u := user.(*User)
-	if u.Status != StatusActive {
-		// must be an active user
-		return false, ""
+	return http.StatusForbidden
+}
+
+// Message returns the denial reason, followed by the evaluated rule if `debug` is set
+func (decision *ACLDecision) Message(debug bool) string {
+	if !debug {
+		return decision.Reason
 	}
-	return true, ""
+	return fmt.Sprintf("%v (%v)", decision.Reason, decision.Explanation)
+}
+
+// ACL handlers evaluate the rule configured for their route in the ACLPolicy.
+// See DefaultACLPolicy for the rules applied out of the box.
+
+func (resource *Resource) HandleListUsersACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListUsers, req, user)
 }
 
 func (resource *Resource) HandleGetUserACL(req *http.Request, user domain.IUser) (bool, string) {
-	// allow anonymous to get user information
-	return true, ""
+	return resource.EvaluateACL(GetUser, req, user)
 }
 
 func (resource *Resource) HandleCreateUserACL(req *http.Request, user domain.IUser) (bool, string) {
-	// allow anonymous to create a user account
-	// if authenticated, only admin can create new users
-	// no point for non-admin to create new users
 	// TODO: only allow authorized but unauthenticated client
-	if user == nil {
-		// enforce authenticated access
-		return true, ""
-	}
-	u := user.(*User)
-	if u.Status != StatusActive {
-		// must be an active user
-		return false, ""
-	}
-	if !u.HasRole(RoleAdmin) {
-		// must have an admin role
-		return false, ""
-	}
-	return true, ""
+	return resource.EvaluateACL(CreateUser, req, user)
 }
 
 func (resource *Resource) HandleUpdateUsersACL(req *http.Request, user domain.IUser) (bool, string) {
-	if user == nil {
-		// enforce authenticated access
-		return false, ""
-	}
-	u := user.(*User)
-	if u.Status != StatusActive {
-		// must be an active user
-		return false, ""
-	}
-	if !u.HasRole(RoleAdmin) {
-		// must have an admin role
-		return false, ""
-	}
-	// only logged-in admins can update users in batch
-	return true, ""
+	return resource.EvaluateACL(UpdateUsers, req, user)
 }
 
 func (resource *Resource) HandleDeleteAllUsersACL(req *http.Request, user domain.IUser) (bool, string) {
-	if user == nil {
-		// enforce authenticated access
-		return false, ""
-	}
-	u := user.(*User)
-	if u.Status != StatusActive {
-		// must be an active user
-		return false, ""
-	}
-	if !u.HasRole(RoleAdmin) {
-		// must have an admin role
-		return false, ""
-	}
-	// only logged-in admins can update users in batch
-	return true, ""
+	return resource.EvaluateACL(DeleteAllUsers, req, user)
 }
 
 func (resource *Resource) HandleConfirmUserACL(req *http.Request, user domain.IUser) (bool, string) {
-	// allow anonymous access. user is expected to specify `code` (business logic)
-	return true, ""
+	// user is expected to specify `code` (business logic)
+	return resource.EvaluateACL(ConfirmUser, req, user)
 }
 
 func (resource *Resource) HandleUpdateUserACL(req *http.Request, user domain.IUser) (bool, string) {
-	params := mux.Vars(req)
-	id := params["id"]
-	repo := resource.UserRepository(req)
-
-	if user == nil {
-		// enforce authenticated access
-		return false, ""
-	}
-	u := user.(*User)
-	if u.Status != StatusActive {
-		// must be an active user
-		return false, ""
-	}
-	if u.HasRole(RoleAdmin) {
-		// must have an admin role
-		return true, ""
-	}
-
-	// retrieve target user
-	_userTarget, err := repo.GetUserById(id)
-	if err != nil {
-		return false, "Invalid user"
-	}
-	userTarget := _userTarget.(*User)
-	if userTarget != nil && u.ID == userTarget.ID {
-		// this is his own account
-		return true, ""
-	}
-	// a user can only `update` its own user account or if user is an admin
-	return false, ""
+	return resource.EvaluateACL(UpdateUser, req, user)
 }
 
 func (resource *Resource) HandleDeleteUserACL(req *http.Request, user domain.IUser) (bool, string) {
-	// only an admin can `delete` a user account
-	if user == nil {
-		// enforce authenticated access
-		return false, ""
-	}
-	u := user.(*User)
-	if u.Status != StatusActive {
-		// must be an active user
-		return false, ""
-	}
-	if !u.HasRole(RoleAdmin) {
-		// must have an admin role
-		return false, ""
-	}
-	// only logged-in admins can update users in batch
-	return true, ""
+	return resource.EvaluateACL(DeleteUser, req, user)
 }
 
 func (resource *Resource) HandleCountUsersACL(req *http.Request, user domain.IUser) (bool, string) {
-	if user == nil {
-		// enforce authenticated access
-		return false, ""
-	}
-	u := user.(*User)
-	if u.Status != StatusActive {
-		// must be an active user
-		return false, ""
-	}
-	if !u.HasRole(RoleAdmin) {
-		// must have an admin role
-		return false, ""
-	}
-	// only logged-in admins can update users in batch
-	return true, ""
+	return resource.EvaluateACL(CountUsers, req, user)
+}
+
+func (resource *Resource) HandleSearchUsersACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(SearchUsers, req, user)
+}
+
+func (resource *Resource) HandleSuggestUsersACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(SuggestUsers, req, user)
+}
+
+func (resource *Resource) HandleListUserGroupsACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListUserGroups, req, user)
+}
+
+func (resource *Resource) HandleListGroupsACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListGroups, req, user)
+}
+
+func (resource *Resource) HandleCreateGroupACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(CreateGroup, req, user)
+}
+
+func (resource *Resource) HandleGetGroupACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(GetGroup, req, user)
+}
+
+func (resource *Resource) HandleUpdateGroupACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(UpdateGroup, req, user)
+}
+
+func (resource *Resource) HandleDeleteGroupACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(DeleteGroup, req, user)
+}
+
+func (resource *Resource) HandleListGroupMembersACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListGroupMembers, req, user)
+}
+
+func (resource *Resource) HandleAddGroupMemberACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(AddGroupMember, req, user)
+}
+
+func (resource *Resource) HandleRemoveGroupMemberACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(RemoveGroupMember, req, user)
+}
+
+func (resource *Resource) HandleStartImpersonationACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(StartImpersonation, req, user)
+}
+
+func (resource *Resource) HandleStopImpersonationACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(StopImpersonation, req, user)
+}
+
+func (resource *Resource) HandleListAuditACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListAudit, req, user)
+}
+
+func (resource *Resource) HandleListUserAuditACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListUserAudit, req, user)
+}
+
+func (resource *Resource) HandleListOutboxACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListOutbox, req, user)
+}
+
+func (resource *Resource) HandleRetryOutboxMessageACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(RetryOutboxMessage, req, user)
+}
+
+func (resource *Resource) HandleListWebhooksACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListWebhooks, req, user)
+}
+
+func (resource *Resource) HandleCreateWebhookACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(CreateWebhook, req, user)
+}
+
+func (resource *Resource) HandleGetWebhookACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(GetWebhook, req, user)
+}
+
+func (resource *Resource) HandleUpdateWebhookACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(UpdateWebhook, req, user)
+}
+
+func (resource *Resource) HandleDeleteWebhookACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(DeleteWebhook, req, user)
+}
+
+func (resource *Resource) HandleListWebhookDeliveriesACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ListWebhookDeliveries, req, user)
+}
+
+func (resource *Resource) HandleReplayWebhookDeliveryACL(req *http.Request, user domain.IUser) (bool, string) {
+	return resource.EvaluateACL(ReplayWebhookDelivery, req, user)
 }
@@ -0,0 +1,131 @@
+package users
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// redactedValue replaces the value of sensitive fields in audit entries
+const redactedValue = "[redacted]"
+
+// AuditChange is the value of a field before and after a mutation
+type AuditChange struct {
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// AuditEntry records a mutation of a user. AuditEntry implements IAuditEntry
+type AuditEntry struct {
+	ID             bson.ObjectId          `json:"id,omitempty" bson:"_id,omitempty"`
+	ActorID        string                 `json:"actorId,omitempty" bson:"actorId,omitempty"`
+	ImpersonatorID string                 `json:"impersonatorId,omitempty" bson:"impersonatorId,omitempty"`
+	TargetID       string                 `json:"targetId,omitempty" bson:"targetId,omitempty"`
+	OrganizationID string                 `json:"organizationId,omitempty" bson:"organizationId,omitempty"`
+	Route          string                 `json:"route" bson:"route"`
+	Changes        map[string]AuditChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	IP             string                 `json:"ip,omitempty" bson:"ip"`
+	UserAgent      string                 `json:"userAgent,omitempty" bson:"userAgent"`
+	CreatedDate    time.Time              `json:"createdDate" bson:"createdDate"`
+}
+
+// AuditEntries struct
+type AuditEntries []AuditEntry
+
+func (entry *AuditEntry) GetID() string {
+	return entry.ID.Hex()
+}
+
+// auditedField is a User field recorded in audit entries
+type auditedField struct {
+	name   string
+	value  func(user *User) interface{}
+	redact bool
+}
+
+var auditedFields = []auditedField{
+	{"username", func(user *User) interface{} { return user.Username }, false},
+	{"email", func(user *User) interface{} { return user.Email }, false},
+	{"status", func(user *User) interface{} { return user.Status }, false},
+	{"roles", func(user *User) interface{} { return user.Roles }, false},
+	{"organizations", func(user *User) interface{} { return user.Organizations }, false},
+	{"groups", func(user *User) interface{} { return user.GroupIDs() }, false},
+	{"hashedPassword", func(user *User) interface{} { return user.HashedPassword }, true},
+	{"confirmationCode", func(user *User) interface{} { return user.ConfirmationCode }, true},
+}
+
+// diffUsers returns the audited fields that differ between before and after.
+// A nil user is treated as having empty fields, for eg: before a user is created.
+func diffUsers(before *User, after *User) map[string]AuditChange {
+	if before == nil {
+		before = &User{}
+	}
+	if after == nil {
+		after = &User{}
+	}
+	changes := map[string]AuditChange{}
+	for _, field := range auditedFields {
+		b, a := field.value(before), field.value(after)
+		if isEmptyAuditValue(b) && isEmptyAuditValue(a) || reflect.DeepEqual(b, a) {
+			continue
+		}
+		if field.redact {
+			b, a = redactAuditValue(b), redactAuditValue(a)
+		}
+		changes[field.name] = AuditChange{Before: b, After: a}
+	}
+	return changes
+}
+
+func isEmptyAuditValue(v interface{}) bool {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	}
+	return false
+}
+
+func redactAuditValue(v interface{}) interface{} {
+	if isEmptyAuditValue(v) {
+		return nil
+	}
+	return redactedValue
+}
+
+// recordAudit records a mutation of the user specified by targetID made by the request.
+// Failing to record an entry does not fail the request.
+func (resource *Resource) recordAudit(req *http.Request, route string, targetID string, changes map[string]AuditChange) {
+	entry := AuditEntry{
+		TargetID:  targetID,
+		Route:     route,
+		Changes:   changes,
+		IP:        remoteIP(req),
+		UserAgent: req.UserAgent(),
+	}
+	user := resource.CurrentUser(req)
+	if actor := asUser(user); actor != nil {
+		entry.ActorID = actor.ID.Hex()
+	}
+	if impersonated, ok := user.(*ImpersonatedUser); ok {
+		entry.ImpersonatorID = impersonated.Impersonator.ID.Hex()
+	}
+	entry.OrganizationID, _ = resource.Organization(req)
+
+	err := resource.AuditRepository(req).CreateEntry(&entry)
+	if err != nil {
+		resource.logRequest(req, LogLevelError, "users: audit entry creation failed", "route", route, "target_id", targetID, "error", err.Error())
+	}
+}
+
+// recordUserAudit records the changes between two states of a user
+func (resource *Resource) recordUserAudit(req *http.Request, route string, before *User, after *User) {
+	targetID := ""
+	if after != nil {
+		targetID = after.ID.Hex()
+	} else if before != nil {
+		targetID = before.ID.Hex()
+	}
+	resource.recordAudit(req, route, targetID, diffUsers(before, after))
+}
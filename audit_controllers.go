@@ -0,0 +1,85 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+//---- Audit Request API v0 ----
+
+type ListAuditResponse_v0 struct {
+	Entries AuditEntries `json:"entries"`
+	LastID  string       `json:"last_id,omitempty"`
+	Code    string       `json:"code,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Success bool         `json:"success"`
+}
+
+// parseAuditTime parses an optional RFC3339 time request param
+func parseAuditTime(req *http.Request, name string) (time.Time, error) {
+	value := req.FormValue(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, NewMessageError(CodeInvalidTime, name, value)
+	}
+	return t, nil
+}
+
+// HandleListAudit_v0 lists audit entries, filtered by `actor`, `target`, `route`, `from` and `to`
+func (resource *Resource) HandleListAudit_v0(w http.ResponseWriter, req *http.Request) {
+	filter := AuditFilter{
+		ActorID:  req.FormValue("actor"),
+		TargetID: req.FormValue("target"),
+		Route:    req.FormValue("route"),
+	}
+	var err error
+	filter.From, err = parseAuditTime(req, "from")
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	filter.To, err = parseAuditTime(req, "to")
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	resource.renderAuditEntries(w, req, &filter)
+}
+
+// HandleListUserAudit_v0 lists audit entries of a user
+func (resource *Resource) HandleListUserAudit_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	resource.renderAuditEntries(w, req, &AuditFilter{
+		TargetID: id,
+	})
+}
+
+func (resource *Resource) renderAuditEntries(w http.ResponseWriter, req *http.Request, filter *AuditFilter) {
+	lastID := req.FormValue("last_id")
+
+	perPage, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	entries := *resource.AuditRepository(req).FilterEntries(filter, lastID, perPage).(*AuditEntries)
+	if len(entries) > 0 {
+		lastID = entries[len(entries)-1].ID.Hex()
+	}
+	setLastIDPageLinks(w, req, lastID, len(entries), perPage)
+	resource.Render(w, req, http.StatusOK, ListAuditResponse_v0{
+		Entries: entries,
+		LastID:  lastID,
+		Code:    CodeAuditRetrieved,
+		Message: resource.Message(req, CodeAuditRetrieved),
+		Success: true,
+	})
+}
@@ -0,0 +1,71 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Audit collection name
+const AuditCollection string = "audit"
+
+func NewAuditRepositoryFactory() IAuditRepositoryFactory {
+	return &AuditRepositoryFactory{}
+}
+
+type AuditRepositoryFactory struct{}
+
+func (factory *AuditRepositoryFactory) New(db domain.IDatabase, organizationID string) IAuditRepository {
+	return &AuditRepository{db, organizationID}
+}
+
+type AuditRepository struct {
+	DB             domain.IDatabase
+	OrganizationID string
+}
+
+// CreateEntry Insert new audit entry into the database
+func (repo *AuditRepository) CreateEntry(_entry IAuditEntry) error {
+	entry := _entry.(*AuditEntry)
+	entry.ID = bson.NewObjectId()
+	entry.CreatedDate = time.Now()
+	return repo.DB.Insert(AuditCollection, entry)
+}
+
+// FilterEntries Get list of audit entries, most recent first
+func (repo *AuditRepository) FilterEntries(filter *AuditFilter, lastID string, limit int) IAuditEntries {
+	entries := AuditEntries{}
+	q := domain.Query{}
+	if repo.OrganizationID != "" {
+		q["organizationId"] = repo.OrganizationID
+	}
+	paginateByID(q, lastID, "-_id")
+	if filter != nil {
+		if filter.ActorID != "" {
+			q["actorId"] = filter.ActorID
+		}
+		if filter.TargetID != "" {
+			q["targetId"] = filter.TargetID
+		}
+		if filter.Route != "" {
+			q["route"] = filter.Route
+		}
+		createdDate := domain.Query{}
+		if !filter.From.IsZero() {
+			createdDate["$gte"] = filter.From
+		}
+		if !filter.To.IsZero() {
+			createdDate["$lt"] = filter.To
+		}
+		if len(createdDate) > 0 {
+			q["createdDate"] = createdDate
+		}
+	}
+	err := repo.DB.FindAll(AuditCollection, q, &entries, pageLimit(limit), "-_id")
+	if err != nil {
+		return &AuditEntries{}
+	}
+	return &entries
+}
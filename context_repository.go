@@ -0,0 +1,598 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// StatusClientClosedRequest is the (non-standard) status of responses to requests canceled by the client
+const StatusClientClosedRequest = 499
+
+// RepositoryTimeouts bound the user repository operations of requests.
+// Default applies to every operation, and Operations overrides it by method name of IContextUserRepository
+// or of the optional interfaces it may implement, e.g. `FilterUsers`. Operations are not bounded if their timeout is zero.
+type RepositoryTimeouts struct {
+	Default    time.Duration
+	Operations map[string]time.Duration
+}
+
+// Timeout returns the timeout of the operation, or zero if it is not bounded
+func (timeouts *RepositoryTimeouts) Timeout(operation string) time.Duration {
+	if timeouts == nil {
+		return 0
+	}
+	if timeout, ok := timeouts.Operations[operation]; ok {
+		return timeout
+	}
+	return timeouts.Default
+}
+
+// contextUserRepositoryTypes are IContextUserRepository and the optional interfaces of its operations
+var contextUserRepositoryTypes = []reflect.Type{
+	reflect.TypeOf((*IContextUserRepository)(nil)).Elem(),
+	reflect.TypeOf((*IContextFilterUserRepository)(nil)).Elem(),
+	reflect.TypeOf((*IContextGroupUserRepository)(nil)).Elem(),
+	reflect.TypeOf((*IContextSuggestUserRepository)(nil)).Elem(),
+}
+
+// isContextUserRepositoryOperation returns true if the operation is a method of contextUserRepositoryTypes
+func isContextUserRepositoryOperation(operation string) bool {
+	for _, repositoryType := range contextUserRepositoryTypes {
+		if _, ok := repositoryType.MethodByName(operation); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that the operations are methods of IContextUserRepository or its optional interfaces
+func (timeouts *RepositoryTimeouts) validate() error {
+	if timeouts == nil {
+		return nil
+	}
+	for operation, timeout := range timeouts.Operations {
+		if !isContextUserRepositoryOperation(operation) {
+			return errors.New(fmt.Sprintf("Unknown operation: `%v`", operation))
+		}
+		if timeout < 0 {
+			return errors.New(fmt.Sprintf("Negative timeout of `%v`: %v", operation, timeout))
+		}
+	}
+	if timeouts.Default < 0 {
+		return errors.New(fmt.Sprintf("Negative default timeout: %v", timeouts.Default))
+	}
+	return nil
+}
+
+// ContextUserRepository returns a context-aware repository scoped to the request's organization, if any.
+// Its operations are bounded by Options.RepositoryTimeouts, and fail with CodeRequestTimeout
+// or CodeRequestCanceled once the context of the request is done.
+// Repositories of factories not implementing IContextUserRepositoryFactory are adapted, see NewContextUserRepository.
+func (resource *Resource) ContextUserRepository(req *http.Request) IContextUserRepository {
+	var repo IContextUserRepository
+	if factory, ok := resource.UserRepositoryFactory.(IContextUserRepositoryFactory); ok {
+		org := resource.repositoryOrganization(req)
+		repo = factory.NewContext(resource.Database, org)
+	} else {
+		repo = NewContextUserRepository(resource.UserRepository(req))
+	}
+	return &requestUserRepository{repo, resource, req}
+}
+
+// NewContextUserRepository adapts a user repository to IContextUserRepository.
+// IDatabase takes no context, so the adapter can't interrupt the database:
+// reads are abandoned once the context is done, and complete in the background,
+// while writes only check the context before they start, so that a failed write was not attempted.
+func NewContextUserRepository(repo IUserRepository) IContextUserRepository {
+	return &ContextUserRepository{repo}
+}
+
+// ContextUserRepository adapts an IUserRepository to IContextUserRepository
+type ContextUserRepository struct {
+	Repository IUserRepository
+}
+
+// read runs the lookup until the context is done
+func (repo *ContextUserRepository) read(ctx context.Context, lookup func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lookup()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// write runs the change unless the context is already done
+func (repo *ContextUserRepository) write(ctx context.Context, change func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return change()
+}
+
+func (repo *ContextUserRepository) CreateUser(ctx context.Context, user domain.IUser) error {
+	return repo.write(ctx, func() error {
+		return repo.Repository.CreateUser(user)
+	})
+}
+
+func (repo *ContextUserRepository) GetUsers(ctx context.Context) (domain.IUsers, error) {
+	var users domain.IUsers
+	err := repo.read(ctx, func() {
+		users = repo.Repository.GetUsers()
+	})
+	if err != nil {
+		return &Users{}, err
+	}
+	return users, nil
+}
+
+func (repo *ContextUserRepository) FilterUsers(ctx context.Context, field string, query string, cursor string, limit int, sort string) (domain.IUsers, error) {
+	var users domain.IUsers
+	err := repo.read(ctx, func() {
+		users = repo.Repository.FilterUsers(field, query, cursor, limit, sort)
+	})
+	if err != nil {
+		return &Users{}, err
+	}
+	return users, nil
+}
+
+// groupRepository returns the adapted repository if the repository it decorates, if any, implements IGroupUserRepository.
+// Memberships are changed through the CachingUserRepository, which invalidates the changed users.
+func (repo *ContextUserRepository) groupRepository() (IGroupUserRepository, bool) {
+	if _, ok := unwrapUserRepository(repo.Repository).(IGroupUserRepository); !ok {
+		return nil, false
+	}
+	groupRepo, ok := repo.Repository.(IGroupUserRepository)
+	return groupRepo, ok
+}
+
+// FilterUsersByGroup requires the adapted repository to implement IGroupUserRepository
+func (repo *ContextUserRepository) FilterUsersByGroup(ctx context.Context, groupID string, lastID string, limit int, sort string) (domain.IUsers, error) {
+	groupRepo, ok := repo.groupRepository()
+	if !ok {
+		return &Users{}, NewMessageError(CodeGroupsNotSupported)
+	}
+	var users domain.IUsers
+	err := repo.read(ctx, func() {
+		users = groupRepo.FilterUsersByGroup(groupID, lastID, limit, sort)
+	})
+	if err != nil {
+		return &Users{}, err
+	}
+	return users, nil
+}
+
+func (repo *ContextUserRepository) CountUsers(ctx context.Context, field string, query string) (int, error) {
+	var count int
+	err := repo.read(ctx, func() {
+		count = repo.Repository.CountUsers(field, query)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// FilterUsersBy requires the adapted repository to implement IFilterUserRepository
+func (repo *ContextUserRepository) FilterUsersBy(ctx context.Context, filter FilterExpr, cursor string, limit int, sort string) (domain.IUsers, error) {
+	filterRepo, ok := unwrapUserRepository(repo.Repository).(IFilterUserRepository)
+	if !ok {
+		return &Users{}, NewMessageError(CodeFilterNotSupported)
+	}
+	var users domain.IUsers
+	err := repo.read(ctx, func() {
+		users = filterRepo.FilterUsersBy(filter, cursor, limit, sort)
+	})
+	if err != nil {
+		return &Users{}, err
+	}
+	return users, nil
+}
+
+// CountUsersBy requires the adapted repository to implement IFilterUserRepository
+func (repo *ContextUserRepository) CountUsersBy(ctx context.Context, filter FilterExpr) (int, error) {
+	filterRepo, ok := unwrapUserRepository(repo.Repository).(IFilterUserRepository)
+	if !ok {
+		return 0, NewMessageError(CodeFilterNotSupported)
+	}
+	var count int
+	err := repo.read(ctx, func() {
+		count = filterRepo.CountUsersBy(filter)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// SuggestUsers requires the adapted repository to implement ISuggestUserRepository
+func (repo *ContextUserRepository) SuggestUsers(ctx context.Context, prefix string, limit int) (domain.IUsers, error) {
+	suggestRepo, ok := unwrapUserRepository(repo.Repository).(ISuggestUserRepository)
+	if !ok {
+		return &Users{}, NewMessageError(CodeSuggestNotSupported)
+	}
+	var users domain.IUsers
+	err := repo.read(ctx, func() {
+		users = suggestRepo.SuggestUsers(prefix, limit)
+	})
+	if err != nil {
+		return &Users{}, err
+	}
+	return users, nil
+}
+
+func (repo *ContextUserRepository) DeleteUsers(ctx context.Context, ids []string) error {
+	return repo.write(ctx, func() error {
+		return repo.Repository.DeleteUsers(ids)
+	})
+}
+
+func (repo *ContextUserRepository) DeleteAllUsers(ctx context.Context) error {
+	return repo.write(ctx, repo.Repository.DeleteAllUsers)
+}
+
+func (repo *ContextUserRepository) GetUserById(ctx context.Context, id string) (domain.IUser, error) {
+	var user domain.IUser
+	var lookupErr error
+	err := repo.read(ctx, func() {
+		user, lookupErr = repo.Repository.GetUserById(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, lookupErr
+}
+
+func (repo *ContextUserRepository) GetUserByUsername(ctx context.Context, username string) (domain.IUser, error) {
+	var user domain.IUser
+	var lookupErr error
+	err := repo.read(ctx, func() {
+		user, lookupErr = repo.Repository.GetUserByUsername(username)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, lookupErr
+}
+
+func (repo *ContextUserRepository) UserExistsByUsername(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	err := repo.read(ctx, func() {
+		exists = repo.Repository.UserExistsByUsername(username)
+	})
+	return exists && err == nil, err
+}
+
+func (repo *ContextUserRepository) UserExistsByEmail(ctx context.Context, email string) (bool, error) {
+	var exists bool
+	err := repo.read(ctx, func() {
+		exists = repo.Repository.UserExistsByEmail(email)
+	})
+	return exists && err == nil, err
+}
+
+func (repo *ContextUserRepository) UpdateUser(ctx context.Context, id string, inUser domain.IUser) (domain.IUser, error) {
+	var user domain.IUser
+	err := repo.write(ctx, func() error {
+		var err error
+		user, err = repo.Repository.UpdateUser(id, inUser)
+		return err
+	})
+	return user, err
+}
+
+func (repo *ContextUserRepository) DeleteUser(ctx context.Context, id string) error {
+	return repo.write(ctx, func() error {
+		return repo.Repository.DeleteUser(id)
+	})
+}
+
+// AddUserToGroup requires the adapted repository to implement IGroupUserRepository
+func (repo *ContextUserRepository) AddUserToGroup(ctx context.Context, id string, groupID string) error {
+	groupRepo, ok := repo.groupRepository()
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	return repo.write(ctx, func() error {
+		return groupRepo.AddUserToGroup(id, groupID)
+	})
+}
+
+// RemoveUserFromGroup requires the adapted repository to implement IGroupUserRepository
+func (repo *ContextUserRepository) RemoveUserFromGroup(ctx context.Context, id string, groupID string) error {
+	groupRepo, ok := repo.groupRepository()
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	return repo.write(ctx, func() error {
+		return groupRepo.RemoveUserFromGroup(id, groupID)
+	})
+}
+
+// RemoveGroupFromUsers requires the adapted repository to implement IGroupUserRepository
+func (repo *ContextUserRepository) RemoveGroupFromUsers(ctx context.Context, groupID string) error {
+	groupRepo, ok := repo.groupRepository()
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	return repo.write(ctx, func() error {
+		return groupRepo.RemoveGroupFromUsers(groupID)
+	})
+}
+
+// CreateUserWithOutbox requires the adapted repository to implement IOutboxUserRepository
+func (repo *ContextUserRepository) CreateUserWithOutbox(ctx context.Context, user domain.IUser, messages ...IOutboxMessage) error {
+	outboxRepo, ok := repo.Repository.(IOutboxUserRepository)
+	if !ok {
+		return errors.New("Repository does not implement IOutboxUserRepository")
+	}
+	return repo.write(ctx, func() error {
+		return outboxRepo.CreateUserWithOutbox(user, messages...)
+	})
+}
+
+// UpdateUserWithOutbox requires the adapted repository to implement IOutboxUserRepository
+func (repo *ContextUserRepository) UpdateUserWithOutbox(ctx context.Context, id string, inUser domain.IUser, messages ...IOutboxMessage) (domain.IUser, error) {
+	outboxRepo, ok := repo.Repository.(IOutboxUserRepository)
+	if !ok {
+		return nil, errors.New("Repository does not implement IOutboxUserRepository")
+	}
+	var user domain.IUser
+	err := repo.write(ctx, func() error {
+		var err error
+		user, err = outboxRepo.UpdateUserWithOutbox(id, inUser, messages...)
+		return err
+	})
+	return user, err
+}
+
+// requestUserRepository is the user repository of a request:
+// it bounds operations with RepositoryTimeouts, reports the errors of done contexts as MessageErrors,
+// logs failed operations, and records the operations in the resource's Metrics and spans, if enabled
+type requestUserRepository struct {
+	repo     IContextUserRepository
+	resource *Resource
+	req      *http.Request
+}
+
+// begin starts the operation within a span with the given attributes,
+// returning its context and the function finishing the operation with its error
+func (repo *requestUserRepository) begin(ctx context.Context, operation string, attributes ...interface{}) (context.Context, func(err error) error) {
+	span := repo.resource.startSpan(repo.req, "users.repository."+operation, append([]interface{}{"operation", operation}, attributes...)...)
+	start := time.Now()
+	var cancel context.CancelFunc
+	if timeout := repo.resource.options.RepositoryTimeouts.Timeout(operation); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	return ctx, func(err error) error {
+		if err != nil && ctx.Err() != nil {
+			err = contextError(ctx.Err())
+		}
+		cancel()
+		duration := time.Since(start)
+		if err != nil {
+			repo.resource.logRepositoryError(repo.req, operation, err, duration)
+		}
+		if repo.resource.Metrics != nil {
+			repo.resource.Metrics.ObserveRepositoryOperation(operation, err, duration)
+		}
+		span.RecordError(err)
+		span.End()
+		return err
+	}
+}
+
+func (repo *requestUserRepository) CreateUser(ctx context.Context, user domain.IUser) error {
+	ctx, finish := repo.begin(ctx, "CreateUser")
+	return finish(repo.repo.CreateUser(ctx, user))
+}
+
+func (repo *requestUserRepository) GetUsers(ctx context.Context) (domain.IUsers, error) {
+	ctx, finish := repo.begin(ctx, "GetUsers")
+	users, err := repo.repo.GetUsers(ctx)
+	return users, finish(err)
+}
+
+func (repo *requestUserRepository) FilterUsers(ctx context.Context, field string, query string, cursor string, limit int, sort string) (domain.IUsers, error) {
+	ctx, finish := repo.begin(ctx, "FilterUsers")
+	users, err := repo.repo.FilterUsers(ctx, field, query, cursor, limit, sort)
+	return users, finish(err)
+}
+
+func (repo *requestUserRepository) FilterUsersByGroup(ctx context.Context, groupID string, lastID string, limit int, sort string) (domain.IUsers, error) {
+	groupRepo, ok := repo.repo.(IContextGroupUserRepository)
+	if !ok {
+		return &Users{}, NewMessageError(CodeGroupsNotSupported)
+	}
+	ctx, finish := repo.begin(ctx, "FilterUsersByGroup", "group.id", groupID)
+	users, err := groupRepo.FilterUsersByGroup(ctx, groupID, lastID, limit, sort)
+	return users, finish(err)
+}
+
+func (repo *requestUserRepository) CountUsers(ctx context.Context, field string, query string) (int, error) {
+	ctx, finish := repo.begin(ctx, "CountUsers")
+	count, err := repo.repo.CountUsers(ctx, field, query)
+	return count, finish(err)
+}
+
+func (repo *requestUserRepository) FilterUsersBy(ctx context.Context, filter FilterExpr, cursor string, limit int, sort string) (domain.IUsers, error) {
+	filterRepo, ok := repo.repo.(IContextFilterUserRepository)
+	if !ok {
+		return &Users{}, NewMessageError(CodeFilterNotSupported)
+	}
+	ctx, finish := repo.begin(ctx, "FilterUsersBy")
+	users, err := filterRepo.FilterUsersBy(ctx, filter, cursor, limit, sort)
+	return users, finish(err)
+}
+
+func (repo *requestUserRepository) CountUsersBy(ctx context.Context, filter FilterExpr) (int, error) {
+	filterRepo, ok := repo.repo.(IContextFilterUserRepository)
+	if !ok {
+		return 0, NewMessageError(CodeFilterNotSupported)
+	}
+	ctx, finish := repo.begin(ctx, "CountUsersBy")
+	count, err := filterRepo.CountUsersBy(ctx, filter)
+	return count, finish(err)
+}
+
+func (repo *requestUserRepository) SuggestUsers(ctx context.Context, prefix string, limit int) (domain.IUsers, error) {
+	suggestRepo, ok := repo.repo.(IContextSuggestUserRepository)
+	if !ok {
+		return &Users{}, NewMessageError(CodeSuggestNotSupported)
+	}
+	ctx, finish := repo.begin(ctx, "SuggestUsers")
+	users, err := suggestRepo.SuggestUsers(ctx, prefix, limit)
+	return users, finish(err)
+}
+
+func (repo *requestUserRepository) DeleteUsers(ctx context.Context, ids []string) error {
+	ctx, finish := repo.begin(ctx, "DeleteUsers")
+	return finish(repo.repo.DeleteUsers(ctx, ids))
+}
+
+func (repo *requestUserRepository) DeleteAllUsers(ctx context.Context) error {
+	ctx, finish := repo.begin(ctx, "DeleteAllUsers")
+	return finish(repo.repo.DeleteAllUsers(ctx))
+}
+
+func (repo *requestUserRepository) GetUserById(ctx context.Context, id string) (domain.IUser, error) {
+	ctx, finish := repo.begin(ctx, "GetUserById", "user.id", id)
+	user, err := repo.repo.GetUserById(ctx, id)
+	return user, finish(err)
+}
+
+func (repo *requestUserRepository) GetUserByUsername(ctx context.Context, username string) (domain.IUser, error) {
+	ctx, finish := repo.begin(ctx, "GetUserByUsername")
+	user, err := repo.repo.GetUserByUsername(ctx, username)
+	return user, finish(err)
+}
+
+func (repo *requestUserRepository) UserExistsByUsername(ctx context.Context, username string) (bool, error) {
+	ctx, finish := repo.begin(ctx, "UserExistsByUsername")
+	exists, err := repo.repo.UserExistsByUsername(ctx, username)
+	return exists, finish(err)
+}
+
+func (repo *requestUserRepository) UserExistsByEmail(ctx context.Context, email string) (bool, error) {
+	ctx, finish := repo.begin(ctx, "UserExistsByEmail")
+	exists, err := repo.repo.UserExistsByEmail(ctx, email)
+	return exists, finish(err)
+}
+
+func (repo *requestUserRepository) UpdateUser(ctx context.Context, id string, inUser domain.IUser) (domain.IUser, error) {
+	ctx, finish := repo.begin(ctx, "UpdateUser", "user.id", id)
+	user, err := repo.repo.UpdateUser(ctx, id, inUser)
+	return user, finish(err)
+}
+
+func (repo *requestUserRepository) DeleteUser(ctx context.Context, id string) error {
+	ctx, finish := repo.begin(ctx, "DeleteUser", "user.id", id)
+	return finish(repo.repo.DeleteUser(ctx, id))
+}
+
+func (repo *requestUserRepository) AddUserToGroup(ctx context.Context, id string, groupID string) error {
+	groupRepo, ok := repo.repo.(IContextGroupUserRepository)
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	ctx, finish := repo.begin(ctx, "AddUserToGroup", "user.id", id, "group.id", groupID)
+	return finish(groupRepo.AddUserToGroup(ctx, id, groupID))
+}
+
+func (repo *requestUserRepository) RemoveUserFromGroup(ctx context.Context, id string, groupID string) error {
+	groupRepo, ok := repo.repo.(IContextGroupUserRepository)
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	ctx, finish := repo.begin(ctx, "RemoveUserFromGroup", "user.id", id, "group.id", groupID)
+	return finish(groupRepo.RemoveUserFromGroup(ctx, id, groupID))
+}
+
+func (repo *requestUserRepository) RemoveGroupFromUsers(ctx context.Context, groupID string) error {
+	groupRepo, ok := repo.repo.(IContextGroupUserRepository)
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	ctx, finish := repo.begin(ctx, "RemoveGroupFromUsers", "group.id", groupID)
+	return finish(groupRepo.RemoveGroupFromUsers(ctx, groupID))
+}
+
+// CreateUserWithOutbox is bounded by the timeout of CreateUser
+func (repo *requestUserRepository) CreateUserWithOutbox(ctx context.Context, user domain.IUser, messages ...IOutboxMessage) error {
+	outboxRepo, ok := repo.repo.(IContextOutboxUserRepository)
+	if !ok {
+		return errors.New("Repository does not implement IContextOutboxUserRepository")
+	}
+	ctx, finish := repo.begin(ctx, "CreateUser")
+	return finish(outboxRepo.CreateUserWithOutbox(ctx, user, messages...))
+}
+
+// UpdateUserWithOutbox is bounded by the timeout of UpdateUser
+func (repo *requestUserRepository) UpdateUserWithOutbox(ctx context.Context, id string, inUser domain.IUser, messages ...IOutboxMessage) (domain.IUser, error) {
+	outboxRepo, ok := repo.repo.(IContextOutboxUserRepository)
+	if !ok {
+		return nil, errors.New("Repository does not implement IContextOutboxUserRepository")
+	}
+	ctx, finish := repo.begin(ctx, "UpdateUser", "user.id", id)
+	user, err := outboxRepo.UpdateUserWithOutbox(ctx, id, inUser, messages...)
+	return user, finish(err)
+}
+
+// contextError returns the MessageError of a done context
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return NewMessageError(CodeRequestTimeout)
+	}
+	return NewMessageError(CodeRequestCanceled)
+}
+
+// isContextError returns true if the error is the MessageError of a done context
+func isContextError(err error) bool {
+	messageErr, ok := err.(*MessageError)
+	return ok && (messageErr.Code == CodeRequestTimeout || messageErr.Code == CodeRequestCanceled)
+}
+
+// repositoryErrorStatus returns the status of responses to a failed repository operation:
+// 504 if it timed out, 499 if the request was canceled, 501 if the repository does not support it,
+// or the given status otherwise
+func repositoryErrorStatus(err error, status int) int {
+	if messageErr, ok := err.(*MessageError); ok {
+		switch messageErr.Code {
+		case CodeRequestTimeout:
+			return http.StatusGatewayTimeout
+		case CodeRequestCanceled:
+			return StatusClientClosedRequest
+		case CodeFilterNotSupported, CodeGroupsNotSupported, CodeSuggestNotSupported, CodeSearchNotSupported:
+			return http.StatusNotImplemented
+		}
+	}
+	return status
+}
+
+// renderUserLookupError renders the error of a done context, or CodeUserNotFound with the given status
+func (resource *Resource) renderUserLookupError(w http.ResponseWriter, req *http.Request, status int, err error) {
+	if isContextError(err) {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, status), err)
+		return
+	}
+	resource.RenderErrorCode(w, req, status, CodeUserNotFound)
+}
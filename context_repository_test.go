@@ -0,0 +1,56 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"encoding/json"
+	"github.com/sogko/slumber/domain"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// basicUserRepositoryFactory returns repositories without any of the optional repository interfaces
+type basicUserRepositoryFactory struct {
+	store *memoryUserStore
+}
+
+func (factory *basicUserRepositoryFactory) New(db domain.IDatabase) IUserRepository {
+	return struct{ IUserRepository }{&memoryUserRepository{store: factory.store}}
+}
+
+func TestUnsupportedRepositoryOperations(t *testing.T) {
+	admin := newTestUser(StatusActive, RoleAdmin)
+	resource := newTestResource(&Options{UserRepositoryFactory: &basicUserRepositoryFactory{newMemoryUserStore(admin)}})
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		url     string
+		code    string
+	}{
+		{"filter", resource.HandleListUsers_v0, "/api/users?filter=status+eq+active", CodeFilterNotSupported},
+		{"count", resource.HandleCountUsers_v0, "/api/users/count?filter=status+eq+active", CodeFilterNotSupported},
+		{"suggest", resource.HandleSuggestUsers_v0, "/api/users/suggest?prefix=a", CodeSuggestNotSupported},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resource.ctx.SetCurrentUserCtx(req, admin)
+		w := httptest.NewRecorder()
+		test.handler(w, req)
+		var response ErrorResponse_v0
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != http.StatusNotImplemented || response.Code != test.code {
+			t.Errorf("%v: expected %v %v, got %v %v", test.name, http.StatusNotImplemented, test.code, w.Code, response.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/groups", nil)
+	_, err := resource.ContextUserRepository(req).(IContextGroupUserRepository).FilterUsersByGroup(req.Context(), admin.ID.Hex(), "", 10, "")
+	if messageErr, ok := err.(*MessageError); !ok || messageErr.Code != CodeGroupsNotSupported {
+		t.Errorf("expected %v, got %v", CodeGroupsNotSupported, err)
+	}
+	if status := repositoryErrorStatus(err, http.StatusBadRequest); status != http.StatusNotImplemented {
+		t.Errorf("expected %v, got %v", http.StatusNotImplemented, status)
+	}
+}
@@ -1,38 +1,64 @@
 package users
 
 import (
+	. "github.com/sogko/slumber-users/domain"
+
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/sogko/slumber/domain"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 //---- User Request API v0 ----
 
+// ListUsersResponse_v0 returns opaque `next` and `prev` cursors, passed back as `cursor`
+// to page through the list in its sort order, and the `total` count of users if requested
 type ListUsersResponse_v0 struct {
 	Users   Users  `json:"users"`
-	LastID  string `json:"last_id, omitempty"`
+	LastID  string `json:"last_id,omitempty"`
+	Next    string `json:"next,omitempty"`
+	Prev    string `json:"prev,omitempty"`
+	Total   *int   `json:"total,omitempty"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
 
+type SearchUsersResponse_v0 struct {
+	Results UserSearchResults `json:"results"`
+	Code    string            `json:"code,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Success bool              `json:"success"`
+}
+
+type SuggestUsersResponse_v0 struct {
+	Suggestions UserSuggestions `json:"suggestions"`
+	Code        string          `json:"code,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Success     bool            `json:"success"`
+}
+
 type CreateUserRequest_v0 struct {
 	User NewUser `json:"user"`
 }
 
 type CreateUserResponse_v0 struct {
 	User    User   `json:"user,omitempty"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
 
+// ConfirmUserResponse_v0 returns the confirmation code as `code`, for backward compatibility
+// the message code is returned as `messageCode`
 type ConfirmUserResponse_v0 struct {
-	Code    string `json:"code,omitempty"`
-	User    User   `json:"user,omitempty"`
-	Message string `json:"message,omitempty"`
-	Success bool   `json:"success"`
+	Code        string `json:"code,omitempty"`
+	User        User   `json:"user,omitempty"`
+	MessageCode string `json:"messageCode,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Success     bool   `json:"success"`
 }
 
 type UpdateUsersRequest_v0 struct {
@@ -43,16 +69,19 @@ type UpdateUsersRequest_v0 struct {
 type UpdateUsersResponse_v0 struct {
 	Action  string   `json:"action,omitempty"`
 	IDs     []string `json:"ids,omitempty"`
+	Code    string   `json:"code,omitempty"`
 	Message string   `json:"message,omitempty"`
 	Success bool     `json:"success"`
 }
 
 type DeleteAllUsersResponse_v0 struct {
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
 type GetUserResponse_v0 struct {
 	User    User   `json:"user,omitempty"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
@@ -63,31 +92,44 @@ type UpdateUserRequest_v0 struct {
 
 type UpdateUserResponse_v0 struct {
 	User    User   `json:"user,omitempty"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
 
 type DeleteUserResponse_v0 struct {
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
 
 type CountUsersResponse_v0 struct {
 	Count   int    `json:"count,omitempty"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
 
 type ErrorResponse_v0 struct {
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Success bool   `json:"success"`
 }
 
+type ACLDeniedResponse_v0 struct {
+	Reason      string `json:"reason"`
+	Rule        string `json:"rule,omitempty"`
+	Explanation string `json:"explanation,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Success     bool   `json:"success"`
+}
+
 func (resource *Resource) DecodeRequestBody(w http.ResponseWriter, req *http.Request, target interface{}) error {
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(target)
 	if err != nil {
-		resource.RenderError(w, req, http.StatusBadRequest, fmt.Sprintf("Request body parse error: %v", err.Error()))
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeRequestBodyInvalid, err.Error())
 		return err
 	}
 	return nil
@@ -100,33 +142,180 @@ func (resource *Resource) RenderError(w http.ResponseWriter, req *http.Request,
 	})
 }
 
-// HandleListUsers_v0 lists users
+// RenderErrorCode renders the message of the code in the language of the request
+func (resource *Resource) RenderErrorCode(w http.ResponseWriter, req *http.Request, status int, code string, args ...interface{}) {
+	resource.Render(w, req, status, ErrorResponse_v0{
+		Code:    code,
+		Message: resource.Message(req, code, args...),
+		Success: false,
+	})
+}
+
+// RenderErrorFrom renders an error, localized if it is a MessageError
+func (resource *Resource) RenderErrorFrom(w http.ResponseWriter, req *http.Request, status int, err error) {
+	code, message := resource.ErrorMessage(req, err)
+	resource.Render(w, req, status, ErrorResponse_v0{
+		Code:    code,
+		Message: message,
+		Success: false,
+	})
+}
+
+// RenderHookError renders an error returned by a hook,
+// with the status code of a HookRejection or 400 otherwise
+func (resource *Resource) RenderHookError(w http.ResponseWriter, req *http.Request, err error) {
+	if rejection, ok := err.(*HookRejection); ok {
+		if rejection.Code != "" {
+			resource.RenderErrorCode(w, req, rejection.Status, rejection.Code)
+			return
+		}
+		resource.RenderErrorCode(w, req, rejection.Status, CodeHookRejected, rejection.Message)
+		return
+	}
+	resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+}
+
+// RenderACLDenied renders a denied ACL decision with 401 or 403 status code.
+// The evaluated rule is only exposed if users.Options.ACLDebug is set.
+func (resource *Resource) RenderACLDenied(w http.ResponseWriter, req *http.Request, decision *ACLDecision) {
+	response := ACLDeniedResponse_v0{
+		Reason:  decision.Reason,
+		Code:    CodeAccessDenied,
+		Message: resource.Message(req, CodeAccessDenied),
+		Success: false,
+	}
+	if resource.options.ACLDebug {
+		response.Rule = decision.Rule
+		response.Explanation = decision.Explanation
+	}
+	resource.Render(w, req, decision.Status(), response)
+}
+
+// HandleListUsers_v0 lists users, sorted by `sort` (see NormalizeUserSort).
+// Pages are fetched with the `cursor` of a previous response, or a legacy `last_id`,
+// and linked in the `Link` header. The `total` count of matching users is returned if `total=true`,
+// which requires the CountUsers rule to allow the request too.
 func (resource *Resource) HandleListUsers_v0(w http.ResponseWriter, req *http.Request) {
-	repo := resource.UserRepository(req)
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req)
 
 	// filter & pagination params
 	field := req.FormValue("field")
 	query := req.FormValue("q")
-	lastID := req.FormValue("last_id")
-	perPageStr := req.FormValue("per_page")
+	cursor := req.FormValue("cursor")
+	if cursor == "" {
+		cursor = req.FormValue("last_id")
+	}
 	sort := req.FormValue("sort")
+	total, _ := strconv.ParseBool(req.FormValue("total"))
+	if total {
+		decision := resource.Authorize(CountUsers, req, resource.CurrentUser(req))
+		if !decision.Allowed {
+			resource.RenderACLDenied(w, req, decision)
+			return
+		}
+	}
 
-	perPage, err := strconv.Atoi(perPageStr)
+	perPage, err := resource.perPage(req)
 	if err != nil {
-		perPage = 20
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	var c *UserCursor
+	if cursor != "" {
+		c, err = DecodeUserCursor(cursor)
+		if err != nil {
+			resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+			return
+		}
+		if sort == "" && c.Sort != "" {
+			// cursors carry the sort of the list
+			sort = c.Sort
+		}
+	}
+	sort = NormalizeUserSort(sort)
+	if c != nil && c.Sort != "" && c.Sort != sort {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidCursor)
+		return
 	}
 
-	u := repo.FilterUsers(field, query, lastID, perPage, sort)
+	// `filter` takes precedence over `field` and `q`, see ParseUserFilter
+	filter, err := resource.userFilter(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, userFilterErrorStatus(err), err)
+		return
+	}
+	// fetch one more user to know if there is a further page
+	var u domain.IUsers
+	if filter != nil {
+		u, err = repo.(IContextFilterUserRepository).FilterUsersBy(ctx, filter, cursor, perPage+1, sort)
+	} else {
+		u, err = repo.FilterUsers(ctx, field, query, cursor, perPage+1, sort)
+	}
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
 	users := *u.(*Users)
+	before := c != nil && c.Before
+	more := len(users) > perPage
+	if more {
+		if before {
+			users = users[1:]
+		} else {
+			users = users[:perPage]
+		}
+	}
+
+	var lastID, next, prev string
 	if len(users) > 0 {
-		lastID = users[len(users)-1].ID.Hex()
+		first, last := &users[0], &users[len(users)-1]
+		lastID = last.ID.Hex()
+		if more || before {
+			next = EncodeUserCursor(last, sort, false)
+		}
+		if (more && before) || (c != nil && !before) {
+			prev = EncodeUserCursor(first, sort, true)
+		}
+	} else if c != nil && !c.Before {
+		lastID = c.ID
+	}
+
+	links := []pageLink{}
+	if next != "" {
+		links = append(links, pageLink{"next", pageURL(req, map[string]string{"cursor": next, "last_id": ""})})
 	}
-	resource.Render(w, req, http.StatusOK, ListUsersResponse_v0{
+	if prev != "" {
+		links = append(links, pageLink{"prev", pageURL(req, map[string]string{"cursor": prev, "last_id": ""})})
+	}
+	links = append(links, pageLink{"first", pageURL(req, map[string]string{"cursor": "", "last_id": ""})})
+	setPageLinks(w, links)
+
+	response := ListUsersResponse_v0{
 		Users:   users,
 		LastID:  lastID,
-		Message: "User list retrieved",
+		Next:    next,
+		Prev:    prev,
+		Code:    CodeUsersRetrieved,
+		Message: resource.Message(req, CodeUsersRetrieved),
 		Success: true,
-	})
+	}
+	if total {
+		// counted with the same filter as the list
+		var count int
+		if filter != nil {
+			count, err = repo.(IContextFilterUserRepository).CountUsersBy(ctx, filter)
+		} else {
+			count, err = repo.CountUsers(ctx, field, query)
+		}
+		if err != nil {
+			resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		response.Total = &count
+	}
+	resource.Render(w, req, http.StatusOK, response)
 }
 
 // HandleUpdateList_v0 update a list of users
@@ -138,25 +327,68 @@ func (resource *Resource) HandleUpdateUsers_v0(w http.ResponseWriter, req *http.
 		return
 	}
 
-	var message = "User list updated"
+	if resource.ControllerHooks.PreUpdateUsersHook != nil {
+		payload := &PreUpdateUsersHookPayload{
+			Action: body.Action,
+			IDs:    body.IDs,
+			Actor:  resource.CurrentUser(req),
+		}
+		err = resource.traceHook(req, "PreUpdateUsersHook", func() error {
+			return resource.ControllerHooks.PreUpdateUsersHook(resource, req, payload)
+		})
+		if err != nil {
+			resource.RenderHookError(w, req, err)
+			return
+		}
+		body.Action = payload.Action
+		body.IDs = payload.IDs
+	}
+
+	var code = CodeUsersUpdated
+	var message = resource.Message(req, code)
 	var success bool = true
 	var returnStatus = http.StatusOK
 
 	if body.Action == "delete" {
-		repo := resource.UserRepository(req)
-		err = repo.DeleteUsers(body.IDs)
+		ctx := req.Context()
+		repo := resource.ContextUserRepository(req)
+		// keep deleted users for the audit log,
+		// admins are never removed from organizations
+		scoped := resource.repositoryOrganization(req) != ""
+		deletedUsers := []*User{}
+		for _, id := range body.IDs {
+			user, err := repo.GetUserById(ctx, id)
+			if isContextError(err) {
+				resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+				return
+			}
+			if err == nil && !(scoped && user.HasRole(RoleAdmin)) {
+				deletedUsers = append(deletedUsers, user.(*User))
+			}
+		}
+		events := resource.usersDeletedEvents(w, req, deletedUsers)
+		err = resource.deleteUsers(events, func() error {
+			return repo.DeleteUsers(ctx, body.IDs)
+		})
+		if err == nil {
+			for _, user := range deletedUsers {
+				resource.recordUserAudit(req, UpdateUsers, user, nil)
+			}
+			err = resource.publishEvents(events)
+		}
 	} else {
-		err = errors.New("Invalid action")
+		err = NewMessageError(CodeInvalidAction)
 	}
 	if err != nil {
 		success = false
-		message = err.Error()
-		returnStatus = http.StatusBadRequest
+		code, message = resource.ErrorMessage(req, err)
+		returnStatus = repositoryErrorStatus(err, http.StatusBadRequest)
 	}
 
 	resource.Render(w, req, returnStatus, UpdateUsersResponse_v0{
 		Action:  body.Action,
 		IDs:     body.IDs,
+		Code:    code,
 		Message: message,
 		Success: success,
 	})
@@ -164,18 +396,47 @@ func (resource *Resource) HandleUpdateUsers_v0(w http.ResponseWriter, req *http.
 
 // HandleDeleteAll_v0 deletes all users
 func (resource *Resource) HandleDeleteAllUsers_v0(w http.ResponseWriter, req *http.Request) {
-	repo := resource.UserRepository(req)
-	_ = repo.DeleteAllUsers()
+	if resource.ControllerHooks.PreDeleteAllUsersHook != nil {
+		err := resource.traceHook(req, "PreDeleteAllUsersHook", func() error {
+			return resource.ControllerHooks.PreDeleteAllUsersHook(resource, req, &PreDeleteAllUsersHookPayload{
+				Actor: resource.CurrentUser(req),
+			})
+		})
+		if err != nil {
+			resource.RenderHookError(w, req, err)
+			return
+		}
+	}
+
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req)
+	event := resource.newEvent(w, req, EventAllUsersDeleted)
+	err := resource.deleteUsers([]*Event{event}, func() error {
+		return repo.DeleteAllUsers(ctx)
+	})
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	resource.recordAudit(req, DeleteAllUsers, "", nil)
+
+	err = resource.publish(event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
 
 	resource.Render(w, req, http.StatusOK, DeleteAllUsersResponse_v0{
-		Message: "All users deleted",
+		Code:    CodeAllUsersDeleted,
+		Message: resource.Message(req, CodeAllUsersDeleted),
 		Success: true,
 	})
 }
 
 // HandleCreateUser_v0 creates a new user
 func (resource *Resource) HandleCreateUser_v0(w http.ResponseWriter, req *http.Request) {
-	repo := resource.UserRepository(req)
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req)
 
 	var body CreateUserRequest_v0
 	err := resource.DecodeRequestBody(w, req, &body)
@@ -183,21 +444,12 @@ func (resource *Resource) HandleCreateUser_v0(w http.ResponseWriter, req *http.R
 		return
 	}
 
-	if repo.UserExistsByUsername(body.User.Username) {
-		resource.RenderError(w, req, http.StatusBadRequest, "Username already exists")
-		return
-	}
-
-	if repo.UserExistsByEmail(body.User.Email) {
-		resource.RenderError(w, req, http.StatusBadRequest, "User with email address already exists")
-		return
-	}
-
 	// New user always have no roles assigned until confirmed
 	// Set flag to `pending` awaiting user to confirm email
 	var newUser = User{
 		Username: body.User.Username,
 		Email:    body.User.Email,
+		Locale:   body.User.Locale,
 		Roles:    Roles{},
 		Status:   StatusPending,
 	}
@@ -206,35 +458,85 @@ func (resource *Resource) HandleCreateUser_v0(w http.ResponseWriter, req *http.R
 	newUser.GenerateConfirmationCode()
 
 	// set password (hashed)
-	newUser.SetPassword(body.User.Password)
+	span := resource.startSpan(req, "users.SetPassword")
+	err = newUser.SetPassword(body.User.Password)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		resource.logRequest(req, LogLevelWarn, "users: password hashing failed", "error", err.Error())
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidPassword, err.Error())
+		return
+	}
+
+	// run a pre-create hook
+	// example of a pre-create hook: reject email domains, assign default roles
+	if resource.ControllerHooks.PreCreateUserHook != nil {
+		err = resource.traceHook(req, "PreCreateUserHook", func() error {
+			return resource.ControllerHooks.PreCreateUserHook(resource, req, &PreCreateUserHookPayload{
+				Input: body.User,
+				User:  &newUser,
+				Actor: resource.CurrentUser(req),
+			})
+		})
+		if err != nil {
+			resource.RenderHookError(w, req, err)
+			return
+		}
+	}
 
 	// ensure that user obj is valid
 	if !newUser.IsValid() {
-		resource.RenderError(w, req, http.StatusBadRequest, "Invalid user object")
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidUser)
+		return
+	}
+
+	// check the username and email once the pre-create hook may have changed them
+	exists, err := repo.UserExistsByUsername(ctx, newUser.Username)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	if exists {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeUsernameExists)
 		return
 	}
 
-	err = repo.CreateUser(&newUser)
+	exists, err = repo.UserExistsByEmail(ctx, newUser.Email)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	if exists {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeEmailExists)
+		return
+	}
+
+	event := resource.newUserEvent(w, req, EventUserCreated, nil, nil)
+	err = resource.createUser(ctx, repo, &newUser, event)
+	if isContextError(err) {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
 	if err != nil {
-		resource.RenderError(w, req, http.StatusBadRequest, "Failed to save user object")
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeUserSaveFailed)
 		return
 	}
+	resource.recordUserAudit(req, CreateUser, nil, &newUser)
 
-	// run a post-create hook
+	// publish `UserCreated`, which runs the post-create hook
 	// example of a post-create hook: send email / message with confirmation link
-	if resource.ControllerHooks.PostCreateUserHook != nil {
-		err = resource.ControllerHooks.PostCreateUserHook(resource, w, req, &PostCreateUserHookPayload{
-			User: &newUser,
-		})
-		if err != nil {
-			resource.RenderError(w, req, http.StatusBadRequest, err.Error())
-			return
-		}
+	// if the outbox is enabled, the event was written with the user and is delivered by the OutboxDispatcher
+	event.User = &newUser
+	err = resource.publish(event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
 	}
 
 	resource.Render(w, req, http.StatusCreated, CreateUserResponse_v0{
 		User:    newUser,
-		Message: "User created",
+		Code:    CodeUserCreated,
+		Message: resource.Message(req, CodeUserCreated),
 		Success: true,
 	})
 }
@@ -245,51 +547,71 @@ func (resource *Resource) HandleConfirmUser_v0(w http.ResponseWriter, req *http.
 	id := params["id"]
 	code := req.FormValue("code")
 
-	repo := resource.UserRepository(req)
-	_user, err := repo.GetUserById(id)
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req)
+	_user, err := repo.GetUserById(ctx, id)
 	if err != nil {
-		resource.RenderError(w, req, http.StatusBadRequest, err.Error())
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
 		return
 	}
 
 	user := _user.(*User)
 	if user.Status != StatusPending {
-		resource.RenderError(w, req, http.StatusBadRequest, "User not pending confirmation")
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeUserNotPending)
 		return
 	}
 
 	if !user.IsCodeVerified(code) {
-		resource.RenderError(w, req, http.StatusBadRequest, "Invalid code")
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidCode)
 		return
 	}
 
-	// set user status to `active`
-	_updatedUser, err := repo.UpdateUser(id, &User{
+	// set user status to `active`, adding the `user` role to the roles assigned so far,
+	// for eg: by a pre-create hook
+	roles := append(Roles{}, user.Roles...)
+	if !user.HasRole(RoleUser) {
+		roles = append(roles, RoleUser)
+	}
+	update := &User{
 		Status: StatusActive,
-		Roles:  Roles{RoleUser},
-	})
-	if err != nil {
-		resource.RenderError(w, req, http.StatusBadRequest, err.Error())
-		return
+		Roles:  roles,
 	}
-	updatedUser := _updatedUser.(*User)
-
-	// run a post-confirmation hook
-	if resource.ControllerHooks.PostConfirmUserHook != nil {
-		err = resource.ControllerHooks.PostConfirmUserHook(resource, w, req, &PostConfirmUserHookPayload{
-			User: user,
+	if resource.ControllerHooks.PreConfirmUserHook != nil {
+		err = resource.traceHook(req, "PreConfirmUserHook", func() error {
+			return resource.ControllerHooks.PreConfirmUserHook(resource, req, &PreConfirmUserHookPayload{
+				User:   user,
+				Code:   code,
+				Update: update,
+				Actor:  resource.CurrentUser(req),
+			})
 		})
 		if err != nil {
-			resource.RenderError(w, req, http.StatusBadRequest, err.Error())
+			resource.RenderHookError(w, req, err)
 			return
 		}
 	}
+	event := resource.newUserEvent(w, req, EventUserConfirmed, user, nil)
+	updatedUser, err := resource.updateUser(ctx, repo, id, update, event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	resource.recordUserAudit(req, ConfirmUser, user, updatedUser)
+
+	// publish `UserConfirmed`, which runs the post-confirmation hook
+	event.User = updatedUser
+	err = resource.publish(event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
 
 	resource.Render(w, req, http.StatusOK, ConfirmUserResponse_v0{
-		Code:    code,
-		User:    *updatedUser,
-		Message: "User confirmed",
-		Success: true,
+		Code:        code,
+		User:        *updatedUser,
+		MessageCode: CodeUserConfirmed,
+		Message:     resource.Message(req, CodeUserConfirmed),
+		Success:     true,
 	})
 }
 
@@ -298,17 +620,18 @@ func (resource *Resource) HandleGetUser_v0(w http.ResponseWriter, req *http.Requ
 	params := mux.Vars(req)
 	id := params["id"]
 
-	repo := resource.UserRepository(req)
-	_user, err := repo.GetUserById(id)
+	repo := resource.ContextUserRepository(req)
+	_user, err := repo.GetUserById(req.Context(), id)
 	if err != nil {
-		resource.RenderError(w, req, http.StatusBadRequest, "User not found")
+		resource.renderUserLookupError(w, req, http.StatusBadRequest, err)
 		return
 	}
 	user := _user.(*User)
 
 	resource.Render(w, req, http.StatusOK, GetUserResponse_v0{
 		User:    *user,
-		Message: "User retrieved",
+		Code:    CodeUserRetrieved,
+		Message: resource.Message(req, CodeUserRetrieved),
 		Success: true,
 	})
 }
@@ -324,17 +647,74 @@ func (resource *Resource) HandleUpdateUser_v0(w http.ResponseWriter, req *http.R
 		return
 	}
 
-	repo := resource.UserRepository(req)
-	_user, err := repo.UpdateUser(id, &body.User)
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req)
+	_before, err := repo.GetUserById(ctx, id)
 	if err != nil {
-		resource.RenderError(w, req, http.StatusBadRequest, err.Error())
+		resource.renderUserLookupError(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	// only global admins can assign global roles and memberships;
+	// organization admins can only update the membership of the other users of their own organization,
+	// as long as they are not admins nor members of other organizations
+	actor := asUser(resource.CurrentUser(req))
+	if actor == nil || !actor.HasRole(RoleAdmin) {
+		org := resource.repositoryOrganization(req)
+		isOrgAdmin := org != "" && actor != nil && actor.HasOrganizationRole(org, RoleAdmin)
+		isSelf := actor != nil && actor.ID.Hex() == id
+		switch {
+		case isOrgAdmin && !isSelf:
+			before := _before.(*User)
+			if before.HasRole(RoleAdmin) || len(before.Organizations) != 1 || !before.IsMemberOf(org) {
+				resource.RenderErrorCode(w, req, http.StatusForbidden, CodeCannotUpdateUser)
+				return
+			}
+			update := User{}
+			if membership := body.User.Membership(org); membership != nil {
+				update.Organizations = []Membership{*membership}
+			}
+			body.User = update
+		case isOrgAdmin:
+			body.User.Roles = nil
+		default:
+			body.User.Roles = nil
+			body.User.Organizations = nil
+		}
+	}
+	if resource.ControllerHooks.PreUpdateUserHook != nil {
+		err = resource.traceHook(req, "PreUpdateUserHook", func() error {
+			return resource.ControllerHooks.PreUpdateUserHook(resource, req, &PreUpdateUserHookPayload{
+				ID:       id,
+				Previous: _before.(*User),
+				Update:   &body.User,
+				Actor:    resource.CurrentUser(req),
+			})
+		})
+		if err != nil {
+			resource.RenderHookError(w, req, err)
+			return
+		}
+	}
+	event := resource.newUserEvent(w, req, EventUserUpdated, _before.(*User), nil)
+	user, err := resource.updateUser(ctx, repo, id, &body.User, event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	resource.recordUserAudit(req, UpdateUser, _before.(*User), user)
+
+	event.User = user
+	err = resource.publish(event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
 		return
 	}
-	user := _user.(*User)
 
 	resource.Render(w, req, http.StatusOK, UpdateUserResponse_v0{
 		User:    *user,
-		Message: "User updated",
+		Code:    CodeUserUpdated,
+		Message: resource.Message(req, CodeUserUpdated),
 		Success: true,
 	})
 }
@@ -344,16 +724,50 @@ func (resource *Resource) HandleDeleteUser_v0(w http.ResponseWriter, req *http.R
 	params := mux.Vars(req)
 	id := params["id"]
 
-	repo := resource.UserRepository(req)
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req)
+	_before, err := repo.GetUserById(ctx, id)
+	if err != nil {
+		resource.renderUserLookupError(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	if resource.ControllerHooks.PreDeleteUserHook != nil {
+		err = resource.traceHook(req, "PreDeleteUserHook", func() error {
+			return resource.ControllerHooks.PreDeleteUserHook(resource, req, &PreDeleteUserHookPayload{
+				User:  _before.(*User),
+				Actor: resource.CurrentUser(req),
+			})
+		})
+		if err != nil {
+			resource.RenderHookError(w, req, err)
+			return
+		}
+	}
+
+	event := resource.newUserEvent(w, req, EventUserDeleted, _before.(*User), nil)
+	err = resource.deleteUsers([]*Event{event}, func() error {
+		return repo.DeleteUser(ctx, id)
+	})
+	if err, ok := err.(*MessageError); ok && err.Code == CodeCannotRemoveAdmin {
+		resource.RenderErrorFrom(w, req, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	resource.recordUserAudit(req, DeleteUser, _before.(*User), nil)
 
-	err := repo.DeleteUser(id)
+	err = resource.publish(event)
 	if err != nil {
-		resource.RenderError(w, req, http.StatusBadRequest, err.Error())
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
 		return
 	}
 
 	resource.Render(w, req, http.StatusOK, DeleteUserResponse_v0{
-		Message: "User deleted",
+		Code:    CodeUserDeleted,
+		Message: resource.Message(req, CodeUserDeleted),
 		Success: true,
 	})
 }
@@ -364,12 +778,125 @@ func (resource *Resource) HandleCountUsers_v0(w http.ResponseWriter, req *http.R
 	field := req.FormValue("field")
 	query := req.FormValue("q")
 
-	repo := resource.UserRepository(req)
-	count := repo.CountUsers(field, query)
+	filter, err := resource.userFilter(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, userFilterErrorStatus(err), err)
+		return
+	}
+
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req)
+	var count int
+	if filter != nil {
+		count, err = repo.(IContextFilterUserRepository).CountUsersBy(ctx, filter)
+	} else {
+		count, err = repo.CountUsers(ctx, field, query)
+	}
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
 
 	resource.Render(w, req, http.StatusOK, CountUsersResponse_v0{
 		Count:   count,
-		Message: "Users count retrieved",
+		Code:    CodeUsersCounted,
+		Message: resource.Message(req, CodeUsersCounted),
 		Success: true,
 	})
 }
+
+// HandleSearchUsers_v0 searches users by username and email local-part with the `q` terms,
+// ranked by relevance and limited to `per_page` results
+func (resource *Resource) HandleSearchUsers_v0(w http.ResponseWriter, req *http.Request) {
+	query := strings.TrimSpace(req.FormValue("q"))
+	if query == "" || len(query) > maxSearchQueryLength {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidSearch, maxSearchQueryLength)
+		return
+	}
+	limit, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := resource.SearchUsers(req, query, limit)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	resource.Render(w, req, http.StatusOK, SearchUsersResponse_v0{
+		Results: results,
+		Code:    CodeUsersSearched,
+		Message: resource.Message(req, CodeUsersSearched),
+		Success: true,
+	})
+}
+
+// HandleSuggestUsers_v0 suggests active users by username `prefix`, for eg: to mention users.
+// Returns up to `limit` (at most MaxSuggestLimit) ids and usernames.
+func (resource *Resource) HandleSuggestUsers_v0(w http.ResponseWriter, req *http.Request) {
+	prefix := strings.TrimSpace(req.FormValue("prefix"))
+	limit := DefaultSuggestLimit
+	var err error
+	if value := req.FormValue("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+	}
+	if err != nil || prefix == "" || len(prefix) > maxSuggestPrefixLength || limit < 1 || limit > MaxSuggestLimit {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidSuggest, maxSuggestPrefixLength, MaxSuggestLimit)
+		return
+	}
+
+	suggestions, err := resource.SuggestUsers(req, prefix, limit)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	resource.Render(w, req, http.StatusOK, SuggestUsersResponse_v0{
+		Suggestions: suggestions,
+		Code:        CodeUsersSuggested,
+		Message:     resource.Message(req, CodeUsersSuggested),
+		Success:     true,
+	})
+}
+
+// userFilter parses the `filter` request param, if any, and validates the `field` searched by prefix.
+// With `regex=true`, `q` is a regular expression matched on `field`, only allowed for admins.
+func (resource *Resource) userFilter(req *http.Request) (FilterExpr, error) {
+	field := req.FormValue("field")
+	err := ValidateUserSearchField(field)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter FilterExpr
+	if value := req.FormValue("filter"); value != "" {
+		filter, err = ParseUserFilter(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if regex, _ := strconv.ParseBool(req.FormValue("regex")); !regex {
+		return filter, nil
+	}
+
+	actor := asUser(resource.CurrentUser(req))
+	if actor == nil || !actor.HasRole(RoleAdmin) {
+		return nil, NewMessageError(CodeRegexForbidden)
+	}
+	regexFilter, err := UserRegexFilter(field, req.FormValue("q"))
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		return FilterAnd{filter, regexFilter}, nil
+	}
+	return regexFilter, nil
+}
+
+// userFilterErrorStatus is 403 for a regex search by a non-admin, 400 otherwise
+func userFilterErrorStatus(err error) int {
+	if messageErr, ok := err.(*MessageError); ok && messageErr.Code == CodeRegexForbidden {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
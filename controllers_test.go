@@ -0,0 +1,62 @@
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCreateUserChecksHookChanges(t *testing.T) {
+	existing := newTestUser(StatusActive, RoleUser)
+	existing.Username, existing.Email = "bob", "bob@example.com"
+
+	tests := []struct {
+		name     string
+		hook     func(user *User)
+		status   int
+		expected string
+	}{
+		{"unchanged", func(user *User) {}, http.StatusCreated, CodeUserCreated},
+		{"username", func(user *User) { user.Username = "bob" }, http.StatusBadRequest, CodeUsernameExists},
+		{"email", func(user *User) { user.Email = "bob@example.com" }, http.StatusBadRequest, CodeEmailExists},
+	}
+	for _, test := range tests {
+		hook := test.hook
+		store := newMemoryUserStore(existing)
+		resource := newTestResource(&Options{
+			UserRepositoryFactory: &memoryUserRepositoryFactory{store},
+			ControllerHooks: &ControllerHooks{
+				PreCreateUserHook: func(resource *Resource, req *http.Request, payload *PreCreateUserHookPayload) error {
+					hook(payload.User)
+					return nil
+				},
+			},
+		})
+
+		w := httptest.NewRecorder()
+		resource.HandleCreateUser_v0(w, newCreateUserRequest("alice", "alice@example.com"))
+		var response ErrorResponse_v0
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != test.status || response.Code != test.expected {
+			t.Errorf("%v: expected %v %v, got %v %v", test.name, test.status, test.expected, w.Code, response.Code)
+		}
+		if test.status != http.StatusCreated && len(store.users) != 1 {
+			t.Errorf("%v: expected no user to be created", test.name)
+		}
+	}
+}
+
+func TestCreateUserRejectsExistingUsername(t *testing.T) {
+	existing := newTestUser(StatusActive, RoleUser)
+	existing.Username, existing.Email = "bob", "bob@example.com"
+	resource := newTestResource(&Options{UserRepositoryFactory: &memoryUserRepositoryFactory{newMemoryUserStore(existing)}})
+
+	w := httptest.NewRecorder()
+	resource.HandleCreateUser_v0(w, newCreateUserRequest("bob", "robert@example.com"))
+	var response ErrorResponse_v0
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusBadRequest || response.Code != CodeUsernameExists {
+		t.Errorf("expected %v, got %v %v", CodeUsernameExists, w.Code, response.Code)
+	}
+}
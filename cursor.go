@@ -0,0 +1,152 @@
+package users
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultUserSort sorts users by descending _id, the order of creation
+const defaultUserSort = "-_id"
+
+// userSortFields whitelists the fields users can be sorted on;
+// unique fields need no _id tie-breaker
+var userSortFields = map[string]bool{
+	"_id":              true,
+	"username":         true,
+	"email":            true,
+	"createdDate":      false,
+	"lastModifiedDate": false,
+	"status":           false,
+}
+
+// NormalizeUserSort returns the sort if it is allowed, `field` or `-field`, or the default sort
+func NormalizeUserSort(sort string) string {
+	if _, ok := userSortFields[strings.TrimPrefix(sort, "-")]; !ok {
+		return defaultUserSort
+	}
+	return sort
+}
+
+// UserCursor is the position of a user within a list sorted by Sort, then by _id.
+// Cursors are opaque to clients, see EncodeUserCursor.
+type UserCursor struct {
+	Sort   string      `json:"s"`
+	Value  interface{} `json:"v"`
+	Time   bool        `json:"t,omitempty"`
+	ID     string      `json:"id"`
+	Before bool        `json:"b,omitempty"`
+}
+
+// NewUserCursor returns the cursor of the user within a list sorted by sort,
+// to page after it, or before it
+func NewUserCursor(user *User, sort string, before bool) *UserCursor {
+	sort = NormalizeUserSort(sort)
+	cursor := &UserCursor{
+		Sort:   sort,
+		ID:     user.ID.Hex(),
+		Before: before,
+	}
+	field := strings.TrimPrefix(sort, "-")
+	if field == "_id" {
+		return cursor
+	}
+	value := userSortValue(user, field)
+	if t, ok := value.(time.Time); ok {
+		cursor.Value = t.UTC().Format(time.RFC3339Nano)
+		cursor.Time = true
+	} else {
+		cursor.Value = value
+	}
+	return cursor
+}
+
+// EncodeUserCursor returns the opaque cursor of the user within a list sorted by sort
+func EncodeUserCursor(user *User, sort string, before bool) string {
+	b, _ := json.Marshal(NewUserCursor(user, sort, before))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeUserCursor decodes an opaque cursor.
+// A bare ObjectId is accepted as the cursor of a legacy `last_id`, with an unknown sort value.
+func DecodeUserCursor(cursor string) (*UserCursor, error) {
+	if bson.IsObjectIdHex(cursor) {
+		return &UserCursor{ID: cursor}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, NewMessageError(CodeInvalidCursor)
+	}
+	var decoded UserCursor
+	err = json.Unmarshal(b, &decoded)
+	if err != nil || !bson.IsObjectIdHex(decoded.ID) || decoded.Sort != NormalizeUserSort(decoded.Sort) {
+		return nil, NewMessageError(CodeInvalidCursor)
+	}
+	if decoded.Time {
+		s, ok := decoded.Value.(string)
+		if !ok {
+			return nil, NewMessageError(CodeInvalidCursor)
+		}
+		decoded.Value, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, NewMessageError(CodeInvalidCursor)
+		}
+	} else if _, ok := decoded.Value.(string); !ok && strings.TrimPrefix(decoded.Sort, "-") != "_id" {
+		return nil, NewMessageError(CodeInvalidCursor)
+	}
+	return &decoded, nil
+}
+
+// userSortValue returns the value of the sort field of the user
+func userSortValue(user *User, field string) interface{} {
+	switch field {
+	case "username":
+		return user.Username
+	case "email":
+		return user.Email
+	case "status":
+		return user.Status
+	case "createdDate":
+		return user.CreatedDate
+	case "lastModifiedDate":
+		return user.LastModifiedDate
+	}
+	return user.ID.Hex()
+}
+
+func equalSortValues(a interface{}, b interface{}) bool {
+	return compareSortValues(a, b) == 0
+}
+
+// compareSortValues compares string or time.Time sort values
+func compareSortValues(a interface{}, b interface{}) int {
+	if t, ok := a.(time.Time); ok {
+		u, _ := b.(time.Time)
+		switch {
+		case t.Before(u):
+			return -1
+		case t.After(u):
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// sortUsers sorts users by the sort field then by _id
+func sortUsers(users Users, field string, desc bool) {
+	sort.SliceStable(users, func(i, j int) bool {
+		c := compareSortValues(userSortValue(&users[i], field), userSortValue(&users[j], field))
+		if c == 0 {
+			c = strings.Compare(string(users[i].ID), string(users[j].ID))
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
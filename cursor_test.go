@@ -0,0 +1,235 @@
+package users
+
+import (
+	"encoding/base64"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userDatabase is a domain.IDatabase of users, returning ties of the sort field in the order they were added
+type userDatabase struct {
+	domain.IDatabase
+	users Users
+}
+
+func userFieldValue(user *User, field string) interface{} {
+	if field == "_id" {
+		return user.ID
+	}
+	return userSortValue(user, field)
+}
+
+func compareFieldValues(a interface{}, b interface{}) int {
+	if id, ok := a.(bson.ObjectId); ok {
+		other, _ := b.(bson.ObjectId)
+		return strings.Compare(string(id), string(other))
+	}
+	return compareSortValues(a, b)
+}
+
+func (db *userDatabase) matches(user *User, q domain.Query) bool {
+	for key, value := range q {
+		if key == "$and" {
+			for _, condition := range value.([]domain.Query) {
+				if !db.matches(user, condition) {
+					return false
+				}
+			}
+			continue
+		}
+		actual := userFieldValue(user, key)
+		condition, ok := value.(domain.Query)
+		if !ok {
+			if compareFieldValues(actual, value) != 0 {
+				return false
+			}
+			continue
+		}
+		for op, operand := range condition {
+			c := compareFieldValues(actual, operand)
+			if (op == "$gt" && c <= 0) || (op == "$lt" && c >= 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (db *userDatabase) FindOne(name string, q domain.Query, result interface{}) error {
+	for i := range db.users {
+		if db.matches(&db.users[i], q) {
+			*result.(*User) = db.users[i]
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *userDatabase) FindAll(name string, q domain.Query, result interface{}, limit int, sortField string) error {
+	users := Users{}
+	for i := range db.users {
+		if db.matches(&db.users[i], q) {
+			users = append(users, db.users[i])
+		}
+	}
+	field := strings.TrimPrefix(sortField, "-")
+	desc := strings.HasPrefix(sortField, "-")
+	sort.SliceStable(users, func(i, j int) bool {
+		c := compareFieldValues(userFieldValue(&users[i], field), userFieldValue(&users[j], field))
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	*result.(*Users) = users
+	return nil
+}
+
+// newTiedUserRepository returns a repository of users with many ties of status and createdDate,
+// added in the reverse order of their _id
+func newTiedUserRepository() (*UserRepository, Users) {
+	statuses := []string{StatusActive, StatusPending, StatusActive, StatusActive, StatusSuspended, StatusPending, StatusActive, StatusActive}
+	created := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := Users{}
+	for i, status := range statuses {
+		user := newTestUser(status, RoleUser)
+		user.CreatedDate = created.Add(time.Duration(i/3) * time.Hour)
+		users = append(users, *user)
+	}
+	db := &userDatabase{}
+	for i := len(users) - 1; i >= 0; i-- {
+		db.users = append(db.users, users[i])
+	}
+	return &UserRepository{DB: db}, users
+}
+
+func userIDs(users Users) []string {
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.ID.Hex())
+	}
+	return ids
+}
+
+func TestFindUsersPageTies(t *testing.T) {
+	for _, sortField := range []string{"status", "-status", "createdDate", "-createdDate", "_id", "-_id"} {
+		repo, users := newTiedUserRepository()
+		expected := append(Users{}, users...)
+		sortUsers(expected, strings.TrimPrefix(sortField, "-"), strings.HasPrefix(sortField, "-"))
+
+		for _, limit := range []int{1, 2, 3, 5} {
+			found := Users{}
+			cursor := ""
+			for len(found) <= len(users) {
+				page, err := repo.findUsersPage(domain.Query{}, cursor, limit, sortField)
+				if err != nil {
+					t.Fatalf("%v: %v", sortField, err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				found = append(found, page...)
+				cursor = EncodeUserCursor(&page[len(page)-1], sortField, false)
+			}
+			if strings.Join(userIDs(found), ",") != strings.Join(userIDs(expected), ",") {
+				t.Errorf("%v by %v: expected every user once in order, got %v of %v users", sortField, limit, len(found), len(users))
+			}
+
+			// paging before the last user returns the users preceding it, in order
+			last := expected[len(expected)-1]
+			page, err := repo.findUsersPage(domain.Query{}, EncodeUserCursor(&last, sortField, true), limit, sortField)
+			if err != nil {
+				t.Fatalf("%v: %v", sortField, err)
+			}
+			previous := expected[len(expected)-1-limit : len(expected)-1]
+			if strings.Join(userIDs(page), ",") != strings.Join(userIDs(previous), ",") {
+				t.Errorf("%v by %v: expected the users before the cursor", sortField, limit)
+			}
+		}
+	}
+}
+
+func TestFindUsersPageLegacyCursor(t *testing.T) {
+	repo, users := newTiedUserRepository()
+	expected := append(Users{}, users...)
+	sortUsers(expected, "status", false)
+
+	// the sort value of a legacy `last_id` is looked up from its user
+	page, err := repo.findUsersPage(domain.Query{}, expected[2].ID.Hex(), 3, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(userIDs(page), ",") != strings.Join(userIDs(expected[3:6]), ",") {
+		t.Errorf("expected the users after the legacy cursor")
+	}
+
+	_, err = repo.findUsersPage(domain.Query{}, bson.NewObjectId().Hex(), 3, "status")
+	if messageErr, ok := err.(*MessageError); !ok || messageErr.Code != CodeInvalidCursor {
+		t.Errorf("expected %v for the legacy cursor of an unknown user, got %v", CodeInvalidCursor, err)
+	}
+
+	// a cursor of another sort is rejected
+	_, err = repo.findUsersPage(domain.Query{}, EncodeUserCursor(&users[0], "username", false), 3, "status")
+	if messageErr, ok := err.(*MessageError); !ok || messageErr.Code != CodeInvalidCursor {
+		t.Errorf("expected %v for the cursor of another sort, got %v", CodeInvalidCursor, err)
+	}
+}
+
+func TestDecodeUserCursor(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	user.CreatedDate = time.Date(2016, 1, 1, 0, 0, 0, 123, time.UTC)
+
+	for _, sortField := range []string{"-_id", "username", "-createdDate"} {
+		cursor, err := DecodeUserCursor(EncodeUserCursor(user, sortField, true))
+		if err != nil {
+			t.Fatalf("%v: %v", sortField, err)
+		}
+		value := userSortValue(user, strings.TrimPrefix(sortField, "-"))
+		if cursor.Sort != sortField || cursor.ID != user.ID.Hex() || !cursor.Before || (sortField != "-_id" && !equalSortValues(cursor.Value, value)) {
+			t.Errorf("%v: expected the cursor of the user, got %+v", sortField, cursor)
+		}
+	}
+
+	cursor, err := DecodeUserCursor(user.ID.Hex())
+	if err != nil || cursor.ID != user.ID.Hex() || cursor.Sort != "" {
+		t.Errorf("expected the legacy cursor of the ObjectId, got %+v, %v", cursor, err)
+	}
+}
+
+func TestDecodeUserCursorErrors(t *testing.T) {
+	id := bson.NewObjectId().Hex()
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"invalid base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"s":"-_id","id":"` + id + `"}`))},
+		{"invalid JSON", encode(`{"s":"-_id",`)},
+		{"JSON of another type", encode(`["-_id"]`)},
+		{"missing id", encode(`{"s":"-_id"}`)},
+		{"invalid id", encode(`{"s":"-_id","id":"123"}`)},
+		{"unknown sort", encode(`{"s":"password","v":"a","id":"` + id + `"}`)},
+		{"missing value", encode(`{"s":"username","id":"` + id + `"}`)},
+		{"value of another type", encode(`{"s":"username","v":1,"id":"` + id + `"}`)},
+		{"time of another type", encode(`{"s":"createdDate","v":1,"t":true,"id":"` + id + `"}`)},
+		{"invalid time", encode(`{"s":"createdDate","v":"yesterday","t":true,"id":"` + id + `"}`)},
+		{"truncated ObjectId", id[:23]},
+	}
+	for _, test := range tests {
+		_, err := DecodeUserCursor(test.cursor)
+		if messageErr, ok := err.(*MessageError); !ok || messageErr.Code != CodeInvalidCursor {
+			t.Errorf("%v: expected %v, got %v", test.name, CodeInvalidCursor, err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+	"time"
+)
+
+// AuditFilter restricts the audit entries returned by IAuditRepository.FilterEntries.
+// Zero-valued fields are not filtered on.
+type AuditFilter struct {
+	ActorID  string
+	TargetID string
+	Route    string
+	From     time.Time
+	To       time.Time
+}
+
+type IAuditEntry interface {
+	GetID() string
+}
+
+type IAuditEntries interface{}
+
+type IAuditRepositoryFactory interface {
+	New(db domain.IDatabase, organizationID string) IAuditRepository
+}
+
+type IAuditRepository interface {
+	CreateEntry(entry IAuditEntry) error
+	FilterEntries(filter *AuditFilter, lastID string, limit int) IAuditEntries
+}
@@ -0,0 +1,54 @@
+package users
+
+import (
+	"context"
+	"github.com/sogko/slumber/domain"
+)
+
+// IContextUserRepositoryFactory is implemented by user repository factories
+// whose repositories take the context of the request, see IContextUserRepository
+type IContextUserRepositoryFactory interface {
+	NewContext(db domain.IDatabase, organizationID string) IContextUserRepository
+}
+
+// IContextUserRepository is the context-aware variant of IUserRepository.
+// Operations should stop once the context is done, and return its error.
+type IContextUserRepository interface {
+	CreateUser(ctx context.Context, user domain.IUser) error
+	GetUsers(ctx context.Context) (domain.IUsers, error)
+	FilterUsers(ctx context.Context, field string, query string, cursor string, limit int, sort string) (domain.IUsers, error)
+	CountUsers(ctx context.Context, field string, query string) (int, error)
+	DeleteUsers(ctx context.Context, ids []string) error
+	DeleteAllUsers(ctx context.Context) error
+	GetUserById(ctx context.Context, id string) (domain.IUser, error)
+	GetUserByUsername(ctx context.Context, username string) (domain.IUser, error)
+	UserExistsByUsername(ctx context.Context, username string) (bool, error)
+	UserExistsByEmail(ctx context.Context, email string) (bool, error)
+	UpdateUser(ctx context.Context, id string, inUser domain.IUser) (domain.IUser, error)
+	DeleteUser(ctx context.Context, id string) error
+}
+
+// IContextFilterUserRepository is the context-aware variant of IFilterUserRepository
+type IContextFilterUserRepository interface {
+	FilterUsersBy(ctx context.Context, filter FilterExpr, cursor string, limit int, sort string) (domain.IUsers, error)
+	CountUsersBy(ctx context.Context, filter FilterExpr) (int, error)
+}
+
+// IContextGroupUserRepository is the context-aware variant of IGroupUserRepository
+type IContextGroupUserRepository interface {
+	FilterUsersByGroup(ctx context.Context, groupID string, lastID string, limit int, sort string) (domain.IUsers, error)
+	AddUserToGroup(ctx context.Context, id string, groupID string) error
+	RemoveUserFromGroup(ctx context.Context, id string, groupID string) error
+	RemoveGroupFromUsers(ctx context.Context, groupID string) error
+}
+
+// IContextSuggestUserRepository is the context-aware variant of ISuggestUserRepository
+type IContextSuggestUserRepository interface {
+	SuggestUsers(ctx context.Context, prefix string, limit int) (domain.IUsers, error)
+}
+
+// IContextOutboxUserRepository is the context-aware variant of IOutboxUserRepository
+type IContextOutboxUserRepository interface {
+	CreateUserWithOutbox(ctx context.Context, user domain.IUser, messages ...IOutboxMessage) error
+	UpdateUserWithOutbox(ctx context.Context, id string, inUser domain.IUser, messages ...IOutboxMessage) (domain.IUser, error)
+}
@@ -0,0 +1,54 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+)
+
+// Filter operators
+const (
+	FilterEq       = "eq"
+	FilterNe       = "ne"
+	FilterIn       = "in"
+	FilterPrefix   = "prefix"
+	FilterContains = "contains"
+	FilterBetween  = "between"
+	FilterGt       = "gt"
+	FilterGte      = "gte"
+	FilterLt       = "lt"
+	FilterLte      = "lte"
+
+	// FilterMatches matches a regular expression,
+	// it is not available in filter expressions and only built for admins, see UserRegexFilter
+	FilterMatches = "matches"
+)
+
+// FilterExpr is a parsed and validated filter expression,
+// translated into a query by each repository backend
+type FilterExpr interface {
+	filterExpr()
+}
+
+// FilterAnd matches if all of its expressions match
+type FilterAnd []FilterExpr
+
+// FilterOr matches if any of its expressions match
+type FilterOr []FilterExpr
+
+// FilterCondition compares a field with its values.
+// Values are strings, or time.Time for date fields.
+type FilterCondition struct {
+	Field  string
+	Op     string
+	Values []interface{}
+}
+
+func (FilterAnd) filterExpr()       {}
+func (FilterOr) filterExpr()        {}
+func (FilterCondition) filterExpr() {}
+
+// IFilterUserRepository is implemented by user repositories that list and count the users matching filter expressions,
+// the `filter` parameter of user lists and counts is rejected otherwise
+type IFilterUserRepository interface {
+	FilterUsersBy(filter FilterExpr, cursor string, limit int, sort string) domain.IUsers
+	CountUsersBy(filter FilterExpr) int
+}
@@ -0,0 +1,35 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+)
+
+type IGroup interface {
+	GetID() string
+	IsValid() bool
+	HasPermission(permission string) bool
+}
+
+type IGroups interface{}
+
+type IGroupRepositoryFactory interface {
+	New(db domain.IDatabase, organizationID string) IGroupRepository
+}
+
+type IGroupRepository interface {
+	CreateGroup(group IGroup) error
+	FilterGroups(ids []string, lastID string, limit int, sort string) IGroups
+	GetGroupById(id string) (IGroup, error)
+	GroupExistsByName(name string) bool
+	UpdateGroup(id string, inGroup IGroup) (IGroup, error)
+	DeleteGroup(id string) error
+}
+
+// IGroupUserRepository is implemented by user repositories that manage the group memberships of users,
+// which the group routes require
+type IGroupUserRepository interface {
+	FilterUsersByGroup(groupID string, lastID string, limit int, sort string) domain.IUsers
+	AddUserToGroup(id string, groupID string) error
+	RemoveUserFromGroup(id string, groupID string) error
+	RemoveGroupFromUsers(groupID string) error
+}
@@ -0,0 +1,21 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+	"time"
+)
+
+type IImpersonationSession interface {
+	GetID() string
+	IsActive(now time.Time) bool
+}
+
+type IImpersonationRepositoryFactory interface {
+	New(db domain.IDatabase) IImpersonationRepository
+}
+
+type IImpersonationRepository interface {
+	CreateSession(session IImpersonationSession) error
+	GetSessionById(id string) (IImpersonationSession, error)
+	StopSession(id string) (IImpersonationSession, error)
+}
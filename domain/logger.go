@@ -0,0 +1,14 @@
+package users
+
+import (
+	"context"
+)
+
+// ILogger receives the structured log events of the resource, as a message followed by key-value pairs.
+// It is implemented by *slog.Logger.
+type ILogger interface {
+	DebugContext(ctx context.Context, msg string, args ...interface{})
+	InfoContext(ctx context.Context, msg string, args ...interface{})
+	WarnContext(ctx context.Context, msg string, args ...interface{})
+	ErrorContext(ctx context.Context, msg string, args ...interface{})
+}
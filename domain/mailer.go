@@ -0,0 +1,14 @@
+package users
+
+// MailMessage is a rendered email with text and HTML alternatives
+type MailMessage struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type IMailer interface {
+	Send(message *MailMessage) error
+}
@@ -0,0 +1,28 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+	"time"
+)
+
+type IAppliedMigration interface {
+	GetVersion() int
+}
+
+type IAppliedMigrations interface{}
+
+type IMigrationRepositoryFactory interface {
+	New(db domain.IDatabase) IMigrationRepository
+}
+
+type IMigrationRepository interface {
+	AppliedMigrations() (IAppliedMigrations, error)
+	RecordMigration(migration IAppliedMigration) error
+	RemoveMigration(version int) error
+
+	// AcquireLock takes the migration lock for the owner, unless another owner holds an unexpired lock
+	AcquireLock(owner string, ttl time.Duration) (bool, error)
+	// RenewLock extends the lock held by the owner, returns false if the owner no longer holds it
+	RenewLock(owner string, ttl time.Duration) (bool, error)
+	ReleaseLock(owner string) error
+}
@@ -0,0 +1,15 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+	"net/http"
+)
+
+type IOrganizationResolver interface {
+	ResolveOrganization(req *http.Request) (string, error)
+}
+
+type IOrganizationUserRepositoryFactory interface {
+	IUserRepositoryFactory
+	NewForOrganization(db domain.IDatabase, organizationID string) IUserRepository
+}
@@ -0,0 +1,36 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+	"time"
+)
+
+type IOutboxMessage interface {
+	GetID() string
+}
+
+type IOutboxMessages interface{}
+
+type IOutboxRepositoryFactory interface {
+	New(db domain.IDatabase, organizationID string) IOutboxRepository
+}
+
+type IOutboxRepository interface {
+	Enqueue(message IOutboxMessage) error
+	GetMessageById(id string) (IOutboxMessage, error)
+	SaveMessage(message IOutboxMessage) error
+	FilterMessages(status string, lastID string, limit int) IOutboxMessages
+	DueMessages(now time.Time, limit int) IOutboxMessages
+	StagedMessages(before time.Time, limit int) IOutboxMessages
+
+	// Relay moves the messages written alongside user documents into the outbox,
+	// for the user specified by the id, or any user if id is empty
+	Relay(id string, limit int) (int, error)
+}
+
+// IOutboxUserRepository is implemented by user repositories that write outbox messages
+// within the same document update as the user change
+type IOutboxUserRepository interface {
+	CreateUserWithOutbox(user domain.IUser, messages ...IOutboxMessage) error
+	UpdateUserWithOutbox(id string, inUser domain.IUser, messages ...IOutboxMessage) (domain.IUser, error)
+}
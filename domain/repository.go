@@ -11,7 +11,7 @@ type IUserRepositoryFactory interface {
 type IUserRepository interface {
 	CreateUser(user domain.IUser) error
 	GetUsers() domain.IUsers
-	FilterUsers(field string, query string, lastID string, limit int, sort string) domain.IUsers
+	FilterUsers(field string, query string, cursor string, limit int, sort string) domain.IUsers
 	CountUsers(field string, query string) int
 	DeleteUsers(ids []string) error
 	DeleteAllUsers() error
@@ -0,0 +1,47 @@
+package users
+
+import (
+	"gopkg.in/mgo.v2"
+)
+
+// Kinds of index drift
+const (
+	IndexMissing    = "missing"
+	IndexUnexpected = "unexpected"
+	IndexChanged    = "changed"
+	// IndexObsolete is an index declared by previous releases, to drop
+	IndexObsolete = "obsolete"
+)
+
+// ISchemaRepository is implemented by repositories that manage the indexes of their collections
+type ISchemaRepository interface {
+	EnsureSchema() (*SchemaReport, error)
+}
+
+// IIndexedDatabase is implemented by databases that can list the indexes of a collection.
+// Drift between declared and actual indexes is only reported for these databases.
+type IIndexedDatabase interface {
+	Indexes(name string) ([]mgo.Index, error)
+}
+
+// SchemaReport is the result of ensuring the indexes of a repository
+type SchemaReport struct {
+	Ensured []IndexReport
+	Failed  []IndexReport
+	// Drift is nil if the database can't list its indexes, see IIndexedDatabase
+	Drift []IndexDrift
+}
+
+// IndexReport is an index ensured, or failed to be ensured
+type IndexReport struct {
+	Collection string
+	Index      mgo.Index
+	Error      string
+}
+
+// IndexDrift is a difference between the declared and the actual indexes of a collection
+type IndexDrift struct {
+	Collection string
+	Key        []string
+	Kind       string
+}
@@ -0,0 +1,19 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+)
+
+// IUserSearcher is implemented by user repositories that search users themselves,
+// the users of other repositories are searched in-process, see UserSearchIndex
+type IUserSearcher interface {
+	SearchUsers(query string, limit int) (IUserSearchResults, error)
+}
+
+type IUserSearchResults interface{}
+
+// ISuggestUserRepository is implemented by user repositories that suggest the active users
+// whose username starts with a prefix, which the suggest route requires
+type ISuggestUserRepository interface {
+	SuggestUsers(prefix string, limit int) domain.IUsers
+}
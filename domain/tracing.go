@@ -0,0 +1,30 @@
+package users
+
+import (
+	"time"
+)
+
+// Span statuses
+const (
+	SpanStatusOK    = "ok"
+	SpanStatusError = "error"
+)
+
+// SpanData is an ended span, with the W3C trace context IDs in hexadecimal
+type SpanData struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]interface{}
+	Status       string
+	Error        string
+}
+
+// ISpanExporter receives the spans of the resource once they end.
+// It is called synchronously, so exporters sending spans to a collector should batch them in the background.
+type ISpanExporter interface {
+	ExportSpan(span *SpanData)
+}
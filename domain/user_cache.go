@@ -0,0 +1,14 @@
+package users
+
+import (
+	"time"
+)
+
+// IUserCache is the backend of the user repository cache, an in-memory LRU by default.
+// Backends outside of the process must serialize the values they are given and return them as is.
+type IUserCache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, ttl time.Duration)
+	Delete(keys ...string)
+	Clear()
+}
@@ -0,0 +1,38 @@
+package users
+
+import (
+	"github.com/sogko/slumber/domain"
+	"time"
+)
+
+type IWebhook interface {
+	GetID() string
+	IsValid() bool
+}
+
+type IWebhooks interface{}
+
+type IWebhookDelivery interface {
+	GetID() string
+}
+
+type IWebhookDeliveries interface{}
+
+type IWebhookRepositoryFactory interface {
+	New(db domain.IDatabase, organizationID string) IWebhookRepository
+}
+
+type IWebhookRepository interface {
+	CreateWebhook(webhook IWebhook) error
+	FilterWebhooks(lastID string, limit int) IWebhooks
+	FindWebhooksForEvent(eventType string, organizationID string) IWebhooks
+	GetWebhookById(id string) (IWebhook, error)
+	UpdateWebhook(id string, inWebhook IWebhook) (IWebhook, error)
+	DeleteWebhook(id string) error
+
+	CreateDelivery(delivery IWebhookDelivery) error
+	GetDeliveryById(id string) (IWebhookDelivery, error)
+	SaveDelivery(delivery IWebhookDelivery) error
+	FilterDeliveries(webhookID string, status string, lastID string, limit int) IWebhookDeliveries
+	DueDeliveries(now time.Time, limit int) IWebhookDeliveries
+}
@@ -0,0 +1,290 @@
+package users
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+// User lifecycle events
+const (
+	EventUserCreated          EventType = "UserCreated"
+	EventUserConfirmed        EventType = "UserConfirmed"
+	EventUserUpdated          EventType = "UserUpdated"
+	EventUserDeleted          EventType = "UserDeleted"
+	EventUsersDeleted         EventType = "UsersDeleted"
+	EventAllUsersDeleted      EventType = "AllUsersDeleted"
+	EventRolesChanged         EventType = "RolesChanged"
+	EventStatusChanged        EventType = "StatusChanged"
+	EventGroupMemberAdded     EventType = "GroupMemberAdded"
+	EventGroupMemberRemoved   EventType = "GroupMemberRemoved"
+	EventImpersonationStarted EventType = "ImpersonationStarted"
+	EventImpersonationStopped EventType = "ImpersonationStopped"
+)
+
+// EventTypes lists the user lifecycle events
+var EventTypes = []EventType{
+	EventUserCreated,
+	EventUserConfirmed,
+	EventUserUpdated,
+	EventUserDeleted,
+	EventUsersDeleted,
+	EventAllUsersDeleted,
+	EventRolesChanged,
+	EventStatusChanged,
+	EventGroupMemberAdded,
+	EventGroupMemberRemoved,
+	EventImpersonationStarted,
+	EventImpersonationStopped,
+}
+
+// Event is published on the resource's event bus after a user is mutated
+type Event struct {
+	Type           EventType `json:"type" bson:"type"`
+	User           *User     `json:"user,omitempty" bson:"user,omitempty"`
+	Previous       *User     `json:"previous,omitempty" bson:"previous,omitempty"`
+	IDs            []string  `json:"ids,omitempty" bson:"ids,omitempty"`
+	GroupID        string    `json:"groupId,omitempty" bson:"groupId,omitempty"`
+	ActorID        string    `json:"actorId,omitempty" bson:"actorId,omitempty"`
+	ImpersonatorID string    `json:"impersonatorId,omitempty" bson:"impersonatorId,omitempty"`
+	OrganizationID string    `json:"organizationId,omitempty" bson:"organizationId,omitempty"`
+	OccurredDate   time.Time `json:"occurredDate" bson:"occurredDate"`
+
+	// Request and ResponseWriter are only set for synchronous delivery within the request,
+	// they are nil for events delivered from the outbox
+	Request        *http.Request       `json:"-" bson:"-"`
+	ResponseWriter http.ResponseWriter `json:"-" bson:"-"`
+
+	// outboxed is set once the event is written to the outbox alongside the user change
+	outboxed bool
+}
+
+// EventHandler handles an event delivered by the event bus.
+// Errors returned by synchronous handlers fail the request that published the event.
+type EventHandler func(resource *Resource, event *Event) error
+
+type DeliveryMode int
+
+const (
+	// DeliverSync runs the handler within the request, in order of subscription
+	DeliverSync DeliveryMode = iota
+	// DeliverAsync runs the handler in its own goroutine, after the request's synchronous handlers
+	DeliverAsync
+)
+
+type IEventBus interface {
+	// Subscribe registers a handler for the given event types, or all events if none is given
+	Subscribe(handler EventHandler, mode DeliveryMode, types ...EventType) (unsubscribe func())
+	Publish(resource *Resource, event *Event) error
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+type subscription struct {
+	handler EventHandler
+	mode    DeliveryMode
+	types   map[EventType]bool
+}
+
+func (sub *subscription) matches(t EventType) bool {
+	return len(sub.types) == 0 || sub.types[t]
+}
+
+// EventBus is the default in-process IEventBus
+type EventBus struct {
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+	pending       sync.WaitGroup
+}
+
+func (bus *EventBus) Subscribe(handler EventHandler, mode DeliveryMode, types ...EventType) func() {
+	sub := &subscription{handler, mode, map[EventType]bool{}}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+	bus.mutex.Lock()
+	bus.subscriptions = append(bus.subscriptions, sub)
+	bus.mutex.Unlock()
+
+	return func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		for i, s := range bus.subscriptions {
+			if s == sub {
+				bus.subscriptions = append(bus.subscriptions[:i], bus.subscriptions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers the event to synchronous handlers in order, stopping at the first error,
+// then to asynchronous handlers.
+func (bus *EventBus) Publish(resource *Resource, event *Event) error {
+	if event.OccurredDate.IsZero() {
+		event.OccurredDate = time.Now()
+	}
+	bus.mutex.RLock()
+	subscriptions := make([]*subscription, len(bus.subscriptions))
+	copy(subscriptions, bus.subscriptions)
+	bus.mutex.RUnlock()
+
+	for _, sub := range subscriptions {
+		if sub.mode != DeliverSync || !sub.matches(event.Type) {
+			continue
+		}
+		err := sub.handler(resource, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	// asynchronous handlers outlive the request
+	detached := *event
+	detached.Request = nil
+	detached.ResponseWriter = nil
+	for _, sub := range subscriptions {
+		if sub.mode != DeliverAsync || !sub.matches(event.Type) {
+			continue
+		}
+		bus.pending.Add(1)
+		go func(sub *subscription, event Event) {
+			defer bus.pending.Done()
+			err := sub.handler(resource, &event)
+			if err != nil {
+				resource.Logger.Error("users: async event handler failed", "event", event.Type, "error", err.Error())
+			}
+		}(sub, detached)
+	}
+	return nil
+}
+
+// Wait blocks until asynchronous deliveries in flight have completed
+func (bus *EventBus) Wait() {
+	bus.pending.Wait()
+}
+
+// subscribeControllerHooks adapts the post-operation ControllerHooks onto the event bus.
+// With the outbox, the hooks run when the OutboxDispatcher delivers the event, without Request and ResponseWriter:
+// failed hooks are retried, and don't fail the request.
+func subscribeControllerHooks(bus IEventBus, hooks *ControllerHooks) {
+	if hooks.PostCreateUserHook != nil {
+		bus.Subscribe((*Resource).runPostHook, DeliverSync, EventUserCreated)
+	}
+	if hooks.PostConfirmUserHook != nil {
+		bus.Subscribe((*Resource).runPostHook, DeliverSync, EventUserConfirmed)
+	}
+}
+
+// runPostHook runs the post-operation ControllerHooks of the event, if any
+func (resource *Resource) runPostHook(event *Event) error {
+	hooks := resource.ControllerHooks
+	switch {
+	case event.Type == EventUserCreated && hooks.PostCreateUserHook != nil:
+		return resource.traceHook(event.Request, "PostCreateUserHook", func() error {
+			return hooks.PostCreateUserHook(resource, event.ResponseWriter, event.Request, &PostCreateUserHookPayload{
+				User: event.User,
+			})
+		})
+	case event.Type == EventUserConfirmed && hooks.PostConfirmUserHook != nil:
+		// the hook has always received the user as it was before confirmation
+		return resource.traceHook(event.Request, "PostConfirmUserHook", func() error {
+			return hooks.PostConfirmUserHook(resource, event.ResponseWriter, event.Request, &PostConfirmUserHookPayload{
+				User: event.Previous,
+			})
+		})
+	}
+	return nil
+}
+
+// newEvent returns an event of the given type, identifying the actor of the request
+func (resource *Resource) newEvent(w http.ResponseWriter, req *http.Request, t EventType) *Event {
+	event := &Event{
+		Type:           t,
+		Request:        req,
+		ResponseWriter: w,
+	}
+	user := resource.CurrentUser(req)
+	if actor := asUser(user); actor != nil {
+		event.ActorID = actor.ID.Hex()
+	}
+	if impersonated, ok := user.(*ImpersonatedUser); ok {
+		event.ImpersonatorID = impersonated.Impersonator.ID.Hex()
+	}
+	event.OrganizationID, _ = resource.Organization(req)
+	return event
+}
+
+// publish publishes the event on the resource's event bus,
+// or writes it to the outbox for delivery by the OutboxDispatcher if the outbox is enabled
+func (resource *Resource) publish(event *Event) error {
+	if resource.OutboxDispatcher == nil {
+		return resource.deliver(event)
+	}
+	if event.outboxed {
+		return nil
+	}
+	return resource.OutboxDispatcher.Enqueue(event)
+}
+
+// deliver publishes the event on the resource's event bus,
+// followed by RolesChanged and StatusChanged if the roles or status of the user differ
+func (resource *Resource) deliver(event *Event) error {
+	err := resource.EventBus.Publish(resource, event)
+	if err != nil || event.Previous == nil || event.User == nil {
+		return err
+	}
+	changes := diffUsers(event.Previous, event.User)
+	for _, t := range []EventType{EventRolesChanged, EventStatusChanged} {
+		field := "roles"
+		if t == EventStatusChanged {
+			field = "status"
+		}
+		if _, ok := changes[field]; !ok {
+			continue
+		}
+		derived := *event
+		derived.Type = t
+		err = resource.EventBus.Publish(resource, &derived)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newUserEvent returns an event of the given type for a mutated user
+func (resource *Resource) newUserEvent(w http.ResponseWriter, req *http.Request, t EventType, before *User, after *User) *Event {
+	event := resource.newEvent(w, req, t)
+	event.User = after
+	event.Previous = before
+	return event
+}
+
+// usersDeletedEvents returns `UserDeleted` for each of the users, followed by `UsersDeleted`
+func (resource *Resource) usersDeletedEvents(w http.ResponseWriter, req *http.Request, users []*User) []*Event {
+	events := []*Event{}
+	ids := []string{}
+	for _, user := range users {
+		events = append(events, resource.newUserEvent(w, req, EventUserDeleted, user, nil))
+		ids = append(ids, user.ID.Hex())
+	}
+	event := resource.newEvent(w, req, EventUsersDeleted)
+	event.IDs = ids
+	return append(events, event)
+}
+
+// publishEvents publishes the events in order, stopping at the first error
+func (resource *Resource) publishEvents(events []*Event) error {
+	for _, event := range events {
+		err := resource.publish(event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Limits of a filter expression
+const (
+	maxFilterLength     = 2048
+	maxFilterConditions = 32
+	maxFilterDepth      = 8
+	maxRegexLength      = 256
+)
+
+// userSearchFields whitelists the fields searchable by prefix with the legacy `field` and `q` params
+var userSearchFields = []string{"username", "email", "status", "locale"}
+
+// ValidateUserSearchField checks that the field can be searched by prefix, see userSearchFields
+func ValidateUserSearchField(field string) error {
+	if field != "" && !containsString(userSearchFields, field) {
+		return NewMessageError(CodeInvalidField, field)
+	}
+	return nil
+}
+
+// UserRegexFilter returns a filter matching the field with a case-insensitive regular expression.
+// Regular expressions are limited in length, must compile, and should only be accepted from admins.
+func UserRegexFilter(field string, pattern string) (FilterExpr, error) {
+	if field == "" {
+		field = "username"
+	}
+	err := ValidateUserSearchField(field)
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" || len(pattern) > maxRegexLength {
+		return nil, NewMessageError(CodeInvalidRegex, fmt.Sprintf("must have between 1 and %v characters", maxRegexLength))
+	}
+	_, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, NewMessageError(CodeInvalidRegex, err.Error())
+	}
+	return FilterCondition{Field: field, Op: FilterMatches, Values: []interface{}{pattern}}, nil
+}
+
+type userFilterField struct {
+	date bool
+	ops  []string
+	// values restricts the allowed values, if any
+	values []string
+}
+
+// userFilterFields whitelists the fields and operators of user filters
+var userFilterFields = map[string]userFilterField{
+	"username":         {ops: []string{FilterEq, FilterNe, FilterIn, FilterPrefix}},
+	"email":            {ops: []string{FilterEq, FilterNe, FilterIn, FilterPrefix}},
+	"emailDomain":      {ops: []string{FilterEq, FilterIn}},
+	"status":           {ops: []string{FilterEq, FilterNe, FilterIn}, values: []string{StatusPending, StatusActive, StatusInactive, StatusSuspended, StatusDeleted}},
+	"roles":            {ops: []string{FilterContains, FilterIn}},
+	"locale":           {ops: []string{FilterEq, FilterNe, FilterIn}},
+	"createdDate":      {date: true, ops: []string{FilterBetween, FilterGt, FilterGte, FilterLt, FilterLte}},
+	"lastModifiedDate": {date: true, ops: []string{FilterBetween, FilterGt, FilterGte, FilterLt, FilterLte}},
+}
+
+// ParseUserFilter parses a user filter expression, for eg:
+//
+//	status in [active, pending] and (roles contains admin or emailDomain eq example.com)
+//	createdDate between [2016-01-01, 2016-12-31T23:59:59Z]
+//
+// Conditions are `<field> <operator> <value>`, where the value is a word, a quoted string,
+// or a list `[a, b]` for `in` and `between`. Conditions are combined with `and`, `or` and parentheses;
+// `and` binds tighter than `or`. Dates are RFC3339 times or `YYYY-MM-DD` dates.
+// Fields and operators are validated against a whitelist, see userFilterFields.
+func ParseUserFilter(filter string) (FilterExpr, error) {
+	if len(filter) > maxFilterLength {
+		return nil, NewMessageError(CodeInvalidFilter, "filter is too long")
+	}
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	expr, err := parser.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, parser.errorf("unexpected `%v`", parser.tokens[parser.pos].text)
+	}
+	return expr, nil
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeFilter(filter string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			i++
+		case strings.ContainsRune("()[],", r):
+			tokens = append(tokens, filterToken{text: string(r)})
+			i++
+		case r == '"':
+			var value []rune
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return nil, NewMessageError(CodeInvalidFilter, "unterminated string")
+			}
+			i++
+			tokens = append(tokens, filterToken{text: string(value), quoted: true})
+		default:
+			start := i
+			for i < len(runes) && !strings.ContainsRune(" \t\n\r()[],\"", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{text: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens     []filterToken
+	pos        int
+	conditions int
+}
+
+func (parser *filterParser) errorf(format string, args ...interface{}) error {
+	return NewMessageError(CodeInvalidFilter, fmt.Sprintf(format, args...))
+}
+
+func (parser *filterParser) peek() *filterToken {
+	if parser.pos < len(parser.tokens) {
+		return &parser.tokens[parser.pos]
+	}
+	return nil
+}
+
+func (parser *filterParser) next() (*filterToken, error) {
+	token := parser.peek()
+	if token == nil {
+		return nil, parser.errorf("unexpected end of filter")
+	}
+	parser.pos++
+	return token, nil
+}
+
+// keyword checks if the next token is the given unquoted keyword and consumes it
+func (parser *filterParser) keyword(keyword string) bool {
+	token := parser.peek()
+	if token != nil && !token.quoted && strings.EqualFold(token.text, keyword) {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *filterParser) parseOr(depth int) (FilterExpr, error) {
+	if depth > maxFilterDepth {
+		return nil, parser.errorf("filter is nested too deeply")
+	}
+	expr, err := parser.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	exprs := FilterOr{expr}
+	for parser.keyword("or") {
+		expr, err = parser.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (parser *filterParser) parseAnd(depth int) (FilterExpr, error) {
+	expr, err := parser.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	exprs := FilterAnd{expr}
+	for parser.keyword("and") {
+		expr, err = parser.parsePrimary(depth)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (parser *filterParser) parsePrimary(depth int) (FilterExpr, error) {
+	token := parser.peek()
+	if token != nil && !token.quoted && token.text == "(" {
+		parser.pos++
+		expr, err := parser.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		token, err := parser.next()
+		if err != nil || token.quoted || token.text != ")" {
+			return nil, parser.errorf("missing `)`")
+		}
+		return expr, nil
+	}
+	return parser.parseCondition()
+}
+
+func (parser *filterParser) parseCondition() (FilterExpr, error) {
+	parser.conditions++
+	if parser.conditions > maxFilterConditions {
+		return nil, parser.errorf("filter has more than %v conditions", maxFilterConditions)
+	}
+
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	name := token.text
+	field, ok := userFilterFields[name]
+	if !ok || token.quoted {
+		return nil, parser.errorf("unknown field `%v`", name)
+	}
+
+	token, err = parser.next()
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(token.text)
+	if !containsString(field.ops, op) {
+		return nil, parser.errorf("operator `%v` is not allowed on `%v`", token.text, name)
+	}
+
+	values, err := parser.parseValues()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case FilterIn:
+		if len(values) == 0 {
+			return nil, parser.errorf("`in` expects a list of values")
+		}
+	case FilterBetween:
+		if len(values) != 2 {
+			return nil, parser.errorf("`between` expects a list of two values")
+		}
+	default:
+		if len(values) != 1 {
+			return nil, parser.errorf("`%v` expects a single value", op)
+		}
+	}
+
+	condition := FilterCondition{Field: name, Op: op}
+	for _, value := range values {
+		if field.values != nil && !containsString(field.values, value) {
+			return nil, parser.errorf("invalid value `%v` for `%v`", value, name)
+		}
+		if !field.date {
+			condition.Values = append(condition.Values, value)
+			continue
+		}
+		t, err := parseFilterDate(value)
+		if err != nil {
+			return nil, parser.errorf("invalid date `%v` for `%v`", value, name)
+		}
+		condition.Values = append(condition.Values, t)
+	}
+	return condition, nil
+}
+
+// parseValues parses a single value, or a list of values
+func (parser *filterParser) parseValues() ([]string, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	if token.quoted || token.text != "[" {
+		if !token.quoted && strings.Contains("()],", token.text) {
+			return nil, parser.errorf("unexpected `%v`", token.text)
+		}
+		return []string{token.text}, nil
+	}
+	values := []string{}
+	for {
+		token, err = parser.next()
+		if err != nil {
+			return nil, err
+		}
+		if !token.quoted && token.text == "]" && len(values) == 0 {
+			return values, nil
+		}
+		if !token.quoted && strings.Contains("()[],", token.text) {
+			return nil, parser.errorf("unexpected `%v`", token.text)
+		}
+		values = append(values, token.text)
+
+		token, err = parser.next()
+		if err != nil {
+			return nil, err
+		}
+		if token.quoted || (token.text != "," && token.text != "]") {
+			return nil, parser.errorf("expected `,` or `]`")
+		}
+		if token.text == "]" {
+			return values, nil
+		}
+	}
+}
+
+func parseFilterDate(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	return t, err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUserFilter(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected FilterExpr
+	}{
+		{"status eq active", FilterCondition{Field: "status", Op: FilterEq, Values: []interface{}{"active"}}},
+		{`username prefix "jo hn"`, FilterCondition{Field: "username", Op: FilterPrefix, Values: []interface{}{"jo hn"}}},
+		{"status IN [active, pending]", FilterCondition{Field: "status", Op: FilterIn, Values: []interface{}{"active", "pending"}}},
+		{"createdDate between [2016-01-01, 2016-12-31T23:59:59Z]", FilterCondition{Field: "createdDate", Op: FilterBetween, Values: []interface{}{
+			time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2016, 12, 31, 23, 59, 59, 0, time.UTC),
+		}}},
+		{"status eq active and (roles contains admin or emailDomain eq example.com)", FilterAnd{
+			FilterCondition{Field: "status", Op: FilterEq, Values: []interface{}{"active"}},
+			FilterOr{
+				FilterCondition{Field: "roles", Op: FilterContains, Values: []interface{}{"admin"}},
+				FilterCondition{Field: "emailDomain", Op: FilterEq, Values: []interface{}{"example.com"}},
+			},
+		}},
+		// `and` binds tighter than `or`
+		{"locale eq en or locale eq es and status eq active", FilterOr{
+			FilterCondition{Field: "locale", Op: FilterEq, Values: []interface{}{"en"}},
+			FilterAnd{
+				FilterCondition{Field: "locale", Op: FilterEq, Values: []interface{}{"es"}},
+				FilterCondition{Field: "status", Op: FilterEq, Values: []interface{}{"active"}},
+			},
+		}},
+	}
+	for _, test := range tests {
+		filter, err := ParseUserFilter(test.filter)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(filter, test.expected) {
+			t.Errorf("%v: expected %#v, got %#v", test.filter, test.expected, filter)
+		}
+	}
+}
+
+func TestParseUserFilterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"unbalanced open paren", "(status eq active"},
+		{"unbalanced close paren", "status eq active)"},
+		{"empty parens", "()"},
+		{"unterminated string", `username eq "john`},
+		{"unknown field", "password eq secret"},
+		{"quoted field", `"status" eq active`},
+		{"unknown operator", "status like active"},
+		{"operator not allowed on field", "username between [a, b]"},
+		{"missing value", "status eq"},
+		{"missing operator", "status"},
+		{"dangling and", "status eq active and"},
+		{"list for a single value", "status eq [active, pending]"},
+		{"empty list", "status in []"},
+		{"between with one value", "createdDate between [2016-01-01]"},
+		{"unterminated list", "status in [active, pending"},
+		{"invalid value", "status eq unknown"},
+		{"invalid date", "createdDate gt yesterday"},
+		{"too long", "username eq " + strings.Repeat("a", maxFilterLength)},
+		{"too many conditions", strings.Repeat("status eq active or ", maxFilterConditions) + "status eq active"},
+		{"nested too deeply", strings.Repeat("(", maxFilterDepth+2) + "status eq active" + strings.Repeat(")", maxFilterDepth+2)},
+	}
+	for _, test := range tests {
+		_, err := ParseUserFilter(test.filter)
+		if messageErr, ok := err.(*MessageError); !ok || messageErr.Code != CodeInvalidFilter {
+			t.Errorf("%v: expected %v, got %v", test.name, CodeInvalidFilter, err)
+		}
+	}
+}
+
+func TestUserFilter(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	admin := newTestUser(StatusActive, RoleAdmin)
+	resource := &Resource{ctx: newTestContext()}
+
+	tests := []struct {
+		name   string
+		params url.Values
+		actor  *User
+		code   string
+		status int
+	}{
+		{"regex", url.Values{"regex": {"true"}, "q": {"^jo"}}, admin, "", 0},
+		{"regex without admin rights", url.Values{"regex": {"true"}, "q": {"^jo"}}, user, CodeRegexForbidden, http.StatusForbidden},
+		{"anonymous regex", url.Values{"regex": {"true"}, "q": {"^jo"}}, nil, CodeRegexForbidden, http.StatusForbidden},
+		{"invalid regex", url.Values{"regex": {"true"}, "q": {"(jo"}}, admin, CodeInvalidRegex, http.StatusBadRequest},
+		{"oversized regex", url.Values{"regex": {"true"}, "q": {strings.Repeat("a", maxRegexLength+1)}}, admin, CodeInvalidRegex, http.StatusBadRequest},
+		{"unknown regex field", url.Values{"regex": {"true"}, "field": {"password"}, "q": {"a"}}, admin, CodeInvalidField, http.StatusBadRequest},
+		{"invalid filter", url.Values{"filter": {"status eq"}}, admin, CodeInvalidFilter, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/users?"+test.params.Encode(), nil)
+		if test.actor != nil {
+			resource.ctx.SetCurrentUserCtx(req, test.actor)
+		}
+		_, err := resource.userFilter(req)
+		if test.code == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if messageErr, ok := err.(*MessageError); !ok || messageErr.Code != test.code {
+			t.Errorf("%v: expected %v, got %v", test.name, test.code, err)
+		}
+		if status := userFilterErrorStatus(err); status != test.status {
+			t.Errorf("%v: expected status %v, got %v", test.name, test.status, status)
+		}
+	}
+}
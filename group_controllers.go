@@ -0,0 +1,339 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+//---- Group Request API v0 ----
+
+type ListGroupsResponse_v0 struct {
+	Groups  Groups `json:"groups"`
+	LastID  string `json:"last_id,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+type CreateGroupRequest_v0 struct {
+	Group Group `json:"group"`
+}
+
+type CreateGroupResponse_v0 struct {
+	Group   Group  `json:"group,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+type GetGroupResponse_v0 struct {
+	Group   Group  `json:"group,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+type UpdateGroupRequest_v0 struct {
+	Group Group `json:"group"`
+}
+
+type UpdateGroupResponse_v0 struct {
+	Group   Group  `json:"group,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+type DeleteGroupResponse_v0 struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+type ListGroupMembersResponse_v0 struct {
+	Users   Users  `json:"users"`
+	LastID  string `json:"last_id,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+type UpdateGroupMemberResponse_v0 struct {
+	GroupID string `json:"groupId,omitempty"`
+	UserID  string `json:"userId,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+// HandleListGroups_v0 lists groups
+func (resource *Resource) HandleListGroups_v0(w http.ResponseWriter, req *http.Request) {
+	repo := resource.GroupRepository(req)
+
+	lastID := req.FormValue("last_id")
+	sort := req.FormValue("sort")
+
+	perPage, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	groups := *repo.FilterGroups(nil, lastID, perPage, sort).(*Groups)
+	if len(groups) > 0 {
+		lastID = groups[len(groups)-1].ID.Hex()
+	}
+	setLastIDPageLinks(w, req, lastID, len(groups), perPage)
+	resource.Render(w, req, http.StatusOK, ListGroupsResponse_v0{
+		Groups:  groups,
+		LastID:  lastID,
+		Code:    CodeGroupsRetrieved,
+		Message: resource.Message(req, CodeGroupsRetrieved),
+		Success: true,
+	})
+}
+
+// HandleCreateGroup_v0 creates a new group
+func (resource *Resource) HandleCreateGroup_v0(w http.ResponseWriter, req *http.Request) {
+	repo := resource.GroupRepository(req)
+
+	var body CreateGroupRequest_v0
+	err := resource.DecodeRequestBody(w, req, &body)
+	if err != nil {
+		return
+	}
+
+	if repo.GroupExistsByName(body.Group.Name) {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeGroupNameExists)
+		return
+	}
+
+	var newGroup = Group{
+		Name:        body.Group.Name,
+		Description: body.Group.Description,
+		Permissions: body.Group.Permissions,
+	}
+	if !newGroup.IsValid() {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidGroup)
+		return
+	}
+
+	err = repo.CreateGroup(&newGroup)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeGroupSaveFailed)
+		return
+	}
+
+	resource.Render(w, req, http.StatusCreated, CreateGroupResponse_v0{
+		Group:   newGroup,
+		Code:    CodeGroupCreated,
+		Message: resource.Message(req, CodeGroupCreated),
+		Success: true,
+	})
+}
+
+// HandleGetGroup_v0 gets group object
+func (resource *Resource) HandleGetGroup_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	repo := resource.GroupRepository(req)
+	_group, err := repo.GetGroupById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeGroupNotFound)
+		return
+	}
+	group := _group.(*Group)
+
+	resource.Render(w, req, http.StatusOK, GetGroupResponse_v0{
+		Group:   *group,
+		Code:    CodeGroupRetrieved,
+		Message: resource.Message(req, CodeGroupRetrieved),
+		Success: true,
+	})
+}
+
+// HandleUpdateGroup_v0 updates group object
+func (resource *Resource) HandleUpdateGroup_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	var body UpdateGroupRequest_v0
+	err := resource.DecodeRequestBody(w, req, &body)
+	if err != nil {
+		return
+	}
+
+	repo := resource.GroupRepository(req)
+	_group, err := repo.UpdateGroup(id, &body.Group)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	group := _group.(*Group)
+
+	resource.Render(w, req, http.StatusOK, UpdateGroupResponse_v0{
+		Group:   *group,
+		Code:    CodeGroupUpdated,
+		Message: resource.Message(req, CodeGroupUpdated),
+		Success: true,
+	})
+}
+
+// HandleDeleteGroup_v0 deletes group object and its memberships
+func (resource *Resource) HandleDeleteGroup_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	// remove memberships first, so that a failure leaves the group to delete again
+	err := resource.ContextUserRepository(req).(IContextGroupUserRepository).RemoveGroupFromUsers(req.Context(), id)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+
+	err = resource.GroupRepository(req).DeleteGroup(id)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	resource.Render(w, req, http.StatusOK, DeleteGroupResponse_v0{
+		Code:    CodeGroupDeleted,
+		Message: resource.Message(req, CodeGroupDeleted),
+		Success: true,
+	})
+}
+
+// HandleListGroupMembers_v0 lists the members of a group
+func (resource *Resource) HandleListGroupMembers_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	_, err := resource.GroupRepository(req).GetGroupById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeGroupNotFound)
+		return
+	}
+
+	lastID := req.FormValue("last_id")
+	sort := req.FormValue("sort")
+
+	perPage, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	_users, err := resource.ContextUserRepository(req).(IContextGroupUserRepository).FilterUsersByGroup(req.Context(), id, lastID, perPage, sort)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	users := *_users.(*Users)
+	if len(users) > 0 {
+		lastID = users[len(users)-1].ID.Hex()
+	}
+	setLastIDPageLinks(w, req, lastID, len(users), perPage)
+	resource.Render(w, req, http.StatusOK, ListGroupMembersResponse_v0{
+		Users:   users,
+		LastID:  lastID,
+		Code:    CodeGroupMembersRetrieved,
+		Message: resource.Message(req, CodeGroupMembersRetrieved),
+		Success: true,
+	})
+}
+
+// HandleAddGroupMember_v0 adds a user to a group
+func (resource *Resource) HandleAddGroupMember_v0(w http.ResponseWriter, req *http.Request) {
+	resource.updateGroupMember(w, req, true)
+}
+
+// HandleRemoveGroupMember_v0 removes a user from a group
+func (resource *Resource) HandleRemoveGroupMember_v0(w http.ResponseWriter, req *http.Request) {
+	resource.updateGroupMember(w, req, false)
+}
+
+func (resource *Resource) updateGroupMember(w http.ResponseWriter, req *http.Request, add bool) {
+	params := mux.Vars(req)
+	id := params["id"]
+	userID := params["user_id"]
+
+	_, err := resource.GroupRepository(req).GetGroupById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeGroupNotFound)
+		return
+	}
+
+	ctx := req.Context()
+	repo := resource.ContextUserRepository(req).(IContextGroupUserRepository)
+	code := CodeGroupMemberAdded
+	route := AddGroupMember
+	eventType := EventGroupMemberAdded
+	change := AuditChange{After: id}
+	if add {
+		err = repo.AddUserToGroup(ctx, userID, id)
+	} else {
+		err = repo.RemoveUserFromGroup(ctx, userID, id)
+		code = CodeGroupMemberRemoved
+		route = RemoveGroupMember
+		eventType = EventGroupMemberRemoved
+		change = AuditChange{Before: id}
+	}
+	if err != nil {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	resource.recordAudit(req, route, userID, map[string]AuditChange{"groups": change})
+
+	event := resource.newEvent(w, req, eventType)
+	event.IDs = []string{userID}
+	event.GroupID = id
+	err = resource.publish(event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	resource.Render(w, req, http.StatusOK, UpdateGroupMemberResponse_v0{
+		GroupID: id,
+		UserID:  userID,
+		Code:    code,
+		Message: resource.Message(req, code),
+		Success: true,
+	})
+}
+
+// HandleListUserGroups_v0 lists the groups of a user
+func (resource *Resource) HandleListUserGroups_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	_user, err := resource.ContextUserRepository(req).GetUserById(req.Context(), id)
+	if err != nil {
+		resource.renderUserLookupError(w, req, http.StatusBadRequest, err)
+		return
+	}
+	user := _user.(*User)
+
+	lastID := req.FormValue("last_id")
+	sort := req.FormValue("sort")
+
+	perPage, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	groups := *resource.GroupRepository(req).FilterGroups(user.GroupIDs(), lastID, perPage, sort).(*Groups)
+	if len(groups) > 0 {
+		lastID = groups[len(groups)-1].ID.Hex()
+	}
+	setLastIDPageLinks(w, req, lastID, len(groups), perPage)
+	resource.Render(w, req, http.StatusOK, ListGroupsResponse_v0{
+		Groups:  groups,
+		LastID:  lastID,
+		Code:    CodeUserGroupsRetrieved,
+		Message: resource.Message(req, CodeUserGroupsRetrieved),
+		Success: true,
+	})
+}
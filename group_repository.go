@@ -0,0 +1,134 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Group collection name
+const GroupsCollection string = "groups"
+
+func NewGroupRepositoryFactory() IGroupRepositoryFactory {
+	return &GroupRepositoryFactory{}
+}
+
+type GroupRepositoryFactory struct{}
+
+func (factory *GroupRepositoryFactory) New(db domain.IDatabase, organizationID string) IGroupRepository {
+	return &GroupRepository{db, organizationID}
+}
+
+type GroupRepository struct {
+	DB             domain.IDatabase
+	OrganizationID string
+}
+
+// scope restricts the query to groups of the repository's organization, if any
+func (repo *GroupRepository) scope(q domain.Query) domain.Query {
+	if repo.OrganizationID != "" {
+		q["organizationId"] = repo.OrganizationID
+	}
+	return q
+}
+
+// CreateGroup Insert new group document into the database
+func (repo *GroupRepository) CreateGroup(_group IGroup) error {
+	group := _group.(*Group)
+	group.ID = bson.NewObjectId()
+	group.OrganizationID = repo.OrganizationID
+	group.CreatedDate = time.Now()
+	group.LastModifiedDate = time.Now()
+	return repo.DB.Insert(GroupsCollection, group)
+}
+
+// FilterGroups Get list of groups, restricted to the given ids if not nil
+func (repo *GroupRepository) FilterGroups(ids []string, lastID string, limit int, sort string) IGroups {
+	groups := Groups{}
+	q := repo.scope(domain.Query{})
+	sort = paginateByID(q, lastID, sort)
+	if ids != nil {
+		objectIds := []bson.ObjectId{}
+		for _, id := range ids {
+			if bson.IsObjectIdHex(id) {
+				objectIds = append(objectIds, bson.ObjectIdHex(id))
+			}
+		}
+		if len(objectIds) == 0 {
+			return &groups
+		}
+		if cursor, ok := q["_id"]; ok {
+			q["$and"] = []domain.Query{
+				domain.Query{"_id": cursor},
+				domain.Query{"_id": domain.Query{"$in": objectIds}},
+			}
+			delete(q, "_id")
+		} else {
+			q["_id"] = domain.Query{"$in": objectIds}
+		}
+	}
+	err := repo.DB.FindAll(GroupsCollection, q, &groups, pageLimit(limit), sort)
+	if err != nil {
+		return &Groups{}
+	}
+	return &groups
+}
+
+// GetGroupById Get group specified by the id
+func (repo *GroupRepository) GetGroupById(id string) (IGroup, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	var group Group
+	err := repo.DB.FindOne(GroupsCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)}), &group)
+	return &group, err
+}
+
+// GroupExistsByName Check if group name already exists
+func (repo *GroupRepository) GroupExistsByName(name string) bool {
+	return repo.DB.Exists(GroupsCollection, repo.scope(domain.Query{"name": name}))
+}
+
+// UpdateGroup Update group specified by the id
+func (repo *GroupRepository) UpdateGroup(id string, _inGroup IGroup) (IGroup, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+
+	inGroup := _inGroup.(*Group)
+
+	// serialize to a sub-set of allowed Group fields to update
+	update := domain.Query{
+		"lastModifiedDate": time.Now(),
+	}
+	if inGroup.Name != "" {
+		update["name"] = inGroup.Name
+	}
+	if inGroup.Description != "" {
+		update["description"] = inGroup.Description
+	}
+	if inGroup.Permissions != nil {
+		update["permissions"] = inGroup.Permissions
+	}
+
+	query := repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)})
+	change := domain.Change{
+		Update:    domain.Query{"$set": update},
+		ReturnNew: true,
+	}
+	var changedGroup Group
+	err := repo.DB.Update(GroupsCollection, query, change, &changedGroup)
+	return &changedGroup, err
+}
+
+// DeleteGroup deletes group specified by the id
+func (repo *GroupRepository) DeleteGroup(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	return repo.DB.RemoveOne(GroupsCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)}))
+}
@@ -0,0 +1,39 @@
+package users
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Group model struct implements IGroup
+type Group struct {
+	ID               bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	Name             string        `json:"name,omitempty" bson:"name"`
+	Description      string        `json:"description,omitempty" bson:"description"`
+	Permissions      []string      `json:"permissions,omitempty" bson:"permissions"`
+	OrganizationID   string        `json:"organizationId,omitempty" bson:"organizationId,omitempty"`
+	LastModifiedDate time.Time     `json:"lastModifiedDate" bson:"lastModifiedDate"`
+	CreatedDate      time.Time     `json:"createdDate,omitempty" bson:"createdDate"`
+}
+
+// Groups struct
+type Groups []Group
+
+func (group *Group) GetID() string {
+	return group.ID.Hex()
+}
+
+// IsValid Ensures that the group object is valid
+func (group *Group) IsValid() bool {
+	return len(group.Name) > 0
+}
+
+// HasPermission checks if the group grants the given permission to its members
+func (group *Group) HasPermission(permission string) bool {
+	for _, p := range group.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
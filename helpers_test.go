@@ -0,0 +1,448 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// testContext is an in-memory domain.IContext keyed by request, like the gorilla context of the host
+type testContext struct {
+	domain.IContext
+	mutex  sync.Mutex
+	values map[*http.Request]map[interface{}]interface{}
+	users  map[*http.Request]domain.IUser
+}
+
+func newTestContext() *testContext {
+	return &testContext{
+		values: map[*http.Request]map[interface{}]interface{}{},
+		users:  map[*http.Request]domain.IUser{},
+	}
+}
+
+func (ctx *testContext) Set(req *http.Request, key interface{}, val interface{}) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.values[req] == nil {
+		ctx.values[req] = map[interface{}]interface{}{}
+	}
+	ctx.values[req][key] = val
+}
+
+func (ctx *testContext) Get(req *http.Request, key interface{}) interface{} {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.values[req][key]
+}
+
+func (ctx *testContext) SetCurrentUserCtx(req *http.Request, user domain.IUser) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.users[req] = user
+}
+
+func (ctx *testContext) GetCurrentUserCtx(req *http.Request) domain.IUser {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.users[req]
+}
+
+// newTestUser returns a user with the given status and roles
+func newTestUser(status string, roles ...Role) *User {
+	return &User{
+		ID:       bson.NewObjectId(),
+		Username: "user",
+		Email:    "user@example.com",
+		Status:   status,
+		Roles:    Roles(roles),
+	}
+}
+
+// testDatabase accepts inserts, for eg: of audit entries; other operations are not supported
+type testDatabase struct {
+	domain.IDatabase
+}
+
+func (db *testDatabase) Insert(name string, obj interface{}) error {
+	return nil
+}
+
+// testRenderer renders JSON responses
+type testRenderer struct{}
+
+func (renderer *testRenderer) Render(w http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// newTestResource returns a resource of the options, with a testDatabase and testRenderer
+func newTestResource(options *Options) *Resource {
+	options.Database = &testDatabase{}
+	options.Renderer = &testRenderer{}
+	options.SkipEnsureSchema = true
+	options.LogLevel = LogLevelError
+	return NewResource(newTestContext(), options)
+}
+
+// newCreateUserRequest returns a request of the CreateUser route
+func newCreateUserRequest(username string, email string) *http.Request {
+	body, _ := json.Marshal(CreateUserRequest_v0{User: NewUser{Username: username, Email: email, Password: "p4ssw0rd"}})
+	return httptest.NewRequest("POST", "/api/users", bytes.NewReader(body))
+}
+
+// memoryUserStore keeps the users of memory user repositories, shared by the organizations
+type memoryUserStore struct {
+	mutex   sync.Mutex
+	users   map[bson.ObjectId]*User
+	lookups int
+}
+
+func newMemoryUserStore(users ...*User) *memoryUserStore {
+	store := &memoryUserStore{users: map[bson.ObjectId]*User{}}
+	for _, user := range users {
+		store.users[user.ID] = copyUser(user)
+	}
+	return store
+}
+
+// memoryUserRepositoryFactory is an IOrganizationUserRepositoryFactory of in-memory repositories of the store
+type memoryUserRepositoryFactory struct {
+	store *memoryUserStore
+}
+
+func (factory *memoryUserRepositoryFactory) New(db domain.IDatabase) IUserRepository {
+	return &memoryUserRepository{factory.store, ""}
+}
+
+func (factory *memoryUserRepositoryFactory) NewForOrganization(db domain.IDatabase, organizationID string) IUserRepository {
+	return &memoryUserRepository{factory.store, organizationID}
+}
+
+// memoryUserRepository is an in-memory IUserRepository and IGroupUserRepository, scoped to an organization if set
+type memoryUserRepository struct {
+	store          *memoryUserStore
+	OrganizationID string
+}
+
+// find returns the users of the repository's organization matching the predicate, sorted by id
+func (repo *memoryUserRepository) find(match func(user *User) bool) Users {
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+	repo.store.lookups++
+	users := Users{}
+	for _, user := range repo.store.users {
+		if repo.OrganizationID != "" && !user.IsMemberOf(repo.OrganizationID) {
+			continue
+		}
+		if match(user) {
+			users = append(users, *copyUser(user))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users
+}
+
+func (repo *memoryUserRepository) findOne(match func(user *User) bool) (domain.IUser, error) {
+	users := repo.find(match)
+	if len(users) == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	return &users[0], nil
+}
+
+// change applies the change to the user specified by the id, if visible from the repository
+func (repo *memoryUserRepository) change(id string, change func(user *User)) (*User, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+	user, ok := repo.store.users[bson.ObjectIdHex(id)]
+	if !ok || (repo.OrganizationID != "" && !user.IsMemberOf(repo.OrganizationID)) {
+		return nil, mgo.ErrNotFound
+	}
+	change(user)
+	user.LastModifiedDate = time.Now()
+	return copyUser(user), nil
+}
+
+func (repo *memoryUserRepository) CreateUser(_user domain.IUser) error {
+	user := _user.(*User)
+	if user.ID == "" {
+		user.ID = bson.NewObjectId()
+	}
+	if repo.OrganizationID != "" && !user.IsMemberOf(repo.OrganizationID) {
+		user.Organizations = append(user.Organizations, Membership{OrganizationID: repo.OrganizationID})
+	}
+	user.CreatedDate = time.Now()
+	user.LastModifiedDate = user.CreatedDate
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+	for _, existing := range repo.store.users {
+		if existing.Username == user.Username || existing.Email == user.Email {
+			return errors.New("E11000 duplicate key error")
+		}
+	}
+	repo.store.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (repo *memoryUserRepository) GetUsers() domain.IUsers {
+	users := repo.find(func(user *User) bool { return true })
+	return &users
+}
+
+func (repo *memoryUserRepository) FilterUsers(field string, query string, cursor string, limit int, sort string) domain.IUsers {
+	users := repo.find(func(user *User) bool {
+		return query == "" || strings.HasPrefix(user.Username, query)
+	})
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return &users
+}
+
+func (repo *memoryUserRepository) CountUsers(field string, query string) int {
+	return len(*repo.FilterUsers(field, query, "", 0, "").(*Users))
+}
+
+func (repo *memoryUserRepository) DeleteUsers(ids []string) error {
+	for _, id := range ids {
+		repo.DeleteUser(id)
+	}
+	return nil
+}
+
+func (repo *memoryUserRepository) DeleteAllUsers() error {
+	for _, user := range repo.find(func(user *User) bool { return true }) {
+		repo.DeleteUser(user.ID.Hex())
+	}
+	return nil
+}
+
+func (repo *memoryUserRepository) GetUserById(id string) (domain.IUser, error) {
+	return repo.findOne(func(user *User) bool { return user.ID.Hex() == id })
+}
+
+func (repo *memoryUserRepository) GetUserByUsername(username string) (domain.IUser, error) {
+	return repo.findOne(func(user *User) bool { return user.Username == username })
+}
+
+func (repo *memoryUserRepository) UserExistsByUsername(username string) bool {
+	_, err := repo.GetUserByUsername(username)
+	return err == nil
+}
+
+func (repo *memoryUserRepository) UserExistsByEmail(email string) bool {
+	_, err := repo.findOne(func(user *User) bool { return user.Email == email })
+	return err == nil
+}
+
+func (repo *memoryUserRepository) UpdateUser(id string, _inUser domain.IUser) (domain.IUser, error) {
+	inUser := _inUser.(*User)
+	return repo.change(id, func(user *User) {
+		if inUser.Username != "" {
+			user.Username = inUser.Username
+		}
+		if inUser.Email != "" {
+			user.Email = inUser.Email
+		}
+		if inUser.Status != "" {
+			user.Status = inUser.Status
+		}
+		if inUser.Roles != nil {
+			user.Roles = append(Roles{}, inUser.Roles...)
+		}
+	})
+}
+
+func (repo *memoryUserRepository) DeleteUser(id string) error {
+	user, err := repo.change(id, func(user *User) {})
+	if err != nil {
+		return err
+	}
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+	delete(repo.store.users, user.ID)
+	return nil
+}
+
+func (repo *memoryUserRepository) FilterUsersByGroup(groupID string, lastID string, limit int, sort string) domain.IUsers {
+	users := repo.find(func(user *User) bool {
+		for _, group := range user.Groups {
+			if group.Hex() == groupID {
+				return true
+			}
+		}
+		return false
+	})
+	return &users
+}
+
+func (repo *memoryUserRepository) AddUserToGroup(id string, groupID string) error {
+	_, err := repo.change(id, func(user *User) {
+		user.Groups = append(user.Groups, bson.ObjectIdHex(groupID))
+	})
+	return err
+}
+
+func (repo *memoryUserRepository) RemoveUserFromGroup(id string, groupID string) error {
+	_, err := repo.change(id, func(user *User) {
+		user.Groups = withoutGroup(user.Groups, groupID)
+	})
+	return err
+}
+
+func (repo *memoryUserRepository) RemoveGroupFromUsers(groupID string) error {
+	for _, user := range *repo.FilterUsersByGroup(groupID, "", 0, "").(*Users) {
+		repo.RemoveUserFromGroup(user.ID.Hex(), groupID)
+	}
+	return nil
+}
+
+func (repo *memoryUserRepository) CreateUserWithOutbox(user domain.IUser, messages ...IOutboxMessage) error {
+	outbox := outboxMessages(messages)
+	err := repo.CreateUser(user)
+	if err != nil {
+		return err
+	}
+	_, err = repo.change(user.(*User).ID.Hex(), func(stored *User) {
+		for i := range outbox {
+			outbox[i].Event.User = copyUser(stored)
+		}
+		stored.Outbox = append(stored.Outbox, outbox...)
+	})
+	return err
+}
+
+func (repo *memoryUserRepository) UpdateUserWithOutbox(id string, inUser domain.IUser, messages ...IOutboxMessage) (domain.IUser, error) {
+	user, err := repo.UpdateUser(id, inUser)
+	if err != nil {
+		return nil, err
+	}
+	outbox := outboxMessages(messages)
+	_, err = repo.change(id, func(stored *User) {
+		for i := range outbox {
+			outbox[i].Event.User = copyUser(stored)
+		}
+		stored.Outbox = append(stored.Outbox, outbox...)
+	})
+	return user, err
+}
+
+// memoryOutboxRepository is an in-memory IOutboxRepository, also its factory, relaying the messages of the user store
+type memoryOutboxRepository struct {
+	mutex    sync.Mutex
+	store    *memoryUserStore
+	messages []*OutboxMessage
+}
+
+func (repo *memoryOutboxRepository) New(db domain.IDatabase, organizationID string) IOutboxRepository {
+	return repo
+}
+
+func (repo *memoryOutboxRepository) Enqueue(message IOutboxMessage) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	copied := *message.(*OutboxMessage)
+	repo.messages = append(repo.messages, &copied)
+	return nil
+}
+
+func (repo *memoryOutboxRepository) GetMessageById(id string) (IOutboxMessage, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, message := range repo.messages {
+		if message.ID.Hex() == id {
+			copied := *message
+			return &copied, nil
+		}
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (repo *memoryOutboxRepository) SaveMessage(_message IOutboxMessage) error {
+	message := _message.(*OutboxMessage)
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for i := range repo.messages {
+		if repo.messages[i].ID == message.ID {
+			copied := *message
+			repo.messages[i] = &copied
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (repo *memoryOutboxRepository) filter(limit int, match func(message *OutboxMessage) bool) IOutboxMessages {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	messages := OutboxMessages{}
+	for _, message := range repo.messages {
+		if match(message) && (limit <= 0 || len(messages) < limit) {
+			messages = append(messages, *message)
+		}
+	}
+	return &messages
+}
+
+func (repo *memoryOutboxRepository) FilterMessages(status string, lastID string, limit int) IOutboxMessages {
+	return repo.filter(limit, func(message *OutboxMessage) bool {
+		return status == "" || message.Status == status
+	})
+}
+
+func (repo *memoryOutboxRepository) DueMessages(now time.Time, limit int) IOutboxMessages {
+	return repo.filter(limit, func(message *OutboxMessage) bool {
+		return message.Status == OutboxPending && !message.NextAttemptDate.After(now)
+	})
+}
+
+func (repo *memoryOutboxRepository) StagedMessages(before time.Time, limit int) IOutboxMessages {
+	return repo.filter(limit, func(message *OutboxMessage) bool {
+		return message.Status == OutboxStaged && message.CreatedDate.Before(before)
+	})
+}
+
+func (repo *memoryOutboxRepository) Relay(id string, limit int) (int, error) {
+	repo.store.mutex.Lock()
+	outbox := []OutboxMessage{}
+	for _, user := range repo.store.users {
+		if id == "" || user.ID.Hex() == id {
+			outbox = append(outbox, user.Outbox...)
+			user.Outbox = nil
+		}
+	}
+	repo.store.mutex.Unlock()
+	for i := range outbox {
+		repo.Enqueue(&outbox[i])
+	}
+	return len(outbox), nil
+}
+
+func withoutGroup(groups []bson.ObjectId, groupID string) []bson.ObjectId {
+	remaining := []bson.ObjectId{}
+	for _, group := range groups {
+		if group.Hex() != groupID {
+			remaining = append(remaining, group)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,433 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message codes, returned as the `code` of every response
+const (
+	CodeRequestFailed      = "request_failed"
+	CodeRequestBodyInvalid = "request_body_invalid"
+	CodeAccessDenied       = "access_denied"
+	CodeHookRejected       = "hook_rejected"
+	CodeInvalidTime        = "invalid_time"
+	CodeInvalidFilter      = "invalid_filter"
+	CodeFilterNotSupported = "filter_not_supported"
+	CodeInvalidCursor      = "invalid_cursor"
+	CodeInvalidPerPage     = "invalid_per_page"
+	CodeInvalidField       = "invalid_field"
+	CodeInvalidRegex       = "invalid_regex"
+	CodeRegexForbidden     = "regex_forbidden"
+	CodeRequestTimeout     = "request_timeout"
+	CodeRequestCanceled    = "request_canceled"
+
+	CodeUsersRetrieved      = "users_retrieved"
+	CodeUsersUpdated        = "users_updated"
+	CodeUsersCounted        = "users_counted"
+	CodeUsersSearched       = "users_searched"
+	CodeInvalidSearch       = "invalid_search"
+	CodeSearchNotSupported  = "search_not_supported"
+	CodeUsersSuggested      = "users_suggested"
+	CodeInvalidSuggest      = "invalid_suggest"
+	CodeSuggestNotSupported = "suggest_not_supported"
+	CodeInvalidAction       = "invalid_action"
+	CodeAllUsersDeleted     = "all_users_deleted"
+	CodeUsernameExists      = "username_exists"
+	CodeEmailExists         = "email_exists"
+	CodeInvalidUser         = "invalid_user"
+	CodeUserSaveFailed      = "user_save_failed"
+	CodeInvalidPassword     = "invalid_password"
+	CodeUserCreated         = "user_created"
+	CodeUserNotPending      = "user_not_pending"
+	CodeInvalidCode         = "invalid_code"
+	CodeUserConfirmed       = "user_confirmed"
+	CodeUserNotFound        = "user_not_found"
+	CodeUserRetrieved       = "user_retrieved"
+	CodeUserUpdated         = "user_updated"
+	CodeUserDeleted         = "user_deleted"
+	CodeCannotRemoveAdmin   = "cannot_remove_admin"
+	CodeCannotUpdateUser    = "cannot_update_user"
+
+	CodeOrganizationNotSpecified = "organization_not_specified"
+	CodeOrganizationForbidden    = "organization_forbidden"
+
+	CodeGroupsRetrieved       = "groups_retrieved"
+	CodeGroupNameExists       = "group_name_exists"
+	CodeInvalidGroup          = "invalid_group"
+	CodeGroupSaveFailed       = "group_save_failed"
+	CodeGroupCreated          = "group_created"
+	CodeGroupNotFound         = "group_not_found"
+	CodeGroupRetrieved        = "group_retrieved"
+	CodeGroupUpdated          = "group_updated"
+	CodeGroupDeleted          = "group_deleted"
+	CodeGroupMembersRetrieved = "group_members_retrieved"
+	CodeGroupMemberAdded      = "group_member_added"
+	CodeGroupMemberRemoved    = "group_member_removed"
+	CodeUserGroupsRetrieved   = "user_groups_retrieved"
+	CodeGroupsNotSupported    = "groups_not_supported"
+
+	CodeImpersonationTokenMalformed    = "impersonation_token_malformed"
+	CodeImpersonationTokenSignature    = "impersonation_token_signature"
+	CodeImpersonationTokenScope        = "impersonation_token_scope"
+	CodeImpersonationTokenExpired      = "impersonation_token_expired"
+	CodeImpersonationTokenNotIssued    = "impersonation_token_not_issued"
+	CodeImpersonationSessionInvalid    = "impersonation_session_invalid"
+	CodeImpersonationSessionInactive   = "impersonation_session_inactive"
+	CodeImpersonatedUserNotFound       = "impersonated_user_not_found"
+	CodeImpersonationDisabled          = "impersonation_disabled"
+	CodeImpersonatorNotFound           = "impersonator_not_found"
+	CodeImpersonateSelf                = "impersonate_self"
+	CodeImpersonateAdmin               = "impersonate_admin"
+	CodeImpersonationSessionSaveFailed = "impersonation_session_save_failed"
+	CodeImpersonationStarted           = "impersonation_started"
+	CodeNotImpersonating               = "not_impersonating"
+	CodeImpersonationStopped           = "impersonation_stopped"
+
+	CodeAuditRetrieved = "audit_retrieved"
+
+	CodeOutboxRetrieved             = "outbox_retrieved"
+	CodeOutboxDisabled              = "outbox_disabled"
+	CodeOutboxMessageNotFound       = "outbox_message_not_found"
+	CodeOutboxMessageNotRetryable   = "outbox_message_not_retryable"
+	CodeOutboxMessageRetryScheduled = "outbox_message_retry_scheduled"
+
+	CodeWebhooksRetrieved          = "webhooks_retrieved"
+	CodeInvalidWebhook             = "invalid_webhook"
+	CodeUnknownEventType           = "unknown_event_type"
+	CodeWebhookSaveFailed          = "webhook_save_failed"
+	CodeWebhookCreated             = "webhook_created"
+	CodeWebhookNotFound            = "webhook_not_found"
+	CodeWebhookRetrieved           = "webhook_retrieved"
+	CodeWebhookUpdated             = "webhook_updated"
+	CodeWebhookDeleted             = "webhook_deleted"
+	CodeWebhookDeliveriesRetrieved = "webhook_deliveries_retrieved"
+	CodeWebhookDeliveryNotFound    = "webhook_delivery_not_found"
+	CodeWebhookDeliveryReplayed    = "webhook_delivery_replayed"
+)
+
+// MessageCatalog maps languages to messages by code.
+// Messages are fmt format strings, formatted with the arguments of the message.
+type MessageCatalog map[string]map[string]string
+
+// DefaultMessageCatalog is used for messages not overridden in Options.Messages
+var DefaultMessageCatalog = MessageCatalog{
+	"en": {
+		CodeRequestFailed:      "%v",
+		CodeRequestBodyInvalid: "Request body parse error: %v",
+		CodeAccessDenied:       "Access denied",
+		CodeHookRejected:       "%v",
+		CodeInvalidTime:        "Invalid `%v` time: %v",
+		CodeInvalidFilter:      "Invalid filter: %v",
+		CodeFilterNotSupported: "Filters are not supported by the user repository",
+		CodeInvalidCursor:      "Invalid cursor",
+		CodeInvalidPerPage:     "`per_page` must be an integer between 1 and %v",
+		CodeInvalidField:       "Field `%v` is not searchable",
+		CodeInvalidRegex:       "Invalid regular expression: %v",
+		CodeRegexForbidden:     "Regular expression search is only available to admins",
+		CodeRequestTimeout:     "The request timed out",
+		CodeRequestCanceled:    "The request was canceled",
+
+		CodeUsersRetrieved:      "User list retrieved",
+		CodeUsersUpdated:        "User list updated",
+		CodeUsersCounted:        "Users count retrieved",
+		CodeUsersSearched:       "User search results retrieved",
+		CodeInvalidSearch:       "`q` must have between 1 and %v characters",
+		CodeSearchNotSupported:  "Search is not supported by the user repository",
+		CodeUsersSuggested:      "User suggestions retrieved",
+		CodeInvalidSuggest:      "`prefix` must have between 1 and %v characters, and `limit` must be between 1 and %v",
+		CodeSuggestNotSupported: "Suggestions are not supported by the user repository",
+		CodeInvalidAction:       "Invalid action",
+		CodeAllUsersDeleted:     "All users deleted",
+		CodeUsernameExists:      "Username already exists",
+		CodeEmailExists:         "User with email address already exists",
+		CodeInvalidUser:         "Invalid user object",
+		CodeUserSaveFailed:      "Failed to save user object",
+		CodeInvalidPassword:     "Invalid password: %v",
+		CodeUserCreated:         "User created",
+		CodeUserNotPending:      "User not pending confirmation",
+		CodeInvalidCode:         "Invalid code",
+		CodeUserConfirmed:       "User confirmed",
+		CodeUserNotFound:        "User not found",
+		CodeUserRetrieved:       "User retrieved",
+		CodeUserUpdated:         "User updated",
+		CodeUserDeleted:         "User deleted",
+		CodeCannotRemoveAdmin:   "Cannot remove an admin from the organization",
+		CodeCannotUpdateUser:    "Cannot update an admin or a member of other organizations",
+
+		CodeOrganizationNotSpecified: "Organization not specified",
+		CodeOrganizationForbidden:    "Not a member of the organization",
+
+		CodeGroupsRetrieved:       "Group list retrieved",
+		CodeGroupNameExists:       "Group name already exists",
+		CodeInvalidGroup:          "Invalid group object",
+		CodeGroupSaveFailed:       "Failed to save group object",
+		CodeGroupCreated:          "Group created",
+		CodeGroupNotFound:         "Group not found",
+		CodeGroupRetrieved:        "Group retrieved",
+		CodeGroupUpdated:          "Group updated",
+		CodeGroupDeleted:          "Group deleted",
+		CodeGroupMembersRetrieved: "Group members retrieved",
+		CodeGroupMemberAdded:      "Group member added",
+		CodeGroupMemberRemoved:    "Group member removed",
+		CodeUserGroupsRetrieved:   "User groups retrieved",
+		CodeGroupsNotSupported:    "Groups are not supported by the user repository",
+
+		CodeImpersonationTokenMalformed:    "Malformed impersonation token",
+		CodeImpersonationTokenSignature:    "Invalid impersonation token signature",
+		CodeImpersonationTokenScope:        "Invalid impersonation token scope",
+		CodeImpersonationTokenExpired:      "Impersonation token expired",
+		CodeImpersonationTokenNotIssued:    "Impersonation token was not issued to current user",
+		CodeImpersonationSessionInvalid:    "Invalid impersonation session",
+		CodeImpersonationSessionInactive:   "Impersonation session is not active",
+		CodeImpersonatedUserNotFound:       "Impersonated user not found",
+		CodeImpersonationDisabled:          "Impersonation is not enabled",
+		CodeImpersonatorNotFound:           "Impersonator not found",
+		CodeImpersonateSelf:                "Cannot impersonate yourself",
+		CodeImpersonateAdmin:               "Cannot impersonate an admin",
+		CodeImpersonationSessionSaveFailed: "Failed to save impersonation session",
+		CodeImpersonationStarted:           "Impersonation started",
+		CodeNotImpersonating:               "Not impersonating user",
+		CodeImpersonationStopped:           "Impersonation stopped",
+
+		CodeAuditRetrieved: "Audit entries retrieved",
+
+		CodeOutboxRetrieved:             "Outbox messages retrieved",
+		CodeOutboxDisabled:              "Outbox is not enabled",
+		CodeOutboxMessageNotFound:       "Outbox message not found",
+		CodeOutboxMessageNotRetryable:   "Outbox message is not pending or dead",
+		CodeOutboxMessageRetryScheduled: "Outbox message scheduled for delivery",
+
+		CodeWebhooksRetrieved:          "Webhook list retrieved",
+		CodeInvalidWebhook:             "Invalid webhook object",
+		CodeUnknownEventType:           "Unknown event type `%v`",
+		CodeWebhookSaveFailed:          "Failed to save webhook object",
+		CodeWebhookCreated:             "Webhook created",
+		CodeWebhookNotFound:            "Webhook not found",
+		CodeWebhookRetrieved:           "Webhook retrieved",
+		CodeWebhookUpdated:             "Webhook updated",
+		CodeWebhookDeleted:             "Webhook deleted",
+		CodeWebhookDeliveriesRetrieved: "Webhook deliveries retrieved",
+		CodeWebhookDeliveryNotFound:    "Webhook delivery not found",
+		CodeWebhookDeliveryReplayed:    "Webhook delivery replayed",
+	},
+	"es": {
+		CodeRequestFailed:      "%v",
+		CodeRequestBodyInvalid: "Error al leer el cuerpo de la solicitud: %v",
+		CodeAccessDenied:       "Acceso denegado",
+		CodeHookRejected:       "%v",
+		CodeInvalidTime:        "Fecha `%v` inválida: %v",
+		CodeInvalidFilter:      "Filtro inválido: %v",
+		CodeFilterNotSupported: "El repositorio de usuarios no admite filtros",
+		CodeInvalidCursor:      "Cursor inválido",
+		CodeInvalidPerPage:     "`per_page` debe ser un entero entre 1 y %v",
+		CodeInvalidField:       "El campo `%v` no se puede buscar",
+		CodeInvalidRegex:       "Expresión regular inválida: %v",
+		CodeRegexForbidden:     "La búsqueda con expresiones regulares solo está disponible para administradores",
+		CodeRequestTimeout:     "La solicitud superó el tiempo de espera",
+		CodeRequestCanceled:    "La solicitud fue cancelada",
+
+		CodeUsersRetrieved:      "Lista de usuarios obtenida",
+		CodeUsersUpdated:        "Lista de usuarios actualizada",
+		CodeUsersCounted:        "Cantidad de usuarios obtenida",
+		CodeUsersSearched:       "Resultados de la búsqueda de usuarios obtenidos",
+		CodeInvalidSearch:       "`q` debe tener entre 1 y %v caracteres",
+		CodeSearchNotSupported:  "El repositorio de usuarios no admite búsquedas",
+		CodeUsersSuggested:      "Sugerencias de usuarios obtenidas",
+		CodeInvalidSuggest:      "`prefix` debe tener entre 1 y %v caracteres, y `limit` debe estar entre 1 y %v",
+		CodeSuggestNotSupported: "El repositorio de usuarios no admite sugerencias",
+		CodeInvalidAction:       "Acción inválida",
+		CodeAllUsersDeleted:     "Todos los usuarios fueron eliminados",
+		CodeUsernameExists:      "El nombre de usuario ya existe",
+		CodeEmailExists:         "Ya existe un usuario con esa dirección de correo",
+		CodeInvalidUser:         "Usuario inválido",
+		CodeUserSaveFailed:      "No se pudo guardar el usuario",
+		CodeInvalidPassword:     "Contraseña inválida: %v",
+		CodeUserCreated:         "Usuario creado",
+		CodeUserNotPending:      "El usuario no está pendiente de confirmación",
+		CodeInvalidCode:         "Código inválido",
+		CodeUserConfirmed:       "Usuario confirmado",
+		CodeUserNotFound:        "Usuario no encontrado",
+		CodeUserRetrieved:       "Usuario obtenido",
+		CodeUserUpdated:         "Usuario actualizado",
+		CodeUserDeleted:         "Usuario eliminado",
+		CodeCannotRemoveAdmin:   "No se puede quitar a un administrador de la organización",
+		CodeCannotUpdateUser:    "No se puede actualizar a un administrador ni a un miembro de otras organizaciones",
+
+		CodeOrganizationNotSpecified: "Organización no especificada",
+		CodeOrganizationForbidden:    "No es miembro de la organización",
+
+		CodeGroupsRetrieved:       "Lista de grupos obtenida",
+		CodeGroupNameExists:       "El nombre del grupo ya existe",
+		CodeInvalidGroup:          "Grupo inválido",
+		CodeGroupSaveFailed:       "No se pudo guardar el grupo",
+		CodeGroupCreated:          "Grupo creado",
+		CodeGroupNotFound:         "Grupo no encontrado",
+		CodeGroupRetrieved:        "Grupo obtenido",
+		CodeGroupUpdated:          "Grupo actualizado",
+		CodeGroupDeleted:          "Grupo eliminado",
+		CodeGroupMembersRetrieved: "Miembros del grupo obtenidos",
+		CodeGroupMemberAdded:      "Miembro agregado al grupo",
+		CodeGroupMemberRemoved:    "Miembro eliminado del grupo",
+		CodeUserGroupsRetrieved:   "Grupos del usuario obtenidos",
+		CodeGroupsNotSupported:    "El repositorio de usuarios no admite grupos",
+
+		CodeImpersonationTokenMalformed:    "Token de suplantación mal formado",
+		CodeImpersonationTokenSignature:    "Firma del token de suplantación inválida",
+		CodeImpersonationTokenScope:        "Alcance del token de suplantación inválido",
+		CodeImpersonationTokenExpired:      "El token de suplantación expiró",
+		CodeImpersonationTokenNotIssued:    "El token de suplantación no fue emitido para el usuario actual",
+		CodeImpersonationSessionInvalid:    "Sesión de suplantación inválida",
+		CodeImpersonationSessionInactive:   "La sesión de suplantación no está activa",
+		CodeImpersonatedUserNotFound:       "Usuario suplantado no encontrado",
+		CodeImpersonationDisabled:          "La suplantación no está habilitada",
+		CodeImpersonatorNotFound:           "Suplantador no encontrado",
+		CodeImpersonateSelf:                "No puedes suplantarte a ti mismo",
+		CodeImpersonateAdmin:               "No se puede suplantar a un administrador",
+		CodeImpersonationSessionSaveFailed: "No se pudo guardar la sesión de suplantación",
+		CodeImpersonationStarted:           "Suplantación iniciada",
+		CodeNotImpersonating:               "No se está suplantando al usuario",
+		CodeImpersonationStopped:           "Suplantación finalizada",
+
+		CodeAuditRetrieved: "Registros de auditoría obtenidos",
+
+		CodeOutboxRetrieved:             "Mensajes del outbox obtenidos",
+		CodeOutboxDisabled:              "El outbox no está habilitado",
+		CodeOutboxMessageNotFound:       "Mensaje del outbox no encontrado",
+		CodeOutboxMessageNotRetryable:   "El mensaje del outbox no está pendiente ni descartado",
+		CodeOutboxMessageRetryScheduled: "Mensaje del outbox programado para entrega",
+
+		CodeWebhooksRetrieved:          "Lista de webhooks obtenida",
+		CodeInvalidWebhook:             "Webhook inválido",
+		CodeUnknownEventType:           "Tipo de evento desconocido `%v`",
+		CodeWebhookSaveFailed:          "No se pudo guardar el webhook",
+		CodeWebhookCreated:             "Webhook creado",
+		CodeWebhookNotFound:            "Webhook no encontrado",
+		CodeWebhookRetrieved:           "Webhook obtenido",
+		CodeWebhookUpdated:             "Webhook actualizado",
+		CodeWebhookDeleted:             "Webhook eliminado",
+		CodeWebhookDeliveriesRetrieved: "Entregas del webhook obtenidas",
+		CodeWebhookDeliveryNotFound:    "Entrega del webhook no encontrada",
+		CodeWebhookDeliveryReplayed:    "Entrega del webhook reenviada",
+	},
+}
+
+// MessageError is an error identified by a message code, rendered in the language of the request
+type MessageError struct {
+	Code string
+	Args []interface{}
+}
+
+func NewMessageError(code string, args ...interface{}) error {
+	return &MessageError{code, args}
+}
+
+// Error returns the message in the default catalog language
+func (err *MessageError) Error() string {
+	return formatMessage(DefaultMessageCatalog["en"][err.Code], err.Code, err.Args)
+}
+
+func formatMessage(format string, code string, args []interface{}) string {
+	if format == "" {
+		format = code
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// compileMessageCatalog merges the overrides onto the DefaultMessageCatalog
+func compileMessageCatalog(overrides MessageCatalog) MessageCatalog {
+	catalog := MessageCatalog{}
+	for _, source := range []MessageCatalog{DefaultMessageCatalog, overrides} {
+		for language, messages := range source {
+			language = normalizeLanguage(language)
+			if catalog[language] == nil {
+				catalog[language] = map[string]string{}
+			}
+			for code, message := range messages {
+				catalog[language][code] = message
+			}
+		}
+	}
+	return catalog
+}
+
+func normalizeLanguage(tag string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header, by descending quality
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+	tags := []weighted{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := normalizeLanguage(fields[0])
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			tags = append(tags, weighted{tag, quality})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].quality > tags[j].quality
+	})
+	result := []string{}
+	for _, t := range tags {
+		result = append(result, t.tag)
+	}
+	return result
+}
+
+// Language negotiates the language of the request's Accept-Language header against the message catalog,
+// falling back to Options.DefaultLanguage
+func (resource *Resource) Language(req *http.Request) string {
+	if req != nil {
+		for _, tag := range parseAcceptLanguage(req.Header.Get("Accept-Language")) {
+			if _, ok := resource.messages[tag]; ok {
+				return tag
+			}
+			if i := strings.Index(tag, "-"); i > 0 {
+				if _, ok := resource.messages[tag[:i]]; ok {
+					return tag[:i]
+				}
+			}
+		}
+	}
+	return resource.defaultLanguage
+}
+
+// Message returns the message of the code in the language of the request
+func (resource *Resource) Message(req *http.Request, code string, args ...interface{}) string {
+	format, ok := resource.messages[resource.Language(req)][code]
+	if !ok {
+		format = resource.messages[resource.defaultLanguage][code]
+	}
+	return formatMessage(format, code, args)
+}
+
+// ErrorMessage returns the code and the message of an error in the language of the request
+func (resource *Resource) ErrorMessage(req *http.Request, err error) (string, string) {
+	if messageErr, ok := err.(*MessageError); ok {
+		return messageErr.Code, resource.Message(req, messageErr.Code, messageErr.Args...)
+	}
+	return CodeRequestFailed, resource.Message(req, CodeRequestFailed, err.Error())
+}
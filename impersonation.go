@@ -0,0 +1,183 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultImpersonationHeader = "X-Impersonation-Token"
+const defaultImpersonationTTL = 15 * time.Minute
+
+// impersonationScope is the only scope issued for impersonation tokens
+const impersonationScope = "impersonation"
+
+// ImpersonatedUser is the user resolved for a request made with an impersonation token.
+// It acts as the target user, while exposing the real actor as Impersonator.
+type ImpersonatedUser struct {
+	*User
+	Impersonator *User
+	SessionID    string
+}
+
+// asUser returns the effective *User of a domain.IUser, or nil
+func asUser(user domain.IUser) *User {
+	switch u := user.(type) {
+	case *User:
+		return u
+	case *ImpersonatedUser:
+		return u.User
+	}
+	return nil
+}
+
+// realActor returns the user actually making the request: the impersonator if impersonating
+func realActor(user domain.IUser) *User {
+	if u, ok := user.(*ImpersonatedUser); ok {
+		return u.Impersonator
+	}
+	return asUser(user)
+}
+
+// ImpersonationClaims are carried by an impersonation token
+type ImpersonationClaims struct {
+	SessionID      string    `json:"jti"`
+	ImpersonatorID string    `json:"act"`
+	TargetID       string    `json:"sub"`
+	Scope          string    `json:"scope"`
+	IssuedAt       time.Time `json:"iat"`
+	ExpiresAt      time.Time `json:"exp"`
+}
+
+// ImpersonationSession records the start and stop of an impersonation.
+// ImpersonationSession implements IImpersonationSession
+type ImpersonationSession struct {
+	ID             bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	ImpersonatorID string        `json:"impersonatorId" bson:"impersonatorId"`
+	TargetID       string        `json:"targetId" bson:"targetId"`
+	IP             string        `json:"ip,omitempty" bson:"ip"`
+	UserAgent      string        `json:"userAgent,omitempty" bson:"userAgent"`
+	StartedDate    time.Time     `json:"startedDate" bson:"startedDate"`
+	ExpiresDate    time.Time     `json:"expiresDate" bson:"expiresDate"`
+	StoppedDate    time.Time     `json:"stoppedDate,omitempty" bson:"stoppedDate,omitempty"`
+}
+
+func (session *ImpersonationSession) GetID() string {
+	return session.ID.Hex()
+}
+
+// IsActive checks that the session has not been stopped or expired
+func (session *ImpersonationSession) IsActive(now time.Time) bool {
+	return session.StoppedDate.IsZero() && now.Before(session.ExpiresDate)
+}
+
+// signImpersonationToken encodes and signs the claims with HMAC-SHA256
+func signImpersonationToken(secret []byte, claims *ImpersonationClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyImpersonationToken checks the signature, scope and expiry of a token and returns its claims
+func verifyImpersonationToken(secret []byte, token string, now time.Time) (*ImpersonationClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, NewMessageError(CodeImpersonationTokenMalformed)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, NewMessageError(CodeImpersonationTokenMalformed)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, NewMessageError(CodeImpersonationTokenSignature)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, NewMessageError(CodeImpersonationTokenMalformed)
+	}
+	var claims ImpersonationClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, NewMessageError(CodeImpersonationTokenMalformed)
+	}
+	if claims.Scope != impersonationScope {
+		return nil, NewMessageError(CodeImpersonationTokenScope)
+	}
+	if !now.Before(claims.ExpiresAt) {
+		return nil, NewMessageError(CodeImpersonationTokenExpired)
+	}
+	return &claims, nil
+}
+
+func (resource *Resource) impersonationHeader() string {
+	if resource.options.ImpersonationHeader != "" {
+		return resource.options.ImpersonationHeader
+	}
+	return defaultImpersonationHeader
+}
+
+func (resource *Resource) impersonationTTL() time.Duration {
+	if resource.options.ImpersonationTTL > 0 {
+		return resource.options.ImpersonationTTL
+	}
+	return defaultImpersonationTTL
+}
+
+// ImpersonationMiddleware resolves requests made with an impersonation token to an ImpersonatedUser.
+// It must run after the middleware that authenticates the current user and before the ACL middleware.
+func (resource *Resource) ImpersonationMiddleware(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	token := req.Header.Get(resource.impersonationHeader())
+	if token == "" || len(resource.options.ImpersonationSecret) == 0 {
+		next(w, req)
+		return
+	}
+
+	claims, err := verifyImpersonationToken(resource.options.ImpersonationSecret, token, time.Now())
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusUnauthorized, err)
+		return
+	}
+
+	// the token is only valid for the admin it was issued to
+	impersonator := asUser(resource.CurrentUser(req))
+	if impersonator == nil || impersonator.ID.Hex() != claims.ImpersonatorID {
+		resource.RenderErrorCode(w, req, http.StatusUnauthorized, CodeImpersonationTokenNotIssued)
+		return
+	}
+
+	session, err := resource.ImpersonationRepository(req).GetSessionById(claims.SessionID)
+	if err != nil || !session.IsActive(time.Now()) {
+		resource.RenderErrorCode(w, req, http.StatusUnauthorized, CodeImpersonationSessionInactive)
+		return
+	}
+
+	_target, err := resource.ContextUserRepository(req).GetUserById(req.Context(), claims.TargetID)
+	if isContextError(err) {
+		resource.RenderErrorFrom(w, req, repositoryErrorStatus(err, http.StatusUnauthorized), err)
+		return
+	}
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusUnauthorized, CodeImpersonatedUserNotFound)
+		return
+	}
+
+	resource.ctx.SetCurrentUserCtx(req, &ImpersonatedUser{
+		User:         _target.(*User),
+		Impersonator: impersonator,
+		SessionID:    claims.SessionID,
+	})
+	next(w, req)
+}
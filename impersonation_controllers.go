@@ -0,0 +1,151 @@
+package users
+
+import (
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"net/http"
+	"time"
+)
+
+//---- Impersonation Request API v0 ----
+
+type StartImpersonationResponse_v0 struct {
+	Token          string    `json:"token,omitempty"`
+	ExpiresAt      time.Time `json:"expiresAt,omitempty"`
+	ImpersonatorID string    `json:"impersonatorId,omitempty"`
+	User           User      `json:"user,omitempty"`
+	Code           string    `json:"code,omitempty"`
+	Message        string    `json:"message,omitempty"`
+	Success        bool      `json:"success"`
+}
+
+type StopImpersonationResponse_v0 struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+// remoteIP returns the IP address of the client
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// HandleStartImpersonation_v0 issues a short-lived token to impersonate a user
+func (resource *Resource) HandleStartImpersonation_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	if len(resource.options.ImpersonationSecret) == 0 {
+		resource.RenderErrorCode(w, req, http.StatusNotImplemented, CodeImpersonationDisabled)
+		return
+	}
+
+	impersonator := realActor(resource.CurrentUser(req))
+	if impersonator == nil {
+		resource.RenderErrorCode(w, req, http.StatusUnauthorized, CodeImpersonatorNotFound)
+		return
+	}
+
+	_target, err := resource.ContextUserRepository(req).GetUserById(req.Context(), id)
+	if err != nil {
+		resource.renderUserLookupError(w, req, http.StatusBadRequest, err)
+		return
+	}
+	target := _target.(*User)
+
+	if target.ID == impersonator.ID {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeImpersonateSelf)
+		return
+	}
+	org, _ := resource.Organization(req)
+	if target.HasRole(RoleAdmin) || (org != "" && target.HasOrganizationRole(org, RoleAdmin)) {
+		resource.RenderErrorCode(w, req, http.StatusForbidden, CodeImpersonateAdmin)
+		return
+	}
+
+	now := time.Now()
+	session := ImpersonationSession{
+		ID:             bson.NewObjectId(),
+		ImpersonatorID: impersonator.ID.Hex(),
+		TargetID:       target.ID.Hex(),
+		IP:             remoteIP(req),
+		UserAgent:      req.UserAgent(),
+		ExpiresDate:    now.Add(resource.impersonationTTL()),
+	}
+	err = resource.ImpersonationRepository(req).CreateSession(&session)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeImpersonationSessionSaveFailed)
+		return
+	}
+
+	token, err := signImpersonationToken(resource.options.ImpersonationSecret, &ImpersonationClaims{
+		SessionID:      session.ID.Hex(),
+		ImpersonatorID: session.ImpersonatorID,
+		TargetID:       session.TargetID,
+		Scope:          impersonationScope,
+		IssuedAt:       now,
+		ExpiresAt:      session.ExpiresDate,
+	})
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	resource.recordAudit(req, StartImpersonation, session.TargetID, nil)
+
+	event := resource.newEvent(w, req, EventImpersonationStarted)
+	event.User = target
+	err = resource.publish(event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	resource.Render(w, req, http.StatusCreated, StartImpersonationResponse_v0{
+		Token:          token,
+		ExpiresAt:      session.ExpiresDate,
+		ImpersonatorID: session.ImpersonatorID,
+		User:           *target,
+		Code:           CodeImpersonationStarted,
+		Message:        resource.Message(req, CodeImpersonationStarted),
+		Success:        true,
+	})
+}
+
+// HandleStopImpersonation_v0 stops the impersonation of a user.
+// The request is expected to be made with the impersonation token.
+func (resource *Resource) HandleStopImpersonation_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	impersonated, ok := resource.CurrentUser(req).(*ImpersonatedUser)
+	if !ok || impersonated.ID.Hex() != id {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeNotImpersonating)
+		return
+	}
+
+	_, err := resource.ImpersonationRepository(req).StopSession(impersonated.SessionID)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	resource.recordAudit(req, StopImpersonation, id, nil)
+
+	event := resource.newEvent(w, req, EventImpersonationStopped)
+	event.User = impersonated.User
+	err = resource.publish(event)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	resource.Render(w, req, http.StatusOK, StopImpersonationResponse_v0{
+		Code:    CodeImpersonationStopped,
+		Message: resource.Message(req, CodeImpersonationStopped),
+		Success: true,
+	})
+}
@@ -0,0 +1,61 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+func NewImpersonationRepositoryFactory() IImpersonationRepositoryFactory {
+	return &ImpersonationRepositoryFactory{}
+}
+
+// Impersonation session collection name
+const ImpersonationsCollection string = "impersonations"
+
+type ImpersonationRepositoryFactory struct{}
+
+func (factory *ImpersonationRepositoryFactory) New(db domain.IDatabase) IImpersonationRepository {
+	return &ImpersonationRepository{db}
+}
+
+type ImpersonationRepository struct {
+	DB domain.IDatabase
+}
+
+// CreateSession records the start of an impersonation
+func (repo *ImpersonationRepository) CreateSession(_session IImpersonationSession) error {
+	session := _session.(*ImpersonationSession)
+	if session.ID == "" {
+		session.ID = bson.NewObjectId()
+	}
+	session.StartedDate = time.Now()
+	return repo.DB.Insert(ImpersonationsCollection, session)
+}
+
+// GetSessionById Get impersonation session specified by the id
+func (repo *ImpersonationRepository) GetSessionById(id string) (IImpersonationSession, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, NewMessageError(CodeImpersonationSessionInvalid)
+	}
+	var session ImpersonationSession
+	err := repo.DB.FindOne(ImpersonationsCollection, domain.Query{"_id": bson.ObjectIdHex(id)}, &session)
+	return &session, err
+}
+
+// StopSession records the stop of an impersonation
+func (repo *ImpersonationRepository) StopSession(id string) (IImpersonationSession, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, NewMessageError(CodeImpersonationSessionInvalid)
+	}
+	query := domain.Query{"_id": bson.ObjectIdHex(id)}
+	change := domain.Change{
+		Update:    domain.Query{"$set": domain.Query{"stoppedDate": time.Now()}},
+		ReturnNew: true,
+	}
+	var session ImpersonationSession
+	err := repo.DB.Update(ImpersonationsCollection, query, change, &session)
+	return &session, err
+}
@@ -0,0 +1,255 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"context"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"github.com/twinj/uuid"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogLevel is the severity of log events, with the values of slog.Level
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = -4
+	LogLevelInfo  LogLevel = 0
+	LogLevelWarn  LogLevel = 4
+	LogLevelError LogLevel = 8
+)
+
+func (level LogLevel) String() string {
+	switch {
+	case level < LogLevelInfo:
+		return "DEBUG"
+	case level < LogLevelWarn:
+		return "INFO"
+	case level < LogLevelError:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// defaultRequestIDHeader carries the ID of requests, see Resource.RequestID
+const defaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the request IDs accepted from clients
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// redactedLogValue replaces the values of sensitive keys in log events
+const redactedLogValue = "[REDACTED]"
+
+// sensitiveLogKeys are redacted from log events, compared in lowercase
+var sensitiveLogKeys = map[string]bool{
+	"password":         true,
+	"hashedpassword":   true,
+	"code":             true,
+	"confirmationcode": true,
+	"token":            true,
+	"secret":           true,
+}
+
+// Logger writes the log events of the resource from its level to an ILogger,
+// redacting the values of sensitive keys such as passwords and confirmation codes
+type Logger struct {
+	logger ILogger
+	level  LogLevel
+}
+
+// NewLogger returns a Logger writing to the standard log package if logger is nil
+func NewLogger(logger ILogger, level LogLevel) *Logger {
+	if logger == nil {
+		logger = &StdLogger{}
+	}
+	return &Logger{logger, level}
+}
+
+// Enabled returns true if events of the level are logged
+func (logger *Logger) Enabled(level LogLevel) bool {
+	return level >= logger.level
+}
+
+// Log writes the event if its level is enabled
+func (logger *Logger) Log(ctx context.Context, level LogLevel, msg string, args ...interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+	args = redactLogArgs(args)
+	switch {
+	case level < LogLevelInfo:
+		logger.logger.DebugContext(ctx, msg, args...)
+	case level < LogLevelWarn:
+		logger.logger.InfoContext(ctx, msg, args...)
+	case level < LogLevelError:
+		logger.logger.WarnContext(ctx, msg, args...)
+	default:
+		logger.logger.ErrorContext(ctx, msg, args...)
+	}
+}
+
+func (logger *Logger) Debug(msg string, args ...interface{}) {
+	logger.Log(context.Background(), LogLevelDebug, msg, args...)
+}
+
+func (logger *Logger) Info(msg string, args ...interface{}) {
+	logger.Log(context.Background(), LogLevelInfo, msg, args...)
+}
+
+func (logger *Logger) Warn(msg string, args ...interface{}) {
+	logger.Log(context.Background(), LogLevelWarn, msg, args...)
+}
+
+func (logger *Logger) Error(msg string, args ...interface{}) {
+	logger.Log(context.Background(), LogLevelError, msg, args...)
+}
+
+// redactLogArgs returns the key-value pairs with the values of sensitive keys redacted
+func redactLogArgs(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	copy(redacted, args)
+	for i := 0; i+1 < len(redacted); i += 2 {
+		if key, ok := redacted[i].(string); ok && sensitiveLogKeys[strings.ToLower(key)] {
+			redacted[i+1] = redactedLogValue
+		}
+	}
+	return redacted
+}
+
+// StdLogger is the default ILogger, writing events with the standard log package
+// as `LEVEL message key=value...`
+type StdLogger struct{}
+
+func (logger *StdLogger) DebugContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.write(LogLevelDebug, msg, args)
+}
+
+func (logger *StdLogger) InfoContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.write(LogLevelInfo, msg, args)
+}
+
+func (logger *StdLogger) WarnContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.write(LogLevelWarn, msg, args)
+}
+
+func (logger *StdLogger) ErrorContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.write(LogLevelError, msg, args)
+}
+
+func (logger *StdLogger) write(level LogLevel, msg string, args []interface{}) {
+	parts := []string{level.String(), msg}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			parts = append(parts, fmt.Sprintf("!BADKEY=%v", args[i]))
+			break
+		}
+		value := fmt.Sprint(args[i+1])
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		parts = append(parts, fmt.Sprintf("%v=%v", args[i], value))
+	}
+	log.Println(strings.Join(parts, " "))
+}
+
+// RequestID returns the ID of the request, taken from the Options.RequestIDHeader header or generated
+func (resource *Resource) RequestID(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	if id, ok := resource.ctx.Get(req, requestIDKey{}).(string); ok {
+		return id
+	}
+	id := req.Header.Get(resource.requestIDHeader)
+	if !isValidRequestID(id) {
+		id = uuid.NewV4().String()
+	}
+	resource.ctx.Set(req, requestIDKey{}, id)
+	return id
+}
+
+// isValidRequestID returns true if the ID of a client is short and printable
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequest writes a request event with the request ID, route, user and the given key-value pairs
+func (resource *Resource) logRequest(req *http.Request, level LogLevel, msg string, args ...interface{}) {
+	if !resource.Logger.Enabled(level) {
+		return
+	}
+	args = append([]interface{}{"request_id", resource.RequestID(req)}, args...)
+	if user := asUser(resource.CurrentUser(req)); user != nil {
+		args = append(args, "user_id", user.ID.Hex())
+	}
+	resource.Logger.Log(req.Context(), level, msg, args...)
+}
+
+// logRepositoryError writes the error of a user repository operation of a request:
+// done contexts are warnings, and users not found are only logged for debugging
+func (resource *Resource) logRepositoryError(req *http.Request, operation string, err error, duration time.Duration) {
+	level := LogLevelError
+	if isContextError(err) {
+		level = LogLevelWarn
+	} else if err == mgo.ErrNotFound {
+		level = LogLevelDebug
+	}
+	resource.logRequest(req, level, "users: repository operation failed",
+		"operation", operation,
+		"error", err.Error(),
+		"duration_ms", duration.Seconds()*1000,
+	)
+}
+
+// wrapLoggingRouteHandlers returns route handlers setting the request ID on responses,
+// and logging the outcome of the requests of the route
+func (resource *Resource) wrapLoggingRouteHandlers(name string, handlers domain.RouteHandlers) domain.RouteHandlers {
+	wrapped := domain.RouteHandlers{}
+	for version, handler := range handlers {
+		next := handler
+		v := version
+		wrapped[version] = func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			w.Header().Set(resource.requestIDHeader, resource.RequestID(req))
+			recorder := &statusRecorder{ResponseWriter: w}
+			next(recorder, req)
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := LogLevelInfo
+			switch {
+			case status >= http.StatusInternalServerError:
+				level = LogLevelError
+			case status >= http.StatusBadRequest:
+				level = LogLevelWarn
+			}
+			// the query is left out, it may hold confirmation codes
+			resource.logRequest(req, level, "users: request handled",
+				"route", name,
+				"version", v,
+				"method", req.Method,
+				"path", req.URL.Path,
+				"status", status,
+				"duration_ms", time.Since(start).Seconds()*1000,
+			)
+		}
+	}
+	return wrapped
+}
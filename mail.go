@@ -0,0 +1,271 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Mail template names
+const (
+	MailConfirmation  = "confirmation"
+	MailPasswordReset = "password_reset"
+	MailEmailChange   = "email_change"
+	MailSuspension    = "suspension"
+)
+
+// MailTemplate holds the text/template sources of the subject and text body,
+// and the html/template source of the HTML body of an email.
+// Templates are executed with MailData.
+type MailTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// MailTemplates maps locales to templates by name
+type MailTemplates map[string]map[string]MailTemplate
+
+// MailData is passed to mail templates
+type MailData struct {
+	User          *User
+	Link          string
+	PreviousEmail string
+	ProductName   string
+}
+
+// DefaultMailTemplates are used for templates not overridden in MailOptions.Templates
+var DefaultMailTemplates = MailTemplates{
+	"en": {
+		MailConfirmation: {
+			Subject: "Confirm your {{.ProductName}} account",
+			Text:    "Hi {{.User.Username}},\n\nPlease confirm your email address by opening the link below:\n\n{{.Link}}\n",
+			HTML:    `<p>Hi {{.User.Username}},</p><p>Please confirm your email address by clicking the link below:</p><p><a href="{{.Link}}">Confirm my account</a></p>`,
+		},
+		MailPasswordReset: {
+			Subject: "Reset your {{.ProductName}} password",
+			Text:    "Hi {{.User.Username}},\n\nYou can reset your password by opening the link below:\n\n{{.Link}}\n\nIf you did not request a password reset, you can ignore this email.\n",
+			HTML:    `<p>Hi {{.User.Username}},</p><p>You can reset your password by clicking the link below:</p><p><a href="{{.Link}}">Reset my password</a></p><p>If you did not request a password reset, you can ignore this email.</p>`,
+		},
+		MailEmailChange: {
+			Subject: "Your {{.ProductName}} email address was changed",
+			Text:    "Hi {{.User.Username}},\n\nThe email address of your account was changed from {{.PreviousEmail}} to {{.User.Email}}.\n\nIf you did not make this change, please contact support.\n",
+			HTML:    `<p>Hi {{.User.Username}},</p><p>The email address of your account was changed from {{.PreviousEmail}} to {{.User.Email}}.</p><p>If you did not make this change, please contact support.</p>`,
+		},
+		MailSuspension: {
+			Subject: "Your {{.ProductName}} account was suspended",
+			Text:    "Hi {{.User.Username}},\n\nYour account was suspended. Please contact support for more information.\n",
+			HTML:    `<p>Hi {{.User.Username}},</p><p>Your account was suspended. Please contact support for more information.</p>`,
+		},
+	},
+	"es": {
+		MailConfirmation: {
+			Subject: "Confirma tu cuenta de {{.ProductName}}",
+			Text:    "Hola {{.User.Username}},\n\nConfirma tu dirección de correo abriendo el siguiente enlace:\n\n{{.Link}}\n",
+			HTML:    `<p>Hola {{.User.Username}},</p><p>Confirma tu dirección de correo haciendo clic en el siguiente enlace:</p><p><a href="{{.Link}}">Confirmar mi cuenta</a></p>`,
+		},
+		MailPasswordReset: {
+			Subject: "Restablece tu contraseña de {{.ProductName}}",
+			Text:    "Hola {{.User.Username}},\n\nPuedes restablecer tu contraseña abriendo el siguiente enlace:\n\n{{.Link}}\n\nSi no solicitaste restablecer tu contraseña, ignora este correo.\n",
+			HTML:    `<p>Hola {{.User.Username}},</p><p>Puedes restablecer tu contraseña haciendo clic en el siguiente enlace:</p><p><a href="{{.Link}}">Restablecer mi contraseña</a></p><p>Si no solicitaste restablecer tu contraseña, ignora este correo.</p>`,
+		},
+		MailEmailChange: {
+			Subject: "La dirección de correo de tu cuenta de {{.ProductName}} cambió",
+			Text:    "Hola {{.User.Username}},\n\nLa dirección de correo de tu cuenta cambió de {{.PreviousEmail}} a {{.User.Email}}.\n\nSi no hiciste este cambio, contacta a soporte.\n",
+			HTML:    `<p>Hola {{.User.Username}},</p><p>La dirección de correo de tu cuenta cambió de {{.PreviousEmail}} a {{.User.Email}}.</p><p>Si no hiciste este cambio, contacta a soporte.</p>`,
+		},
+		MailSuspension: {
+			Subject: "Tu cuenta de {{.ProductName}} fue suspendida",
+			Text:    "Hola {{.User.Username}},\n\nTu cuenta fue suspendida. Contacta a soporte para más información.\n",
+			HTML:    `<p>Hola {{.User.Username}},</p><p>Tu cuenta fue suspendida. Contacta a soporte para más información.</p>`,
+		},
+	},
+}
+
+type MailOptions struct {
+	// Mailer sends the emails, for eg: SMTPMailer, LogMailer or FileMailer
+	Mailer IMailer
+	// From address of the emails
+	From string
+	// BaseURL is prepended to Options.BasePath in links, for eg: `https://example.com`
+	BaseURL     string
+	ProductName string
+	// DefaultLocale is used for users without a locale, or without templates for their locale; defaults to `en`
+	DefaultLocale string
+	// Templates override DefaultMailTemplates per locale and name
+	Templates MailTemplates
+}
+
+type compiledMailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// MailNotifier renders and sends notification emails for user lifecycle events.
+// It sends the confirmation link when a user is created, notifies the previous address when
+// the email address of a user is changed, and notifies users when they are suspended.
+type MailNotifier struct {
+	resource  *Resource
+	options   MailOptions
+	templates map[string]map[string]*compiledMailTemplate
+}
+
+func NewMailNotifier(resource *Resource, options *MailOptions) (*MailNotifier, error) {
+	if options.Mailer == nil {
+		return nil, errors.New("Mailer is required")
+	}
+	notifier := &MailNotifier{
+		resource:  resource,
+		options:   *options,
+		templates: map[string]map[string]*compiledMailTemplate{},
+	}
+	if notifier.options.DefaultLocale == "" {
+		notifier.options.DefaultLocale = "en"
+	}
+
+	for _, templates := range []MailTemplates{DefaultMailTemplates, options.Templates} {
+		for locale, named := range templates {
+			for name, template := range named {
+				compiled, err := compileMailTemplate(locale+"/"+name, template)
+				if err != nil {
+					return nil, err
+				}
+				if notifier.templates[locale] == nil {
+					notifier.templates[locale] = map[string]*compiledMailTemplate{}
+				}
+				notifier.templates[locale][name] = compiled
+			}
+		}
+	}
+	if notifier.templates[notifier.options.DefaultLocale] == nil {
+		return nil, errors.New(fmt.Sprintf("No mail templates for default locale `%v`", notifier.options.DefaultLocale))
+	}
+	return notifier, nil
+}
+
+func compileMailTemplate(name string, template MailTemplate) (*compiledMailTemplate, error) {
+	subject, err := texttemplate.New(name + "/subject").Parse(template.Subject)
+	if err != nil {
+		return nil, err
+	}
+	text, err := texttemplate.New(name + "/text").Parse(template.Text)
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.New(name + "/html").Parse(template.HTML)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledMailTemplate{subject, text, html}, nil
+}
+
+// template returns the named template for the locale, falling back to its base language
+// (for eg: `es` for `es-MX`) and the default locale
+func (notifier *MailNotifier) template(locale string, name string) *compiledMailTemplate {
+	locale = strings.ToLower(strings.Replace(locale, "_", "-", -1))
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, notifier.options.DefaultLocale)
+	for _, candidate := range candidates {
+		if template, ok := notifier.templates[candidate][name]; ok {
+			return template
+		}
+	}
+	return nil
+}
+
+// Send renders the named template in the user's locale and sends it to the given address
+func (notifier *MailNotifier) Send(name string, to string, data *MailData) error {
+	template := notifier.template(data.User.Locale, name)
+	if template == nil {
+		return errors.New(fmt.Sprintf("Mail template not found: `%v`", name))
+	}
+	data.ProductName = notifier.options.ProductName
+
+	var subject, text, html bytes.Buffer
+	err := template.subject.Execute(&subject, data)
+	if err != nil {
+		return err
+	}
+	err = template.text.Execute(&text, data)
+	if err != nil {
+		return err
+	}
+	err = template.html.Execute(&html, data)
+	if err != nil {
+		return err
+	}
+	return notifier.options.Mailer.Send(&MailMessage{
+		From:    notifier.options.From,
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+}
+
+// ConfirmationLink returns the link to the ConfirmUser route for the user
+func (notifier *MailNotifier) ConfirmationLink(user *User) string {
+	basePath := notifier.resource.options.BasePath
+	if basePath == "" {
+		basePath = defaultBasePath
+	}
+	return fmt.Sprintf("%v%v/%v/confirm?code=%v", strings.TrimSuffix(notifier.options.BaseURL, "/"), basePath, user.ID.Hex(), url.QueryEscape(user.ConfirmationCode))
+}
+
+func (notifier *MailNotifier) SendConfirmation(user *User) error {
+	return notifier.Send(MailConfirmation, user.Email, &MailData{
+		User: user,
+		Link: notifier.ConfirmationLink(user),
+	})
+}
+
+// SendPasswordReset sends the password reset link, which is provided by the host app
+func (notifier *MailNotifier) SendPasswordReset(user *User, link string) error {
+	return notifier.Send(MailPasswordReset, user.Email, &MailData{
+		User: user,
+		Link: link,
+	})
+}
+
+// SendEmailChange notifies the previous email address of the user
+func (notifier *MailNotifier) SendEmailChange(previous *User, user *User) error {
+	return notifier.Send(MailEmailChange, previous.Email, &MailData{
+		User:          user,
+		PreviousEmail: previous.Email,
+	})
+}
+
+func (notifier *MailNotifier) SendSuspension(user *User) error {
+	return notifier.Send(MailSuspension, user.Email, &MailData{
+		User: user,
+	})
+}
+
+// HandleEvent is subscribed to the event bus
+func (notifier *MailNotifier) HandleEvent(resource *Resource, event *Event) error {
+	switch event.Type {
+	case EventUserCreated:
+		if event.User != nil && event.User.Status == StatusPending && event.User.ConfirmationCode != "" {
+			return notifier.SendConfirmation(event.User)
+		}
+	case EventUserUpdated:
+		if event.User != nil && event.Previous != nil && event.Previous.Email != event.User.Email {
+			return notifier.SendEmailChange(event.Previous, event.User)
+		}
+	case EventStatusChanged:
+		if event.User != nil && event.User.Status == StatusSuspended {
+			return notifier.SendSuspension(event.User)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SMTPMailer sends emails through an SMTP server. SMTPMailer implements IMailer
+type SMTPMailer struct {
+	// Addr of the SMTP server, for eg: `smtp.example.com:587`
+	Addr string
+	// Auth is optional, for eg: smtp.PlainAuth("", username, password, host)
+	Auth smtp.Auth
+}
+
+func NewSMTPMailer(addr string, auth smtp.Auth) *SMTPMailer {
+	return &SMTPMailer{addr, auth}
+}
+
+func (mailer *SMTPMailer) Send(message *MailMessage) error {
+	body, err := encodeMailMessage(message)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(mailer.Addr, mailer.Auth, message.From, []string{message.To}, body)
+}
+
+// LogMailer logs emails instead of sending them, for eg: in development. LogMailer implements IMailer
+type LogMailer struct{}
+
+func NewLogMailer() *LogMailer {
+	return &LogMailer{}
+}
+
+func (mailer *LogMailer) Send(message *MailMessage) error {
+	log.Println(fmt.Sprintf("LogMailer: to: %v, subject: %v\n%v", message.To, message.Subject, message.Text))
+	return nil
+}
+
+// FileMailer writes emails as `.eml` files to a directory, for eg: in tests. FileMailer implements IMailer
+type FileMailer struct {
+	Dir string
+}
+
+func NewFileMailer(dir string) *FileMailer {
+	return &FileMailer{dir}
+}
+
+func (mailer *FileMailer) Send(message *MailMessage) error {
+	body, err := encodeMailMessage(message)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(mailer.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%v-%v.eml", time.Now().UnixNano(), strings.Replace(message.To, "@", "_at_", -1))
+	return ioutil.WriteFile(filepath.Join(mailer.Dir, filepath.Base(name)), body, 0644)
+}
+
+// encodeMailMessage encodes the message as a multipart/alternative MIME message
+func encodeMailMessage(message *MailMessage) ([]byte, error) {
+	if message.To == "" || strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.From, "\r\n") {
+		return nil, errors.New(fmt.Sprintf("Invalid mail address: `%v`", message.To))
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %v\r\n", message.From)
+	fmt.Fprintf(&buf, "To: %v\r\n", message.To)
+	fmt.Fprintf(&buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%v\r\n\r\n", writer.Boundary())
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", message.Text},
+		{"text/html; charset=utf-8", message.HTML},
+	}
+	for _, part := range parts {
+		if part.content == "" {
+			continue
+		}
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		_, err = qp.Write([]byte(part.content))
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
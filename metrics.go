@@ -0,0 +1,290 @@
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the latency histograms
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricsOptions enables the instrumentation of the resource, see Metrics
+type MetricsOptions struct {
+	// Namespace prefixes the metric names, defaults to `users`
+	Namespace string
+	// Buckets of the latency histograms, default to DefaultLatencyBuckets
+	Buckets []float64
+}
+
+// Metrics instruments the routes, the user lifecycle and the user repository operations of requests.
+// It is an http.Handler exposing the metrics in the Prometheus text format, to be mounted by the application.
+//
+// Requests denied by the ACL middleware never reach the route handlers, and are only counted
+// if Options.ACLRenderDenials is set.
+type Metrics struct {
+	requests           *metricFamily
+	requestDuration    *metricFamily
+	usersCreated       *metricFamily
+	usersConfirmed     *metricFamily
+	usersSuspended     *metricFamily
+	usersDeleted       *metricFamily
+	repositoryDuration *metricFamily
+}
+
+func NewMetrics(options *MetricsOptions) *Metrics {
+	namespace := options.Namespace
+	if namespace == "" {
+		namespace = "users"
+	}
+	buckets := options.Buckets
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		requests: newMetricFamily(namespace+"_http_requests_total", "counter",
+			"Requests handled by route, method and status code.", nil, "route", "method", "status"),
+		requestDuration: newMetricFamily(namespace+"_http_request_duration_seconds", "histogram",
+			"Latency of the requests by route and method.", buckets, "route", "method"),
+		usersCreated: newMetricFamily(namespace+"_created_total", "counter",
+			"Users created.", nil),
+		usersConfirmed: newMetricFamily(namespace+"_confirmed_total", "counter",
+			"Users who confirmed their email address.", nil),
+		usersSuspended: newMetricFamily(namespace+"_suspended_total", "counter",
+			"Users suspended.", nil),
+		usersDeleted: newMetricFamily(namespace+"_deleted_total", "counter",
+			"Users deleted, one at a time or in bulk. Deleting all users is not counted.", nil),
+		repositoryDuration: newMetricFamily(namespace+"_repository_operation_duration_seconds", "histogram",
+			"Latency of the user repository operations of requests by operation and result.", buckets, "operation", "result"),
+	}
+}
+
+// ObserveRequest records a request handled by the route
+func (metrics *Metrics) ObserveRequest(route string, method string, status int, duration time.Duration) {
+	metrics.requests.add(1, route, method, strconv.Itoa(status))
+	metrics.requestDuration.observe(duration.Seconds(), route, method)
+}
+
+// ObserveRepositoryOperation records a user repository operation, with the `error` result if it failed
+func (metrics *Metrics) ObserveRepositoryOperation(operation string, err error, duration time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metrics.repositoryDuration.observe(duration.Seconds(), operation, result)
+}
+
+// HandleEvent counts the user lifecycle events
+func (metrics *Metrics) HandleEvent(resource *Resource, event *Event) error {
+	switch event.Type {
+	case EventUserCreated:
+		metrics.usersCreated.add(1)
+	case EventUserConfirmed:
+		metrics.usersConfirmed.add(1)
+	case EventUserDeleted:
+		metrics.usersDeleted.add(1)
+	case EventStatusChanged:
+		if event.User != nil && event.User.Status == StatusSuspended {
+			metrics.usersSuspended.add(1)
+		}
+	}
+	return nil
+}
+
+// Write writes the metrics in the Prometheus text format
+func (metrics *Metrics) Write(w io.Writer) error {
+	buffer := bufio.NewWriter(w)
+	for _, family := range []*metricFamily{
+		metrics.requests,
+		metrics.requestDuration,
+		metrics.usersCreated,
+		metrics.usersConfirmed,
+		metrics.usersSuspended,
+		metrics.usersDeleted,
+		metrics.repositoryDuration,
+	} {
+		family.write(buffer)
+	}
+	return buffer.Flush()
+}
+
+// ServeHTTP exposes the metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Write(w)
+}
+
+// metricFamily is a counter or a histogram, with a series per combination of label values
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	buckets []float64
+	labels  []string
+	mutex   sync.Mutex
+	series  map[string]*metricSeries
+}
+
+// metricSeries holds the value of a counter, or the sum, count and bucket counts of a histogram
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	count       uint64
+	buckets     []uint64
+}
+
+func newMetricFamily(name string, kind string, help string, buckets []float64, labels ...string) *metricFamily {
+	return &metricFamily{
+		name:    name,
+		kind:    kind,
+		help:    help,
+		buckets: buckets,
+		labels:  labels,
+		series:  map[string]*metricSeries{},
+	}
+}
+
+// get returns the series of the label values, the caller holds the mutex
+func (family *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{
+			labelValues: labelValues,
+			buckets:     make([]uint64, len(family.buckets)),
+		}
+		family.series[key] = series
+	}
+	return series
+}
+
+func (family *metricFamily) add(value float64, labelValues ...string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	family.get(labelValues).value += value
+}
+
+func (family *metricFamily) observe(value float64, labelValues ...string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	series := family.get(labelValues)
+	series.value += value
+	series.count++
+	for i, bound := range family.buckets {
+		if value <= bound {
+			series.buckets[i]++
+			break
+		}
+	}
+}
+
+func (family *metricFamily) write(w io.Writer) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n", family.name, family.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", family.name, family.kind)
+	if len(family.labels) == 0 && len(family.series) == 0 && family.kind == "counter" {
+		// counters without labels are exposed from zero
+		family.get(nil)
+	}
+	keys := []string{}
+	for key := range family.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := family.series[key]
+		labels := formatMetricLabels(family.labels, series.labelValues)
+		if family.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", family.name, labels, formatMetricValue(series.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range family.buckets {
+			cumulative += series.buckets[i]
+			le := bucketMetricLabels(family.labels, series.labelValues, formatMetricValue(bound))
+			fmt.Fprintf(w, "%v_bucket%v %v\n", family.name, le, cumulative)
+		}
+		le := bucketMetricLabels(family.labels, series.labelValues, "+Inf")
+		fmt.Fprintf(w, "%v_bucket%v %v\n", family.name, le, series.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", family.name, labels, formatMetricValue(series.value))
+		fmt.Fprintf(w, "%v_count%v %v\n", family.name, labels, series.count)
+	}
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, name, metricLabelEscaper.Replace(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// bucketMetricLabels formats the labels of a histogram bucket, with its `le` upper bound
+func bucketMetricLabels(names []string, values []string, le string) string {
+	names = append(append([]string{}, names...), "le")
+	values = append(append([]string{}, values...), le)
+	return formatMetricLabels(names, values)
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// statusRecorder records the status code written by a route handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(b []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(b)
+}
+
+// wrapMetricsRouteHandlers returns route handlers recording the requests of the route
+func (resource *Resource) wrapMetricsRouteHandlers(name string, method string, handlers domain.RouteHandlers) domain.RouteHandlers {
+	wrapped := domain.RouteHandlers{}
+	for version, handler := range handlers {
+		next := handler
+		wrapped[version] = func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+			next(recorder, req)
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			resource.Metrics.ObserveRequest(name, method, status, time.Since(start))
+		}
+	}
+	return wrapped
+}
@@ -0,0 +1,125 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2"
+	"time"
+)
+
+// Migrations collection names
+const (
+	MigrationsCollection     string = "users_migrations"
+	MigrationLocksCollection string = "users_migrations_lock"
+)
+
+// migrationLockID is the id of the single migration lock document
+const migrationLockID = "users"
+
+func NewMigrationRepositoryFactory() IMigrationRepositoryFactory {
+	return &MigrationRepositoryFactory{}
+}
+
+type MigrationRepositoryFactory struct{}
+
+func (factory *MigrationRepositoryFactory) New(db domain.IDatabase) IMigrationRepository {
+	return &MigrationRepository{db}
+}
+
+type MigrationRepository struct {
+	DB domain.IDatabase
+}
+
+type migrationLock struct {
+	ID          string    `bson:"_id"`
+	Owner       string    `bson:"owner"`
+	ExpiresDate time.Time `bson:"expiresDate"`
+}
+
+// AppliedMigrations Get list of applied migrations, by ascending version
+func (repo *MigrationRepository) AppliedMigrations() (IAppliedMigrations, error) {
+	migrations := AppliedMigrations{}
+	err := repo.DB.FindAll(MigrationsCollection, domain.Query{}, &migrations, 0, "_id")
+	if err != nil {
+		return &AppliedMigrations{}, err
+	}
+	return &migrations, nil
+}
+
+// RecordMigration Insert the record of an applied migration
+func (repo *MigrationRepository) RecordMigration(_migration IAppliedMigration) error {
+	migration := _migration.(*AppliedMigration)
+	if migration.AppliedDate.IsZero() {
+		migration.AppliedDate = time.Now()
+	}
+	return repo.DB.Insert(MigrationsCollection, migration)
+}
+
+// RemoveMigration Delete the record of a reverted migration
+func (repo *MigrationRepository) RemoveMigration(version int) error {
+	return repo.DB.RemoveOne(MigrationsCollection, domain.Query{"_id": version})
+}
+
+// AcquireLock Insert the lock document, or take over an expired lock
+func (repo *MigrationRepository) AcquireLock(owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lock := migrationLock{
+		ID:          migrationLockID,
+		Owner:       owner,
+		ExpiresDate: now.Add(ttl),
+	}
+	err := repo.DB.Insert(MigrationLocksCollection, &lock)
+	if err == nil {
+		return true, nil
+	}
+	if !repo.DB.Exists(MigrationLocksCollection, domain.Query{"_id": migrationLockID}) {
+		// the insert failed for another reason than an existing lock
+		return false, err
+	}
+	query := domain.Query{
+		"_id":         migrationLockID,
+		"expiresDate": domain.Query{"$lt": now},
+	}
+	change := domain.Change{
+		Update: domain.Query{"$set": domain.Query{
+			"owner":       owner,
+			"expiresDate": lock.ExpiresDate,
+		}},
+		ReturnNew: true,
+	}
+	var changedLock migrationLock
+	err = repo.DB.Update(MigrationLocksCollection, query, change, &changedLock)
+	if err != nil {
+		// held by another owner
+		return false, nil
+	}
+	return true, nil
+}
+
+// RenewLock Extend the lock document if held by the owner
+func (repo *MigrationRepository) RenewLock(owner string, ttl time.Duration) (bool, error) {
+	query := domain.Query{
+		"_id":   migrationLockID,
+		"owner": owner,
+	}
+	change := domain.Change{
+		Update:    domain.Query{"$set": domain.Query{"expiresDate": time.Now().Add(ttl)}},
+		ReturnNew: true,
+	}
+	var changedLock migrationLock
+	err := repo.DB.Update(MigrationLocksCollection, query, change, &changedLock)
+	if err == mgo.ErrNotFound {
+		// taken over by another owner, or released
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseLock Delete the lock document if held by the owner
+func (repo *MigrationRepository) ReleaseLock(owner string) error {
+	return repo.DB.RemoveOne(MigrationLocksCollection, domain.Query{"_id": migrationLockID, "owner": owner})
+}
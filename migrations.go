@@ -0,0 +1,361 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"time"
+)
+
+// Migration directions
+const (
+	MigrationUp   = "up"
+	MigrationDown = "down"
+)
+
+// DefaultMigrationLockTTL is the time after which the lock of an interrupted migration run can be taken over.
+// The lock is renewed every third of its TTL while migrations run.
+const DefaultMigrationLockTTL = 15 * time.Minute
+
+// Migration is a versioned change of the users collection, such as backfilling a new field.
+// Down is optional; migrations without it can't be reverted.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx *MigrationContext) error
+	Down        func(ctx *MigrationContext) error
+}
+
+// MigrationContext is passed to migrations.
+// In dry-run mode, migrations must not write, and count the documents they would change in Affected;
+// UpdateAll does so.
+type MigrationContext struct {
+	DB       domain.IDatabase
+	DryRun   bool
+	Affected int
+
+	// lockLost is closed once the migration lock can no longer be renewed
+	lockLost <-chan struct{}
+}
+
+// Err returns an error once the migration lock is lost, for eg: to another instance after a failed renewal.
+// Migrations writing in batches with DB should stop when it does; UpdateAll checks it.
+func (ctx *MigrationContext) Err() error {
+	select {
+	case <-ctx.lockLost:
+		return errMigrationLockLost
+	default:
+		return nil
+	}
+}
+
+// UpdateAll updates the matching documents, or counts them in dry-run mode
+func (ctx *MigrationContext) UpdateAll(name string, query domain.Query, change domain.Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.DryRun {
+		count, err := ctx.DB.Count(name, query)
+		ctx.Affected += count
+		return err
+	}
+	count, err := ctx.DB.UpdateAll(name, query, change)
+	ctx.Affected += count
+	return err
+}
+
+// AppliedMigration records a migration applied to the database
+type AppliedMigration struct {
+	Version     int       `json:"version" bson:"_id"`
+	Description string    `json:"description" bson:"description"`
+	AppliedDate time.Time `json:"appliedDate" bson:"appliedDate"`
+}
+
+type AppliedMigrations []AppliedMigration
+
+func (migration *AppliedMigration) GetVersion() int {
+	return migration.Version
+}
+
+// MigrationStatus is the state of a registered or applied migration.
+// Unknown migrations are applied but not registered, for eg: by a newer release.
+type MigrationStatus struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	Applied     bool      `json:"applied"`
+	AppliedDate time.Time `json:"appliedDate"`
+	Unknown     bool      `json:"unknown,omitempty"`
+}
+
+// MigrationResult is the outcome of running a migration
+type MigrationResult struct {
+	Version     int           `json:"version"`
+	Description string        `json:"description"`
+	Direction   string        `json:"direction"`
+	DryRun      bool          `json:"dryRun"`
+	Affected    int           `json:"affected"`
+	Duration    time.Duration `json:"duration"`
+}
+
+var registeredMigrations = map[int]Migration{}
+
+// RegisterMigration registers a migration of the users collection, typically from an `init` function.
+// It panics if the migration is invalid or its version is already registered.
+func RegisterMigration(migration Migration) {
+	if migration.Version < 1 || migration.Up == nil {
+		panic(fmt.Sprintf("users: migration %v requires a positive version and an Up function", migration.Version))
+	}
+	if _, ok := registeredMigrations[migration.Version]; ok {
+		panic(fmt.Sprintf("users: migration %v is already registered", migration.Version))
+	}
+	registeredMigrations[migration.Version] = migration
+}
+
+// RegisteredMigrations returns the registered migrations, by ascending version
+func RegisteredMigrations() []Migration {
+	migrations := []Migration{}
+	for _, migration := range registeredMigrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations
+}
+
+// Migrator applies and reverts migrations, holding the migration lock
+// so that only one instance migrates at a time. Dry runs don't take the lock.
+type Migrator struct {
+	DB         domain.IDatabase
+	Repository IMigrationRepository
+	Migrations []Migration
+	LockTTL    time.Duration
+}
+
+// NewMigrator returns a Migrator of the migrations, which must have distinct versions
+func NewMigrator(db domain.IDatabase, repo IMigrationRepository, migrations []Migration) (*Migrator, error) {
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	for i, migration := range sorted {
+		if migration.Version < 1 || migration.Up == nil {
+			return nil, errors.New(fmt.Sprintf("Migration %v requires a positive version and an Up function", migration.Version))
+		}
+		if i > 0 && sorted[i-1].Version == migration.Version {
+			return nil, errors.New(fmt.Sprintf("Migration %v is declared more than once", migration.Version))
+		}
+	}
+	return &Migrator{
+		DB:         db,
+		Repository: repo,
+		Migrations: sorted,
+		LockTTL:    DefaultMigrationLockTTL,
+	}, nil
+}
+
+// Migrator returns a Migrator of the registered migrations
+func (resource *Resource) Migrator() (*Migrator, error) {
+	return NewMigrator(resource.Database, resource.MigrationRepositoryFactory.New(resource.Database), RegisteredMigrations())
+}
+
+// Status returns the state of the registered and applied migrations, by ascending version
+func (migrator *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := migrator.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []MigrationStatus{}
+	for _, migration := range migrator.Migrations {
+		status := MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+		}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedDate = record.AppliedDate
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, record := range applied {
+		statuses = append(statuses, MigrationStatus{
+			Version:     record.Version,
+			Description: record.Description,
+			Applied:     true,
+			AppliedDate: record.AppliedDate,
+			Unknown:     true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Up applies the pending migrations up to the target version, or all of them if target is 0
+func (migrator *Migrator) Up(target int, dryRun bool) ([]MigrationResult, error) {
+	return migrator.run(MigrationUp, target, dryRun)
+}
+
+// Down reverts the applied migrations with a version above the target, latest first
+func (migrator *Migrator) Down(target int, dryRun bool) ([]MigrationResult, error) {
+	return migrator.run(MigrationDown, target, dryRun)
+}
+
+var errMigrationLockLost = errors.New("Migration lock lost, migrations aborted")
+
+func (migrator *Migrator) run(direction string, target int, dryRun bool) ([]MigrationResult, error) {
+	var lockLost <-chan struct{}
+	if !dryRun {
+		owner := bson.NewObjectId().Hex()
+		locked, err := migrator.Repository.AcquireLock(owner, migrator.lockTTL())
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			return nil, errors.New("Migrations are locked by another instance")
+		}
+		defer migrator.Repository.ReleaseLock(owner)
+		var stop func()
+		lockLost, stop = migrator.heartbeat(owner)
+		defer stop()
+	}
+
+	applied, err := migrator.applied()
+	if err != nil {
+		return nil, err
+	}
+	migrations := []Migration{}
+	if direction == MigrationUp {
+		for _, migration := range migrator.Migrations {
+			if _, ok := applied[migration.Version]; !ok && (target == 0 || migration.Version <= target) {
+				migrations = append(migrations, migration)
+			}
+		}
+	} else {
+		for i := len(migrator.Migrations) - 1; i >= 0; i-- {
+			migration := migrator.Migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > target {
+				if migration.Down == nil {
+					return nil, errors.New(fmt.Sprintf("Migration %v can't be reverted", migration.Version))
+				}
+				migrations = append(migrations, migration)
+			}
+		}
+	}
+
+	results := []MigrationResult{}
+	for _, migration := range migrations {
+		select {
+		case <-lockLost:
+			return results, errMigrationLockLost
+		default:
+		}
+		result, err := migrator.apply(migration, direction, dryRun, lockLost)
+		if err != nil {
+			return results, errors.New(fmt.Sprintf("Migration %v (%v) failed: %v", migration.Version, direction, err.Error()))
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+// lockTTL returns the LockTTL, or DefaultMigrationLockTTL if not set
+func (migrator *Migrator) lockTTL() time.Duration {
+	if migrator.LockTTL <= 0 {
+		return DefaultMigrationLockTTL
+	}
+	return migrator.LockTTL
+}
+
+// heartbeat renews the lock of the owner every third of its TTL, until stopped.
+// The returned channel is closed if a renewal fails, since another instance may take the lock over once expired.
+func (migrator *Migrator) heartbeat(owner string) (<-chan struct{}, func()) {
+	lost := make(chan struct{})
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ttl := migrator.lockTTL()
+	go func() {
+		defer close(stopped)
+		interval := ttl / 3
+		if interval <= 0 {
+			interval = ttl
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewed, err := migrator.Repository.RenewLock(owner, ttl)
+				if err != nil || !renewed {
+					close(lost)
+					return
+				}
+			}
+		}
+	}()
+	return lost, func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// apply runs the migration and records its new state, unless in dry-run mode
+func (migrator *Migrator) apply(migration Migration, direction string, dryRun bool, lockLost <-chan struct{}) (*MigrationResult, error) {
+	ctx := &MigrationContext{
+		DB:       migrator.DB,
+		DryRun:   dryRun,
+		lockLost: lockLost,
+	}
+	start := time.Now()
+	var err error
+	if direction == MigrationUp {
+		err = migration.Up(ctx)
+	} else {
+		err = migration.Down(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if direction == MigrationUp {
+			err = migrator.Repository.RecordMigration(&AppliedMigration{
+				Version:     migration.Version,
+				Description: migration.Description,
+			})
+		} else {
+			err = migrator.Repository.RemoveMigration(migration.Version)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &MigrationResult{
+		Version:     migration.Version,
+		Description: migration.Description,
+		Direction:   direction,
+		DryRun:      dryRun,
+		Affected:    ctx.Affected,
+		Duration:    time.Since(start),
+	}, nil
+}
+
+// applied returns the applied migrations by version
+func (migrator *Migrator) applied() (map[int]AppliedMigration, error) {
+	records, err := migrator.Repository.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]AppliedMigration{}
+	for _, record := range *records.(*AppliedMigrations) {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
@@ -0,0 +1,364 @@
+package users
+
+import (
+	"errors"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// migrationDatabase is an in-memory domain.IDatabase of the migrations and migration lock collections
+type migrationDatabase struct {
+	domain.IDatabase
+	mutex   sync.Mutex
+	applied map[int]AppliedMigration
+	lock    *migrationLock
+}
+
+func newMigrationDatabase() *migrationDatabase {
+	return &migrationDatabase{applied: map[int]AppliedMigration{}}
+}
+
+func (db *migrationDatabase) Insert(name string, obj interface{}) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if name == MigrationsCollection {
+		migration := obj.(*AppliedMigration)
+		if _, ok := db.applied[migration.Version]; ok {
+			return errors.New("E11000 duplicate key error")
+		}
+		db.applied[migration.Version] = *migration
+		return nil
+	}
+	if db.lock != nil {
+		return errors.New("E11000 duplicate key error")
+	}
+	lock := *obj.(*migrationLock)
+	db.lock = &lock
+	return nil
+}
+
+func (db *migrationDatabase) Exists(name string, q domain.Query) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.lock != nil
+}
+
+func (db *migrationDatabase) Update(name string, q domain.Query, change domain.Change, result interface{}) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.lock == nil {
+		return mgo.ErrNotFound
+	}
+	if owner, ok := q["owner"]; ok && owner != db.lock.Owner {
+		return mgo.ErrNotFound
+	}
+	if expires, ok := q["expiresDate"]; ok && !db.lock.ExpiresDate.Before(expires.(domain.Query)["$lt"].(time.Time)) {
+		return mgo.ErrNotFound
+	}
+	set := change.Update.(domain.Query)["$set"].(domain.Query)
+	if owner, ok := set["owner"]; ok {
+		db.lock.Owner = owner.(string)
+	}
+	db.lock.ExpiresDate = set["expiresDate"].(time.Time)
+	return nil
+}
+
+func (db *migrationDatabase) RemoveOne(name string, q domain.Query) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if name == MigrationsCollection {
+		delete(db.applied, q["_id"].(int))
+		return nil
+	}
+	if db.lock == nil || q["owner"] != db.lock.Owner {
+		return mgo.ErrNotFound
+	}
+	db.lock = nil
+	return nil
+}
+
+func (db *migrationDatabase) FindAll(name string, q domain.Query, result interface{}, limit int, sortField string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	migrations := AppliedMigrations{}
+	for _, migration := range db.applied {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	*result.(*AppliedMigrations) = migrations
+	return nil
+}
+
+func (db *migrationDatabase) locked() bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.lock != nil
+}
+
+// recordingMigrations returns migrations of the versions, which record the versions they run in order
+func recordingMigrations(ran *[]int, versions ...int) []Migration {
+	migrations := []Migration{}
+	for _, version := range versions {
+		version := version
+		migrations = append(migrations, Migration{
+			Version: version,
+			Up: func(ctx *MigrationContext) error {
+				*ran = append(*ran, version)
+				return nil
+			},
+			Down: func(ctx *MigrationContext) error {
+				*ran = append(*ran, -version)
+				return nil
+			},
+		})
+	}
+	return migrations
+}
+
+func newTestMigrator(t *testing.T, db *migrationDatabase, migrations []Migration) *Migrator {
+	migrator, err := NewMigrator(db, NewMigrationRepositoryFactory().New(db), migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+func resultVersions(results []MigrationResult) []int {
+	versions := []int{}
+	for _, result := range results {
+		versions = append(versions, result.Version)
+	}
+	return versions
+}
+
+func equalVersions(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNewMigratorDuplicateVersions(t *testing.T) {
+	ran := []int{}
+	_, err := NewMigrator(newMigrationDatabase(), nil, recordingMigrations(&ran, 1, 2, 1))
+	if err == nil {
+		t.Error("expected an error for duplicate versions")
+	}
+	_, err = NewMigrator(newMigrationDatabase(), nil, []Migration{{Version: 1}})
+	if err == nil {
+		t.Error("expected an error for a migration without Up")
+	}
+}
+
+func TestMigratorOrder(t *testing.T) {
+	db := newMigrationDatabase()
+	ran := []int{}
+	migrator := newTestMigrator(t, db, recordingMigrations(&ran, 3, 1, 2))
+
+	results, err := migrator.Up(2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalVersions(ran, []int{1, 2}) || !equalVersions(resultVersions(results), []int{1, 2}) {
+		t.Errorf("expected migrations up to the target by ascending version, got %v", ran)
+	}
+	results, err = migrator.Up(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalVersions(ran, []int{1, 2, 3}) || !equalVersions(resultVersions(results), []int{3}) {
+		t.Errorf("expected the remaining migration to be applied, got %v", ran)
+	}
+
+	ran = ran[:0]
+	results, err = migrator.Down(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalVersions(ran, []int{-3, -2}) || !equalVersions(resultVersions(results), []int{3, 2}) {
+		t.Errorf("expected migrations above the target to be reverted latest first, got %v", ran)
+	}
+	if _, ok := db.applied[1]; !ok || len(db.applied) != 1 {
+		t.Errorf("expected only the first migration to remain applied, got %v", db.applied)
+	}
+	if db.locked() {
+		t.Error("expected the lock to be released")
+	}
+}
+
+func TestMigratorSkipsApplied(t *testing.T) {
+	db := newMigrationDatabase()
+	db.applied[2] = AppliedMigration{Version: 2, AppliedDate: time.Now()}
+	db.applied[9] = AppliedMigration{Version: 9, Description: "newer release", AppliedDate: time.Now()}
+	ran := []int{}
+	migrator := newTestMigrator(t, db, recordingMigrations(&ran, 1, 2, 3))
+
+	if _, err := migrator.Up(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if !equalVersions(ran, []int{1, 3}) {
+		t.Errorf("expected only the pending migrations to run, got %v", ran)
+	}
+
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 4 || !statuses[3].Unknown || statuses[3].Version != 9 {
+		t.Fatalf("expected the applied migration of a newer release to be unknown, got %+v", statuses)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("expected migration %v to be applied", status.Version)
+		}
+	}
+}
+
+func TestMigratorDryRun(t *testing.T) {
+	db := newMigrationDatabase()
+	db.lock = &migrationLock{ID: migrationLockID, Owner: "other", ExpiresDate: time.Now().Add(time.Hour)}
+	ran := []int{}
+	migrator := newTestMigrator(t, db, recordingMigrations(&ran, 1))
+
+	results, err := migrator.Up(0, true)
+	if err != nil {
+		t.Fatalf("expected dry runs not to take the lock, got %v", err)
+	}
+	if len(results) != 1 || !results[0].DryRun || len(db.applied) != 0 {
+		t.Errorf("expected the migration not to be recorded, got %+v", results)
+	}
+}
+
+func TestMigratorDownWithoutDown(t *testing.T) {
+	db := newMigrationDatabase()
+	db.applied[1] = AppliedMigration{Version: 1}
+	migrator := newTestMigrator(t, db, []Migration{{Version: 1, Up: func(ctx *MigrationContext) error { return nil }}})
+
+	if _, err := migrator.Down(0, false); err == nil {
+		t.Error("expected an error for a migration that can't be reverted")
+	}
+	if _, ok := db.applied[1]; !ok || db.locked() {
+		t.Error("expected the migration to remain applied and the lock to be released")
+	}
+}
+
+func TestMigratorLockContention(t *testing.T) {
+	db := newMigrationDatabase()
+	started, proceed := make(chan struct{}), make(chan struct{})
+	ran := []int{}
+	first := newTestMigrator(t, db, []Migration{{
+		Version: 1,
+		Up: func(ctx *MigrationContext) error {
+			close(started)
+			<-proceed
+			return nil
+		},
+	}})
+	second := newTestMigrator(t, db, recordingMigrations(&ran, 1))
+
+	done := make(chan error)
+	go func() {
+		_, err := first.Up(0, false)
+		done <- err
+	}()
+	<-started
+	_, err := second.Up(0, false)
+	if err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("expected the second runner to be locked out, got %v", err)
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock is released once the first runner is done, which applied the migration
+	results, err := second.Up(0, false)
+	if err != nil || len(results) != 0 || len(ran) != 0 {
+		t.Errorf("expected the second runner to find nothing to apply, got %v, %v", results, err)
+	}
+}
+
+func TestMigratorTakesOverExpiredLock(t *testing.T) {
+	db := newMigrationDatabase()
+	db.lock = &migrationLock{ID: migrationLockID, Owner: "interrupted", ExpiresDate: time.Now().Add(-time.Minute)}
+	ran := []int{}
+	migrator := newTestMigrator(t, db, recordingMigrations(&ran, 1))
+
+	if _, err := migrator.Up(0, false); err != nil {
+		t.Fatalf("expected the expired lock to be taken over, got %v", err)
+	}
+	if !equalVersions(ran, []int{1}) || db.locked() {
+		t.Errorf("expected the migration to run and the lock to be released, got %v", ran)
+	}
+}
+
+func TestMigratorReleasesLockOnFailure(t *testing.T) {
+	db := newMigrationDatabase()
+	ran := []int{}
+	migrations := recordingMigrations(&ran, 1, 3)
+	migrations = append(migrations, Migration{
+		Version: 2,
+		Up: func(ctx *MigrationContext) error {
+			return errors.New("invalid document")
+		},
+	})
+	migrator := newTestMigrator(t, db, migrations)
+
+	results, err := migrator.Up(0, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid document") {
+		t.Fatalf("expected the error of the migration, got %v", err)
+	}
+	if !equalVersions(resultVersions(results), []int{1}) || !equalVersions(ran, []int{1}) {
+		t.Errorf("expected the migrations after the failed one not to run, got %v", ran)
+	}
+	if _, ok := db.applied[2]; ok || len(db.applied) != 1 {
+		t.Errorf("expected the failed migration not to be recorded, got %v", db.applied)
+	}
+	if db.locked() {
+		t.Error("expected the lock to be released after the failure")
+	}
+}
+
+func TestMigratorLockLost(t *testing.T) {
+	db := newMigrationDatabase()
+	migrator := newTestMigrator(t, db, []Migration{{
+		Version: 1,
+		Up: func(ctx *MigrationContext) error {
+			// another instance takes the lock over
+			db.mutex.Lock()
+			db.lock.Owner = "other"
+			db.mutex.Unlock()
+			for i := 0; i < 100; i++ {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			return nil
+		},
+	}})
+	migrator.LockTTL = 30 * time.Millisecond
+
+	_, err := migrator.Up(0, false)
+	if err == nil || !strings.Contains(err.Error(), errMigrationLockLost.Error()) {
+		t.Errorf("expected the migration to stop once the lock is lost, got %v", err)
+	}
+	if len(db.applied) != 0 {
+		t.Error("expected the migration not to be recorded")
+	}
+	if !db.locked() {
+		t.Error("expected the lock of the other instance not to be released")
+	}
+}
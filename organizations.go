@@ -0,0 +1,120 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const defaultOrganizationHeader = "X-Organization-ID"
+
+// HeaderOrganizationResolver resolves the organization from a request header
+// (defaults to `X-Organization-ID`)
+type HeaderOrganizationResolver struct {
+	Header string
+}
+
+func (resolver *HeaderOrganizationResolver) ResolveOrganization(req *http.Request) (string, error) {
+	header := resolver.Header
+	if header == "" {
+		header = defaultOrganizationHeader
+	}
+	org := strings.TrimSpace(req.Header.Get(header))
+	if org == "" {
+		return "", errors.New(fmt.Sprintf("Missing `%v` header", header))
+	}
+	return org, nil
+}
+
+// SubdomainOrganizationResolver resolves the organization from the subdomain of `Domain`,
+// for eg: `acme.example.com` resolves to `acme` if Domain is `example.com`
+type SubdomainOrganizationResolver struct {
+	Domain string
+}
+
+func (resolver *SubdomainOrganizationResolver) ResolveOrganization(req *http.Request) (string, error) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	suffix := "." + strings.TrimPrefix(resolver.Domain, ".")
+	if !strings.HasSuffix(host, suffix) {
+		return "", errors.New(fmt.Sprintf("Host `%v` is not a subdomain of `%v`", host, resolver.Domain))
+	}
+	org := strings.TrimSuffix(host, suffix)
+	if org == "" || strings.Contains(org, ".") {
+		return "", errors.New(fmt.Sprintf("Invalid organization subdomain `%v`", org))
+	}
+	return org, nil
+}
+
+// OrganizationResolverFunc adapts a function to IOrganizationResolver,
+// for eg: to resolve the organization from a token claim
+type OrganizationResolverFunc func(req *http.Request) (string, error)
+
+func (f OrganizationResolverFunc) ResolveOrganization(req *http.Request) (string, error) {
+	return f(req)
+}
+
+// Organization returns the organization the request is scoped to.
+// Returns an empty string if no users.Options.OrganizationResolver is configured.
+//
+// Unauthenticated requests are scoped to the organization too, eg: anonymous sign-ups join it.
+// Resolvers may trust the client, eg: HeaderOrganizationResolver, so the organization is only used
+// for authenticated members and global admins; other users get CodeOrganizationForbidden.
+func (resource *Resource) Organization(req *http.Request) (string, error) {
+	if resource.OrganizationResolver == nil {
+		return "", nil
+	}
+	org, err := resource.OrganizationResolver.ResolveOrganization(req)
+	if err != nil {
+		return "", err
+	}
+	if org == "" {
+		return "", NewMessageError(CodeOrganizationNotSpecified)
+	}
+	user := asUser(resource.CurrentUser(req))
+	if user != nil && !user.HasRole(RoleAdmin) && !user.IsMemberOf(org) {
+		return "", NewMessageError(CodeOrganizationForbidden)
+	}
+	return org, nil
+}
+
+// unresolvedOrganization scopes the repositories of requests that cannot be resolved to an organization.
+// No document belongs to it, so that the repositories match nothing.
+const unresolvedOrganization = "\x00unresolved"
+
+// repositoryOrganization returns the organization the repositories of the request are scoped to.
+// Repositories fail closed if the organization cannot be resolved, rather than being unscoped.
+func (resource *Resource) repositoryOrganization(req *http.Request) string {
+	org, err := resource.Organization(req)
+	if err != nil {
+		return unresolvedOrganization
+	}
+	return org
+}
+
+// wrapOrganizationRouteHandlers returns route handlers that reject requests
+// that cannot be resolved to an organization of the user
+func (resource *Resource) wrapOrganizationRouteHandlers(handlers domain.RouteHandlers) domain.RouteHandlers {
+	wrapped := domain.RouteHandlers{}
+	for version, handler := range handlers {
+		next := handler
+		wrapped[version] = func(w http.ResponseWriter, req *http.Request) {
+			_, err := resource.Organization(req)
+			if err, ok := err.(*MessageError); ok && err.Code == CodeOrganizationForbidden {
+				resource.RenderErrorFrom(w, req, http.StatusForbidden, err)
+				return
+			}
+			if err != nil {
+				resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+				return
+			}
+			next(w, req)
+		}
+	}
+	return wrapped
+}
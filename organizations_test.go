@@ -0,0 +1,95 @@
+package users
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOrganization(t *testing.T) {
+	member := newTestUser(StatusActive, RoleUser)
+	member.Organizations = []Membership{{OrganizationID: "acme"}}
+	admin := newTestUser(StatusActive, RoleAdmin)
+
+	tests := []struct {
+		name     string
+		header   string
+		user     *User
+		expected string
+		code     string
+	}{
+		{"anonymous", "acme", nil, "acme", ""},
+		{"member", "acme", member, "acme", ""},
+		{"global admin", "acme", admin, "acme", ""},
+		{"non-member", "globex", member, "", CodeOrganizationForbidden},
+		{"anonymous without organization", "", nil, "", ""},
+	}
+	for _, test := range tests {
+		resource := &Resource{ctx: newTestContext(), OrganizationResolver: &HeaderOrganizationResolver{}}
+		req := httptest.NewRequest("GET", "/api/users", nil)
+		if test.header != "" {
+			req.Header.Set(defaultOrganizationHeader, test.header)
+		}
+		if test.user != nil {
+			resource.ctx.SetCurrentUserCtx(req, test.user)
+		}
+		org, err := resource.Organization(req)
+		if org != test.expected {
+			t.Errorf("%v: expected organization `%v`, got `%v`", test.name, test.expected, org)
+		}
+		if test.header == "" && err == nil {
+			t.Errorf("%v: expected an error", test.name)
+		}
+		if messageErr, ok := err.(*MessageError); test.code != "" && (!ok || messageErr.Code != test.code) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.code, err)
+		}
+		if test.header != "" && test.code == "" && err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestOrganizationAnonymousRequests(t *testing.T) {
+	other := newTestUser(StatusActive, RoleUser)
+	other.Username, other.Email = "bob", "bob@example.com"
+	other.Organizations = []Membership{{OrganizationID: "globex"}}
+	store := newMemoryUserStore(other)
+	resource := newTestResource(&Options{
+		UserRepositoryFactory: &memoryUserRepositoryFactory{store},
+		OrganizationResolver:  &HeaderOrganizationResolver{},
+	})
+
+	// anonymous sign-ups join the organization of the request
+	req := newCreateUserRequest("alice", "alice@example.com")
+	req.Header.Set(defaultOrganizationHeader, "acme")
+	w := httptest.NewRecorder()
+	resource.HandleCreateUser_v0(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the user to be created, got %v: %v", w.Code, w.Body.String())
+	}
+	created, err := (&memoryUserRepositoryFactory{store}).New(nil).GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.(*User).IsMemberOf("acme") || len(created.(*User).Organizations) != 1 {
+		t.Errorf("expected the user to join the organization, got %v", created.(*User).Organizations)
+	}
+
+	// anonymous lookups are scoped to the organization of the request
+	for _, test := range []struct {
+		org    string
+		status int
+	}{
+		{"acme", http.StatusBadRequest},
+		{"globex", http.StatusOK},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/users/"+other.ID.Hex(), nil), map[string]string{"id": other.ID.Hex()})
+		req.Header.Set(defaultOrganizationHeader, test.org)
+		w := httptest.NewRecorder()
+		resource.HandleGetUser_v0(w, req)
+		if w.Code != test.status {
+			t.Errorf("%v: expected %v, got %v: %v", test.org, test.status, w.Code, w.Body.String())
+		}
+	}
+}
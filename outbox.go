@@ -0,0 +1,373 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"context"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+// Outbox message statuses
+const (
+	// OutboxStaged messages are written before a change that can't include them,
+	// and released once the change succeeds
+	OutboxStaged    = "staged"
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	OutboxDead      = "dead"
+	OutboxCancelled = "cancelled"
+)
+
+// OutboxMessage holds an event awaiting delivery. OutboxMessage implements IOutboxMessage
+type OutboxMessage struct {
+	ID              bson.ObjectId `json:"id" bson:"_id"`
+	Event           Event         `json:"event" bson:"event"`
+	Status          string        `json:"status" bson:"status"`
+	Attempts        int           `json:"attempts" bson:"attempts"`
+	LastError       string        `json:"lastError,omitempty" bson:"lastError"`
+	NextAttemptDate time.Time     `json:"nextAttemptDate,omitempty" bson:"nextAttemptDate"`
+	DeliveredDate   time.Time     `json:"deliveredDate,omitempty" bson:"deliveredDate"`
+	CreatedDate     time.Time     `json:"createdDate" bson:"createdDate"`
+}
+
+// OutboxMessages struct
+type OutboxMessages []OutboxMessage
+
+func (message *OutboxMessage) GetID() string {
+	return message.ID.Hex()
+}
+
+// NewOutboxMessage returns a pending message for the event
+func NewOutboxMessage(event *Event) *OutboxMessage {
+	if event.OccurredDate.IsZero() {
+		event.OccurredDate = time.Now()
+	}
+	detached := *event
+	detached.Request = nil
+	detached.ResponseWriter = nil
+	detached.User = withoutOutbox(event.User)
+	detached.Previous = withoutOutbox(event.Previous)
+	return &OutboxMessage{
+		ID:              bson.NewObjectId(),
+		Event:           detached,
+		Status:          OutboxPending,
+		NextAttemptDate: time.Now(),
+		CreatedDate:     time.Now(),
+	}
+}
+
+// withoutOutbox returns a copy of the user without its pending outbox messages
+func withoutOutbox(user *User) *User {
+	if user == nil || user.Outbox == nil {
+		return user
+	}
+	copied := *user
+	copied.Outbox = nil
+	return &copied
+}
+
+type OutboxOptions struct {
+	// PollInterval between dispatches of due messages, defaults to 5 seconds
+	PollInterval time.Duration
+	// BatchSize is the maximum number of messages dispatched per poll, defaults to 100
+	BatchSize int
+	// MaxAttempts before a message is marked `dead`, defaults to 8
+	MaxAttempts int
+	// InitialBackoff is doubled after every failed attempt, defaults to 1 second
+	InitialBackoff time.Duration
+	// MaxBackoff defaults to 1 hour
+	MaxBackoff time.Duration
+	// StagedTimeout after which staged messages of interrupted requests are reconciled, defaults to 1 minute
+	StagedTimeout time.Duration
+}
+
+// OutboxDispatcher delivers the messages of the outbox to the event bus, at-least-once.
+//
+// Events of user creation, confirmation and updates are written within the user document update,
+// and relayed to the outbox collection by the dispatcher.
+// Other events are written to the outbox collection; events of deletions are staged before the change
+// and reconciled against the users collection if the request was interrupted.
+//
+// A message is delivered when all synchronous subscribers of the event bus succeed,
+// failed deliveries are retried with exponential backoff until MaxAttempts, after which the message is marked `dead`.
+// Delivered events have no Request and ResponseWriter.
+type OutboxDispatcher struct {
+	resource *Resource
+	options  OutboxOptions
+	notify   chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+func NewOutboxDispatcher(resource *Resource, options *OutboxOptions) *OutboxDispatcher {
+	dispatcher := &OutboxDispatcher{
+		resource: resource,
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	if options != nil {
+		dispatcher.options = *options
+	}
+	if dispatcher.options.PollInterval <= 0 {
+		dispatcher.options.PollInterval = 5 * time.Second
+	}
+	if dispatcher.options.BatchSize <= 0 {
+		dispatcher.options.BatchSize = 100
+	}
+	if dispatcher.options.MaxAttempts <= 0 {
+		dispatcher.options.MaxAttempts = 8
+	}
+	if dispatcher.options.InitialBackoff <= 0 {
+		dispatcher.options.InitialBackoff = time.Second
+	}
+	if dispatcher.options.MaxBackoff <= 0 {
+		dispatcher.options.MaxBackoff = time.Hour
+	}
+	if dispatcher.options.StagedTimeout <= 0 {
+		dispatcher.options.StagedTimeout = time.Minute
+	}
+	return dispatcher
+}
+
+// repository returns an unscoped outbox repository, messages are not dispatched within a request
+func (dispatcher *OutboxDispatcher) repository() IOutboxRepository {
+	return dispatcher.resource.OutboxRepositoryFactory.New(dispatcher.resource.Database, "")
+}
+
+// Start polls the outbox in the background until Stop is called
+func (dispatcher *OutboxDispatcher) Start() {
+	dispatcher.done.Add(1)
+	go func() {
+		defer dispatcher.done.Done()
+		ticker := time.NewTicker(dispatcher.options.PollInterval)
+		defer ticker.Stop()
+		for {
+			dispatcher.Poll()
+			select {
+			case <-dispatcher.stop:
+				return
+			case <-ticker.C:
+			case <-dispatcher.notify:
+			}
+		}
+	}()
+}
+
+// Stop stops polling and waits for the current poll to complete
+func (dispatcher *OutboxDispatcher) Stop() {
+	dispatcher.stopOnce.Do(func() {
+		close(dispatcher.stop)
+	})
+	dispatcher.done.Wait()
+}
+
+// Notify wakes the background dispatcher up, for eg: after a message is written
+func (dispatcher *OutboxDispatcher) Notify() {
+	select {
+	case dispatcher.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue writes a pending message for the event to the outbox
+func (dispatcher *OutboxDispatcher) Enqueue(event *Event) error {
+	err := dispatcher.repository().Enqueue(NewOutboxMessage(event))
+	if err != nil {
+		return err
+	}
+	event.outboxed = true
+	dispatcher.Notify()
+	return nil
+}
+
+// Poll reconciles staged messages, relays messages written alongside user documents
+// and delivers due messages
+func (dispatcher *OutboxDispatcher) Poll() {
+	repo := dispatcher.repository()
+
+	staged := *repo.StagedMessages(time.Now().Add(-dispatcher.options.StagedTimeout), dispatcher.options.BatchSize).(*OutboxMessages)
+	for i := range staged {
+		dispatcher.reconcile(&staged[i])
+	}
+
+	_, err := repo.Relay("", dispatcher.options.BatchSize)
+	if err != nil {
+		dispatcher.resource.Logger.Error("users: outbox relay failed", "error", err.Error())
+	}
+
+	due := *repo.DueMessages(time.Now(), dispatcher.options.BatchSize).(*OutboxMessages)
+	for i := range due {
+		dispatcher.Deliver(&due[i])
+	}
+}
+
+// Deliver publishes the message's event on the event bus and records the outcome
+func (dispatcher *OutboxDispatcher) Deliver(message *OutboxMessage) {
+	message.Attempts++
+	event := message.Event
+	err := dispatcher.resource.deliver(&event)
+	if err == nil {
+		message.Status = OutboxDelivered
+		message.LastError = ""
+		message.DeliveredDate = time.Now()
+	} else if message.Attempts >= dispatcher.options.MaxAttempts {
+		message.Status = OutboxDead
+		message.LastError = err.Error()
+	} else {
+		message.Status = OutboxPending
+		message.LastError = err.Error()
+		message.NextAttemptDate = time.Now().Add(exponentialBackoff(dispatcher.options.InitialBackoff, dispatcher.options.MaxBackoff, message.Attempts))
+	}
+	err = dispatcher.repository().SaveMessage(message)
+	if err != nil {
+		dispatcher.resource.Logger.Error("users: outbox message save failed", "message_id", message.ID.Hex(), "error", err.Error())
+	}
+}
+
+// Retry resets a message, for eg: a `dead` message, so that it is delivered on the next poll
+func (dispatcher *OutboxDispatcher) Retry(message *OutboxMessage) error {
+	message.Attempts = 0
+	message.Status = OutboxPending
+	message.NextAttemptDate = time.Now()
+	err := dispatcher.repository().SaveMessage(message)
+	if err == nil {
+		dispatcher.Notify()
+	}
+	return err
+}
+
+// stage writes the events to the outbox before a change that can't include them.
+// The returned function releases the messages for delivery if the change succeeded, or cancels them.
+func (dispatcher *OutboxDispatcher) stage(events []*Event) (func(err error), error) {
+	repo := dispatcher.repository()
+	messages := []*OutboxMessage{}
+	for _, event := range events {
+		message := NewOutboxMessage(event)
+		message.Status = OutboxStaged
+		err := repo.Enqueue(message)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return func(changeErr error) {
+		for i, message := range messages {
+			message.Status = OutboxPending
+			if changeErr != nil {
+				message.Status = OutboxCancelled
+				message.LastError = changeErr.Error()
+			}
+			err := repo.SaveMessage(message)
+			if err != nil {
+				// left staged, the message will be reconciled
+				dispatcher.resource.Logger.Warn("users: staged outbox message release failed", "message_id", message.ID.Hex(), "error", err.Error())
+			}
+			events[i].outboxed = true
+		}
+		dispatcher.Notify()
+	}, nil
+}
+
+// reconcile releases a staged message if its change was made, or cancels it
+func (dispatcher *OutboxDispatcher) reconcile(message *OutboxMessage) {
+	message.Status = OutboxCancelled
+	if dispatcher.changeMade(&message.Event) {
+		message.Status = OutboxPending
+		message.NextAttemptDate = time.Now()
+	}
+	err := dispatcher.repository().SaveMessage(message)
+	if err != nil {
+		dispatcher.resource.Logger.Error("users: outbox message save failed", "message_id", message.ID.Hex(), "error", err.Error())
+	}
+}
+
+// changeMade checks that the users removed by the event no longer exist,
+// or are no longer members of the event's organization
+func (dispatcher *OutboxDispatcher) changeMade(event *Event) bool {
+	db := dispatcher.resource.Database
+	scope := func(q domain.Query) domain.Query {
+		if event.OrganizationID != "" {
+			q["organizations.organizationId"] = event.OrganizationID
+		}
+		return q
+	}
+	switch event.Type {
+	case EventUserDeleted:
+		return event.Previous != nil && !db.Exists(UsersCollection, scope(domain.Query{"_id": event.Previous.ID}))
+	case EventUsersDeleted:
+		for _, id := range event.IDs {
+			if bson.IsObjectIdHex(id) && db.Exists(UsersCollection, scope(domain.Query{"_id": bson.ObjectIdHex(id)})) {
+				return false
+			}
+		}
+		return true
+	case EventAllUsersDeleted:
+		// admins are never removed from organizations
+		return !db.Exists(UsersCollection, scope(domain.Query{"roles": domain.Query{"$ne": RoleAdmin}}))
+	}
+	return false
+}
+
+// exponentialBackoff returns the delay before retrying after the given number of failed attempts
+func exponentialBackoff(initial time.Duration, max time.Duration, attempts int) time.Duration {
+	backoff := initial
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// createUser inserts the user, together with the event in the outbox if enabled
+func (resource *Resource) createUser(ctx context.Context, repo IContextUserRepository, user *User, event *Event) error {
+	if resource.OutboxDispatcher == nil {
+		return repo.CreateUser(ctx, user)
+	}
+	err := repo.(IContextOutboxUserRepository).CreateUserWithOutbox(ctx, user, NewOutboxMessage(event))
+	if err != nil {
+		return err
+	}
+	event.outboxed = true
+	resource.OutboxDispatcher.Notify()
+	return nil
+}
+
+// updateUser updates the user, together with the event in the outbox if enabled
+func (resource *Resource) updateUser(ctx context.Context, repo IContextUserRepository, id string, update *User, event *Event) (*User, error) {
+	var _user domain.IUser
+	var err error
+	if resource.OutboxDispatcher == nil {
+		_user, err = repo.UpdateUser(ctx, id, update)
+	} else {
+		_user, err = repo.(IContextOutboxUserRepository).UpdateUserWithOutbox(ctx, id, update, NewOutboxMessage(event))
+	}
+	if err != nil {
+		return nil, err
+	}
+	user := _user.(*User)
+	if resource.OutboxDispatcher != nil {
+		event.outboxed = true
+		resource.OutboxDispatcher.Notify()
+	}
+	return user, nil
+}
+
+// deleteUsers runs the deletion, staging its events in the outbox if enabled
+func (resource *Resource) deleteUsers(events []*Event, remove func() error) error {
+	if resource.OutboxDispatcher == nil {
+		return remove()
+	}
+	release, err := resource.OutboxDispatcher.stage(events)
+	if err != nil {
+		return err
+	}
+	err = remove()
+	release(err)
+	return err
+}
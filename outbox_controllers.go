@@ -0,0 +1,83 @@
+package users
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+//---- Outbox Request API v0 ----
+
+type ListOutboxResponse_v0 struct {
+	Messages OutboxMessages `json:"messages"`
+	LastID   string         `json:"last_id,omitempty"`
+	Code     string         `json:"code,omitempty"`
+	Message  string         `json:"message,omitempty"`
+	Success  bool           `json:"success"`
+}
+
+type RetryOutboxMessageResponse_v0 struct {
+	OutboxMessage OutboxMessage `json:"outboxMessage"`
+	Code          string        `json:"code,omitempty"`
+	Message       string        `json:"message,omitempty"`
+	Success       bool          `json:"success"`
+}
+
+// HandleListOutbox_v0 lists outbox messages, optionally filtered by `status`,
+// for eg: `dead` messages that exhausted their attempts
+func (resource *Resource) HandleListOutbox_v0(w http.ResponseWriter, req *http.Request) {
+	lastID := req.FormValue("last_id")
+	status := req.FormValue("status")
+
+	perPage, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	messages := *resource.OutboxRepository(req).FilterMessages(status, lastID, perPage).(*OutboxMessages)
+	if len(messages) > 0 {
+		lastID = messages[len(messages)-1].ID.Hex()
+	}
+	setLastIDPageLinks(w, req, lastID, len(messages), perPage)
+	resource.Render(w, req, http.StatusOK, ListOutboxResponse_v0{
+		Messages: messages,
+		LastID:   lastID,
+		Code:     CodeOutboxRetrieved,
+		Message:  resource.Message(req, CodeOutboxRetrieved),
+		Success:  true,
+	})
+}
+
+// HandleRetryOutboxMessage_v0 schedules a pending or dead message for immediate delivery
+func (resource *Resource) HandleRetryOutboxMessage_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	if resource.OutboxDispatcher == nil {
+		resource.RenderErrorCode(w, req, http.StatusNotImplemented, CodeOutboxDisabled)
+		return
+	}
+
+	_message, err := resource.OutboxRepository(req).GetMessageById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeOutboxMessageNotFound)
+		return
+	}
+	message := _message.(*OutboxMessage)
+	if message.Status != OutboxPending && message.Status != OutboxDead {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeOutboxMessageNotRetryable)
+		return
+	}
+
+	err = resource.OutboxDispatcher.Retry(message)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	resource.Render(w, req, http.StatusOK, RetryOutboxMessageResponse_v0{
+		OutboxMessage: *message,
+		Code:          CodeOutboxMessageRetryScheduled,
+		Message:       resource.Message(req, CodeOutboxMessageRetryScheduled),
+		Success:       true,
+	})
+}
@@ -0,0 +1,168 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Outbox collection name
+const OutboxCollection string = "outbox"
+
+func NewOutboxRepositoryFactory() IOutboxRepositoryFactory {
+	return &OutboxRepositoryFactory{}
+}
+
+type OutboxRepositoryFactory struct{}
+
+func (factory *OutboxRepositoryFactory) New(db domain.IDatabase, organizationID string) IOutboxRepository {
+	return &OutboxRepository{db, organizationID}
+}
+
+type OutboxRepository struct {
+	DB             domain.IDatabase
+	OrganizationID string
+}
+
+// scope restricts the query to messages of events within the repository's organization, if any
+func (repo *OutboxRepository) scope(q domain.Query) domain.Query {
+	if repo.OrganizationID != "" {
+		q["event.organizationId"] = repo.OrganizationID
+	}
+	return q
+}
+
+// Enqueue Insert new message document into the outbox
+func (repo *OutboxRepository) Enqueue(_message IOutboxMessage) error {
+	message := _message.(*OutboxMessage)
+	if message.ID == "" {
+		message.ID = bson.NewObjectId()
+	}
+	if message.CreatedDate.IsZero() {
+		message.CreatedDate = time.Now()
+	}
+	return repo.DB.Insert(OutboxCollection, message)
+}
+
+// GetMessageById Get message specified by the id
+func (repo *OutboxRepository) GetMessageById(id string) (IOutboxMessage, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	var message OutboxMessage
+	err := repo.DB.FindOne(OutboxCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)}), &message)
+	return &message, err
+}
+
+// SaveMessage Update the state of a message after an attempt
+func (repo *OutboxRepository) SaveMessage(_message IOutboxMessage) error {
+	message := _message.(*OutboxMessage)
+	query := domain.Query{"_id": message.ID}
+	change := domain.Change{
+		Update: domain.Query{"$set": domain.Query{
+			"status":          message.Status,
+			"attempts":        message.Attempts,
+			"lastError":       message.LastError,
+			"nextAttemptDate": message.NextAttemptDate,
+			"deliveredDate":   message.DeliveredDate,
+		}},
+		ReturnNew: true,
+	}
+	var changedMessage OutboxMessage
+	return repo.DB.Update(OutboxCollection, query, change, &changedMessage)
+}
+
+// FilterMessages Get list of messages, optionally filtered by status
+func (repo *OutboxRepository) FilterMessages(status string, lastID string, limit int) IOutboxMessages {
+	messages := OutboxMessages{}
+	q := repo.scope(domain.Query{})
+	if status != "" {
+		q["status"] = status
+	}
+	sort := paginateByID(q, lastID, "-_id")
+	err := repo.DB.FindAll(OutboxCollection, q, &messages, pageLimit(limit), sort)
+	if err != nil {
+		return &OutboxMessages{}
+	}
+	return &messages
+}
+
+// DueMessages Get list of pending messages due for delivery, oldest first
+func (repo *OutboxRepository) DueMessages(now time.Time, limit int) IOutboxMessages {
+	messages := OutboxMessages{}
+	q := repo.scope(domain.Query{
+		"status":          OutboxPending,
+		"nextAttemptDate": domain.Query{"$lte": now},
+	})
+	err := repo.DB.FindAll(OutboxCollection, q, &messages, limit, "_id")
+	if err != nil {
+		return &OutboxMessages{}
+	}
+	return &messages
+}
+
+// StagedMessages Get list of messages staged before the given time
+func (repo *OutboxRepository) StagedMessages(before time.Time, limit int) IOutboxMessages {
+	messages := OutboxMessages{}
+	q := repo.scope(domain.Query{
+		"status":      OutboxStaged,
+		"createdDate": domain.Query{"$lte": before},
+	})
+	err := repo.DB.FindAll(OutboxCollection, q, &messages, limit, "_id")
+	if err != nil {
+		return &OutboxMessages{}
+	}
+	return &messages
+}
+
+// Relay moves the messages written alongside user documents into the outbox collection.
+// Events without user, eg: written by other repositories, get the user document as it is when relayed.
+// Messages are inserted before they are pulled from the user document, so a message may be relayed
+// more than once if interrupted, but never lost.
+func (repo *OutboxRepository) Relay(id string, limit int) (int, error) {
+	q := domain.Query{"outbox.0": domain.Query{"$exists": true}}
+	if id != "" {
+		if !bson.IsObjectIdHex(id) {
+			return 0, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+		}
+		q["_id"] = bson.ObjectIdHex(id)
+	}
+	users := Users{}
+	err := repo.DB.FindAll(UsersCollection, q, &users, limit, "_id")
+	if err != nil {
+		return 0, err
+	}
+
+	relayed := 0
+	for i := range users {
+		user := &users[i]
+		outbox := user.Outbox
+		user.Outbox = nil
+		for _, message := range outbox {
+			if message.Event.User == nil {
+				message.Event.User = user
+			}
+			if !repo.DB.Exists(OutboxCollection, domain.Query{"_id": message.ID}) {
+				err = repo.DB.Insert(OutboxCollection, &message)
+				if err != nil {
+					return relayed, err
+				}
+			}
+			change := domain.Change{
+				Update:    domain.Query{"$pull": domain.Query{"outbox": domain.Query{"_id": message.ID}}},
+				ReturnNew: true,
+			}
+			var changedUser User
+			err = repo.DB.Update(UsersCollection, domain.Query{"_id": user.ID}, change, &changedUser)
+			if err != nil {
+				return relayed, err
+			}
+			relayed++
+		}
+	}
+	return relayed, nil
+}
@@ -0,0 +1,81 @@
+package users
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOutboxRetriesPostCreateUserHook(t *testing.T) {
+	store := newMemoryUserStore()
+	outboxRepo := &memoryOutboxRepository{store: store}
+	attempts := 0
+	var hooked *User
+	resource := newTestResource(&Options{
+		UserRepositoryFactory:   &memoryUserRepositoryFactory{store},
+		OutboxRepositoryFactory: outboxRepo,
+		Outbox:                  &OutboxOptions{PollInterval: time.Hour, InitialBackoff: time.Millisecond},
+		ControllerHooks: &ControllerHooks{
+			PostCreateUserHook: func(resource *Resource, w http.ResponseWriter, req *http.Request, payload *PostCreateUserHookPayload) error {
+				attempts++
+				if attempts == 1 {
+					return errors.New("mail server unavailable")
+				}
+				hooked = payload.User.(*User)
+				return nil
+			},
+		},
+	})
+	// poll by hand
+	resource.OutboxDispatcher.Stop()
+
+	w := httptest.NewRecorder()
+	resource.HandleCreateUser_v0(w, newCreateUserRequest("alice", "alice@example.com"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the user to be created, got %v: %v", w.Code, w.Body.String())
+	}
+	if attempts != 0 {
+		t.Fatalf("expected the hook not to run within the request, got %v attempts", attempts)
+	}
+
+	resource.OutboxDispatcher.Poll()
+	if attempts != 1 || hooked != nil {
+		t.Fatalf("expected the first attempt to fail, got %v attempts", attempts)
+	}
+	messages := outboxRepo.messages
+	if len(messages) != 1 || messages[0].Status != OutboxPending || messages[0].LastError != "mail server unavailable" {
+		t.Fatalf("expected the message to be retried, got %+v", messages)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	resource.OutboxDispatcher.Poll()
+	if attempts != 2 || hooked == nil || hooked.Username != "alice" {
+		t.Fatalf("expected the hook to run with the created user on the next poll, got %v attempts", attempts)
+	}
+	if message := outboxRepo.messages[0]; message.Status != OutboxDelivered || message.Attempts != 2 {
+		t.Errorf("expected the message to be delivered on the second attempt, got %+v", message)
+	}
+}
+
+func TestPostCreateUserHookWithoutOutbox(t *testing.T) {
+	store := newMemoryUserStore()
+	resource := newTestResource(&Options{
+		UserRepositoryFactory: &memoryUserRepositoryFactory{store},
+		ControllerHooks: &ControllerHooks{
+			PostCreateUserHook: func(resource *Resource, w http.ResponseWriter, req *http.Request, payload *PostCreateUserHookPayload) error {
+				if req == nil || w == nil {
+					t.Error("expected the hook to run within the request")
+				}
+				return nil
+			},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	resource.HandleCreateUser_v0(w, newCreateUserRequest("alice", "alice@example.com"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the user to be created, got %v: %v", w.Code, w.Body.String())
+	}
+}
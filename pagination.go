@@ -0,0 +1,95 @@
+package users
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Page sizes of list endpoints, see Options.MaxPerPage
+const (
+	DefaultPerPage    = 20
+	DefaultMaxPerPage = 100
+)
+
+// maxPageLimit caps the limit of list queries of the repositories,
+// which treat a limit < 1 as DefaultPerPage, so that no query is unbounded
+const maxPageLimit = 1000
+
+// pageLimit returns the limit of a list query, see maxPageLimit
+func pageLimit(limit int) int {
+	if limit < 1 {
+		return DefaultPerPage
+	}
+	if limit > maxPageLimit {
+		return maxPageLimit
+	}
+	return limit
+}
+
+// perPage returns the `per_page` request param, defaults to DefaultPerPage.
+// Values above Options.MaxPerPage are capped, values that are not positive integers are rejected.
+func (resource *Resource) perPage(req *http.Request) (int, error) {
+	max := resource.options.MaxPerPage
+	if max < 1 {
+		max = DefaultMaxPerPage
+	}
+	value := req.FormValue("per_page")
+	if value == "" {
+		if DefaultPerPage > max {
+			return max, nil
+		}
+		return DefaultPerPage, nil
+	}
+	perPage, err := strconv.Atoi(value)
+	if err != nil || perPage < 1 {
+		return 0, NewMessageError(CodeInvalidPerPage, max)
+	}
+	if perPage > max {
+		perPage = max
+	}
+	return perPage, nil
+}
+
+// pageLink is a link of a RFC 8288 `Link` header
+type pageLink struct {
+	rel  string
+	href string
+}
+
+// pageURL returns the request URL with the given query params replaced, or removed if empty
+func pageURL(req *http.Request, params map[string]string) string {
+	query := req.URL.Query()
+	for key, value := range params {
+		if value == "" {
+			query.Del(key)
+		} else {
+			query.Set(key, value)
+		}
+	}
+	u := url.URL{Path: req.URL.Path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// setPageLinks sets the `Link` header of a list response
+func setPageLinks(w http.ResponseWriter, links []pageLink) {
+	values := []string{}
+	for _, link := range links {
+		values = append(values, "<"+link.href+">; rel=\""+link.rel+"\"")
+	}
+	if len(values) > 0 {
+		w.Header().Set("Link", strings.Join(values, ", "))
+	}
+}
+
+// setLastIDPageLinks sets the `next` and `first` links of a list paginated by `last_id`,
+// where a full page may be followed by another one
+func setLastIDPageLinks(w http.ResponseWriter, req *http.Request, lastID string, count int, perPage int) {
+	links := []pageLink{}
+	if count >= perPage && lastID != "" {
+		links = append(links, pageLink{"next", pageURL(req, map[string]string{"last_id": lastID})})
+	}
+	links = append(links, pageLink{"first", pageURL(req, map[string]string{"last_id": ""})})
+	setPageLinks(w, links)
+}
@@ -0,0 +1,528 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sogko/slumber/domain"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ACLPolicy maps a route name (`ListUsers`, `CountUsers`, ...) to a rule expression,
+// for eg: `authenticated && active && (admin || self)`
+type ACLPolicy map[string]string
+
+// DefaultACLPolicy is the policy applied to routes that are not overridden in users.Options
+// Organization admins (`org_admin`) manage the users of their own organization only,
+// since the repository is scoped to the request's organization.
+var DefaultACLPolicy = ACLPolicy{
+	ListUsers:      "authenticated && active && (admin || member)",
+	CountUsers:     "authenticated && active && (admin || org_admin)",
+	SearchUsers:    "authenticated && active && (admin || member)",
+	SuggestUsers:   "authenticated && active && (admin || member)",
+	GetUser:        "true",
+	CreateUser:     "anonymous || (active && (admin || org_admin))",
+	UpdateUsers:    "authenticated && active && (admin || org_admin)",
+	DeleteAllUsers: "authenticated && active && (admin || org_admin)",
+	ConfirmUser:    "true",
+	UpdateUser:     "authenticated && active && (admin || org_admin || self)",
+	DeleteUser:     "authenticated && active && (admin || org_admin)",
+	ListUserGroups: "authenticated && active && (admin || org_admin || self)",
+
+	ListGroups:        "authenticated && active && (admin || member)",
+	CreateGroup:       "authenticated && active && (admin || org_admin)",
+	GetGroup:          "authenticated && active && (admin || member)",
+	UpdateGroup:       "authenticated && active && (admin || org_admin)",
+	DeleteGroup:       "authenticated && active && (admin || org_admin)",
+	ListGroupMembers:  "authenticated && active && (admin || member)",
+	AddGroupMember:    "authenticated && active && (admin || org_admin)",
+	RemoveGroupMember: "authenticated && active && (admin || org_admin)",
+
+	StartImpersonation: "authenticated && active && admin && !impersonating",
+	StopImpersonation:  "impersonating",
+
+	ListAudit:     "authenticated && active && (admin || org_admin)",
+	ListUserAudit: "authenticated && active && (admin || org_admin)",
+
+	ListOutbox:         "authenticated && active && admin",
+	RetryOutboxMessage: "authenticated && active && admin",
+
+	ListWebhooks:          "authenticated && active && (admin || org_admin)",
+	CreateWebhook:         "authenticated && active && (admin || org_admin)",
+	GetWebhook:            "authenticated && active && (admin || org_admin)",
+	UpdateWebhook:         "authenticated && active && (admin || org_admin)",
+	DeleteWebhook:         "authenticated && active && (admin || org_admin)",
+	ListWebhookDeliveries: "authenticated && active && (admin || org_admin)",
+	ReplayWebhookDelivery: "authenticated && active && (admin || org_admin)",
+}
+
+// LoadACLPolicyFile reads an ACLPolicy from a JSON or YAML file.
+// YAML support is limited to a flat mapping of route names to rule expressions.
+func LoadACLPolicyFile(path string) (ACLPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return parseYAMLPolicy(data)
+	default:
+		policy := ACLPolicy{}
+		err = json.Unmarshal(data, &policy)
+		if err != nil {
+			return nil, err
+		}
+		return policy, nil
+	}
+}
+
+func parseYAMLPolicy(data []byte) (ACLPolicy, error) {
+	policy := ACLPolicy{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid policy line %v: `%v`", lineNo, line))
+		}
+		name := strings.TrimSpace(line[:i])
+		rule := strings.TrimSpace(line[i+1:])
+		if len(rule) >= 2 && (rule[0] == '"' || rule[0] == '\'') && rule[len(rule)-1] == rule[0] {
+			rule = rule[1 : len(rule)-1]
+		}
+		policy[name] = rule
+	}
+	return policy, scanner.Err()
+}
+
+// aclContext holds the values a rule expression is evaluated against
+type aclContext struct {
+	resource *Resource
+	req      *http.Request
+	user     *User
+	// actor is the user actually making the request, which differs from user while impersonating
+	actor *User
+
+	// groups of the user, loaded on first use
+	groups *Groups
+
+	// negated is true while evaluating the operand of a `!`
+	negated bool
+	// denials lists the reasons of identifiers that evaluated to false
+	denials []string
+	// trace records every identifier evaluated, in order
+	trace []string
+}
+
+// aclPredicate resolves a single identifier in a rule expression
+type aclPredicate func(ctx *aclContext, arg string) bool
+
+// aclDenialReasons maps an identifier to the reason given when it evaluates to false
+var aclDenialReasons = map[string]func(arg string) string{
+	"authenticated": func(arg string) string {
+		return ACLReasonUnauthenticated
+	},
+	"active": func(arg string) string {
+		return ACLReasonInactiveAccount
+	},
+	"admin": func(arg string) string {
+		return ACLReasonMissingPermission + ":" + string(RoleAdmin)
+	},
+	"role": func(arg string) string {
+		return ACLReasonMissingPermission + ":" + arg
+	},
+	"self": func(arg string) string {
+		return ACLReasonNotOwner
+	},
+	"member": func(arg string) string {
+		return ACLReasonNotMember
+	},
+	"org_admin": func(arg string) string {
+		return ACLReasonMissingPermission + ":org_admin"
+	},
+	"permission": func(arg string) string {
+		return ACLReasonMissingPermission + ":" + arg
+	},
+	"group": func(arg string) string {
+		return ACLReasonMissingPermission + ":group:" + arg
+	},
+	"impersonating": func(arg string) string {
+		return ACLReasonNotImpersonating
+	},
+}
+
+// aclPredicates lists the identifiers available to rule expressions.
+// Identifiers in the form of `name:arg` pass `arg` to the predicate.
+var aclPredicates = map[string]aclPredicate{
+	"true": func(ctx *aclContext, arg string) bool {
+		return true
+	},
+	"false": func(ctx *aclContext, arg string) bool {
+		return false
+	},
+	"anonymous": func(ctx *aclContext, arg string) bool {
+		return ctx.user == nil
+	},
+	"authenticated": func(ctx *aclContext, arg string) bool {
+		return ctx.user != nil
+	},
+	"active": func(ctx *aclContext, arg string) bool {
+		return ctx.user != nil && ctx.user.Status == StatusActive
+	},
+	"admin": func(ctx *aclContext, arg string) bool {
+		return ctx.user != nil && ctx.user.HasRole(RoleAdmin)
+	},
+	"role": func(ctx *aclContext, arg string) bool {
+		return ctx.user != nil && ctx.user.HasRole(Role(arg))
+	},
+	"self": func(ctx *aclContext, arg string) bool {
+		// a user can only act on its own user account
+		id := mux.Vars(ctx.req)["id"]
+		return ctx.user != nil && id != "" && ctx.user.ID.Hex() == id
+	},
+	"member": func(ctx *aclContext, arg string) bool {
+		// always true if no organization resolver is configured
+		if ctx.user == nil {
+			return false
+		}
+		org, err := ctx.resource.Organization(ctx.req)
+		if err != nil {
+			return false
+		}
+		return org == "" || ctx.user.IsMemberOf(org)
+	},
+	"org_admin": func(ctx *aclContext, arg string) bool {
+		if ctx.user == nil {
+			return false
+		}
+		org, err := ctx.resource.Organization(ctx.req)
+		if err != nil || org == "" {
+			return false
+		}
+		return ctx.user.HasOrganizationRole(org, RoleAdmin)
+	},
+	"impersonating": func(ctx *aclContext, arg string) bool {
+		return ctx.user != nil && ctx.actor != ctx.user
+	},
+	"permission": func(ctx *aclContext, arg string) bool {
+		// permission granted by any of the user's groups
+		for _, group := range ctx.userGroups() {
+			if group.HasPermission(arg) {
+				return true
+			}
+		}
+		return false
+	},
+	"group": func(ctx *aclContext, arg string) bool {
+		for _, group := range ctx.userGroups() {
+			if group.Name == arg {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// userGroups returns the groups of the user, loading them on first use
+func (ctx *aclContext) userGroups() Groups {
+	if ctx.user == nil || len(ctx.user.Groups) == 0 {
+		return Groups{}
+	}
+	if ctx.groups == nil {
+		repo := ctx.resource.GroupRepository(ctx.req)
+		ctx.groups = repo.FilterGroups(ctx.user.GroupIDs(), "", len(ctx.user.Groups), "").(*Groups)
+	}
+	return *ctx.groups
+}
+
+// aclRule is a compiled rule expression
+type aclRule interface {
+	eval(ctx *aclContext) bool
+}
+
+type aclIdent struct {
+	name string
+	arg  string
+}
+
+func (rule *aclIdent) eval(ctx *aclContext) bool {
+	result := aclPredicates[rule.name](ctx, rule.arg)
+	token := rule.name
+	if rule.arg != "" {
+		token += ":" + rule.arg
+	}
+	ctx.trace = append(ctx.trace, fmt.Sprintf("%v=%v", token, result))
+	if !result && !ctx.negated {
+		if reason, ok := aclDenialReasons[rule.name]; ok {
+			ctx.denials = append(ctx.denials, reason(rule.arg))
+		}
+	}
+	return result
+}
+
+type aclNot struct {
+	rule aclRule
+}
+
+func (rule *aclNot) eval(ctx *aclContext) bool {
+	ctx.negated = !ctx.negated
+	result := !rule.rule.eval(ctx)
+	ctx.negated = !ctx.negated
+	return result
+}
+
+type aclAnd struct {
+	left, right aclRule
+}
+
+func (rule *aclAnd) eval(ctx *aclContext) bool {
+	return rule.left.eval(ctx) && rule.right.eval(ctx)
+}
+
+type aclOr struct {
+	left, right aclRule
+}
+
+func (rule *aclOr) eval(ctx *aclContext) bool {
+	return rule.left.eval(ctx) || rule.right.eval(ctx)
+}
+
+// compileACLRule parses a rule expression.
+// Grammar: or := and ('||' and)* ; and := unary ('&&' unary)* ; unary := '!' unary | '(' or ')' | ident
+func compileACLRule(expr string) (aclRule, error) {
+	tokens, err := tokenizeACLRule(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &aclParser{tokens: tokens}
+	rule, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New(fmt.Sprintf("Unexpected `%v` in rule `%v`", p.tokens[p.pos], expr))
+	}
+	return rule, nil
+}
+
+func tokenizeACLRule(expr string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case isACLIdentChar(c):
+			j := i
+			for j < len(expr) && isACLIdentChar(expr[j]) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			return nil, errors.New(fmt.Sprintf("Invalid character `%c` in rule `%v`", c, expr))
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Empty rule")
+	}
+	return tokens, nil
+}
+
+func isACLIdentChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '_' || c == ':' || c == '-' || c == '.'
+}
+
+type aclParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *aclParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *aclParser) parseOr() (aclRule, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &aclOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *aclParser) parseAnd() (aclRule, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &aclAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *aclParser) parseUnary() (aclRule, error) {
+	token := p.peek()
+	p.pos++
+	switch token {
+	case "":
+		return nil, errors.New("Unexpected end of rule")
+	case "!":
+		rule, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &aclNot{rule}, nil
+	case "(":
+		rule, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("Missing `)`")
+		}
+		p.pos++
+		return rule, nil
+	case ")", "&&", "||":
+		return nil, errors.New(fmt.Sprintf("Unexpected `%v`", token))
+	}
+	name, arg := token, ""
+	if i := strings.Index(token, ":"); i >= 0 {
+		name, arg = token[:i], token[i+1:]
+	}
+	if _, ok := aclPredicates[name]; !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown identifier `%v`", name))
+	}
+	return &aclIdent{name, arg}, nil
+}
+
+// compiledACLRule is a rule expression and its parsed form
+type compiledACLRule struct {
+	expr string
+	rule aclRule
+}
+
+// compileACLPolicy compiles the default policy merged with the given overrides.
+// Overrides must be keyed by the name of a route of DefaultACLPolicy, so that misspelled routes are not left to the defaults.
+func compileACLPolicy(overrides ACLPolicy) (map[string]*compiledACLRule, error) {
+	policy := ACLPolicy{}
+	for name, expr := range DefaultACLPolicy {
+		policy[name] = expr
+	}
+	for name, expr := range overrides {
+		if _, ok := DefaultACLPolicy[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown route `%v` in ACL policy", name))
+		}
+		policy[name] = expr
+	}
+	rules := map[string]*compiledACLRule{}
+	for name, expr := range policy {
+		rule, err := compileACLRule(expr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid ACL rule for `%v`: %v", name, err.Error()))
+		}
+		rules[name] = &compiledACLRule{expr, rule}
+	}
+	return rules, nil
+}
+
+// Authorize evaluates the rule for the given route name against the request and user.
+// Routes without a rule are denied.
+func (resource *Resource) Authorize(name string, req *http.Request, user domain.IUser) *ACLDecision {
+	span := resource.startSpan(req, "users.acl", "route", name)
+	decision := resource.authorize(name, req, user)
+	span.SetAttributes("acl.allowed", decision.Allowed, "acl.reason", decision.Reason)
+	if actor := asUser(user); actor != nil {
+		span.SetAttributes("enduser.id", actor.ID.Hex())
+	}
+	span.End()
+	return decision
+}
+
+func (resource *Resource) authorize(name string, req *http.Request, user domain.IUser) *ACLDecision {
+	decision := &ACLDecision{Route: name}
+	compiled, ok := resource.aclRules[name]
+	if !ok {
+		decision.Reason = ACLReasonForbidden
+		decision.Explanation = fmt.Sprintf("no rule defined for `%v`", name)
+		return decision
+	}
+	ctx := &aclContext{
+		resource: resource,
+		req:      req,
+	}
+	if user != nil {
+		ctx.user = asUser(user)
+		ctx.actor = realActor(user)
+	}
+	decision.Rule = compiled.expr
+	decision.Allowed = compiled.rule.eval(ctx)
+	decision.Explanation = fmt.Sprintf("rule `%v` evaluated: %v", compiled.expr, strings.Join(ctx.trace, ", "))
+	if !decision.Allowed {
+		decision.Reason = pickACLDenialReason(ctx.denials)
+	}
+	return decision
+}
+
+// EvaluateACL evaluates the rule for the given route name and returns the result
+// in the form expected by domain.Route.ACLHandler
+func (resource *Resource) EvaluateACL(name string, req *http.Request, user domain.IUser) (bool, string) {
+	decision := resource.Authorize(name, req, user)
+	if decision.Allowed {
+		return true, ""
+	}
+	return false, decision.Message(resource.options.ACLDebug)
+}
+
+// pickACLDenialReason returns the most relevant of the recorded denial reasons
+func pickACLDenialReason(denials []string) string {
+	priorities := []string{
+		ACLReasonUnauthenticated,
+		ACLReasonInactiveAccount,
+		ACLReasonNotMember,
+		ACLReasonNotOwner,
+		ACLReasonMissingPermission,
+	}
+	for _, priority := range priorities {
+		for _, reason := range denials {
+			if reason == priority || strings.HasPrefix(reason, priority+":") {
+				return reason
+			}
+		}
+	}
+	return ACLReasonForbidden
+}
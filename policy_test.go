@@ -0,0 +1,383 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"github.com/gorilla/mux"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeACLRule(t *testing.T) {
+	tokens, err := tokenizeACLRule("authenticated&&(admin || !role:editor)\n|| group:ops-team.eu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"authenticated", "&&", "(", "admin", "||", "!", "role:editor", ")", "||", "group:ops-team.eu"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("expected tokens %v, got %v", expected, tokens)
+	}
+
+	for _, expr := range []string{"", "   ", "admin & self", "admin | self", "admin == self", "role:\"admin\""} {
+		if _, err := tokenizeACLRule(expr); err == nil {
+			t.Errorf("expected `%v` to fail to tokenize", expr)
+		}
+	}
+}
+
+func TestCompileACLRule(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{"true", true},
+		{"!true", false},
+		{"!!true", true},
+		// `&&` binds tighter than `||`
+		{"true || false && false", true},
+		{"false && false || true", true},
+		{"false && true || false", false},
+		{"(true || false) && false", false},
+		{"false && (false || true)", false},
+		{"!false && true", true},
+		{"!(true && false)", true},
+		{"!(true || false) || !true", false},
+		{"((true))", true},
+	}
+	for _, test := range tests {
+		rule, err := compileACLRule(test.expr)
+		if err != nil {
+			t.Errorf("`%v`: %v", test.expr, err)
+			continue
+		}
+		if result := rule.eval(&aclContext{}); result != test.expected {
+			t.Errorf("`%v`: expected %v, got %v", test.expr, test.expected, result)
+		}
+	}
+
+	for _, expr := range []string{"true &&", "|| true", "(true", "true)", "()", "true false", "!", "unknown", "unknown:arg"} {
+		if _, err := compileACLRule(expr); err == nil {
+			t.Errorf("expected `%v` to fail to compile", expr)
+		}
+	}
+}
+
+func TestCompileACLPolicy(t *testing.T) {
+	rules, err := compileACLPolicy(ACLPolicy{ListUsers: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != len(DefaultACLPolicy) {
+		t.Errorf("expected %v rules, got %v", len(DefaultACLPolicy), len(rules))
+	}
+	if rules[ListUsers].expr != "admin" {
+		t.Errorf("expected the override of `%v`, got `%v`", ListUsers, rules[ListUsers].expr)
+	}
+	if rules[GetUser].expr != DefaultACLPolicy[GetUser] {
+		t.Errorf("expected the default rule of `%v`, got `%v`", GetUser, rules[GetUser].expr)
+	}
+
+	_, err = compileACLPolicy(ACLPolicy{"ListUser": "admin"})
+	if err == nil || !strings.Contains(err.Error(), "ListUser") {
+		t.Errorf("expected an unknown route error, got %v", err)
+	}
+	_, err = compileACLPolicy(ACLPolicy{ListUsers: "admin &&"})
+	if err == nil || !strings.Contains(err.Error(), ListUsers) {
+		t.Errorf("expected an invalid rule error, got %v", err)
+	}
+}
+
+// evalACLRule evaluates the rule expression for the user of the request
+func evalACLRule(t *testing.T, resource *Resource, req *http.Request, user domain.IUser, expr string) bool {
+	rule, err := compileACLRule(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &aclContext{resource: resource, req: req}
+	if user != nil {
+		ctx.user = asUser(user)
+		ctx.actor = realActor(user)
+	}
+	return rule.eval(ctx)
+}
+
+func TestACLPredicates(t *testing.T) {
+	resource := &Resource{ctx: newTestContext()}
+	anonymous := (*User)(nil)
+	user := newTestUser(StatusActive, RoleUser)
+	editor := newTestUser(StatusActive, RoleUser, "editor")
+	pending := newTestUser(StatusPending)
+	admin := newTestUser(StatusActive, RoleAdmin)
+
+	tests := []struct {
+		name     string
+		user     *User
+		expr     string
+		expected bool
+	}{
+		{"anonymous", anonymous, "anonymous", true},
+		{"anonymous", user, "anonymous", false},
+		{"authenticated", anonymous, "authenticated", false},
+		{"authenticated", pending, "authenticated", true},
+		{"active", anonymous, "active", false},
+		{"active", pending, "active", false},
+		{"active", user, "active", true},
+		{"admin", user, "admin", false},
+		{"admin", admin, "admin", true},
+		{"role", anonymous, "role:editor", false},
+		{"role", user, "role:editor", false},
+		{"role", editor, "role:editor", true},
+		{"role", admin, "role:admin", true},
+	}
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	for _, test := range tests {
+		var u domain.IUser
+		if test.user != nil {
+			u = test.user
+		}
+		if result := evalACLRule(t, resource, req, u, test.expr); result != test.expected {
+			t.Errorf("%v: expected `%v` to be %v, got %v", test.name, test.expr, test.expected, result)
+		}
+	}
+}
+
+func TestACLPredicateSelf(t *testing.T) {
+	resource := &Resource{ctx: newTestContext()}
+	user := newTestUser(StatusActive, RoleUser)
+	req := httptest.NewRequest("GET", "/api/users/"+user.ID.Hex(), nil)
+
+	if evalACLRule(t, resource, mux.SetURLVars(req, map[string]string{"id": user.ID.Hex()}), user, "self") != true {
+		t.Error("expected `self` for the user's own id")
+	}
+	if evalACLRule(t, resource, mux.SetURLVars(req, map[string]string{"id": bson.NewObjectId().Hex()}), user, "self") != false {
+		t.Error("expected not `self` for the id of another user")
+	}
+	if evalACLRule(t, resource, req, user, "self") != false {
+		t.Error("expected not `self` for routes without id")
+	}
+	if evalACLRule(t, resource, mux.SetURLVars(req, map[string]string{"id": user.ID.Hex()}), nil, "self") != false {
+		t.Error("expected not `self` for anonymous requests")
+	}
+}
+
+func TestACLPredicatesOrganization(t *testing.T) {
+	member := newTestUser(StatusActive, RoleUser)
+	member.Organizations = []Membership{{OrganizationID: "acme", Roles: Roles{RoleUser}}}
+	orgAdmin := newTestUser(StatusActive, RoleUser)
+	orgAdmin.Organizations = []Membership{{OrganizationID: "acme", Roles: Roles{RoleAdmin}}}
+	otherOrgAdmin := newTestUser(StatusActive, RoleUser)
+	otherOrgAdmin.Organizations = []Membership{{OrganizationID: "globex", Roles: Roles{RoleAdmin}}}
+	admin := newTestUser(StatusActive, RoleAdmin)
+
+	tests := []struct {
+		name             string
+		resolver         IOrganizationResolver
+		user             *User
+		member, orgAdmin bool
+	}{
+		{"no resolver", nil, member, true, false},
+		{"no resolver", nil, orgAdmin, true, false},
+		{"anonymous", &HeaderOrganizationResolver{}, nil, false, false},
+		{"member", &HeaderOrganizationResolver{}, member, true, false},
+		{"organization admin", &HeaderOrganizationResolver{}, orgAdmin, true, true},
+		{"admin of another organization", &HeaderOrganizationResolver{}, otherOrgAdmin, false, false},
+		// global admins are not members, their rules use `admin`
+		{"global admin", &HeaderOrganizationResolver{}, admin, false, false},
+	}
+	for _, test := range tests {
+		ctx := newTestContext()
+		resource := &Resource{ctx: ctx, OrganizationResolver: test.resolver}
+		req := httptest.NewRequest("GET", "/api/users", nil)
+		req.Header.Set("X-Organization-ID", "acme")
+		var u domain.IUser
+		if test.user != nil {
+			u = test.user
+			ctx.SetCurrentUserCtx(req, u)
+		}
+		if result := evalACLRule(t, resource, req, u, "member"); result != test.member {
+			t.Errorf("%v: expected `member` to be %v, got %v", test.name, test.member, result)
+		}
+		if result := evalACLRule(t, resource, req, u, "org_admin"); result != test.orgAdmin {
+			t.Errorf("%v: expected `org_admin` to be %v, got %v", test.name, test.orgAdmin, result)
+		}
+	}
+}
+
+func TestACLPredicatesGroups(t *testing.T) {
+	resource := &Resource{ctx: newTestContext()}
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	group := Group{ID: bson.NewObjectId(), Name: "ops", Permissions: []string{"users:export"}}
+	user := newTestUser(StatusActive, RoleUser)
+	user.Groups = []bson.ObjectId{group.ID}
+
+	eval := func(u *User, expr string) bool {
+		rule, err := compileACLRule(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the groups are loaded from the group repository on first use
+		groups := Groups{group}
+		return rule.eval(&aclContext{resource: resource, req: req, user: u, actor: u, groups: &groups})
+	}
+	if !eval(user, "permission:users:export") {
+		t.Error("expected the permission of the user's group")
+	}
+	if eval(user, "permission:users:delete") {
+		t.Error("expected no permission missing from the user's groups")
+	}
+	if !eval(user, "group:ops") {
+		t.Error("expected the user's group")
+	}
+	if eval(user, "group:dev") {
+		t.Error("expected no group the user is not in")
+	}
+	nobody := newTestUser(StatusActive, RoleUser)
+	if eval(nobody, "permission:users:export") || eval(nobody, "group:ops") {
+		t.Error("expected no permission nor group for users without groups")
+	}
+	if eval(nil, "permission:users:export") || eval(nil, "group:ops") {
+		t.Error("expected no permission nor group for anonymous requests")
+	}
+}
+
+func TestACLPredicateImpersonating(t *testing.T) {
+	resource := &Resource{ctx: newTestContext()}
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	admin := newTestUser(StatusActive, RoleAdmin)
+	target := newTestUser(StatusActive, RoleUser)
+
+	if evalACLRule(t, resource, req, nil, "impersonating") {
+		t.Error("expected anonymous requests not to be impersonating")
+	}
+	if evalACLRule(t, resource, req, target, "impersonating") {
+		t.Error("expected users acting as themselves not to be impersonating")
+	}
+	impersonated := &ImpersonatedUser{User: target, Impersonator: admin}
+	if !evalACLRule(t, resource, req, impersonated, "impersonating") {
+		t.Error("expected impersonated users to be impersonating")
+	}
+	// rules apply to the impersonated user
+	if evalACLRule(t, resource, req, impersonated, "admin") {
+		t.Error("expected the rules to apply to the impersonated user")
+	}
+}
+
+func TestAuthorizeDenialReason(t *testing.T) {
+	rules, err := compileACLPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := &Resource{ctx: newTestContext(), aclRules: rules}
+	req := httptest.NewRequest("DELETE", "/api/users", nil)
+
+	tests := []struct {
+		user   *User
+		reason string
+	}{
+		{nil, ACLReasonUnauthenticated},
+		{newTestUser(StatusSuspended, RoleAdmin), ACLReasonInactiveAccount},
+		{newTestUser(StatusActive, RoleUser), ACLReasonMissingPermission + ":" + string(RoleAdmin)},
+	}
+	for _, test := range tests {
+		var u domain.IUser
+		if test.user != nil {
+			u = test.user
+		}
+		decision := resource.Authorize(DeleteAllUsers, req, u)
+		if decision.Allowed || decision.Reason != test.reason {
+			t.Errorf("expected denial `%v`, got allowed=%v reason=`%v`", test.reason, decision.Allowed, decision.Reason)
+		}
+	}
+
+	decision := resource.Authorize("Unknown", req, newTestUser(StatusActive, RoleAdmin))
+	if decision.Allowed || decision.Reason != ACLReasonForbidden {
+		t.Errorf("expected routes without rule to be forbidden, got allowed=%v reason=`%v`", decision.Allowed, decision.Reason)
+	}
+}
+
+// legacyACL are the per-route ACL functions replaced by DefaultACLPolicy.
+// The lookup of the target user by HandleUpdateUserACL is replaced by comparing ids,
+// since its own account always exists for an authenticated user.
+var legacyACL = map[string]func(req *http.Request, user *User) bool{
+	ListUsers: func(req *http.Request, user *User) bool {
+		return user != nil && user.Status == StatusActive
+	},
+	GetUser: func(req *http.Request, user *User) bool {
+		return true
+	},
+	CreateUser: func(req *http.Request, user *User) bool {
+		if user == nil {
+			return true
+		}
+		return user.Status == StatusActive && user.HasRole(RoleAdmin)
+	},
+	UpdateUsers: func(req *http.Request, user *User) bool {
+		return user != nil && user.Status == StatusActive && user.HasRole(RoleAdmin)
+	},
+	DeleteAllUsers: func(req *http.Request, user *User) bool {
+		return user != nil && user.Status == StatusActive && user.HasRole(RoleAdmin)
+	},
+	ConfirmUser: func(req *http.Request, user *User) bool {
+		return true
+	},
+	UpdateUser: func(req *http.Request, user *User) bool {
+		if user == nil || user.Status != StatusActive {
+			return false
+		}
+		if user.HasRole(RoleAdmin) {
+			return true
+		}
+		return user.ID.Hex() == mux.Vars(req)["id"]
+	},
+	DeleteUser: func(req *http.Request, user *User) bool {
+		return user != nil && user.Status == StatusActive && user.HasRole(RoleAdmin)
+	},
+	CountUsers: func(req *http.Request, user *User) bool {
+		return user != nil && user.Status == StatusActive && user.HasRole(RoleAdmin)
+	},
+}
+
+func TestDefaultACLPolicyParity(t *testing.T) {
+	rules, err := compileACLPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := &Resource{ctx: newTestContext(), aclRules: rules}
+
+	users := map[string]*User{
+		"anonymous":       nil,
+		"pending user":    newTestUser(StatusPending),
+		"suspended user":  newTestUser(StatusSuspended, RoleUser),
+		"active user":     newTestUser(StatusActive, RoleUser),
+		"suspended admin": newTestUser(StatusSuspended, RoleAdmin),
+		"active admin":    newTestUser(StatusActive, RoleAdmin),
+	}
+	other := bson.NewObjectId().Hex()
+
+	for route, legacy := range legacyACL {
+		for name, user := range users {
+			ids := []string{other}
+			if user != nil {
+				ids = append(ids, user.ID.Hex())
+			}
+			for _, id := range ids {
+				req := mux.SetURLVars(httptest.NewRequest("GET", "/api/users/"+id, nil), map[string]string{"id": id})
+				var u domain.IUser
+				if user != nil {
+					u = user
+				}
+				expected := legacy(req, user)
+				decision := resource.Authorize(route, req, u)
+				if decision.Allowed != expected {
+					t.Errorf("%v, %v on own account %v: expected %v, got %v (%v)",
+						route, name, id != other, expected, decision.Allowed, decision.Explanation)
+				}
+			}
+		}
+	}
+}
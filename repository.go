@@ -6,9 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/sogko/slumber/domain"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"log"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -22,100 +22,221 @@ func NewUserRepositoryFactory() IUserRepositoryFactory {
 type UserRepositoryFactory struct{}
 
 func (factory *UserRepositoryFactory) New(db domain.IDatabase) IUserRepository {
-	return &UserRepository{db}
+	return &UserRepository{db, ""}
+}
+
+// NewForOrganization returns a repository that scopes every query to the given organization
+func (factory *UserRepositoryFactory) NewForOrganization(db domain.IDatabase, organizationID string) IUserRepository {
+	return &UserRepository{db, organizationID}
 }
 
 type UserRepository struct {
-	DB domain.IDatabase
+	DB             domain.IDatabase
+	OrganizationID string
+}
+
+// scope restricts the query to users of the repository's organization, if any
+func (repo *UserRepository) scope(q domain.Query) domain.Query {
+	if repo.OrganizationID != "" {
+		q["organizations.organizationId"] = repo.OrganizationID
+	}
+	return q
 }
 
 // CreateUser Insert new user document into the database
 func (repo *UserRepository) CreateUser(_user domain.IUser) error {
 	user := _user.(*User)
+	repo.prepareUser(user)
+	return repo.DB.Insert(UsersCollection, user)
+}
+
+// CreateUserWithOutbox Insert new user document together with the outbox messages.
+// The events of the messages hold the user as created.
+func (repo *UserRepository) CreateUserWithOutbox(_user domain.IUser, messages ...IOutboxMessage) error {
+	user := _user.(*User)
+	repo.prepareUser(user)
+	outbox := outboxMessages(messages)
+	for i := range outbox {
+		created := *user
+		outbox[i].Event.User = &created
+	}
+	user.Outbox = outbox
+	err := repo.DB.Insert(UsersCollection, user)
+	user.Outbox = nil
+	return err
+}
+
+// prepareUser sets the id and dates of a new user, and its membership of the repository's organization
+func (repo *UserRepository) prepareUser(user *User) {
+	if repo.OrganizationID != "" && !user.IsMemberOf(repo.OrganizationID) {
+		// users created within an organization are members of it
+		user.Organizations = append(user.Organizations, Membership{
+			OrganizationID: repo.OrganizationID,
+			Roles:          Roles{},
+		})
+	}
 	user.ID = bson.NewObjectId()
 	user.CreatedDate = time.Now()
 	user.LastModifiedDate = time.Now()
-	return repo.DB.Insert(UsersCollection, user)
 }
 
 // GetUsers Get list of users
 func (repo *UserRepository) GetUsers() domain.IUsers {
 	users := Users{}
-	err := repo.DB.FindAll(UsersCollection, nil, &users, 50, "")
+	err := repo.DB.FindAll(UsersCollection, repo.scope(domain.Query{}), &users, 50, "")
 	if err != nil {
 		return Users{}
 	}
 	return users
 }
 
-func (repo *UserRepository) FilterUsers(field string, query string, lastID string, limit int, sort string) domain.IUsers {
+// FilterUsers Get a page of users after (or before) the cursor, see EncodeUserCursor
+func (repo *UserRepository) FilterUsers(field string, query string, cursor string, limit int, sort string) domain.IUsers {
+	users, err := repo.findUsersPage(repo.searchQuery(field, query), cursor, pageLimit(limit), sort)
+	if err != nil {
+		return &Users{}
+	}
+	return &users
+}
+
+// FilterUsersByGroup Get list of members of the group specified by the id
+func (repo *UserRepository) FilterUsersByGroup(groupID string, lastID string, limit int, sort string) domain.IUsers {
+	if !bson.IsObjectIdHex(groupID) {
+		return &Users{}
+	}
 	users := Users{}
+	q := repo.scope(domain.Query{"groups": bson.ObjectIdHex(groupID)})
+	sort = paginateByID(q, lastID, sort)
+	err := repo.DB.FindAll(UsersCollection, q, &users, pageLimit(limit), sort)
+	if err != nil {
+		return &Users{}
+	}
+	return &users
+}
+
+// FilterUsersBy Get a page of users matching the filter expression, after (or before) the cursor
+func (repo *UserRepository) FilterUsersBy(filter FilterExpr, cursor string, limit int, sort string) domain.IUsers {
+	users, err := repo.findUsersPage(repo.filterQuery(filter), cursor, pageLimit(limit), sort)
+	if err != nil {
+		return &Users{}
+	}
+	return &users
+}
 
-	// ensure that collection has the right text index
-	// refactor building collection index
-	err := repo.DB.EnsureIndex(UsersCollection, mgo.Index{
-		Key: []string{
-			"$text:username",
-			"$text:email",
-			"$text:status",
+// SuggestUsers Get active users whose username starts with the prefix, ignoring case
+func (repo *UserRepository) SuggestUsers(prefix string, limit int) domain.IUsers {
+	users := Users{}
+	q := repo.scope(domain.Query{
+		"username": domain.Query{
+			"$regex":   "^" + regexp.QuoteMeta(prefix),
+			"$options": "i",
 		},
-		Background: true,
-		Sparse:     true,
+		"status": StatusActive,
 	})
+	err := repo.DB.FindAll(UsersCollection, q, &users, pageLimit(limit), "username")
 	if err != nil {
-		log.Println("FilterUsers: EnsureIndex", err.Error())
+		return &Users{}
 	}
-	// parse sort string
-	allowedSortMap := map[string]bool{
-		"_id":  true,
-		"-_id": true,
+	return &users
+}
+
+// CountUsersBy Count users matching the filter expression
+func (repo *UserRepository) CountUsersBy(filter FilterExpr) int {
+	count, err := repo.DB.Count(UsersCollection, repo.filterQuery(filter))
+	if err != nil {
+		return 0
 	}
-	// ensure that sort string is allowed
-	// we are basically concerned about sorting on un-indexed keys
-	if !allowedSortMap[sort] {
-		sort = "-_id" // set it to default sort
+	return count
+}
+
+func (repo *UserRepository) filterQuery(filter FilterExpr) domain.Query {
+	q := repo.scope(domain.Query{})
+	if filter != nil {
+		// nest the filter so that it can't collide with the scope and pagination conditions
+		q["$and"] = []domain.Query{translateUserFilter(filter)}
 	}
+	return q
+}
 
-	q := domain.Query{}
-	if lastID != "" && bson.IsObjectIdHex(lastID) {
-		if sort == "_id" {
-			q["_id"] = domain.Query{
-				"$gt": bson.ObjectIdHex(lastID),
-			}
-		} else {
-			q["_id"] = domain.Query{
-				"$lt": bson.ObjectIdHex(lastID),
-			}
-		}
+// translateUserFilter translates a filter expression into a query
+func translateUserFilter(expr FilterExpr) domain.Query {
+	switch expr := expr.(type) {
+	case FilterAnd:
+		return domain.Query{"$and": translateUserFilters(expr)}
+	case FilterOr:
+		return domain.Query{"$or": translateUserFilters(expr)}
+	case FilterCondition:
+		return translateUserFilterCondition(expr)
 	}
+	return domain.Query{}
+}
 
-	if query != "" {
-		if field != "" {
-			q[field] = domain.Query{
-				"$regex":   fmt.Sprintf("^%v.*", query),
+func translateUserFilters(exprs []FilterExpr) []domain.Query {
+	queries := []domain.Query{}
+	for _, expr := range exprs {
+		queries = append(queries, translateUserFilter(expr))
+	}
+	return queries
+}
+
+func translateUserFilterCondition(condition FilterCondition) domain.Query {
+	field := condition.Field
+	values := condition.Values
+
+	if field == "emailDomain" {
+		// match the domain at the end of the email address
+		domains := []domain.Query{}
+		for _, value := range values {
+			domains = append(domains, domain.Query{"email": domain.Query{
+				"$regex":   "@" + regexp.QuoteMeta(value.(string)) + "$",
 				"$options": "i",
-			}
-		} else {
-			// if not field is specified, we do a text search on pre-defined text index
-			q["$text"] = domain.Query{
-				"$search": query,
-			}
+			}})
+		}
+		if len(domains) == 1 {
+			return domains[0]
 		}
+		return domain.Query{"$or": domains}
 	}
 
-	err = repo.DB.FindAll(UsersCollection, q, &users, limit, sort)
-	if err != nil {
-		return &Users{}
+	switch condition.Op {
+	case FilterEq, FilterContains:
+		return domain.Query{field: values[0]}
+	case FilterNe:
+		return domain.Query{field: domain.Query{"$ne": values[0]}}
+	case FilterIn:
+		return domain.Query{field: domain.Query{"$in": values}}
+	case FilterPrefix:
+		return domain.Query{field: domain.Query{"$regex": "^" + regexp.QuoteMeta(values[0].(string))}}
+	case FilterMatches:
+		return domain.Query{field: domain.Query{"$regex": values[0], "$options": "i"}}
+	case FilterBetween:
+		return domain.Query{field: domain.Query{"$gte": values[0], "$lte": values[1]}}
+	case FilterGt, FilterGte, FilterLt, FilterLte:
+		return domain.Query{field: domain.Query{"$" + condition.Op: values[0]}}
 	}
-	return &users
+	return domain.Query{}
 }
 
 func (repo *UserRepository) CountUsers(field string, query string) int {
-	q := domain.Query{}
+	count, err := repo.DB.Count(UsersCollection, repo.searchQuery(field, query))
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// searchQuery matches users with the literal `query` prefix in the field, or text search if no field is given.
+// Fields that are not searchable (see userSearchFields) match no user.
+func (repo *UserRepository) searchQuery(field string, query string) domain.Query {
+	q := repo.scope(domain.Query{})
+	if ValidateUserSearchField(field) != nil {
+		q["_id"] = domain.Query{"$exists": false}
+		return q
+	}
 	if query != "" {
 		if field != "" {
 			q[field] = domain.Query{
-				"$regex":   fmt.Sprintf("^%v.*", query),
+				"$regex":   "^" + regexp.QuoteMeta(query),
 				"$options": "i",
 			}
 		} else {
@@ -125,12 +246,7 @@ func (repo *UserRepository) CountUsers(field string, query string) int {
 			}
 		}
 	}
-
-	count, err := repo.DB.Count(UsersCollection, q)
-	if err != nil {
-		return 0
-	}
-	return count
+	return q
 }
 
 // DeleteUsers Delete a list of users
@@ -147,16 +263,59 @@ func (repo *UserRepository) DeleteUsers(ids []string) error {
 	if len(objectIds) == 0 {
 		return nil
 	}
+	if repo.OrganizationID != "" {
+		return repo.removeMemberships(domain.Query{"_id": bson.M{"$in": objectIds}})
+	}
 	err := repo.DB.RemoveAll(UsersCollection, domain.Query{"_id": bson.M{"$in": objectIds}})
 	return err
 }
 
 // DeleteAllUsers Delete all users
 func (repo *UserRepository) DeleteAllUsers() error {
+	if repo.OrganizationID != "" {
+		// only remove the users from the organization
+		return repo.removeMemberships(domain.Query{})
+	}
 	err := repo.DB.DropCollection(UsersCollection)
 	return err
 }
 
+// removeMemberships removes the matching users from the repository's organization.
+// Users without other memberships are deleted, the others only lose their membership.
+// Admins are never removed.
+func (repo *UserRepository) removeMemberships(q domain.Query) error {
+	// delete the last members first, users losing their membership below would match otherwise
+	last := repo.scope(domain.Query{
+		"roles":         domain.Query{"$ne": RoleAdmin},
+		"organizations": domain.Query{"$size": 1},
+	})
+	others := repo.scope(domain.Query{
+		"roles":           domain.Query{"$ne": RoleAdmin},
+		"organizations.1": domain.Query{"$exists": true},
+	})
+	for key, value := range q {
+		last[key] = value
+		others[key] = value
+	}
+	err := repo.DB.RemoveAll(UsersCollection, last)
+	if err != nil {
+		return err
+	}
+	_, err = repo.DB.UpdateAll(UsersCollection, others, repo.pullMembership())
+	return err
+}
+
+// pullMembership is the change removing the membership of the repository's organization
+func (repo *UserRepository) pullMembership() domain.Change {
+	return domain.Change{
+		Update: domain.Query{
+			"$pull": domain.Query{"organizations": domain.Query{"organizationId": repo.OrganizationID}},
+			"$set":  domain.Query{"lastModifiedDate": time.Now()},
+		},
+		ReturnNew: true,
+	}
+}
+
 // GetUser Get user specified by the id
 func (repo *UserRepository) GetUserById(id string) (domain.IUser, error) {
 
@@ -165,18 +324,19 @@ func (repo *UserRepository) GetUserById(id string) (domain.IUser, error) {
 	}
 
 	var user User
-	err := repo.DB.FindOne(UsersCollection, domain.Query{"_id": bson.ObjectIdHex(id)}, &user)
+	err := repo.DB.FindOne(UsersCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)}), &user)
 	return &user, err
 }
 
 // GetUser Get user specified by the username
 func (repo *UserRepository) GetUserByUsername(username string) (domain.IUser, error) {
 	var user User
-	err := repo.DB.FindOne(UsersCollection, domain.Query{"username": username}, &user)
+	err := repo.DB.FindOne(UsersCollection, repo.scope(domain.Query{"username": username}), &user)
 	return &user, err
 }
 
 // UserExistsByUsername Check if username already exists
+// Usernames and email addresses are unique across organizations
 func (repo *UserRepository) UserExistsByUsername(username string) bool {
 	return repo.DB.Exists(UsersCollection, domain.Query{"username": username})
 }
@@ -188,6 +348,55 @@ func (repo *UserRepository) UserExistsByEmail(email string) bool {
 
 // UpdateUser Update user specified by the id
 func (repo *UserRepository) UpdateUser(id string, _inUser domain.IUser) (domain.IUser, error) {
+	return repo.updateUser(id, _inUser, nil)
+}
+
+// UpdateUserWithOutbox Update user specified by the id, pushing the outbox messages within the same update.
+// The events of the messages hold their previous user with the update applied.
+func (repo *UserRepository) UpdateUserWithOutbox(id string, _inUser domain.IUser, messages ...IOutboxMessage) (domain.IUser, error) {
+	inUser := _inUser.(*User)
+	outbox := outboxMessages(messages)
+	for i := range outbox {
+		if previous := outbox[i].Event.Previous; previous != nil {
+			outbox[i].Event.User = repo.updatedUser(previous, inUser)
+		}
+	}
+	return repo.updateUser(id, inUser, outbox)
+}
+
+// updatedUser returns a copy of the user with the fields set by updateUser applied
+func (repo *UserRepository) updatedUser(user *User, inUser *User) *User {
+	updated := *user
+	updated.LastModifiedDate = time.Now()
+	if inUser.Email != "" {
+		updated.Email = inUser.Email
+	}
+	if inUser.Username != "" {
+		updated.Username = inUser.Username
+	}
+	if inUser.Status != "" {
+		updated.Status = inUser.Status
+	}
+	if inUser.Locale != "" {
+		updated.Locale = inUser.Locale
+	}
+	if len(inUser.Roles) > 0 {
+		updated.Roles = inUser.Roles
+	}
+	if repo.OrganizationID != "" {
+		if membership := inUser.Membership(repo.OrganizationID); membership != nil {
+			updated.Organizations = append([]Membership{}, user.Organizations...)
+			if current := updated.Membership(repo.OrganizationID); current != nil {
+				current.Roles = membership.Roles
+			}
+		}
+	} else if len(inUser.Organizations) > 0 {
+		updated.Organizations = inUser.Organizations
+	}
+	return &updated
+}
+
+func (repo *UserRepository) updateUser(id string, _inUser domain.IUser, outbox []OutboxMessage) (domain.IUser, error) {
 
 	if !bson.IsObjectIdHex(id) {
 		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
@@ -208,26 +417,354 @@ func (repo *UserRepository) UpdateUser(id string, _inUser domain.IUser) (domain.
 	if inUser.Status != "" {
 		update["status"] = inUser.Status
 	}
+	if inUser.Locale != "" {
+		update["locale"] = inUser.Locale
+	}
 	if len(inUser.Roles) > 0 {
 		update["roles"] = inUser.Roles
 	}
 
-	query := domain.Query{"_id": bson.ObjectIdHex(id)}
+	query := repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)})
+	if repo.OrganizationID != "" {
+		// only the membership of the repository's organization can be updated
+		if membership := inUser.Membership(repo.OrganizationID); membership != nil {
+			update["organizations.$.roles"] = membership.Roles
+		}
+	} else if len(inUser.Organizations) > 0 {
+		update["organizations"] = inUser.Organizations
+	}
+
+	changes := domain.Query{"$set": update}
+	if len(outbox) > 0 {
+		changes["$push"] = domain.Query{"outbox": domain.Query{"$each": outbox}}
+	}
 	change := domain.Change{
-		Update:    domain.Query{"$set": update},
+		Update:    changes,
 		ReturnNew: true,
 	}
 	var changedUser User
 	err := repo.DB.Update(UsersCollection, query, change, &changedUser)
+	changedUser.Outbox = nil
 	return &changedUser, err
 }
 
+// AddUserToGroup adds the group specified by groupID to the user's groups
+func (repo *UserRepository) AddUserToGroup(id string, groupID string) error {
+	return repo.updateGroups(id, groupID, "$addToSet")
+}
+
+// RemoveUserFromGroup removes the group specified by groupID from the user's groups
+func (repo *UserRepository) RemoveUserFromGroup(id string, groupID string) error {
+	return repo.updateGroups(id, groupID, "$pull")
+}
+
+// RemoveGroupFromUsers removes the group specified by groupID from the groups of all its members
+func (repo *UserRepository) RemoveGroupFromUsers(groupID string) error {
+	if !bson.IsObjectIdHex(groupID) {
+		return errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", groupID))
+	}
+	query := repo.scope(domain.Query{"groups": bson.ObjectIdHex(groupID)})
+	change := domain.Change{
+		Update: domain.Query{
+			"$pull": domain.Query{"groups": bson.ObjectIdHex(groupID)},
+			"$set":  domain.Query{"lastModifiedDate": time.Now()},
+		},
+	}
+	_, err := repo.DB.UpdateAll(UsersCollection, query, change)
+	return err
+}
+
+func (repo *UserRepository) updateGroups(id string, groupID string, operator string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	if !bson.IsObjectIdHex(groupID) {
+		return errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", groupID))
+	}
+	query := repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)})
+	change := domain.Change{
+		Update: domain.Query{
+			operator: domain.Query{"groups": bson.ObjectIdHex(groupID)},
+			"$set":   domain.Query{"lastModifiedDate": time.Now()},
+		},
+		ReturnNew: true,
+	}
+	var changedUser User
+	return repo.DB.Update(UsersCollection, query, change, &changedUser)
+}
+
 // DeleteUser deletes user specified by the id
 func (repo *UserRepository) DeleteUser(id string) error {
 
 	if !bson.IsObjectIdHex(id) {
 		return errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
 	}
+	if repo.OrganizationID != "" {
+		return repo.removeMembership(bson.ObjectIdHex(id))
+	}
 	err := repo.DB.RemoveOne(UsersCollection, domain.Query{"_id": bson.ObjectIdHex(id)})
 	return err
 }
+
+// removeMembership removes the user from the repository's organization,
+// deleting the user if it has no other membership. Admins are never removed.
+func (repo *UserRepository) removeMembership(id bson.ObjectId) error {
+	var user User
+	err := repo.DB.FindOne(UsersCollection, repo.scope(domain.Query{"_id": id}), &user)
+	if err != nil {
+		return err
+	}
+	if user.HasRole(RoleAdmin) {
+		return NewMessageError(CodeCannotRemoveAdmin)
+	}
+	// the conditions guard against changes since the user was read
+	q := repo.scope(domain.Query{
+		"_id":   id,
+		"roles": domain.Query{"$ne": RoleAdmin},
+	})
+	if len(user.Organizations) <= 1 {
+		q["organizations"] = domain.Query{"$size": 1}
+		return repo.DB.RemoveOne(UsersCollection, q)
+	}
+	q["organizations.1"] = domain.Query{"$exists": true}
+	var changedUser User
+	return repo.DB.Update(UsersCollection, q, repo.pullMembership(), &changedUser)
+}
+
+func outboxMessages(messages []IOutboxMessage) []OutboxMessage {
+	outbox := []OutboxMessage{}
+	for _, message := range messages {
+		outbox = append(outbox, *message.(*OutboxMessage))
+	}
+	return outbox
+}
+
+// findUsersPage finds users matching the query, ordered by the sort field then by _id,
+// after the cursor or, for a `before` cursor, before it.
+// The database sorts on a single field, so ties of a non-unique sort field are queried by _id:
+// first the remaining ties of the cursor's value, then the following values,
+// where the ties of the last value found are queried again by _id as they may be cut.
+// Ties of the other values, found in full, are ordered by _id in memory.
+func (repo *UserRepository) findUsersPage(q domain.Query, cursor string, limit int, sort string) (Users, error) {
+	sort = NormalizeUserSort(sort)
+	field := strings.TrimPrefix(sort, "-")
+	desc := strings.HasPrefix(sort, "-")
+
+	var c *UserCursor
+	if cursor != "" {
+		var err error
+		c, err = repo.resolveUserCursor(cursor, sort)
+		if err != nil {
+			return Users{}, err
+		}
+		if c.Before {
+			// paging before the cursor is paging after it in the reverse order
+			desc = !desc
+		}
+	}
+	cmp, idSort, fieldSort := "$gt", "_id", field
+	if desc {
+		cmp, idSort, fieldSort = "$lt", "-_id", "-"+field
+	}
+
+	users := Users{}
+	if field == "_id" {
+		page := q
+		if c != nil {
+			page = andQuery(q, domain.Query{"_id": domain.Query{cmp: bson.ObjectIdHex(c.ID)}})
+		}
+		err := repo.DB.FindAll(UsersCollection, page, &users, limit, idSort)
+		if err != nil {
+			return Users{}, err
+		}
+	} else {
+		if c != nil {
+			ties := andQuery(q, domain.Query{field: c.Value, "_id": domain.Query{cmp: bson.ObjectIdHex(c.ID)}})
+			err := repo.DB.FindAll(UsersCollection, ties, &users, limit, idSort)
+			if err != nil {
+				return Users{}, err
+			}
+		}
+		if len(users) < limit {
+			next := q
+			if c != nil {
+				next = andQuery(q, domain.Query{field: domain.Query{cmp: c.Value}})
+			}
+			rest := Users{}
+			err := repo.DB.FindAll(UsersCollection, next, &rest, limit-len(users), fieldSort)
+			if err != nil {
+				return Users{}, err
+			}
+			if len(rest) > 0 && !userSortFields[field] {
+				last := userSortValue(&rest[len(rest)-1], field)
+				for len(rest) > 0 && equalSortValues(userSortValue(&rest[len(rest)-1], field), last) {
+					rest = rest[:len(rest)-1]
+				}
+				ties := Users{}
+				err = repo.DB.FindAll(UsersCollection, andQuery(q, domain.Query{field: last}), &ties, limit-len(users)-len(rest), idSort)
+				if err != nil {
+					return Users{}, err
+				}
+				rest = append(rest, ties...)
+				// values before the last one are found in full, order their ties by _id
+				sortUsers(rest, field, desc)
+			}
+			users = append(users, rest...)
+		}
+	}
+	if c != nil && c.Before {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+	return users, nil
+}
+
+// resolveUserCursor decodes the cursor, which must match the sort.
+// The sort value of a legacy `last_id` cursor is looked up from its user.
+func (repo *UserRepository) resolveUserCursor(cursor string, sort string) (*UserCursor, error) {
+	c, err := DecodeUserCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if c.Sort == "" {
+		if strings.TrimPrefix(sort, "-") != "_id" {
+			var user User
+			err = repo.DB.FindOne(UsersCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(c.ID)}), &user)
+			if err != nil {
+				return nil, NewMessageError(CodeInvalidCursor)
+			}
+			return DecodeUserCursor(EncodeUserCursor(&user, sort, false))
+		}
+		c.Sort = sort
+	}
+	if c.Sort != sort {
+		return nil, NewMessageError(CodeInvalidCursor)
+	}
+	return c, nil
+}
+
+// andQuery combines both queries
+func andQuery(q domain.Query, condition domain.Query) domain.Query {
+	return domain.Query{"$and": []domain.Query{q, condition}}
+}
+
+// paginateByID adds the `lastID` cursor condition to the query and returns the allowed sort string
+func paginateByID(q domain.Query, lastID string, sort string) string {
+	// parse sort string
+	allowedSortMap := map[string]bool{
+		"_id":  true,
+		"-_id": true,
+	}
+	// ensure that sort string is allowed
+	// we are basically concerned about sorting on un-indexed keys
+	if !allowedSortMap[sort] {
+		sort = "-_id" // set it to default sort
+	}
+	if lastID != "" && bson.IsObjectIdHex(lastID) {
+		if sort == "_id" {
+			q["_id"] = domain.Query{
+				"$gt": bson.ObjectIdHex(lastID),
+			}
+		} else {
+			q["_id"] = domain.Query{
+				"$lt": bson.ObjectIdHex(lastID),
+			}
+		}
+	}
+	return sort
+}
+
+// searchCandidatesFactor is the number of candidates fetched per result, to be ranked by scoreUserSearch
+const searchCandidatesFactor = 5
+
+// SearchUsers Get users matching the search query, ranked by relevance.
+// Candidates are found with the text index, ordered by text score, and by username or email prefix;
+// fuzzy prefixes within one edit are only queried if there are too few candidates, as they can't use indexes.
+// Text matches only found in other fields (for eg: status) are dropped by the ranking.
+func (repo *UserRepository) SearchUsers(query string, limit int) (IUserSearchResults, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return &UserSearchResults{}, nil
+	}
+	limit = pageLimit(limit)
+	candidates := []*User{}
+	found := map[string]bool{}
+	add := func(q domain.Query, sort string) error {
+		users := Users{}
+		err := repo.DB.FindAll(UsersCollection, repo.scope(q), &users, limit*searchCandidatesFactor, sort)
+		for i := range users {
+			if id := users[i].ID.Hex(); !found[id] {
+				found[id] = true
+				candidates = append(candidates, &users[i])
+			}
+		}
+		return err
+	}
+
+	// rank text matches by their order of text score
+	err := add(domain.Query{"$text": domain.Query{"$search": strings.Join(terms, " ")}}, "$textScore:score")
+	if err != nil {
+		return &UserSearchResults{}, err
+	}
+	bonus := map[string]float64{}
+	for i, user := range candidates {
+		bonus[user.ID.Hex()] = 1 / float64(i+1)
+	}
+
+	prefixes := []domain.Query{}
+	for _, term := range terms {
+		pattern := "^" + regexp.QuoteMeta(term)
+		prefixes = append(prefixes,
+			domain.Query{"username": domain.Query{"$regex": pattern, "$options": "i"}},
+			domain.Query{"email": domain.Query{"$regex": pattern, "$options": "i"}},
+		)
+	}
+	err = add(domain.Query{"$or": prefixes}, "")
+	if err != nil {
+		return &UserSearchResults{}, err
+	}
+
+	results := rankUserSearch(candidates, terms, bonus, limit)
+	if len(results) < limit {
+		fuzzy := []domain.Query{}
+		for _, term := range terms {
+			if maxSearchEdits(len([]rune(term))) == 0 {
+				continue
+			}
+			pattern := fuzzySearchPattern(term)
+			fuzzy = append(fuzzy,
+				domain.Query{"username": domain.Query{"$regex": pattern, "$options": "i"}},
+				domain.Query{"email": domain.Query{"$regex": pattern, "$options": "i"}},
+			)
+		}
+		if len(fuzzy) > 0 {
+			err = add(domain.Query{"$or": fuzzy}, "")
+			if err != nil {
+				return &UserSearchResults{}, err
+			}
+			results = rankUserSearch(candidates, terms, bonus, limit)
+		}
+	}
+	return &results, nil
+}
+
+// fuzzySearchPattern returns a regex of the values starting within one edit of the term, see prefixEditDistance
+func fuzzySearchPattern(term string) string {
+	runes := []rune(term)
+	variants := []string{}
+	for i := range runes {
+		before, after := regexp.QuoteMeta(string(runes[:i])), regexp.QuoteMeta(string(runes[i+1:]))
+		current := regexp.QuoteMeta(string(runes[i : i+1]))
+		variants = append(variants,
+			before+"."+after,         // substitution
+			before+after,             // deletion
+			before+"."+current+after, // insertion
+		)
+		if i+1 < len(runes) {
+			// transposition
+			variants = append(variants, before+regexp.QuoteMeta(string(runes[i+1]))+current+regexp.QuoteMeta(string(runes[i+2:])))
+		}
+	}
+	return "^(?:" + strings.Join(variants, "|") + ")"
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/sogko/slumber/domain"
 	"net/http"
+	"time"
 )
 
 type PostCreateUserHookPayload struct {
@@ -15,17 +16,182 @@ type PostConfirmUserHookPayload struct {
 	User domain.IUser
 }
 
+// PreCreateUserHookPayload holds the user about to be created, which the hook may modify
+type PreCreateUserHookPayload struct {
+	Input NewUser
+	User  *User
+	Actor domain.IUser
+}
+
+// PreConfirmUserHookPayload holds the fields about to be set on the confirmed user, which the hook may modify
+type PreConfirmUserHookPayload struct {
+	User   *User
+	Code   string
+	Update *User
+	Actor  domain.IUser
+}
+
+// PreUpdateUserHookPayload holds the fields about to be updated, which the hook may modify
+type PreUpdateUserHookPayload struct {
+	ID       string
+	Previous *User
+	Update   *User
+	Actor    domain.IUser
+}
+
+type PreDeleteUserHookPayload struct {
+	User  *User
+	Actor domain.IUser
+}
+
+// PreUpdateUsersHookPayload holds the bulk action about to be applied, which the hook may modify
+type PreUpdateUsersHookPayload struct {
+	Action string
+	IDs    []string
+	Actor  domain.IUser
+}
+
+type PreDeleteAllUsersHookPayload struct {
+	Actor domain.IUser
+}
+
+// HookRejection is returned by a pre-operation hook to reject the request
+// with the given status code and message.
+// If Code is set, the message of the code in the Options.Messages catalog is rendered instead.
+type HookRejection struct {
+	Status  int
+	Message string
+	Code    string
+}
+
+func (rejection *HookRejection) Error() string {
+	return rejection.Message
+}
+
+// RejectRequest returns a HookRejection
+func RejectRequest(status int, message string) error {
+	return &HookRejection{Status: status, Message: message}
+}
+
+// ControllerHooks:
+// Pre-operation hooks run before the operation, after the request is parsed.
+// They may modify their payload, or return an error to reject the request (see HookRejection).
+// Post-operation hooks are adapted onto the event bus as synchronous subscribers,
+// see Options.EventBus for subscribing to all user lifecycle events.
 type ControllerHooks struct {
+	PreCreateUserHook     func(resource *Resource, req *http.Request, payload *PreCreateUserHookPayload) error
+	PreConfirmUserHook    func(resource *Resource, req *http.Request, payload *PreConfirmUserHookPayload) error
+	PreUpdateUserHook     func(resource *Resource, req *http.Request, payload *PreUpdateUserHookPayload) error
+	PreDeleteUserHook     func(resource *Resource, req *http.Request, payload *PreDeleteUserHookPayload) error
+	PreUpdateUsersHook    func(resource *Resource, req *http.Request, payload *PreUpdateUsersHookPayload) error
+	PreDeleteAllUsersHook func(resource *Resource, req *http.Request, payload *PreDeleteAllUsersHookPayload) error
+
+	// post-operation hooks get no ResponseWriter and Request if Options.Outbox is set
 	PostCreateUserHook  func(resource *Resource, w http.ResponseWriter, req *http.Request, payload *PostCreateUserHookPayload) error
 	PostConfirmUserHook func(resource *Resource, w http.ResponseWriter, req *http.Request, payload *PostConfirmUserHookPayload) error
 }
 
 type Options struct {
-	BasePath              string
-	Database              domain.IDatabase
-	Renderer              domain.IRenderer
-	UserRepositoryFactory IUserRepositoryFactory
-	ControllerHooks       *ControllerHooks
+	BasePath               string
+	GroupsBasePath         string
+	WebhooksBasePath       string
+	Database               domain.IDatabase
+	Renderer               domain.IRenderer
+	UserRepositoryFactory  IUserRepositoryFactory
+	GroupRepositoryFactory IGroupRepositoryFactory
+	ControllerHooks        *ControllerHooks
+	ACLPolicy              ACLPolicy
+
+	// ACLDebug adds the evaluated rule to ACL denial messages
+	ACLDebug bool
+	// ACLRenderDenials evaluates ACL rules within the route handlers instead of the ACL middleware,
+	// so that denials are rendered with 401/403 status codes and a structured ACLDeniedResponse_v0
+	ACLRenderDenials bool
+
+	// OrganizationResolver scopes requests to an organization (tenant).
+	// If nil, users are kept in a single global namespace.
+	// Requests of authenticated users are only scoped for members of the organization and global admins,
+	// anonymous requests are scoped too, see Resource.Organization.
+	OrganizationResolver IOrganizationResolver
+
+	// ImpersonationSecret signs impersonation tokens; impersonation is disabled if empty
+	ImpersonationSecret []byte
+	// ImpersonationTTL defaults to 15 minutes
+	ImpersonationTTL time.Duration
+	// ImpersonationHeader defaults to `X-Impersonation-Token`
+	ImpersonationHeader            string
+	ImpersonationRepositoryFactory IImpersonationRepositoryFactory
+	AuditRepositoryFactory         IAuditRepositoryFactory
+
+	// EventBus delivers user lifecycle events, defaults to an in-process EventBus
+	EventBus IEventBus
+
+	// Webhooks enables the delivery of events to registered webhooks if not nil
+	Webhooks                 *WebhookOptions
+	WebhookRepositoryFactory IWebhookRepositoryFactory
+
+	// Outbox enables the transactional outbox if not nil:
+	// events are written with the user changes and delivered to the event bus by a background OutboxDispatcher,
+	// including to the post-operation ControllerHooks, which then get no Request and ResponseWriter.
+	// The UserRepositoryFactory must return repositories implementing IOutboxUserRepository.
+	Outbox                  *OutboxOptions
+	OutboxRepositoryFactory IOutboxRepositoryFactory
+
+	// Messages override DefaultMessageCatalog per language and message code
+	Messages MessageCatalog
+	// DefaultLanguage of responses if none of the languages of the Accept-Language header are available,
+	// defaults to `en`
+	DefaultLanguage string
+
+	// Mail enables notification emails if not nil, see MailNotifier.
+	// Emails are sent asynchronously, or retried by the OutboxDispatcher if the outbox is enabled.
+	Mail *MailOptions
+
+	// MigrationRepositoryFactory stores the applied migrations and the migration lock, see Resource.Migrator
+	MigrationRepositoryFactory IMigrationRepositoryFactory
+
+	// SkipEnsureSchema skips ensuring the indexes of the repositories in NewResource,
+	// for applications calling Resource.EnsureSchema themselves
+	SkipEnsureSchema bool
+
+	// StrictSchema makes NewResource panic if Resource.EnsureSchema fails, including on index drift,
+	// instead of logging the error
+	StrictSchema bool
+
+	// UserCache enables caching user lookups if not nil, see CachingUserRepository.
+	// NewContext of an IContextUserRepositoryFactory is not used then, see CachingUserRepositoryFactory.
+	UserCache *UserCacheOptions
+
+	// SearchIndex is when the in-process index searching repositories that don't implement IUserSearcher is built,
+	// defaults to SearchIndexLazy
+	SearchIndex SearchIndexMode
+
+	// AvatarURL returns the avatar of users suggested by the SuggestUsers route, if any
+	AvatarURL func(user *User) string
+	// SuggestCacheTTL is the time suggestions of a prefix are cached, defaults to DefaultSuggestCacheTTL.
+	// Caching is disabled if negative.
+	SuggestCacheTTL time.Duration
+
+	// MaxPerPage caps the `per_page` of list endpoints, defaults to DefaultMaxPerPage
+	MaxPerPage int
+
+	// RepositoryTimeouts bound the user repository operations of requests, see Resource.ContextUserRepository
+	RepositoryTimeouts *RepositoryTimeouts
+
+	// Metrics enables the instrumentation of the resource if not nil, exposed by Resource.Metrics
+	Metrics *MetricsOptions
+
+	// Logger receives the structured log events of the resource, e.g. a *slog.Logger,
+	// defaults to a StdLogger writing to the standard log package
+	Logger ILogger
+	// LogLevel is the minimum level of logged events, defaults to LogLevelInfo
+	LogLevel LogLevel
+	// RequestIDHeader holds the request ID logged with the events of a request, and is set on responses.
+	// Defaults to `X-Request-Id`; requests without a valid ID are given a generated one.
+	RequestIDHeader string
+
+	// Tracing enables tracing if not nil, see Tracer
+	Tracing *TracingOptions
 }
 
 func NewResource(ctx domain.IContext, options *Options) *Resource {
@@ -45,30 +211,212 @@ func NewResource(ctx domain.IContext, options *Options) *Resource {
 		userRepositoryFactory = NewUserRepositoryFactory()
 	}
 
+	groupRepositoryFactory := options.GroupRepositoryFactory
+	if groupRepositoryFactory == nil {
+		// init default GroupRepositoryFactory
+		groupRepositoryFactory = NewGroupRepositoryFactory()
+	}
+
+	impersonationRepositoryFactory := options.ImpersonationRepositoryFactory
+	if impersonationRepositoryFactory == nil {
+		// init default ImpersonationRepositoryFactory
+		impersonationRepositoryFactory = NewImpersonationRepositoryFactory()
+	}
+
+	auditRepositoryFactory := options.AuditRepositoryFactory
+	if auditRepositoryFactory == nil {
+		// init default AuditRepositoryFactory
+		auditRepositoryFactory = NewAuditRepositoryFactory()
+	}
+
 	controllerHooks := options.ControllerHooks
 	if controllerHooks == nil {
-		controllerHooks = &ControllerHooks{nil, nil}
+		controllerHooks = &ControllerHooks{}
 	}
 
-	u := &Resource{ctx, options, nil,
-		database,
-		renderer,
-		userRepositoryFactory,
-		controllerHooks,
+	webhookRepositoryFactory := options.WebhookRepositoryFactory
+	if webhookRepositoryFactory == nil {
+		// init default WebhookRepositoryFactory
+		webhookRepositoryFactory = NewWebhookRepositoryFactory()
 	}
-	u.generateRoutes(options.BasePath)
+
+	outboxRepositoryFactory := options.OutboxRepositoryFactory
+	if outboxRepositoryFactory == nil {
+		// init default OutboxRepositoryFactory
+		outboxRepositoryFactory = NewOutboxRepositoryFactory()
+	}
+
+	migrationRepositoryFactory := options.MigrationRepositoryFactory
+	if migrationRepositoryFactory == nil {
+		// init default MigrationRepositoryFactory
+		migrationRepositoryFactory = NewMigrationRepositoryFactory()
+	}
+	if options.Outbox != nil {
+		if _, ok := userRepositoryFactory.New(database).(IOutboxUserRepository); !ok {
+			panic("users.Options.UserRepositoryFactory must return an IOutboxUserRepository if Outbox is set")
+		}
+		if factory, ok := userRepositoryFactory.(IContextUserRepositoryFactory); ok {
+			if _, ok := factory.NewContext(database, "").(IContextOutboxUserRepository); !ok {
+				panic("users.Options.UserRepositoryFactory must return an IContextOutboxUserRepository from NewContext if Outbox is set")
+			}
+		}
+	}
+	err := options.RepositoryTimeouts.validate()
+	if err != nil {
+		panic("users.Options.RepositoryTimeouts is invalid: " + err.Error())
+	}
+
+	eventBus := options.EventBus
+	if eventBus == nil {
+		eventBus = NewEventBus()
+	}
+	subscribeControllerHooks(eventBus, controllerHooks)
+
+	// compile ACL rules; policy in options override the default policy per route name
+	aclRules, err := compileACLPolicy(options.ACLPolicy)
+	if err != nil {
+		panic("users.Options.ACLPolicy is invalid: " + err.Error())
+	}
+
+	messages := compileMessageCatalog(options.Messages)
+	defaultLanguage := normalizeLanguage(options.DefaultLanguage)
+	if defaultLanguage == "" {
+		defaultLanguage = "en"
+	}
+	if messages[defaultLanguage] == nil {
+		panic("users.Options.Messages has no messages for the default language: " + defaultLanguage)
+	}
+
+	organizationResolver := options.OrganizationResolver
+	if organizationResolver != nil {
+		if _, ok := userRepositoryFactory.(IOrganizationUserRepositoryFactory); !ok {
+			panic("users.Options.UserRepositoryFactory must implement IOrganizationUserRepositoryFactory if OrganizationResolver is set")
+		}
+	}
+
+	// decorate the user repositories once their optional interfaces are checked
+	var userCache *CachingUserRepositoryFactory
+	if options.UserCache != nil {
+		userCache = NewCachingUserRepositoryFactory(userRepositoryFactory, options.UserCache)
+		userRepositoryFactory = userCache
+	}
+
+	requestIDHeader := options.RequestIDHeader
+	if requestIDHeader == "" {
+		requestIDHeader = defaultRequestIDHeader
+	}
+
+	u := &Resource{
+		ctx:                            ctx,
+		requestIDHeader:                requestIDHeader,
+		Logger:                         NewLogger(options.Logger, options.LogLevel),
+		options:                        options,
+		aclRules:                       aclRules,
+		messages:                       messages,
+		defaultLanguage:                defaultLanguage,
+		Database:                       database,
+		Renderer:                       renderer,
+		UserRepositoryFactory:          userRepositoryFactory,
+		GroupRepositoryFactory:         groupRepositoryFactory,
+		ImpersonationRepositoryFactory: impersonationRepositoryFactory,
+		AuditRepositoryFactory:         auditRepositoryFactory,
+		ControllerHooks:                controllerHooks,
+		EventBus:                       eventBus,
+		WebhookRepositoryFactory:       webhookRepositoryFactory,
+		OutboxRepositoryFactory:        outboxRepositoryFactory,
+		MigrationRepositoryFactory:     migrationRepositoryFactory,
+		OrganizationResolver:           organizationResolver,
+		UserCache:                      userCache,
+	}
+	if options.Tracing != nil {
+		if options.Tracing.Exporter == nil {
+			panic("users.Options.Tracing.Exporter is required")
+		}
+		u.Tracer = NewTracer(options.Tracing.Exporter)
+	}
+	if options.Metrics != nil {
+		u.Metrics = NewMetrics(options.Metrics)
+		eventBus.Subscribe(u.Metrics.HandleEvent, DeliverSync, EventUserCreated, EventUserConfirmed, EventUserDeleted, EventStatusChanged)
+	}
+	if options.Mail != nil {
+		u.MailNotifier, err = NewMailNotifier(u, options.Mail)
+		if err != nil {
+			panic("users.Options.Mail is invalid: " + err.Error())
+		}
+		mode := DeliverAsync
+		if options.Outbox != nil {
+			mode = DeliverSync
+		}
+		eventBus.Subscribe(u.MailNotifier.HandleEvent, mode, EventUserCreated, EventUserUpdated, EventStatusChanged)
+	}
+	u.WebhookDispatcher = NewWebhookDispatcher(u, options.Webhooks)
+	if options.Webhooks != nil {
+		eventBus.Subscribe(u.WebhookDispatcher.HandleEvent, DeliverAsync)
+	}
+	suggestCacheTTL := options.SuggestCacheTTL
+	if suggestCacheTTL == 0 {
+		suggestCacheTTL = DefaultSuggestCacheTTL
+	}
+	if suggestCacheTTL > 0 {
+		u.suggestCache = newSuggestCache(suggestCacheTTL)
+		eventBus.Subscribe(u.suggestCache.HandleEvent, DeliverSync, EventUserCreated, EventUserConfirmed, EventUserUpdated, EventUserDeleted, EventUsersDeleted, EventAllUsersDeleted, EventStatusChanged)
+	}
+	if !options.SkipEnsureSchema {
+		// the resource can serve without its indexes, if slowly, or with duplicate usernames and emails
+		_, err = u.EnsureSchema()
+		if err != nil && options.StrictSchema {
+			panic("users: ensure schema failed: " + err.Error())
+		}
+		if err != nil {
+			u.Logger.Error("users: ensure schema failed", "error", err.Error())
+		}
+	}
+	if _, ok := unwrapUserRepository(userRepositoryFactory.New(database)).(IUserSearcher); !ok && options.SearchIndex != SearchIndexDisabled {
+		// search the users of the repository in-process
+		u.SearchIndex = NewUserSearchIndex()
+		eventBus.Subscribe(u.SearchIndex.HandleEvent, DeliverSync, EventUserCreated, EventUserConfirmed, EventUserUpdated, EventUserDeleted, EventAllUsersDeleted)
+		if options.SearchIndex == SearchIndexBackground {
+			go u.buildSearchIndex()
+		}
+	}
+	if options.Outbox != nil {
+		u.OutboxDispatcher = NewOutboxDispatcher(u, options.Outbox)
+		u.OutboxDispatcher.Start()
+	}
+	u.generateRoutes(options.BasePath, options.GroupsBasePath, options.WebhooksBasePath)
 	return u
 }
 
 // UsersResource implements IResource
 type Resource struct {
-	ctx                   domain.IContext
-	options               *Options
-	routes                *domain.Routes
-	Database              domain.IDatabase
-	Renderer              domain.IRenderer
-	UserRepositoryFactory IUserRepositoryFactory
-	ControllerHooks       *ControllerHooks
+	ctx                            domain.IContext
+	options                        *Options
+	routes                         *domain.Routes
+	aclRules                       map[string]*compiledACLRule
+	messages                       MessageCatalog
+	defaultLanguage                string
+	suggestCache                   *suggestCache
+	requestIDHeader                string
+	Logger                         *Logger
+	Database                       domain.IDatabase
+	Renderer                       domain.IRenderer
+	UserRepositoryFactory          IUserRepositoryFactory
+	GroupRepositoryFactory         IGroupRepositoryFactory
+	ImpersonationRepositoryFactory IImpersonationRepositoryFactory
+	AuditRepositoryFactory         IAuditRepositoryFactory
+	ControllerHooks                *ControllerHooks
+	EventBus                       IEventBus
+	WebhookRepositoryFactory       IWebhookRepositoryFactory
+	WebhookDispatcher              *WebhookDispatcher
+	OutboxRepositoryFactory        IOutboxRepositoryFactory
+	MigrationRepositoryFactory     IMigrationRepositoryFactory
+	OutboxDispatcher               *OutboxDispatcher
+	MailNotifier                   *MailNotifier
+	SearchIndex                    *UserSearchIndex
+	UserCache                      *CachingUserRepositoryFactory
+	Metrics                        *Metrics
+	Tracer                         *Tracer
+	OrganizationResolver           IOrganizationResolver
 }
 
 func (resource *Resource) Context() domain.IContext {
@@ -83,6 +431,45 @@ func (resource *Resource) Render(w http.ResponseWriter, req *http.Request, statu
 	resource.Renderer.Render(w, req, status, v)
 }
 
+// CurrentUser returns the authenticated user for the request, or nil
+func (resource *Resource) CurrentUser(req *http.Request) domain.IUser {
+	return resource.ctx.GetCurrentUserCtx(req)
+}
+
+// UserRepository returns a repository scoped to the request's organization, if any
 func (resource *Resource) UserRepository(req *http.Request) IUserRepository {
+	org := resource.repositoryOrganization(req)
+	if org != "" {
+		factory := resource.UserRepositoryFactory.(IOrganizationUserRepositoryFactory)
+		return factory.NewForOrganization(resource.Database, org)
+	}
 	return resource.UserRepositoryFactory.New(resource.Database)
 }
+
+// GroupRepository returns a repository scoped to the request's organization, if any
+func (resource *Resource) GroupRepository(req *http.Request) IGroupRepository {
+	org := resource.repositoryOrganization(req)
+	return resource.GroupRepositoryFactory.New(resource.Database, org)
+}
+
+func (resource *Resource) ImpersonationRepository(req *http.Request) IImpersonationRepository {
+	return resource.ImpersonationRepositoryFactory.New(resource.Database)
+}
+
+// AuditRepository returns a repository scoped to the request's organization, if any
+func (resource *Resource) AuditRepository(req *http.Request) IAuditRepository {
+	org := resource.repositoryOrganization(req)
+	return resource.AuditRepositoryFactory.New(resource.Database, org)
+}
+
+// WebhookRepository returns a repository scoped to the request's organization, if any
+func (resource *Resource) WebhookRepository(req *http.Request) IWebhookRepository {
+	org := resource.repositoryOrganization(req)
+	return resource.WebhookRepositoryFactory.New(resource.Database, org)
+}
+
+// OutboxRepository returns a repository scoped to the request's organization, if any
+func (resource *Resource) OutboxRepository(req *http.Request) IOutboxRepository {
+	org := resource.repositoryOrganization(req)
+	return resource.OutboxRepositoryFactory.New(resource.Database, org)
+}
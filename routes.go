@@ -2,12 +2,15 @@ package users
 
 import (
 	"github.com/sogko/slumber/domain"
+	"net/http"
 	"strings"
 )
 
 const (
 	ListUsers      = "ListUsers"
 	CountUsers     = "CountUsers"
+	SearchUsers    = "SearchUsers"
+	SuggestUsers   = "SuggestUsers"
 	GetUser        = "GetUser"
 	CreateUser     = "CreateUser"
 	UpdateUsers    = "UpdateUsers"
@@ -15,13 +18,53 @@ const (
 	ConfirmUser    = "ConfirmUser"
 	UpdateUser     = "UpdateUser"
 	DeleteUser     = "DeleteUser"
+	ListUserGroups = "ListUserGroups"
+
+	StartImpersonation = "StartImpersonation"
+	StopImpersonation  = "StopImpersonation"
+
+	ListAudit     = "ListAudit"
+	ListUserAudit = "ListUserAudit"
+
+	ListOutbox         = "ListOutbox"
+	RetryOutboxMessage = "RetryOutboxMessage"
+
+	ListGroups        = "ListGroups"
+	CreateGroup       = "CreateGroup"
+	GetGroup          = "GetGroup"
+	UpdateGroup       = "UpdateGroup"
+	DeleteGroup       = "DeleteGroup"
+	ListGroupMembers  = "ListGroupMembers"
+	AddGroupMember    = "AddGroupMember"
+	RemoveGroupMember = "RemoveGroupMember"
+
+	ListWebhooks          = "ListWebhooks"
+	CreateWebhook         = "CreateWebhook"
+	GetWebhook            = "GetWebhook"
+	UpdateWebhook         = "UpdateWebhook"
+	DeleteWebhook         = "DeleteWebhook"
+	ListWebhookDeliveries = "ListWebhookDeliveries"
+	ReplayWebhookDelivery = "ReplayWebhookDelivery"
 )
 const defaultBasePath = "/api/users"
+const defaultGroupsBasePath = "/api/groups"
+const defaultWebhooksBasePath = "/api/webhooks"
 
-func (resource *Resource) generateRoutes(basePath string) *domain.Routes {
+func (resource *Resource) generateRoutes(basePath string, groupsBasePath string, webhooksBasePath string) *domain.Routes {
 	if basePath == "" {
 		basePath = defaultBasePath
 	}
+	if groupsBasePath == "" {
+		groupsBasePath = defaultGroupsBasePath
+	}
+	if webhooksBasePath == "" {
+		webhooksBasePath = defaultWebhooksBasePath
+	}
+	basePaths := map[string]string{
+		defaultBasePath:         basePath,
+		defaultGroupsBasePath:   groupsBasePath,
+		defaultWebhooksBasePath: webhooksBasePath,
+	}
 	var baseRoutes = domain.Routes{
 		domain.Route{
 			Name:           ListUsers,
@@ -43,6 +86,56 @@ func (resource *Resource) generateRoutes(basePath string) *domain.Routes {
 			},
 			ACLHandler: resource.HandleCountUsersACL,
 		},
+		domain.Route{
+			Name:           SearchUsers,
+			Method:         "GET",
+			Pattern:        "/api/users/search",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleSearchUsers_v0,
+			},
+			ACLHandler: resource.HandleSearchUsersACL,
+		},
+		domain.Route{
+			Name:           SuggestUsers,
+			Method:         "GET",
+			Pattern:        "/api/users/suggest",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleSuggestUsers_v0,
+			},
+			ACLHandler: resource.HandleSuggestUsersACL,
+		},
+		domain.Route{
+			Name:           ListAudit,
+			Method:         "GET",
+			Pattern:        "/api/users/audit",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListAudit_v0,
+			},
+			ACLHandler: resource.HandleListAuditACL,
+		},
+		domain.Route{
+			Name:           ListOutbox,
+			Method:         "GET",
+			Pattern:        "/api/users/outbox",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListOutbox_v0,
+			},
+			ACLHandler: resource.HandleListOutboxACL,
+		},
+		domain.Route{
+			Name:           RetryOutboxMessage,
+			Method:         "POST",
+			Pattern:        "/api/users/outbox/{id}/retry",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleRetryOutboxMessage_v0,
+			},
+			ACLHandler: resource.HandleRetryOutboxMessageACL,
+		},
 		domain.Route{
 			Name:           CreateUser,
 			Method:         "POST",
@@ -118,6 +211,196 @@ func (resource *Resource) generateRoutes(basePath string) *domain.Routes {
 			},
 			ACLHandler: resource.HandleDeleteUserACL,
 		},
+		domain.Route{
+			Name:           ListUserGroups,
+			Method:         "GET",
+			Pattern:        "/api/users/{id}/groups",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListUserGroups_v0,
+			},
+			ACLHandler: resource.HandleListUserGroupsACL,
+		},
+		domain.Route{
+			Name:           ListUserAudit,
+			Method:         "GET",
+			Pattern:        "/api/users/{id}/audit",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListUserAudit_v0,
+			},
+			ACLHandler: resource.HandleListUserAuditACL,
+		},
+		domain.Route{
+			Name:           StartImpersonation,
+			Method:         "POST",
+			Pattern:        "/api/users/{id}/impersonate",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleStartImpersonation_v0,
+			},
+			ACLHandler: resource.HandleStartImpersonationACL,
+		},
+		domain.Route{
+			Name:           StopImpersonation,
+			Method:         "DELETE",
+			Pattern:        "/api/users/{id}/impersonate",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleStopImpersonation_v0,
+			},
+			ACLHandler: resource.HandleStopImpersonationACL,
+		},
+		domain.Route{
+			Name:           ListGroups,
+			Method:         "GET",
+			Pattern:        "/api/groups",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListGroups_v0,
+			},
+			ACLHandler: resource.HandleListGroupsACL,
+		},
+		domain.Route{
+			Name:           CreateGroup,
+			Method:         "POST",
+			Pattern:        "/api/groups",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleCreateGroup_v0,
+			},
+			ACLHandler: resource.HandleCreateGroupACL,
+		},
+		domain.Route{
+			Name:           GetGroup,
+			Method:         "GET",
+			Pattern:        "/api/groups/{id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleGetGroup_v0,
+			},
+			ACLHandler: resource.HandleGetGroupACL,
+		},
+		domain.Route{
+			Name:           UpdateGroup,
+			Method:         "PUT",
+			Pattern:        "/api/groups/{id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleUpdateGroup_v0,
+			},
+			ACLHandler: resource.HandleUpdateGroupACL,
+		},
+		domain.Route{
+			Name:           DeleteGroup,
+			Method:         "DELETE",
+			Pattern:        "/api/groups/{id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleDeleteGroup_v0,
+			},
+			ACLHandler: resource.HandleDeleteGroupACL,
+		},
+		domain.Route{
+			Name:           ListGroupMembers,
+			Method:         "GET",
+			Pattern:        "/api/groups/{id}/members",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListGroupMembers_v0,
+			},
+			ACLHandler: resource.HandleListGroupMembersACL,
+		},
+		domain.Route{
+			Name:           AddGroupMember,
+			Method:         "PUT",
+			Pattern:        "/api/groups/{id}/members/{user_id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleAddGroupMember_v0,
+			},
+			ACLHandler: resource.HandleAddGroupMemberACL,
+		},
+		domain.Route{
+			Name:           RemoveGroupMember,
+			Method:         "DELETE",
+			Pattern:        "/api/groups/{id}/members/{user_id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleRemoveGroupMember_v0,
+			},
+			ACLHandler: resource.HandleRemoveGroupMemberACL,
+		},
+		domain.Route{
+			Name:           ListWebhooks,
+			Method:         "GET",
+			Pattern:        "/api/webhooks",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListWebhooks_v0,
+			},
+			ACLHandler: resource.HandleListWebhooksACL,
+		},
+		domain.Route{
+			Name:           CreateWebhook,
+			Method:         "POST",
+			Pattern:        "/api/webhooks",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleCreateWebhook_v0,
+			},
+			ACLHandler: resource.HandleCreateWebhookACL,
+		},
+		domain.Route{
+			Name:           GetWebhook,
+			Method:         "GET",
+			Pattern:        "/api/webhooks/{id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleGetWebhook_v0,
+			},
+			ACLHandler: resource.HandleGetWebhookACL,
+		},
+		domain.Route{
+			Name:           UpdateWebhook,
+			Method:         "PUT",
+			Pattern:        "/api/webhooks/{id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleUpdateWebhook_v0,
+			},
+			ACLHandler: resource.HandleUpdateWebhookACL,
+		},
+		domain.Route{
+			Name:           DeleteWebhook,
+			Method:         "DELETE",
+			Pattern:        "/api/webhooks/{id}",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleDeleteWebhook_v0,
+			},
+			ACLHandler: resource.HandleDeleteWebhookACL,
+		},
+		domain.Route{
+			Name:           ListWebhookDeliveries,
+			Method:         "GET",
+			Pattern:        "/api/webhooks/{id}/deliveries",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleListWebhookDeliveries_v0,
+			},
+			ACLHandler: resource.HandleListWebhookDeliveriesACL,
+		},
+		domain.Route{
+			Name:           ReplayWebhookDelivery,
+			Method:         "POST",
+			Pattern:        "/api/webhooks/{id}/deliveries/{delivery_id}/replay",
+			DefaultVersion: "0.0",
+			RouteHandlers: domain.RouteHandlers{
+				"0.0": resource.HandleReplayWebhookDelivery_v0,
+			},
+			ACLHandler: resource.HandleReplayWebhookDeliveryACL,
+		},
 	}
 
 	routes := domain.Routes{}
@@ -126,13 +409,59 @@ func (resource *Resource) generateRoutes(basePath string) *domain.Routes {
 		r := domain.Route{
 			Name:           route.Name,
 			Method:         route.Method,
-			Pattern:        strings.Replace(route.Pattern, defaultBasePath, basePath, -1),
+			Pattern:        resolvePattern(route.Pattern, basePaths),
 			DefaultVersion: route.DefaultVersion,
 			RouteHandlers:  route.RouteHandlers,
 			ACLHandler:     route.ACLHandler,
 		}
+		if resource.options.ACLRenderDenials {
+			// let the ACL middleware through and enforce the rule in the route handlers
+			r.RouteHandlers = resource.wrapACLRouteHandlers(route.Name, r.RouteHandlers)
+			r.ACLHandler = allowAllACL
+		}
+		if resource.OrganizationResolver != nil {
+			r.RouteHandlers = resource.wrapOrganizationRouteHandlers(r.RouteHandlers)
+		}
+		if resource.Metrics != nil {
+			r.RouteHandlers = resource.wrapMetricsRouteHandlers(route.Name, route.Method, r.RouteHandlers)
+		}
+		r.RouteHandlers = resource.wrapLoggingRouteHandlers(route.Name, r.RouteHandlers)
+		if resource.Tracer != nil {
+			r.RouteHandlers = resource.wrapTracingRouteHandlers(route.Name, route.Method, r.RouteHandlers)
+		}
 		routes = routes.Append(&domain.Routes{r})
 	}
 	resource.routes = &routes
 	return resource.routes
 }
+
+// resolvePattern replaces the default base paths of a route pattern with the configured ones
+func resolvePattern(pattern string, basePaths map[string]string) string {
+	for defaultPath, path := range basePaths {
+		if pattern == defaultPath || strings.HasPrefix(pattern, defaultPath+"/") {
+			return path + strings.TrimPrefix(pattern, defaultPath)
+		}
+	}
+	return pattern
+}
+
+func allowAllACL(req *http.Request, user domain.IUser) (bool, string) {
+	return true, ""
+}
+
+// wrapACLRouteHandlers returns route handlers that render a structured response for denied requests
+func (resource *Resource) wrapACLRouteHandlers(name string, handlers domain.RouteHandlers) domain.RouteHandlers {
+	wrapped := domain.RouteHandlers{}
+	for version, handler := range handlers {
+		next := handler
+		wrapped[version] = func(w http.ResponseWriter, req *http.Request) {
+			decision := resource.Authorize(name, req, resource.CurrentUser(req))
+			if !decision.Allowed {
+				resource.RenderACLDenied(w, req, decision)
+				return
+			}
+			next(w, req)
+		}
+	}
+	return wrapped
+}
@@ -0,0 +1,162 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2"
+	"sort"
+	"strings"
+)
+
+// UserIndexes are the indexes of the users collection, ensured by Resource.EnsureSchema.
+// Compound indexes with _id back the sort orders of user lists (see userSortFields)
+// and serve queries on their first field.
+var UserIndexes = []mgo.Index{
+	{Key: []string{"username"}, Unique: true, Background: true},
+	{Key: []string{"email"}, Unique: true, Background: true},
+	{Key: []string{"status", "_id"}, Background: true},
+	{Key: []string{"createdDate", "_id"}, Background: true},
+	{Key: []string{"lastModifiedDate", "_id"}, Background: true},
+	{Key: []string{"organizations.organizationId"}, Background: true},
+	{Key: []string{"groups"}, Background: true},
+	{
+		Key: []string{
+			"$text:username",
+			"$text:email",
+		},
+		Background: true,
+		Sparse:     true,
+	},
+}
+
+// ObsoleteUserIndexes are the indexes of the users collection declared by previous releases.
+// They are reported as IndexObsolete drift and must be dropped by hand: a collection has a single text index,
+// so the text index of UserIndexes fails to be ensured until the previous one, which included `status`, is dropped.
+var ObsoleteUserIndexes = []mgo.Index{
+	{
+		Key: []string{
+			"$text:username",
+			"$text:email",
+			"$text:status",
+		},
+		Background: true,
+		Sparse:     true,
+	},
+}
+
+// EnsureSchema ensures the indexes of the users collection
+func (repo *UserRepository) EnsureSchema() (*SchemaReport, error) {
+	return ensureIndexes(repo.DB, UsersCollection, UserIndexes, ObsoleteUserIndexes)
+}
+
+// EnsureSchema ensures the indexes declared by the user repository, if it implements ISchemaRepository,
+// and logs drift between the declared and actual indexes.
+// It returns an error if indexes failed to be ensured, or are missing, changed or obsolete;
+// unexpected indexes, for eg: created by hand, are only logged.
+// It is run by NewResource unless Options.SkipEnsureSchema is set.
+func (resource *Resource) EnsureSchema() (*SchemaReport, error) {
+	repo, ok := unwrapUserRepository(resource.UserRepositoryFactory.New(resource.Database)).(ISchemaRepository)
+	if !ok {
+		return &SchemaReport{}, nil
+	}
+	report, err := repo.EnsureSchema()
+	if report == nil {
+		report = &SchemaReport{}
+	}
+	for _, drift := range report.Drift {
+		resource.Logger.Warn("users: index drift", "kind", drift.Kind, "collection", drift.Collection, "key", drift.Key)
+	}
+	return report, err
+}
+
+// ensureIndexes ensures the indexes of the collection, and reports drift if the database can list them
+func ensureIndexes(db domain.IDatabase, collection string, indexes []mgo.Index, obsolete []mgo.Index) (*SchemaReport, error) {
+	report := &SchemaReport{}
+	for _, index := range indexes {
+		err := db.EnsureIndex(collection, index)
+		if err != nil {
+			report.Failed = append(report.Failed, IndexReport{Collection: collection, Index: index, Error: err.Error()})
+			continue
+		}
+		report.Ensured = append(report.Ensured, IndexReport{Collection: collection, Index: index})
+	}
+	if indexed, ok := db.(IIndexedDatabase); ok {
+		actual, err := indexed.Indexes(collection)
+		if err != nil {
+			return report, errors.New(fmt.Sprintf("Failed to list indexes of %v: %v", collection, err.Error()))
+		}
+		report.Drift = indexDrift(collection, indexes, obsolete, actual)
+	}
+	if len(report.Failed) > 0 {
+		failed := []string{}
+		for _, index := range report.Failed {
+			failed = append(failed, fmt.Sprintf("%v (%v)", index.Index.Key, index.Error))
+		}
+		return report, errors.New(fmt.Sprintf("Failed to ensure indexes of %v: %v", collection, strings.Join(failed, ", ")))
+	}
+	drifted := []string{}
+	for _, drift := range report.Drift {
+		if drift.Kind != IndexUnexpected {
+			drifted = append(drifted, fmt.Sprintf("%v (%v)", drift.Key, drift.Kind))
+		}
+	}
+	if len(drifted) > 0 {
+		return report, errors.New(fmt.Sprintf("Indexes of %v differ from their declaration: %v", collection, strings.Join(drifted, ", ")))
+	}
+	return report, nil
+}
+
+// indexDrift compares the declared and actual indexes by their keys
+func indexDrift(collection string, declared []mgo.Index, obsolete []mgo.Index, actual []mgo.Index) []IndexDrift {
+	drift := []IndexDrift{}
+	found := map[string]mgo.Index{}
+	for _, index := range actual {
+		if key := indexKey(index); key != "_id" {
+			found[key] = index
+		}
+	}
+	for _, index := range declared {
+		key := indexKey(index)
+		existing, ok := found[key]
+		if !ok {
+			drift = append(drift, IndexDrift{Collection: collection, Key: index.Key, Kind: IndexMissing})
+			continue
+		}
+		if existing.Unique != index.Unique || existing.Sparse != index.Sparse {
+			drift = append(drift, IndexDrift{Collection: collection, Key: index.Key, Kind: IndexChanged})
+		}
+		delete(found, key)
+	}
+	for _, index := range obsolete {
+		key := indexKey(index)
+		if _, ok := found[key]; ok {
+			drift = append(drift, IndexDrift{Collection: collection, Key: index.Key, Kind: IndexObsolete})
+			delete(found, key)
+		}
+	}
+	unexpected := []string{}
+	for key := range found {
+		unexpected = append(unexpected, key)
+	}
+	sort.Strings(unexpected)
+	for _, key := range unexpected {
+		drift = append(drift, IndexDrift{Collection: collection, Key: found[key].Key, Kind: IndexUnexpected})
+	}
+	return drift
+}
+
+// indexKey identifies an index by its key; the fields of text indexes are unordered
+func indexKey(index mgo.Index) string {
+	key := append([]string{}, index.Key...)
+	text := true
+	for _, field := range key {
+		text = text && strings.HasPrefix(field, "$text:")
+	}
+	if text {
+		sort.Strings(key)
+	}
+	return strings.Join(key, ",")
+}
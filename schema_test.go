@@ -0,0 +1,191 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// indexedDatabase is an IIndexedDatabase listing the given indexes, ensuring indexes without changing them
+type indexedDatabase struct {
+	domain.IDatabase
+	indexes []mgo.Index
+	ensured []mgo.Index
+	failed  map[string]error
+}
+
+func (db *indexedDatabase) EnsureIndex(name string, index mgo.Index) error {
+	if err, ok := db.failed[indexKey(index)]; ok {
+		return err
+	}
+	db.ensured = append(db.ensured, index)
+	return nil
+}
+
+// FindAll finds no users, for the search index of NewResource
+func (db *indexedDatabase) FindAll(name string, q domain.Query, result interface{}, limit int, sort string) error {
+	return nil
+}
+
+func (db *indexedDatabase) Indexes(name string) ([]mgo.Index, error) {
+	return append([]mgo.Index{{Key: []string{"_id"}}}, db.indexes...), nil
+}
+
+// unindexedDatabase can't list its indexes
+type unindexedDatabase struct {
+	domain.IDatabase
+}
+
+func (db *unindexedDatabase) EnsureIndex(name string, index mgo.Index) error {
+	return nil
+}
+
+// declaredIndexes returns a copy of UserIndexes, changed by the given function
+func declaredIndexes(change func(indexes []mgo.Index) []mgo.Index) []mgo.Index {
+	indexes := []mgo.Index{}
+	for _, index := range UserIndexes {
+		index.Key = append([]string{}, index.Key...)
+		indexes = append(indexes, index)
+	}
+	return change(indexes)
+}
+
+func TestEnsureSchemaDrift(t *testing.T) {
+	tests := []struct {
+		name    string
+		indexes []mgo.Index
+		drift   []string
+		err     bool
+	}{
+		{"declared", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			return indexes
+		}), nil, false},
+		{"text index fields in another order", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			last := &indexes[len(indexes)-1]
+			last.Key[0], last.Key[1] = last.Key[1], last.Key[0]
+			return indexes
+		}), nil, false},
+		{"missing", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			return indexes[1:]
+		}), []string{"[username] missing"}, true},
+		{"not unique", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			indexes[1].Unique = false
+			return indexes
+		}), []string{"[email] changed"}, true},
+		{"unique", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			indexes[2].Unique = true
+			return indexes
+		}), []string{"[status _id] changed"}, true},
+		{"not sparse", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			indexes[len(indexes)-1].Sparse = false
+			return indexes
+		}), []string{"[$text:username $text:email] changed"}, true},
+		{"obsolete", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			return append(indexes[:len(indexes)-1], ObsoleteUserIndexes...)
+		}), []string{"[$text:username $text:email] missing", "[$text:username $text:email $text:status] obsolete"}, true},
+		{"unexpected", declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			return append(indexes, mgo.Index{Key: []string{"locale"}})
+		}), []string{"[locale] unexpected"}, false},
+	}
+	for _, test := range tests {
+		repo := &UserRepository{DB: &indexedDatabase{indexes: test.indexes}}
+		report, err := repo.EnsureSchema()
+		drift := []string{}
+		for _, d := range report.Drift {
+			drift = append(drift, fmt.Sprintf("%v %v", d.Key, d.Kind))
+		}
+		if strings.Join(drift, ", ") != strings.Join(test.drift, ", ") {
+			t.Errorf("%v: expected drift %v, got %v", test.name, test.drift, drift)
+		}
+		if test.err != (err != nil) {
+			t.Errorf("%v: expected an error %v, got %v", test.name, test.err, err)
+		}
+		if len(report.Ensured) != len(UserIndexes) {
+			t.Errorf("%v: expected every index to be ensured, got %v", test.name, len(report.Ensured))
+		}
+	}
+}
+
+func TestEnsureSchemaFailed(t *testing.T) {
+	db := &indexedDatabase{
+		indexes: UserIndexes,
+		failed:  map[string]error{"username": errors.New("duplicate key")},
+	}
+	report, err := (&UserRepository{DB: db}).EnsureSchema()
+	if err == nil || !strings.Contains(err.Error(), "duplicate key") {
+		t.Errorf("expected the error of the failed index, got %v", err)
+	}
+	if len(report.Failed) != 1 || len(report.Ensured) != len(UserIndexes)-1 {
+		t.Errorf("expected the other indexes to be ensured, got %+v", report)
+	}
+}
+
+func TestEnsureSchemaWithoutIndexes(t *testing.T) {
+	report, err := (&UserRepository{DB: &unindexedDatabase{}}).EnsureSchema()
+	if err != nil || report.Drift != nil {
+		t.Errorf("expected no drift to be reported, got %v, %v", report.Drift, err)
+	}
+}
+
+// recordingLogger records the messages logged
+type recordingLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (logger *recordingLogger) record(msg string) {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.messages = append(logger.messages, msg)
+}
+
+func (logger *recordingLogger) DebugContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.record(msg)
+}
+
+func (logger *recordingLogger) InfoContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.record(msg)
+}
+
+func (logger *recordingLogger) WarnContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.record(msg)
+}
+
+func (logger *recordingLogger) ErrorContext(ctx context.Context, msg string, args ...interface{}) {
+	logger.record(msg)
+}
+
+func newSchemaTestOptions(logger ILogger, strict bool) *Options {
+	return &Options{
+		Database: &indexedDatabase{indexes: declaredIndexes(func(indexes []mgo.Index) []mgo.Index {
+			return indexes[1:]
+		})},
+		Renderer:              &testRenderer{},
+		UserRepositoryFactory: NewUserRepositoryFactory(),
+		Logger:                logger,
+		StrictSchema:          strict,
+	}
+}
+
+func TestNewResourceSchemaDrift(t *testing.T) {
+	logger := &recordingLogger{}
+	NewResource(newTestContext(), newSchemaTestOptions(logger, false))
+	logged := strings.Join(logger.messages, "\n")
+	if !strings.Contains(logged, "users: index drift") || !strings.Contains(logged, "users: ensure schema failed") {
+		t.Errorf("expected the drift to be logged, got %v", logger.messages)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected NewResource to panic on drift with StrictSchema")
+		}
+	}()
+	NewResource(newTestContext(), newSchemaTestOptions(logger, true))
+}
@@ -0,0 +1,278 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits of a search query
+const (
+	maxSearchQueryLength = 128
+	maxSearchTerms       = 8
+)
+
+// Scores of a term matching a field, see scoreUserSearch
+const (
+	searchExactScore     = 10.0
+	searchPrefixScore    = 6.0
+	searchSubstringScore = 3.0
+	searchFuzzyScore     = 2.0
+	// matches in the email local-part weigh less than in the username
+	searchEmailWeight = 0.8
+)
+
+// UserSearchResult is a user matching a search query, with the ranges of its fields matching the terms
+type UserSearchResult struct {
+	User       User              `json:"user"`
+	Score      float64           `json:"score"`
+	Highlights []SearchHighlight `json:"highlights"`
+}
+
+type UserSearchResults []UserSearchResult
+
+// SearchHighlight is a field value with the [start, end) rune ranges matching the search terms
+type SearchHighlight struct {
+	Field   string   `json:"field"`
+	Value   string   `json:"value"`
+	Matches [][2]int `json:"matches"`
+}
+
+// SearchUsers searches the users of the request's repository if it implements IUserSearcher,
+// or the in-process SearchIndex otherwise, built by the first search unless built already (see Options.SearchIndex)
+func (resource *Resource) SearchUsers(req *http.Request, query string, limit int) (UserSearchResults, error) {
+	repo := resource.UserRepository(req)
+	if searcher, ok := unwrapUserRepository(repo).(IUserSearcher); ok {
+		results, err := searcher.SearchUsers(query, limit)
+		if err != nil {
+			return UserSearchResults{}, err
+		}
+		return *results.(*UserSearchResults), nil
+	}
+	if resource.SearchIndex == nil {
+		return UserSearchResults{}, NewMessageError(CodeSearchNotSupported)
+	}
+	org, err := resource.Organization(req)
+	if err != nil {
+		return UserSearchResults{}, err
+	}
+	err = resource.buildSearchIndex()
+	if err != nil {
+		return UserSearchResults{}, err
+	}
+	return resource.SearchIndex.Search(org, query, limit), nil
+}
+
+// buildSearchIndex builds the SearchIndex with the users of all organizations, unless built already
+func (resource *Resource) buildSearchIndex() error {
+	err := resource.SearchIndex.Build(resource.UserRepositoryFactory.New(resource.Database))
+	if err != nil {
+		resource.Logger.Error("users: search index build failed", "error", err.Error())
+	}
+	return err
+}
+
+// searchTerms splits the query into lowercase terms, using the local-part of email addresses
+func searchTerms(query string) []string {
+	if len(query) > maxSearchQueryLength {
+		query = query[:maxSearchQueryLength]
+	}
+	terms := []string{}
+	for _, term := range strings.Fields(strings.ToLower(query)) {
+		if i := strings.Index(term, "@"); i >= 0 {
+			term = term[:i]
+		}
+		if term == "" || containsString(terms, term) {
+			continue
+		}
+		terms = append(terms, term)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// emailLocalPart returns the part of the email before `@`
+func emailLocalPart(email string) string {
+	if i := strings.Index(email, "@"); i >= 0 {
+		return email[:i]
+	}
+	return email
+}
+
+// scoreUserSearch scores the user against all of the terms, matched on the username or the email local-part
+// exactly, by prefix, by substring, or by a prefix within a few edits (fuzzy).
+// The score is 0 if a term matches neither field.
+func scoreUserSearch(user *User, terms []string) (float64, []SearchHighlight) {
+	fields := []struct {
+		name   string
+		value  string
+		search string
+		weight float64
+	}{
+		{"username", user.Username, strings.ToLower(user.Username), 1},
+		{"email", user.Email, strings.ToLower(emailLocalPart(user.Email)), searchEmailWeight},
+	}
+	matches := make([][][2]int, len(fields))
+	total := 0.0
+	for _, term := range terms {
+		best, bestField, bestMatch := 0.0, -1, [2]int{}
+		for i, field := range fields {
+			score, match := scoreSearchTerm(field.search, term)
+			score *= field.weight
+			if score > best {
+				best, bestField, bestMatch = score, i, match
+			}
+		}
+		if bestField < 0 {
+			return 0, nil
+		}
+		total += best
+		matches[bestField] = append(matches[bestField], bestMatch)
+	}
+	highlights := []SearchHighlight{}
+	for i, field := range fields {
+		if len(matches[i]) > 0 {
+			highlights = append(highlights, SearchHighlight{
+				Field:   field.name,
+				Value:   field.value,
+				Matches: mergeSearchMatches(matches[i]),
+			})
+		}
+	}
+	return total, highlights
+}
+
+// scoreSearchTerm scores a term within a lowercase value, and returns the rune range it matches
+func scoreSearchTerm(value string, term string) (float64, [2]int) {
+	if value == "" {
+		return 0, [2]int{}
+	}
+	length := utf8.RuneCountInString(term)
+	switch {
+	case value == term:
+		return searchExactScore, [2]int{0, length}
+	case strings.HasPrefix(value, term):
+		// favour values that are mostly matched
+		return searchPrefixScore + 2*float64(length)/float64(utf8.RuneCountInString(value)), [2]int{0, length}
+	}
+	if i := strings.Index(value, term); i >= 0 {
+		start := utf8.RuneCountInString(value[:i])
+		return searchSubstringScore, [2]int{start, start + length}
+	}
+	edits := maxSearchEdits(length)
+	if edits == 0 {
+		return 0, [2]int{}
+	}
+	distance, end := prefixEditDistance([]rune(term), []rune(value))
+	if distance > edits {
+		return 0, [2]int{}
+	}
+	return searchFuzzyScore / float64(1+distance), [2]int{0, end}
+}
+
+// maxSearchEdits is the number of edits allowed for a fuzzy match of a term of the given length
+func maxSearchEdits(length int) int {
+	switch {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	}
+	return 2
+}
+
+// prefixEditDistance returns the smallest edit distance between the term and a prefix of the value,
+// and the length of that prefix. Edits are insertions, deletions, substitutions and transpositions of adjacent runes.
+func prefixEditDistance(term []rune, value []rune) (int, int) {
+	beforePrevious := make([]int, len(value)+1)
+	previous := make([]int, len(value)+1)
+	current := make([]int, len(value)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(term); i++ {
+		current[0] = i
+		for j := 1; j <= len(value); j++ {
+			cost := 1
+			if term[i-1] == value[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j-1]+cost, minInt(previous[j]+1, current[j-1]+1))
+			if i > 1 && j > 1 && term[i-1] == value[j-2] && term[i-2] == value[j-1] {
+				current[j] = minInt(current[j], beforePrevious[j-2]+1)
+			}
+		}
+		beforePrevious, previous, current = previous, current, beforePrevious
+	}
+	// on ties, favour the prefix closest to the length of the term
+	distance, end := len(term)+1, 0
+	for j, d := range previous {
+		if d < distance || (d == distance && absInt(j-len(term)) < absInt(end-len(term))) {
+			distance, end = d, j
+		}
+	}
+	return distance, end
+}
+
+// mergeSearchMatches sorts and merges overlapping ranges
+func mergeSearchMatches(matches [][2]int) [][2]int {
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i][0] < matches[j][0]
+	})
+	merged := [][2]int{}
+	for _, match := range matches {
+		if n := len(merged); n > 0 && match[0] <= merged[n-1][1] {
+			if match[1] > merged[n-1][1] {
+				merged[n-1][1] = match[1]
+			}
+			continue
+		}
+		merged = append(merged, match)
+	}
+	return merged
+}
+
+// rankUserSearch scores the candidates, adding their bonus if they match, and returns the best ones
+func rankUserSearch(candidates []*User, terms []string, bonus map[string]float64, limit int) UserSearchResults {
+	results := UserSearchResults{}
+	for _, user := range candidates {
+		score, highlights := scoreUserSearch(user, terms)
+		if score == 0 {
+			continue
+		}
+		results = append(results, UserSearchResult{
+			User:       *user,
+			Score:      score + bonus[user.ID.Hex()],
+			Highlights: highlights,
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].User.Username < results[j].User.Username
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,256 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// searchIndexPageSize is the number of users loaded at a time by UserSearchIndex.Rebuild
+const searchIndexPageSize = 500
+
+// SearchIndexMode is when the in-process UserSearchIndex is built, see Options.SearchIndex
+type SearchIndexMode int
+
+const (
+	// SearchIndexLazy builds the index on the first search
+	SearchIndexLazy SearchIndexMode = iota
+	// SearchIndexBackground starts building the index in its own goroutine from NewResource,
+	// searches wait for it to be built
+	SearchIndexBackground
+	// SearchIndexDisabled disables the in-process index,
+	// users can only be searched if the repository implements IUserSearcher
+	SearchIndexDisabled
+)
+
+// UserSearchIndex is an in-process n-gram index of the usernames and email local-parts of users,
+// to search repository backends that don't implement IUserSearcher.
+// It is kept up to date with the user lifecycle events, see HandleEvent.
+type UserSearchIndex struct {
+	mutex sync.RWMutex
+	users map[string]*User
+	// grams maps the trigrams and `^`-prefixed leading grams of the values to user ids
+	grams map[string]map[string]bool
+
+	// building is held while the index is built, see Build
+	building sync.Mutex
+	built    uint32
+}
+
+func NewUserSearchIndex() *UserSearchIndex {
+	return &UserSearchIndex{
+		users: map[string]*User{},
+		grams: map[string]map[string]bool{},
+	}
+}
+
+// Build indexes all of the users of the repository unless the index is built already.
+// Concurrent callers wait for the first one to build it; a failed build is retried by the next call.
+func (index *UserSearchIndex) Build(repo IUserRepository) error {
+	if index.Built() {
+		return nil
+	}
+	index.building.Lock()
+	defer index.building.Unlock()
+	if index.Built() {
+		return nil
+	}
+	err := index.Rebuild(repo)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&index.built, 1)
+	return nil
+}
+
+// Built returns true once the index is built
+func (index *UserSearchIndex) Built() bool {
+	return atomic.LoadUint32(&index.built) == 1
+}
+
+// Rebuild indexes all of the users of the repository
+func (index *UserSearchIndex) Rebuild(repo IUserRepository) error {
+	index.mutex.Lock()
+	index.users = map[string]*User{}
+	index.grams = map[string]map[string]bool{}
+	index.mutex.Unlock()
+
+	cursor := ""
+	for {
+		users := *repo.FilterUsers("", "", cursor, searchIndexPageSize, "_id").(*Users)
+		for i := range users {
+			index.Add(&users[i])
+		}
+		if len(users) < searchIndexPageSize {
+			return nil
+		}
+		cursor = users[len(users)-1].ID.Hex()
+	}
+}
+
+// Add indexes the user, replacing its previous version
+func (index *UserSearchIndex) Add(user *User) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	id := user.ID.Hex()
+	index.remove(id)
+	indexed := *user
+	index.users[id] = &indexed
+	for _, gram := range userSearchGrams(&indexed) {
+		if index.grams[gram] == nil {
+			index.grams[gram] = map[string]bool{}
+		}
+		index.grams[gram][id] = true
+	}
+}
+
+// Remove removes the user specified by the id from the index
+func (index *UserSearchIndex) Remove(id string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.remove(id)
+}
+
+func (index *UserSearchIndex) remove(id string) {
+	user, ok := index.users[id]
+	if !ok {
+		return
+	}
+	for _, gram := range userSearchGrams(user) {
+		delete(index.grams[gram], id)
+		if len(index.grams[gram]) == 0 {
+			delete(index.grams, gram)
+		}
+	}
+	delete(index.users, id)
+}
+
+// Search returns the best matches of the query, see scoreUserSearch.
+// Results are restricted to the members of the organization, if any.
+// Candidates share the leading gram of a short term, or enough trigrams of a longer term
+// to be within the edits allowed for a fuzzy match, or the leading gram of a term allowing edits.
+func (index *UserSearchIndex) Search(organizationID string, query string, limit int) UserSearchResults {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return UserSearchResults{}
+	}
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	// candidates must match every term, start with the first one
+	var candidates map[string]bool
+	for _, term := range terms {
+		matched := index.candidates(term)
+		if candidates != nil {
+			for id := range candidates {
+				if !matched[id] {
+					delete(candidates, id)
+				}
+			}
+		} else {
+			candidates = matched
+		}
+	}
+	users := []*User{}
+	for id := range candidates {
+		user := index.users[id]
+		if organizationID == "" || user.IsMemberOf(organizationID) {
+			users = append(users, user)
+		}
+	}
+	return rankUserSearch(users, terms, nil, limit)
+}
+
+func (index *UserSearchIndex) candidates(term string) map[string]bool {
+	matched := map[string]bool{}
+	runes := []rune(term)
+	if len(runes) < 3 {
+		for id := range index.grams["^"+term] {
+			matched[id] = true
+		}
+		return matched
+	}
+	grams := trigrams(term)
+	// each edit changes at most 3 trigrams
+	required := len(grams) - 3*maxSearchEdits(len(runes))
+	if required < 1 {
+		required = 1
+	}
+	counts := map[string]int{}
+	for _, gram := range grams {
+		for id := range index.grams[gram] {
+			counts[id]++
+		}
+	}
+	for id, count := range counts {
+		if count >= required {
+			matched[id] = true
+		}
+	}
+	if maxSearchEdits(len(runes)) > 0 {
+		// edits close together may leave no trigram in common, find those by their leading gram
+		for id := range index.grams["^"+string(runes[:2])] {
+			matched[id] = true
+		}
+	}
+	return matched
+}
+
+// HandleEvent updates the index with the user changes
+func (index *UserSearchIndex) HandleEvent(resource *Resource, event *Event) error {
+	switch event.Type {
+	case EventUserCreated, EventUserConfirmed, EventUserUpdated:
+		if event.User != nil {
+			index.Add(event.User)
+		}
+	case EventUserDeleted:
+		if event.Previous != nil {
+			index.Remove(event.Previous.ID.Hex())
+		}
+	case EventAllUsersDeleted:
+		if !index.Built() {
+			// the build loads the remaining users
+			return nil
+		}
+		return index.Rebuild(resource.UserRepositoryFactory.New(resource.Database))
+	}
+	return nil
+}
+
+// userSearchGrams returns the grams of the username and the email local-part
+func userSearchGrams(user *User) []string {
+	grams := []string{}
+	for _, value := range []string{user.Username, emailLocalPart(user.Email)} {
+		value = strings.ToLower(value)
+		if value == "" {
+			continue
+		}
+		runes := []rune(value)
+		// leading grams find values by a short prefix
+		grams = append(grams, "^"+string(runes[:1]))
+		if len(runes) > 1 {
+			grams = append(grams, "^"+string(runes[:2]))
+		}
+		grams = append(grams, trigrams(value)...)
+	}
+	return grams
+}
+
+// trigrams returns the distinct trigrams of the value, or the value itself if shorter
+func trigrams(value string) []string {
+	runes := []rune(value)
+	if utf8.RuneCountInString(value) < 3 {
+		return []string{value}
+	}
+	grams := []string{}
+	for i := 0; i+3 <= len(runes); i++ {
+		gram := string(runes[i : i+3])
+		if !containsString(grams, gram) {
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
@@ -0,0 +1,177 @@
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func newSearchTestUser(username string, email string) *User {
+	user := newTestUser(StatusActive, RoleUser)
+	user.Username, user.Email = username, email
+	return user
+}
+
+func searchUsernames(results UserSearchResults) []string {
+	usernames := []string{}
+	for _, result := range results {
+		usernames = append(usernames, result.User.Username)
+	}
+	return usernames
+}
+
+func TestUserSearchIndexRanking(t *testing.T) {
+	index := NewUserSearchIndex()
+	for _, user := range []*User{
+		newSearchTestUser("jonh", "jonh@example.com"),
+		newSearchTestUser("ajohn", "ajohn@example.com"),
+		newSearchTestUser("johnny", "johnny@example.com"),
+		newSearchTestUser("bob", "john@example.com"),
+		newSearchTestUser("john", "j@example.com"),
+		newSearchTestUser("alice", "alice@example.com"),
+	} {
+		index.Add(user)
+	}
+
+	results := index.Search("", "John", 10)
+	// exact, exact email local-part, prefix, substring, then within an edit
+	expected := []string{"john", "bob", "johnny", "ajohn", "jonh"}
+	if !reflect.DeepEqual(searchUsernames(results), expected) {
+		t.Fatalf("expected %v, got %v", expected, searchUsernames(results))
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score >= results[i-1].Score {
+			t.Errorf("expected decreasing scores, got %v for %v", results[i].Score, results[i].User.Username)
+		}
+	}
+	if highlights := results[1].Highlights; len(highlights) != 1 || highlights[0].Field != "email" || !reflect.DeepEqual(highlights[0].Matches, [][2]int{{0, 4}}) {
+		t.Errorf("expected the email to be highlighted, got %+v", highlights)
+	}
+	if highlights := results[3].Highlights; len(highlights) != 1 || highlights[0].Field != "username" || !reflect.DeepEqual(highlights[0].Matches, [][2]int{{1, 5}}) {
+		t.Errorf("expected the substring to be highlighted, got %+v", highlights)
+	}
+
+	if results := index.Search("", "john", 2); !reflect.DeepEqual(searchUsernames(results), expected[:2]) {
+		t.Errorf("expected the best %v results, got %v", 2, searchUsernames(results))
+	}
+	// every term must match
+	if results := index.Search("", "john example", 10); len(results) != 0 {
+		t.Errorf("expected no results, got %v", searchUsernames(results))
+	}
+}
+
+func TestUserSearchIndexOrganizations(t *testing.T) {
+	index := NewUserSearchIndex()
+	member := newSearchTestUser("john", "john@example.com")
+	member.Organizations = []Membership{{OrganizationID: "acme"}}
+	index.Add(member)
+	index.Add(newSearchTestUser("johnny", "johnny@example.com"))
+
+	if results := index.Search("acme", "john", 10); !reflect.DeepEqual(searchUsernames(results), []string{"john"}) {
+		t.Errorf("expected only the members of the organization, got %v", searchUsernames(results))
+	}
+	if results := index.Search("", "john", 10); len(results) != 2 {
+		t.Errorf("expected the users of every organization, got %v", searchUsernames(results))
+	}
+}
+
+func TestUserSearchIndexEvents(t *testing.T) {
+	john := newSearchTestUser("john", "john@example.com")
+	store := newMemoryUserStore(john)
+	resource := &Resource{UserRepositoryFactory: &memoryUserRepositoryFactory{store}}
+	index := NewUserSearchIndex()
+	if err := index.Build(resource.UserRepositoryFactory.New(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newSearchTestUser("alice", "alice@example.com")
+	index.HandleEvent(resource, &Event{Type: EventUserCreated, User: alice})
+	if results := index.Search("", "alice", 10); !reflect.DeepEqual(searchUsernames(results), []string{"alice"}) {
+		t.Errorf("expected the created user to be found, got %v", searchUsernames(results))
+	}
+
+	renamed := *alice
+	renamed.Username, renamed.Email = "zoe", "zoe@example.com"
+	index.HandleEvent(resource, &Event{Type: EventUserUpdated, User: &renamed, Previous: alice})
+	if results := index.Search("", "zoe", 10); !reflect.DeepEqual(searchUsernames(results), []string{"zoe"}) {
+		t.Errorf("expected the updated user to be found, got %v", searchUsernames(results))
+	}
+	if results := index.Search("", "alice", 10); len(results) != 0 {
+		t.Errorf("expected the previous username not to be found, got %v", searchUsernames(results))
+	}
+
+	index.HandleEvent(resource, &Event{Type: EventUserDeleted, Previous: &renamed})
+	if results := index.Search("", "zoe", 10); len(results) != 0 {
+		t.Errorf("expected the deleted user not to be found, got %v", searchUsernames(results))
+	}
+
+	// all users deleted rebuilds the index from the repository
+	resource.UserRepositoryFactory.New(nil).DeleteAllUsers()
+	index.HandleEvent(resource, &Event{Type: EventAllUsersDeleted})
+	if results := index.Search("", "john", 10); len(results) != 0 {
+		t.Errorf("expected the index to be rebuilt, got %v", searchUsernames(results))
+	}
+}
+
+func searchRequest(resource *Resource, query string) (int, SearchUsersResponse_v0) {
+	req := httptest.NewRequest("GET", "/api/users/search?q="+query, nil)
+	w := httptest.NewRecorder()
+	resource.HandleSearchUsers_v0(w, req)
+	var response SearchUsersResponse_v0
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestSearchIndexLazy(t *testing.T) {
+	store := newMemoryUserStore(newSearchTestUser("john", "john@example.com"))
+	resource := newTestResource(&Options{UserRepositoryFactory: &memoryUserRepositoryFactory{store}})
+	if resource.SearchIndex.Built() || store.lookups != 0 {
+		t.Fatal("expected the search index not to be built by NewResource")
+	}
+
+	status, response := searchRequest(resource, "john")
+	if status != http.StatusOK || !reflect.DeepEqual(searchUsernames(response.Results), []string{"john"}) {
+		t.Fatalf("expected the first search to build the index, got %v %v", status, searchUsernames(response.Results))
+	}
+	if !resource.SearchIndex.Built() {
+		t.Error("expected the search index to be built")
+	}
+
+	w := httptest.NewRecorder()
+	resource.HandleCreateUser_v0(w, newCreateUserRequest("johnny", "johnny@example.com"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the user to be created, got %v: %v", w.Code, w.Body.String())
+	}
+	if _, response := searchRequest(resource, "john"); !reflect.DeepEqual(searchUsernames(response.Results), []string{"john", "johnny"}) {
+		t.Errorf("expected the created user to be found, got %v", searchUsernames(response.Results))
+	}
+}
+
+func TestSearchIndexBackground(t *testing.T) {
+	store := newMemoryUserStore(newSearchTestUser("john", "john@example.com"))
+	resource := newTestResource(&Options{
+		UserRepositoryFactory: &memoryUserRepositoryFactory{store},
+		SearchIndex:           SearchIndexBackground,
+	})
+
+	// searches wait for the build
+	if status, response := searchRequest(resource, "john"); status != http.StatusOK || len(response.Results) != 1 {
+		t.Errorf("expected the user to be found, got %v %v", status, searchUsernames(response.Results))
+	}
+}
+
+func TestSearchIndexDisabled(t *testing.T) {
+	store := newMemoryUserStore(newSearchTestUser("john", "john@example.com"))
+	resource := newTestResource(&Options{
+		UserRepositoryFactory: &memoryUserRepositoryFactory{store},
+		SearchIndex:           SearchIndexDisabled,
+	})
+	if resource.SearchIndex != nil {
+		t.Fatal("expected no search index")
+	}
+	if status, response := searchRequest(resource, "john"); status != http.StatusNotImplemented || response.Code != CodeSearchNotSupported {
+		t.Errorf("expected %v %v, got %v %v", http.StatusNotImplemented, CodeSearchNotSupported, status, response.Code)
+	}
+}
@@ -0,0 +1,132 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of username suggestions
+const (
+	DefaultSuggestLimit    = 5
+	MaxSuggestLimit        = 10
+	maxSuggestPrefixLength = 64
+)
+
+// Defaults of the suggestion cache, see Options.SuggestCacheTTL
+const (
+	DefaultSuggestCacheTTL = 30 * time.Second
+	suggestCacheSize       = 1000
+)
+
+// UserSuggestion is the lightweight view of a user suggested for a username prefix
+type UserSuggestion struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar,omitempty"`
+}
+
+type UserSuggestions []UserSuggestion
+
+// SuggestUsers returns the active users whose username starts with the prefix, ignoring case.
+// Suggestions are cached for Options.SuggestCacheTTL.
+func (resource *Resource) SuggestUsers(req *http.Request, prefix string, limit int) (UserSuggestions, error) {
+	org, err := resource.Organization(req)
+	if err != nil {
+		return UserSuggestions{}, err
+	}
+	key := suggestCacheKey(org, prefix, limit)
+	if resource.suggestCache != nil {
+		if suggestions, ok := resource.suggestCache.get(key); ok {
+			return suggestions, nil
+		}
+	}
+
+	_users, err := resource.ContextUserRepository(req).(IContextSuggestUserRepository).SuggestUsers(req.Context(), prefix, limit)
+	if err != nil {
+		return UserSuggestions{}, err
+	}
+	users := *_users.(*Users)
+	suggestions := UserSuggestions{}
+	for i := range users {
+		suggestion := UserSuggestion{
+			ID:       users[i].ID.Hex(),
+			Username: users[i].Username,
+		}
+		if resource.options.AvatarURL != nil {
+			suggestion.Avatar = resource.options.AvatarURL(&users[i])
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	if resource.suggestCache != nil {
+		resource.suggestCache.set(key, suggestions)
+	}
+	return suggestions, nil
+}
+
+// suggestCache caches the suggestions of hot prefixes for a short time.
+// It is cleared on every user change, so stale suggestions only come from other instances.
+type suggestCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]suggestCacheEntry
+}
+
+type suggestCacheEntry struct {
+	suggestions UserSuggestions
+	expires     time.Time
+}
+
+func newSuggestCache(ttl time.Duration) *suggestCache {
+	return &suggestCache{
+		ttl:     ttl,
+		entries: map[string]suggestCacheEntry{},
+	}
+}
+
+func suggestCacheKey(organizationID string, prefix string, limit int) string {
+	return strings.Join([]string{organizationID, strings.ToLower(prefix), strconv.Itoa(limit)}, "\x00")
+}
+
+func (cache *suggestCache) get(key string) (UserSuggestions, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.suggestions, true
+}
+
+func (cache *suggestCache) set(key string, suggestions UserSuggestions) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if len(cache.entries) >= suggestCacheSize {
+		for k, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, k)
+			}
+		}
+	}
+	if len(cache.entries) >= suggestCacheSize {
+		// evict an arbitrary entry
+		for k := range cache.entries {
+			delete(cache.entries, k)
+			break
+		}
+	}
+	cache.entries[key] = suggestCacheEntry{suggestions, now.Add(cache.ttl)}
+}
+
+// HandleEvent clears the cache on user changes
+func (cache *suggestCache) HandleEvent(resource *Resource, event *Event) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = map[string]suggestCacheEntry{}
+	return nil
+}
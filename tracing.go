@@ -0,0 +1,271 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceParentHeader carries the W3C trace context of incoming requests
+const traceParentHeader = "traceparent"
+
+// TracingOptions enables tracing if not nil, see Tracer
+type TracingOptions struct {
+	// Exporter receives the ended spans, e.g. an adapter to an OpenTelemetry exporter, or an InMemorySpanExporter
+	Exporter ISpanExporter
+}
+
+// Tracer starts the spans of route handlers, ACL decisions, user repository operations of requests and hooks.
+// Spans of a request share its trace, continued from the `traceparent` header if valid.
+// ACL decisions made by the ACL middleware run before the route handler, so their spans are siblings
+// of the route handler's span, unless Options.ACLRenderDenials is set.
+type Tracer struct {
+	exporter ISpanExporter
+}
+
+func NewTracer(exporter ISpanExporter) *Tracer {
+	return &Tracer{exporter}
+}
+
+// Start starts a span of the trace with the given attributes, as key-value pairs.
+// A new trace is started if traceID is empty.
+func (tracer *Tracer) Start(traceID string, parentSpanID string, name string, attributes ...interface{}) *Span {
+	if traceID == "" {
+		traceID = newTraceID(16)
+		parentSpanID = ""
+	}
+	span := &Span{
+		exporter: tracer.exporter,
+		data: SpanData{
+			TraceID:      traceID,
+			SpanID:       newTraceID(8),
+			ParentSpanID: parentSpanID,
+			Name:         name,
+			StartTime:    time.Now(),
+			Attributes:   map[string]interface{}{},
+			Status:       SpanStatusOK,
+		},
+	}
+	span.SetAttributes(attributes...)
+	return span
+}
+
+// Span is an operation of a trace, exported once it ends.
+// The methods of a nil Span do nothing, so that call sites don't check if tracing is enabled.
+type Span struct {
+	exporter ISpanExporter
+	mutex    sync.Mutex
+	data     SpanData
+	ended    bool
+}
+
+func (span *Span) TraceID() string {
+	if span == nil {
+		return ""
+	}
+	return span.data.TraceID
+}
+
+func (span *Span) SpanID() string {
+	if span == nil {
+		return ""
+	}
+	return span.data.SpanID
+}
+
+// SetAttributes sets the attributes given as key-value pairs
+func (span *Span) SetAttributes(attributes ...interface{}) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.data.Attributes[fmt.Sprint(attributes[i])] = attributes[i+1]
+	}
+}
+
+// RecordError sets the error status of the span, if err is not nil
+func (span *Span) RecordError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.data.Status = SpanStatusError
+	span.data.Error = err.Error()
+}
+
+// End ends the span and exports it, once
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	if span.ended {
+		span.mutex.Unlock()
+		return
+	}
+	span.ended = true
+	span.data.EndTime = time.Now()
+	data := span.data
+	data.Attributes = map[string]interface{}{}
+	for key, value := range span.data.Attributes {
+		data.Attributes[key] = value
+	}
+	span.mutex.Unlock()
+	span.exporter.ExportSpan(&data)
+}
+
+// InMemorySpanExporter keeps the exported spans in memory, to inspect them in tests
+type InMemorySpanExporter struct {
+	mutex sync.Mutex
+	spans []*SpanData
+}
+
+func NewInMemorySpanExporter() *InMemorySpanExporter {
+	return &InMemorySpanExporter{}
+}
+
+func (exporter *InMemorySpanExporter) ExportSpan(span *SpanData) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.spans = append(exporter.spans, span)
+}
+
+// Spans returns the exported spans, in the order they ended
+func (exporter *InMemorySpanExporter) Spans() []*SpanData {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	return append([]*SpanData{}, exporter.spans...)
+}
+
+// Reset forgets the exported spans
+func (exporter *InMemorySpanExporter) Reset() {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.spans = nil
+}
+
+// newTraceID returns a random ID of the given number of bytes, in hexadecimal
+func newTraceID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceParent returns the trace and parent span IDs of a W3C `traceparent` header
+func parseTraceParent(header string) (string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, spanID := parts[1], parts[2]
+	if !isTraceID(traceID, 32) || !isTraceID(spanID, 16) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+// isTraceID returns true if the ID is a non-zero lowercase hexadecimal of the given length
+func isTraceID(id string, length int) bool {
+	if len(id) != length || strings.Trim(id, "0") == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type requestTraceKey struct{}
+
+// requestTrace is the trace of a request, and the span of its route handler once started
+type requestTrace struct {
+	traceID  string
+	parentID string
+	span     *Span
+}
+
+// requestTrace returns the trace of the request, continued from its `traceparent` header if valid
+func (resource *Resource) requestTrace(req *http.Request) *requestTrace {
+	if trace, ok := resource.ctx.Get(req, requestTraceKey{}).(*requestTrace); ok {
+		return trace
+	}
+	trace := &requestTrace{}
+	if traceID, parentID, ok := parseTraceParent(req.Header.Get(traceParentHeader)); ok {
+		trace.traceID, trace.parentID = traceID, parentID
+	} else {
+		trace.traceID = newTraceID(16)
+	}
+	resource.ctx.Set(req, requestTraceKey{}, trace)
+	return trace
+}
+
+// startSpan starts a span within the trace of the request, under the span of its route handler if started.
+// It returns nil if tracing is disabled; spans without a request start their own trace.
+func (resource *Resource) startSpan(req *http.Request, name string, attributes ...interface{}) *Span {
+	if resource.Tracer == nil {
+		return nil
+	}
+	if req == nil {
+		return resource.Tracer.Start("", "", name, attributes...)
+	}
+	trace := resource.requestTrace(req)
+	parentID := trace.parentID
+	if trace.span != nil {
+		parentID = trace.span.SpanID()
+	}
+	return resource.Tracer.Start(trace.traceID, parentID, name, attributes...)
+}
+
+// traceHook runs a controller hook within a span
+func (resource *Resource) traceHook(req *http.Request, name string, hook func() error) error {
+	span := resource.startSpan(req, "users.hook."+name, "hook", name)
+	err := hook()
+	span.RecordError(err)
+	span.End()
+	return err
+}
+
+// wrapTracingRouteHandlers returns route handlers running the requests of the route within a span
+func (resource *Resource) wrapTracingRouteHandlers(name string, method string, handlers domain.RouteHandlers) domain.RouteHandlers {
+	wrapped := domain.RouteHandlers{}
+	for version, handler := range handlers {
+		next := handler
+		wrapped[version] = func(w http.ResponseWriter, req *http.Request) {
+			span := resource.startSpan(req, "users."+name,
+				"route", name,
+				"http.method", method,
+				"http.path", req.URL.Path,
+				"request.id", resource.RequestID(req),
+			)
+			resource.requestTrace(req).span = span
+			recorder := &statusRecorder{ResponseWriter: w}
+			next(recorder, req)
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttributes("http.status_code", status)
+			if user := asUser(resource.CurrentUser(req)); user != nil {
+				span.SetAttributes("enduser.id", user.ID.Hex())
+			}
+			if status >= http.StatusInternalServerError {
+				span.RecordError(errors.New(http.StatusText(status)))
+			}
+			span.End()
+		}
+	}
+	return wrapped
+}
@@ -0,0 +1,221 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"context"
+	"errors"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTracingResource(exporter *InMemorySpanExporter) *Resource {
+	return &Resource{
+		ctx:             newTestContext(),
+		options:         &Options{},
+		Logger:          NewLogger(nil, LogLevelError),
+		Tracer:          NewTracer(exporter),
+		requestIDHeader: defaultRequestIDHeader,
+	}
+}
+
+// exportedSpan returns the only exported span with the name
+func exportedSpan(t *testing.T, exporter *InMemorySpanExporter, name string) *SpanData {
+	var found *SpanData
+	for _, span := range exporter.Spans() {
+		if span.Name != name {
+			continue
+		}
+		if found != nil {
+			t.Fatalf("expected a single `%v` span", name)
+		}
+		found = span
+	}
+	if found == nil {
+		t.Fatalf("expected a `%v` span, got %v", name, exporter.Spans())
+	}
+	return found
+}
+
+func assertSpanAttributes(t *testing.T, span *SpanData, expected map[string]interface{}) {
+	for key, value := range expected {
+		if actual, ok := span.Attributes[key]; !ok || actual != value {
+			t.Errorf("%v: expected attribute %v to be %v, got %v", span.Name, key, value, actual)
+		}
+	}
+}
+
+func TestTracingRouteHandler(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	resource := newTracingResource(exporter)
+	user := newTestUser(StatusActive, RoleUser)
+	req := httptest.NewRequest("GET", "/api/users/"+user.ID.Hex(), nil)
+	req.Header.Set(defaultRequestIDHeader, "request-1")
+	req.Header.Set(traceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resource.ctx.SetCurrentUserCtx(req, user)
+
+	handlers := resource.wrapTracingRouteHandlers(GetUser, "GET", domain.RouteHandlers{
+		"0.0": func(w http.ResponseWriter, req *http.Request) {
+			resource.traceHook(req, "PostGetUserHook", func() error { return nil })
+			w.WriteHeader(http.StatusCreated)
+		},
+	})
+	handlers["0.0"](httptest.NewRecorder(), req)
+
+	span := exportedSpan(t, exporter, "users."+GetUser)
+	assertSpanAttributes(t, span, map[string]interface{}{
+		"route":            GetUser,
+		"http.method":      "GET",
+		"http.path":        "/api/users/" + user.ID.Hex(),
+		"request.id":       "request-1",
+		"http.status_code": http.StatusCreated,
+		"enduser.id":       user.ID.Hex(),
+	})
+	if span.Status != SpanStatusOK {
+		t.Errorf("expected status %v, got %v", SpanStatusOK, span.Status)
+	}
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("expected the trace of the `traceparent` header, got %v/%v", span.TraceID, span.ParentSpanID)
+	}
+
+	hook := exportedSpan(t, exporter, "users.hook.PostGetUserHook")
+	if hook.TraceID != span.TraceID || hook.ParentSpanID != span.SpanID {
+		t.Errorf("expected the hook span to be a child of the route handler span")
+	}
+}
+
+func TestTracingRouteHandlerError(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	resource := newTracingResource(exporter)
+	req := httptest.NewRequest("GET", "/api/users", nil)
+
+	handlers := resource.wrapTracingRouteHandlers(ListUsers, "GET", domain.RouteHandlers{
+		"0.0": func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	})
+	handlers["0.0"](httptest.NewRecorder(), req)
+
+	span := exportedSpan(t, exporter, "users."+ListUsers)
+	assertSpanAttributes(t, span, map[string]interface{}{"http.status_code": http.StatusInternalServerError})
+	if _, ok := span.Attributes["enduser.id"]; ok {
+		t.Error("expected no `enduser.id` for anonymous requests")
+	}
+	if span.Status != SpanStatusError {
+		t.Errorf("expected status %v, got %v", SpanStatusError, span.Status)
+	}
+}
+
+func TestTracingACLDecision(t *testing.T) {
+	rules, err := compileACLPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewInMemorySpanExporter()
+	resource := newTracingResource(exporter)
+	resource.aclRules = rules
+	user := newTestUser(StatusActive, RoleUser)
+	req := httptest.NewRequest("DELETE", "/api/users", nil)
+
+	decision := resource.Authorize(DeleteAllUsers, req, user)
+	if decision.Allowed {
+		t.Fatal("expected users to be denied DeleteAllUsers")
+	}
+
+	span := exportedSpan(t, exporter, "users.acl")
+	assertSpanAttributes(t, span, map[string]interface{}{
+		"route":       DeleteAllUsers,
+		"acl.allowed": false,
+		"acl.reason":  decision.Reason,
+		"enduser.id":  user.ID.Hex(),
+	})
+	if decision.Reason == "" {
+		t.Error("expected a denial reason")
+	}
+}
+
+// tracingGroupRepository is an IContextUserRepository with group memberships, failing to remove members
+type tracingGroupRepository struct {
+	IContextUserRepository
+}
+
+func (repo *tracingGroupRepository) FilterUsersByGroup(ctx context.Context, groupID string, lastID string, limit int, sort string) (domain.IUsers, error) {
+	return &Users{}, nil
+}
+
+func (repo *tracingGroupRepository) AddUserToGroup(ctx context.Context, id string, groupID string) error {
+	return nil
+}
+
+func (repo *tracingGroupRepository) RemoveUserFromGroup(ctx context.Context, id string, groupID string) error {
+	return errors.New("not a member")
+}
+
+func (repo *tracingGroupRepository) RemoveGroupFromUsers(ctx context.Context, groupID string) error {
+	return nil
+}
+
+func TestTracingRepositoryOperation(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	resource := newTracingResource(exporter)
+	req := httptest.NewRequest("POST", "/api/groups", nil)
+	repo := &requestUserRepository{&tracingGroupRepository{}, resource, req}
+	userID, groupID := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+
+	if err := repo.AddUserToGroup(req.Context(), userID, groupID); err != nil {
+		t.Fatal(err)
+	}
+	span := exportedSpan(t, exporter, "users.repository.AddUserToGroup")
+	assertSpanAttributes(t, span, map[string]interface{}{
+		"operation": "AddUserToGroup",
+		"user.id":   userID,
+		"group.id":  groupID,
+	})
+	if span.Status != SpanStatusOK {
+		t.Errorf("expected status %v, got %v", SpanStatusOK, span.Status)
+	}
+
+	if err := repo.RemoveUserFromGroup(req.Context(), userID, groupID); err == nil {
+		t.Fatal("expected an error")
+	}
+	span = exportedSpan(t, exporter, "users.repository.RemoveUserFromGroup")
+	assertSpanAttributes(t, span, map[string]interface{}{
+		"operation": "RemoveUserFromGroup",
+		"user.id":   userID,
+		"group.id":  groupID,
+	})
+	if span.Status != SpanStatusError || span.Error != "not a member" {
+		t.Errorf("expected the error of the operation, got %v: %v", span.Status, span.Error)
+	}
+}
+
+func TestTracingHook(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	resource := newTracingResource(exporter)
+
+	err := resource.traceHook(nil, "PostCreateUserHook", func() error {
+		return errors.New("rejected")
+	})
+	if err == nil || err.Error() != "rejected" {
+		t.Fatalf("expected the error of the hook, got %v", err)
+	}
+
+	span := exportedSpan(t, exporter, "users.hook.PostCreateUserHook")
+	assertSpanAttributes(t, span, map[string]interface{}{"hook": "PostCreateUserHook"})
+	if span.Status != SpanStatusError || span.Error != "rejected" {
+		t.Errorf("expected the error of the hook, got %v: %v", span.Status, span.Error)
+	}
+	if span.TraceID == "" || span.ParentSpanID != "" {
+		t.Errorf("expected hooks without a request to start their own trace")
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	resource := &Resource{ctx: newTestContext()}
+	if span := resource.startSpan(httptest.NewRequest("GET", "/api/users", nil), "users.acl"); span != nil {
+		t.Error("expected no span if tracing is disabled")
+	}
+}
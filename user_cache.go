@@ -0,0 +1,465 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"container/list"
+	"errors"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of UserCacheOptions
+const (
+	DefaultUserCacheSize        = 10000
+	DefaultUserCacheTTL         = time.Minute
+	DefaultUserCacheNegativeTTL = 10 * time.Second
+)
+
+// UserCacheOptions configure the caching of user lookups, see CachingUserRepository
+type UserCacheOptions struct {
+	// Backend defaults to a LRUUserCache of Size entries
+	Backend IUserCache
+	Size    int
+	// TTL of cached users and existing usernames and emails, defaults to DefaultUserCacheTTL
+	TTL time.Duration
+	// NegativeTTL of usernames and emails that don't exist, defaults to DefaultUserCacheNegativeTTL
+	NegativeTTL time.Duration
+}
+
+// UserCacheStats counts the lookups served from the cache (hits) or the repository (misses)
+type UserCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+//---- LRU cache ----
+
+// LRUUserCache is an in-memory IUserCache evicting the least recently used entries beyond its size
+type LRUUserCache struct {
+	mutex   sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func NewLRUUserCache(size int) *LRUUserCache {
+	if size < 1 {
+		size = DefaultUserCacheSize
+	}
+	return &LRUUserCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (cache *LRUUserCache) Get(key string) (interface{}, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (cache *LRUUserCache) Set(key string, value interface{}, ttl time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := &lruEntry{key, value, time.Now().Add(ttl)}
+	if element, ok := cache.entries[key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (cache *LRUUserCache) Delete(keys ...string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, key := range keys {
+		if element, ok := cache.entries[key]; ok {
+			cache.order.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+}
+
+func (cache *LRUUserCache) Clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.order.Init()
+	cache.entries = map[string]*list.Element{}
+}
+
+//---- Caching repository ----
+
+// NewCachingUserRepositoryFactory decorates the repositories of the factory with a cache of user lookups
+func NewCachingUserRepositoryFactory(factory IUserRepositoryFactory, options *UserCacheOptions) *CachingUserRepositoryFactory {
+	if options == nil {
+		options = &UserCacheOptions{}
+	}
+	cached := *options
+	if cached.Backend == nil {
+		cached.Backend = NewLRUUserCache(cached.Size)
+	}
+	if cached.TTL <= 0 {
+		cached.TTL = DefaultUserCacheTTL
+	}
+	if cached.NegativeTTL <= 0 {
+		cached.NegativeTTL = DefaultUserCacheNegativeTTL
+	}
+	return &CachingUserRepositoryFactory{
+		Factory: factory,
+		options: &cached,
+	}
+}
+
+// CachingUserRepositoryFactory does not implement IContextUserRepositoryFactory, even if the decorated factory does:
+// repositories of its NewContext would bypass the cache, and leave stale entries behind their writes.
+// The caching repositories of requests are adapted with NewContextUserRepository instead,
+// so RepositoryTimeouts only abandon their reads and can't interrupt the database.
+type CachingUserRepositoryFactory struct {
+	Factory IUserRepositoryFactory
+	options *UserCacheOptions
+	hits    uint64
+	misses  uint64
+}
+
+func (factory *CachingUserRepositoryFactory) New(db domain.IDatabase) IUserRepository {
+	return &CachingUserRepository{factory.Factory.New(db), factory, ""}
+}
+
+// NewForOrganization requires the decorated factory to implement IOrganizationUserRepositoryFactory
+func (factory *CachingUserRepositoryFactory) NewForOrganization(db domain.IDatabase, organizationID string) IUserRepository {
+	repo := factory.Factory.(IOrganizationUserRepositoryFactory).NewForOrganization(db, organizationID)
+	return &CachingUserRepository{repo, factory, organizationID}
+}
+
+// Stats returns the hits and misses of user lookups
+func (factory *CachingUserRepositoryFactory) Stats() UserCacheStats {
+	return UserCacheStats{
+		Hits:   atomic.LoadUint64(&factory.hits),
+		Misses: atomic.LoadUint64(&factory.misses),
+	}
+}
+
+// CachingUserRepository caches user lookups by id and username, and username and email existence checks.
+// Users are cached regardless of the organization, and only returned if they are members of the repository's.
+// The cache is invalidated by the writes of the repository: the changed users on create, update and delete,
+// everything on bulk deletes and group removals. Writes to the collection outside of the repository (for eg: migrations)
+// are only seen once the entries expire.
+// Every method of IUserRepository is implemented, so that no write reaches the decorated repository uncached.
+type CachingUserRepository struct {
+	Repository     IUserRepository
+	factory        *CachingUserRepositoryFactory
+	OrganizationID string
+}
+
+// Unwrap returns the decorated repository
+func (repo *CachingUserRepository) Unwrap() IUserRepository {
+	return repo.Repository
+}
+
+// unwrapUserRepository returns the repository decorated by a CachingUserRepository, if any,
+// to check the optional interfaces it implements
+func unwrapUserRepository(repo IUserRepository) IUserRepository {
+	if cached, ok := repo.(*CachingUserRepository); ok {
+		return cached.Unwrap()
+	}
+	return repo
+}
+
+func userIDCacheKey(id string) string {
+	return "user:id:" + id
+}
+
+func usernameCacheKey(username string) string {
+	return "user:username:" + username
+}
+
+func usernameExistsCacheKey(username string) string {
+	return "exists:username:" + username
+}
+
+func emailExistsCacheKey(email string) string {
+	return "exists:email:" + email
+}
+
+func (repo *CachingUserRepository) cache() IUserCache {
+	return repo.factory.options.Backend
+}
+
+func (repo *CachingUserRepository) hit() {
+	atomic.AddUint64(&repo.factory.hits, 1)
+}
+
+func (repo *CachingUserRepository) miss() {
+	atomic.AddUint64(&repo.factory.misses, 1)
+}
+
+// cachedUser returns a copy of the cached user if it is visible from the repository's organization
+func (repo *CachingUserRepository) cachedUser(key string) (*User, bool) {
+	value, ok := repo.cache().Get(key)
+	if !ok {
+		return nil, false
+	}
+	user, ok := value.(*User)
+	if !ok || (repo.OrganizationID != "" && !user.IsMemberOf(repo.OrganizationID)) {
+		return nil, false
+	}
+	return copyUser(user), true
+}
+
+func (repo *CachingUserRepository) cacheUser(user *User) {
+	cached := copyUser(user)
+	repo.cache().Set(userIDCacheKey(user.ID.Hex()), cached, repo.factory.options.TTL)
+	repo.cache().Set(usernameCacheKey(user.Username), cached, repo.factory.options.TTL)
+}
+
+func (repo *CachingUserRepository) GetUsers() domain.IUsers {
+	return repo.Repository.GetUsers()
+}
+
+func (repo *CachingUserRepository) FilterUsers(field string, query string, cursor string, limit int, sort string) domain.IUsers {
+	return repo.Repository.FilterUsers(field, query, cursor, limit, sort)
+}
+
+func (repo *CachingUserRepository) CountUsers(field string, query string) int {
+	return repo.Repository.CountUsers(field, query)
+}
+
+// GetUserById Get user specified by the id, from the cache if possible
+func (repo *CachingUserRepository) GetUserById(id string) (domain.IUser, error) {
+	if user, ok := repo.cachedUser(userIDCacheKey(id)); ok {
+		repo.hit()
+		return user, nil
+	}
+	repo.miss()
+	user, err := repo.Repository.GetUserById(id)
+	if err == nil {
+		repo.cacheUser(user.(*User))
+	}
+	return user, err
+}
+
+// GetUserByUsername Get user specified by the username, from the cache if possible
+func (repo *CachingUserRepository) GetUserByUsername(username string) (domain.IUser, error) {
+	if user, ok := repo.cachedUser(usernameCacheKey(username)); ok {
+		repo.hit()
+		return user, nil
+	}
+	repo.miss()
+	user, err := repo.Repository.GetUserByUsername(username)
+	if err == nil {
+		repo.cacheUser(user.(*User))
+	}
+	return user, err
+}
+
+// UserExistsByUsername Check if username already exists, from the cache if possible
+func (repo *CachingUserRepository) UserExistsByUsername(username string) bool {
+	return repo.exists(usernameExistsCacheKey(username), func() bool {
+		return repo.Repository.UserExistsByUsername(username)
+	})
+}
+
+// UserExistsByEmail Check if email already exists, from the cache if possible
+func (repo *CachingUserRepository) UserExistsByEmail(email string) bool {
+	return repo.exists(emailExistsCacheKey(email), func() bool {
+		return repo.Repository.UserExistsByEmail(email)
+	})
+}
+
+func (repo *CachingUserRepository) exists(key string, check func() bool) bool {
+	if value, ok := repo.cache().Get(key); ok {
+		if exists, ok := value.(bool); ok {
+			repo.hit()
+			return exists
+		}
+	}
+	repo.miss()
+	exists := check()
+	ttl := repo.factory.options.TTL
+	if !exists {
+		ttl = repo.factory.options.NegativeTTL
+	}
+	repo.cache().Set(key, exists, ttl)
+	return exists
+}
+
+// invalidate removes the entries of the user specified by the id, and of the given versions of the user.
+// If no version is given, the current one is looked up.
+func (repo *CachingUserRepository) invalidate(id string, users ...*User) {
+	if len(users) == 0 {
+		if user, err := repo.Repository.GetUserById(id); err == nil {
+			users = append(users, user.(*User))
+		}
+	}
+	keys := []string{userIDCacheKey(id)}
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		keys = append(keys,
+			userIDCacheKey(user.ID.Hex()),
+			usernameCacheKey(user.Username),
+			usernameExistsCacheKey(user.Username),
+			emailExistsCacheKey(user.Email),
+		)
+	}
+	repo.cache().Delete(keys...)
+}
+
+// before returns the current version of the user, to invalidate its entries after a write
+func (repo *CachingUserRepository) before(id string) *User {
+	user, err := repo.Repository.GetUserById(id)
+	if err != nil {
+		return nil
+	}
+	return user.(*User)
+}
+
+func (repo *CachingUserRepository) CreateUser(user domain.IUser) error {
+	err := repo.Repository.CreateUser(user)
+	repo.invalidate(user.(*User).ID.Hex(), user.(*User))
+	return err
+}
+
+func (repo *CachingUserRepository) UpdateUser(id string, inUser domain.IUser) (domain.IUser, error) {
+	before := repo.before(id)
+	user, err := repo.Repository.UpdateUser(id, inUser)
+	repo.invalidate(id, before, asUser(user))
+	return user, err
+}
+
+func (repo *CachingUserRepository) DeleteUser(id string) error {
+	before := repo.before(id)
+	err := repo.Repository.DeleteUser(id)
+	repo.invalidate(id, before)
+	return err
+}
+
+func (repo *CachingUserRepository) DeleteUsers(ids []string) error {
+	err := repo.Repository.DeleteUsers(ids)
+	repo.cache().Clear()
+	return err
+}
+
+func (repo *CachingUserRepository) DeleteAllUsers() error {
+	err := repo.Repository.DeleteAllUsers()
+	repo.cache().Clear()
+	return err
+}
+
+// FilterUsersByGroup requires the decorated repository to implement IGroupUserRepository
+func (repo *CachingUserRepository) FilterUsersByGroup(groupID string, lastID string, limit int, sort string) domain.IUsers {
+	groupRepo, ok := repo.Repository.(IGroupUserRepository)
+	if !ok {
+		return &Users{}
+	}
+	return groupRepo.FilterUsersByGroup(groupID, lastID, limit, sort)
+}
+
+// AddUserToGroup requires the decorated repository to implement IGroupUserRepository
+func (repo *CachingUserRepository) AddUserToGroup(id string, groupID string) error {
+	groupRepo, ok := repo.Repository.(IGroupUserRepository)
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	err := groupRepo.AddUserToGroup(id, groupID)
+	repo.invalidate(id)
+	return err
+}
+
+// RemoveUserFromGroup requires the decorated repository to implement IGroupUserRepository
+func (repo *CachingUserRepository) RemoveUserFromGroup(id string, groupID string) error {
+	groupRepo, ok := repo.Repository.(IGroupUserRepository)
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	err := groupRepo.RemoveUserFromGroup(id, groupID)
+	repo.invalidate(id)
+	return err
+}
+
+// RemoveGroupFromUsers requires the decorated repository to implement IGroupUserRepository
+func (repo *CachingUserRepository) RemoveGroupFromUsers(groupID string) error {
+	groupRepo, ok := repo.Repository.(IGroupUserRepository)
+	if !ok {
+		return NewMessageError(CodeGroupsNotSupported)
+	}
+	err := groupRepo.RemoveGroupFromUsers(groupID)
+	repo.cache().Clear()
+	return err
+}
+
+// CreateUserWithOutbox requires the decorated repository to implement IOutboxUserRepository
+func (repo *CachingUserRepository) CreateUserWithOutbox(user domain.IUser, messages ...IOutboxMessage) error {
+	outboxRepo, ok := repo.Repository.(IOutboxUserRepository)
+	if !ok {
+		return errors.New("User repository does not implement IOutboxUserRepository")
+	}
+	err := outboxRepo.CreateUserWithOutbox(user, messages...)
+	repo.invalidate(user.(*User).ID.Hex(), user.(*User))
+	return err
+}
+
+// UpdateUserWithOutbox requires the decorated repository to implement IOutboxUserRepository
+func (repo *CachingUserRepository) UpdateUserWithOutbox(id string, inUser domain.IUser, messages ...IOutboxMessage) (domain.IUser, error) {
+	outboxRepo, ok := repo.Repository.(IOutboxUserRepository)
+	if !ok {
+		return nil, errors.New("User repository does not implement IOutboxUserRepository")
+	}
+	before := repo.before(id)
+	user, err := outboxRepo.UpdateUserWithOutbox(id, inUser, messages...)
+	repo.invalidate(id, before, asUser(user))
+	return user, err
+}
+
+// copyUser returns a copy of the user that shares no slices with it
+func copyUser(user *User) *User {
+	copied := *user
+	if user.Roles != nil {
+		copied.Roles = append(Roles{}, user.Roles...)
+	}
+	if user.Groups != nil {
+		copied.Groups = append([]bson.ObjectId{}, user.Groups...)
+	}
+	if user.Outbox != nil {
+		copied.Outbox = append([]OutboxMessage{}, user.Outbox...)
+	}
+	if user.Organizations != nil {
+		copied.Organizations = []Membership{}
+		for _, membership := range user.Organizations {
+			if membership.Roles != nil {
+				membership.Roles = append(Roles{}, membership.Roles...)
+			}
+			copied.Organizations = append(copied.Organizations, membership)
+		}
+	}
+	return &copied
+}
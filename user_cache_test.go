@@ -0,0 +1,217 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func newCachingTestFactory(options *UserCacheOptions, users ...*User) (*CachingUserRepositoryFactory, *memoryUserStore) {
+	store := newMemoryUserStore(users...)
+	return NewCachingUserRepositoryFactory(&memoryUserRepositoryFactory{store}, options), store
+}
+
+func assertCacheStats(t *testing.T, factory *CachingUserRepositoryFactory, hits uint64, misses uint64) {
+	if stats := factory.Stats(); stats.Hits != hits || stats.Misses != misses {
+		t.Errorf("expected %v hits and %v misses, got %v and %v", hits, misses, stats.Hits, stats.Misses)
+	}
+}
+
+func TestCachingUserRepositoryHitsAndMisses(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	factory, store := newCachingTestFactory(nil, user)
+	repo := factory.New(nil)
+
+	for i := 0; i < 2; i++ {
+		cached, err := repo.GetUserById(user.ID.Hex())
+		if err != nil || cached.(*User).Username != user.Username {
+			t.Fatalf("expected the user, got %v, %v", cached, err)
+		}
+	}
+	assertCacheStats(t, factory, 1, 1)
+
+	// the lookup by id cached the user by username too
+	if _, err := repo.GetUserByUsername(user.Username); err != nil {
+		t.Fatal(err)
+	}
+	assertCacheStats(t, factory, 2, 1)
+	if store.lookups != 1 {
+		t.Errorf("expected a single lookup of the repository, got %v", store.lookups)
+	}
+
+	// existence checks are cached, including negative ones
+	for i := 0; i < 2; i++ {
+		if !repo.UserExistsByEmail(user.Email) {
+			t.Error("expected the email to exist")
+		}
+		if repo.UserExistsByUsername("nobody") {
+			t.Error("expected the username not to exist")
+		}
+	}
+	assertCacheStats(t, factory, 4, 3)
+}
+
+func TestCachingUserRepositoryReturnsCopies(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	factory, _ := newCachingTestFactory(nil, user)
+	repo := factory.New(nil)
+
+	cached, _ := repo.GetUserById(user.ID.Hex())
+	cached.(*User).Roles[0] = RoleAdmin
+	cached, _ = repo.GetUserById(user.ID.Hex())
+	if cached.(*User).HasRole(RoleAdmin) {
+		t.Error("expected changes of returned users not to change the cache")
+	}
+}
+
+func TestCachingUserRepositoryInvalidatesUpdates(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	factory, _ := newCachingTestFactory(nil, user)
+	repo := factory.New(nil)
+
+	repo.GetUserById(user.ID.Hex())
+	if !repo.UserExistsByUsername(user.Username) || repo.UserExistsByUsername("renamed") {
+		t.Fatal("expected only the current username to exist")
+	}
+
+	_, err := repo.UpdateUser(user.ID.Hex(), &User{Username: "renamed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := repo.GetUserById(user.ID.Hex())
+	if err != nil || updated.(*User).Username != "renamed" {
+		t.Errorf("expected the updated user, got %v, %v", updated, err)
+	}
+	if _, err := repo.GetUserByUsername(user.Username); err == nil {
+		t.Error("expected the previous username not to be found")
+	}
+	if repo.UserExistsByUsername(user.Username) || !repo.UserExistsByUsername("renamed") {
+		t.Error("expected the existence of the usernames to be invalidated")
+	}
+}
+
+func TestCachingUserRepositoryInvalidatesDeletes(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	factory, _ := newCachingTestFactory(nil, user)
+	repo := factory.New(nil)
+
+	repo.GetUserById(user.ID.Hex())
+	if err := repo.DeleteUser(user.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUserById(user.ID.Hex()); err == nil {
+		t.Error("expected the deleted user not to be found")
+	}
+	if repo.UserExistsByUsername(user.Username) {
+		t.Error("expected the username of the deleted user not to exist")
+	}
+}
+
+func TestCachingUserRepositoryInvalidatesBulkWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(repo IUserRepository, user *User, groupID string) error
+		check func(user *User) bool
+	}{
+		{"DeleteUsers", func(repo IUserRepository, user *User, groupID string) error {
+			return repo.DeleteUsers([]string{user.ID.Hex()})
+		}, nil},
+		{"DeleteAllUsers", func(repo IUserRepository, user *User, groupID string) error {
+			return repo.DeleteAllUsers()
+		}, nil},
+		{"RemoveGroupFromUsers", func(repo IUserRepository, user *User, groupID string) error {
+			return repo.(IGroupUserRepository).RemoveGroupFromUsers(groupID)
+		}, func(user *User) bool {
+			return len(user.Groups) == 0
+		}},
+	}
+	for _, test := range tests {
+		groupID := bson.NewObjectId()
+		user := newTestUser(StatusActive, RoleUser)
+		user.Groups = []bson.ObjectId{groupID}
+		factory, _ := newCachingTestFactory(nil, user)
+		repo := factory.New(nil)
+
+		repo.GetUserById(user.ID.Hex())
+		if err := test.write(repo, user, groupID.Hex()); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		changed, err := repo.GetUserById(user.ID.Hex())
+		if test.check == nil && err == nil {
+			t.Errorf("%v: expected the deleted user not to be found", test.name)
+		}
+		if test.check != nil && (err != nil || !test.check(changed.(*User))) {
+			t.Errorf("%v: expected the changed user, got %v, %v", test.name, changed, err)
+		}
+	}
+}
+
+func TestCachingUserRepositoryExpires(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	factory, store := newCachingTestFactory(&UserCacheOptions{TTL: 10 * time.Millisecond, NegativeTTL: 10 * time.Millisecond}, user)
+	repo := factory.New(nil)
+
+	repo.GetUserById(user.ID.Hex())
+	repo.UserExistsByUsername("nobody")
+	time.Sleep(20 * time.Millisecond)
+	repo.GetUserById(user.ID.Hex())
+	repo.UserExistsByUsername("nobody")
+
+	assertCacheStats(t, factory, 0, 4)
+	if store.lookups != 4 {
+		t.Errorf("expected the expired entries to be looked up again, got %v lookups", store.lookups)
+	}
+}
+
+func TestCachingUserRepositoryOrganizations(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	user.Organizations = []Membership{{OrganizationID: "acme"}}
+	factory, _ := newCachingTestFactory(nil, user)
+
+	if _, err := factory.NewForOrganization(nil, "acme").GetUserById(user.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := factory.NewForOrganization(nil, "globex").GetUserById(user.ID.Hex()); err == nil {
+		t.Error("expected the cached user not to be visible to another organization")
+	}
+	if _, err := factory.NewForOrganization(nil, "globex").GetUserByUsername(user.Username); err == nil {
+		t.Error("expected the cached username not to be visible to another organization")
+	}
+	assertCacheStats(t, factory, 0, 3)
+	if _, err := factory.New(nil).GetUserById(user.ID.Hex()); err != nil {
+		t.Error("expected the cached user to be visible to unscoped repositories")
+	}
+	assertCacheStats(t, factory, 1, 3)
+}
+
+func TestCachingUserRepositoryGroups(t *testing.T) {
+	user := newTestUser(StatusActive, RoleUser)
+	factory, _ := newCachingTestFactory(nil, user)
+	repo := NewContextUserRepository(factory.New(nil)).(IContextGroupUserRepository)
+	groupID := bson.NewObjectId().Hex()
+	ctx := context.Background()
+
+	factory.New(nil).GetUserById(user.ID.Hex())
+	if err := repo.AddUserToGroup(ctx, user.ID.Hex(), groupID); err != nil {
+		t.Fatal(err)
+	}
+	members, err := repo.FilterUsersByGroup(ctx, groupID, "", 10, "")
+	if err != nil || len(*members.(*Users)) != 1 {
+		t.Fatalf("expected the member of the group, got %v, %v", members, err)
+	}
+	cached, _ := factory.New(nil).GetUserById(user.ID.Hex())
+	if len(cached.(*User).Groups) != 1 {
+		t.Error("expected the cached user to be invalidated once added to the group")
+	}
+
+	if err := repo.RemoveUserFromGroup(ctx, user.ID.Hex(), groupID); err != nil {
+		t.Fatal(err)
+	}
+	cached, _ = factory.New(nil).GetUserById(user.ID.Hex())
+	if len(cached.(*User).Groups) != 0 {
+		t.Error("expected the cached user to be invalidated once removed from the group")
+	}
+}
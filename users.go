@@ -22,21 +22,34 @@ type NewUser struct {
 	Username string `json:"username,omitempty"`
 	Email    string `json:"email,omitempty"`
 	Password string `json:"password,omitempty"`
+	Locale   string `json:"locale,omitempty"`
+}
+
+// Membership of a user in an organization, with the roles held within that organization
+type Membership struct {
+	OrganizationID string `json:"organizationId" bson:"organizationId"`
+	Roles          Roles  `json:"roles,omitempty" bson:"roles"`
 }
 
 // User model struct implements domain.IUser
 type User struct {
-	ID               bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
-	Username         string        `json:"username,omitempty" bson:"username"`
-	Email            string        `json:"email,omitempty" bson:"email"`
-	Roles            Roles         `json:"roles,omitempty" bson:"roles"`
-	Status           string        `json:"status,omitempty" bson:"status"`
-	LastModifiedDate time.Time     `json:"lastModifiedDate" bson:"lastModifiedDate"`
-	CreatedDate      time.Time     `json:"createdDate,omitempty" bson:"createdDate"`
+	ID               bson.ObjectId   `json:"id,omitempty" bson:"_id,omitempty"`
+	Username         string          `json:"username,omitempty" bson:"username"`
+	Email            string          `json:"email,omitempty" bson:"email"`
+	Roles            Roles           `json:"roles,omitempty" bson:"roles"`
+	Status           string          `json:"status,omitempty" bson:"status"`
+	Locale           string          `json:"locale,omitempty" bson:"locale,omitempty"`
+	Organizations    []Membership    `json:"organizations,omitempty" bson:"organizations,omitempty"`
+	Groups           []bson.ObjectId `json:"groups,omitempty" bson:"groups,omitempty"`
+	LastModifiedDate time.Time       `json:"lastModifiedDate" bson:"lastModifiedDate"`
+	CreatedDate      time.Time       `json:"createdDate,omitempty" bson:"createdDate"`
 
 	// fields are not exported to JSON
 	ConfirmationCode string `json:"-" bson:"confirmationCode"`
 	HashedPassword   string `json:"-" bson:"hashedPassword"`
+
+	// outbox messages written with the user change, awaiting relay by the OutboxDispatcher
+	Outbox []OutboxMessage `json:"-" bson:"outbox,omitempty"`
 }
 
 // Users struct
@@ -100,3 +113,41 @@ func (user *User) HasRole(r domain.IRole) bool {
 	}
 	return false
 }
+
+// Membership returns the user's membership in the given organization, or nil
+func (user *User) Membership(organizationID string) *Membership {
+	for i := range user.Organizations {
+		if user.Organizations[i].OrganizationID == organizationID {
+			return &user.Organizations[i]
+		}
+	}
+	return nil
+}
+
+// IsMemberOf checks if user belongs to the given organization
+func (user *User) IsMemberOf(organizationID string) bool {
+	return user.Membership(organizationID) != nil
+}
+
+// HasOrganizationRole checks if user holds the role within the given organization
+func (user *User) HasOrganizationRole(organizationID string, role Role) bool {
+	membership := user.Membership(organizationID)
+	if membership == nil {
+		return false
+	}
+	for _, a := range membership.Roles {
+		if a == role {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupIDs returns the ids of the groups the user is a member of
+func (user *User) GroupIDs() []string {
+	ids := []string{}
+	for _, id := range user.Groups {
+		ids = append(ids, id.Hex())
+	}
+	return ids
+}
@@ -0,0 +1,306 @@
+package users
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+//---- Webhook Request API v0 ----
+
+// NewWebhook holds the webhook fields accepted from clients, including its secret
+type NewWebhook struct {
+	URL    string   `json:"url,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events,omitempty"`
+	Active *bool    `json:"active,omitempty"`
+}
+
+type ListWebhooksResponse_v0 struct {
+	Webhooks Webhooks `json:"webhooks"`
+	LastID   string   `json:"last_id,omitempty"`
+	Code     string   `json:"code,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Success  bool     `json:"success"`
+}
+
+type CreateWebhookRequest_v0 struct {
+	Webhook NewWebhook `json:"webhook"`
+}
+
+type CreateWebhookResponse_v0 struct {
+	Webhook Webhook `json:"webhook,omitempty"`
+	Code    string  `json:"code,omitempty"`
+	Message string  `json:"message,omitempty"`
+	Success bool    `json:"success"`
+}
+
+type GetWebhookResponse_v0 struct {
+	Webhook Webhook `json:"webhook,omitempty"`
+	Code    string  `json:"code,omitempty"`
+	Message string  `json:"message,omitempty"`
+	Success bool    `json:"success"`
+}
+
+type UpdateWebhookRequest_v0 struct {
+	Webhook NewWebhook `json:"webhook"`
+}
+
+type UpdateWebhookResponse_v0 struct {
+	Webhook Webhook `json:"webhook,omitempty"`
+	Code    string  `json:"code,omitempty"`
+	Message string  `json:"message,omitempty"`
+	Success bool    `json:"success"`
+}
+
+type DeleteWebhookResponse_v0 struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success"`
+}
+
+type ListWebhookDeliveriesResponse_v0 struct {
+	Deliveries WebhookDeliveries `json:"deliveries"`
+	LastID     string            `json:"last_id,omitempty"`
+	Code       string            `json:"code,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Success    bool              `json:"success"`
+}
+
+type ReplayWebhookDeliveryResponse_v0 struct {
+	Delivery WebhookDelivery `json:"delivery,omitempty"`
+	Code     string          `json:"code,omitempty"`
+	Message  string          `json:"message,omitempty"`
+	Success  bool            `json:"success"`
+}
+
+// validateWebhookEvents ensures that webhooks only subscribe to known event types
+func validateWebhookEvents(events []string) error {
+	known := map[string]bool{WebhookAllEvents: true}
+	for _, t := range EventTypes {
+		known[string(t)] = true
+	}
+	for _, event := range events {
+		if !known[event] {
+			return NewMessageError(CodeUnknownEventType, event)
+		}
+	}
+	return nil
+}
+
+// HandleListWebhooks_v0 lists webhooks
+func (resource *Resource) HandleListWebhooks_v0(w http.ResponseWriter, req *http.Request) {
+	lastID := req.FormValue("last_id")
+
+	perPage, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	webhooks := *resource.WebhookRepository(req).FilterWebhooks(lastID, perPage).(*Webhooks)
+	if len(webhooks) > 0 {
+		lastID = webhooks[len(webhooks)-1].ID.Hex()
+	}
+	setLastIDPageLinks(w, req, lastID, len(webhooks), perPage)
+	resource.Render(w, req, http.StatusOK, ListWebhooksResponse_v0{
+		Webhooks: webhooks,
+		LastID:   lastID,
+		Code:     CodeWebhooksRetrieved,
+		Message:  resource.Message(req, CodeWebhooksRetrieved),
+		Success:  true,
+	})
+}
+
+// HandleCreateWebhook_v0 registers a new webhook
+func (resource *Resource) HandleCreateWebhook_v0(w http.ResponseWriter, req *http.Request) {
+	var body CreateWebhookRequest_v0
+	err := resource.DecodeRequestBody(w, req, &body)
+	if err != nil {
+		return
+	}
+
+	newWebhook := Webhook{
+		URL:    body.Webhook.URL,
+		Secret: body.Webhook.Secret,
+		Events: body.Webhook.Events,
+		Active: body.Webhook.Active == nil || *body.Webhook.Active,
+	}
+	if !resource.WebhookDispatcher.IsValidWebhook(&newWebhook) {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidWebhook)
+		return
+	}
+	err = validateWebhookEvents(newWebhook.Events)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	err = resource.WebhookRepository(req).CreateWebhook(&newWebhook)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeWebhookSaveFailed)
+		return
+	}
+
+	resource.Render(w, req, http.StatusCreated, CreateWebhookResponse_v0{
+		Webhook: newWebhook,
+		Code:    CodeWebhookCreated,
+		Message: resource.Message(req, CodeWebhookCreated),
+		Success: true,
+	})
+}
+
+// HandleGetWebhook_v0 gets webhook object
+func (resource *Resource) HandleGetWebhook_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	_webhook, err := resource.WebhookRepository(req).GetWebhookById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeWebhookNotFound)
+		return
+	}
+
+	resource.Render(w, req, http.StatusOK, GetWebhookResponse_v0{
+		Webhook: *_webhook.(*Webhook),
+		Code:    CodeWebhookRetrieved,
+		Message: resource.Message(req, CodeWebhookRetrieved),
+		Success: true,
+	})
+}
+
+// HandleUpdateWebhook_v0 updates webhook object
+func (resource *Resource) HandleUpdateWebhook_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	var body UpdateWebhookRequest_v0
+	err := resource.DecodeRequestBody(w, req, &body)
+	if err != nil {
+		return
+	}
+
+	repo := resource.WebhookRepository(req)
+	_webhook, err := repo.GetWebhookById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeWebhookNotFound)
+		return
+	}
+	webhook := _webhook.(*Webhook)
+
+	// merge the given fields into the current webhook
+	if body.Webhook.URL != "" {
+		webhook.URL = body.Webhook.URL
+	}
+	if body.Webhook.Secret != "" {
+		webhook.Secret = body.Webhook.Secret
+	}
+	if len(body.Webhook.Events) > 0 {
+		webhook.Events = body.Webhook.Events
+	}
+	if body.Webhook.Active != nil {
+		webhook.Active = *body.Webhook.Active
+	}
+	if !resource.WebhookDispatcher.IsValidWebhook(webhook) {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeInvalidWebhook)
+		return
+	}
+	err = validateWebhookEvents(webhook.Events)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	_webhook, err = repo.UpdateWebhook(id, webhook)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	resource.Render(w, req, http.StatusOK, UpdateWebhookResponse_v0{
+		Webhook: *_webhook.(*Webhook),
+		Code:    CodeWebhookUpdated,
+		Message: resource.Message(req, CodeWebhookUpdated),
+		Success: true,
+	})
+}
+
+// HandleDeleteWebhook_v0 deletes webhook object
+func (resource *Resource) HandleDeleteWebhook_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	err := resource.WebhookRepository(req).DeleteWebhook(id)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	resource.Render(w, req, http.StatusOK, DeleteWebhookResponse_v0{
+		Code:    CodeWebhookDeleted,
+		Message: resource.Message(req, CodeWebhookDeleted),
+		Success: true,
+	})
+}
+
+// HandleListWebhookDeliveries_v0 lists the deliveries of a webhook,
+// use `status=dead` to list the dead-letter queue
+func (resource *Resource) HandleListWebhookDeliveries_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+
+	repo := resource.WebhookRepository(req)
+	_, err := repo.GetWebhookById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeWebhookNotFound)
+		return
+	}
+
+	lastID := req.FormValue("last_id")
+	status := req.FormValue("status")
+
+	perPage, err := resource.perPage(req)
+	if err != nil {
+		resource.RenderErrorFrom(w, req, http.StatusBadRequest, err)
+		return
+	}
+	deliveries := *repo.FilterDeliveries(id, status, lastID, perPage).(*WebhookDeliveries)
+	if len(deliveries) > 0 {
+		lastID = deliveries[len(deliveries)-1].ID.Hex()
+	}
+	setLastIDPageLinks(w, req, lastID, len(deliveries), perPage)
+	resource.Render(w, req, http.StatusOK, ListWebhookDeliveriesResponse_v0{
+		Deliveries: deliveries,
+		LastID:     lastID,
+		Code:       CodeWebhookDeliveriesRetrieved,
+		Message:    resource.Message(req, CodeWebhookDeliveriesRetrieved),
+		Success:    true,
+	})
+}
+
+// HandleReplayWebhookDelivery_v0 attempts a delivery again
+func (resource *Resource) HandleReplayWebhookDelivery_v0(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+	deliveryID := params["delivery_id"]
+
+	repo := resource.WebhookRepository(req)
+	_webhook, err := repo.GetWebhookById(id)
+	if err != nil {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeWebhookNotFound)
+		return
+	}
+	_delivery, err := repo.GetDeliveryById(deliveryID)
+	if err != nil || _delivery.(*WebhookDelivery).WebhookID != id {
+		resource.RenderErrorCode(w, req, http.StatusBadRequest, CodeWebhookDeliveryNotFound)
+		return
+	}
+	delivery := _delivery.(*WebhookDelivery)
+
+	resource.WebhookDispatcher.Replay(_webhook.(*Webhook), delivery)
+
+	resource.Render(w, req, http.StatusOK, ReplayWebhookDeliveryResponse_v0{
+		Delivery: *delivery,
+		Code:     CodeWebhookDeliveryReplayed,
+		Message:  resource.Message(req, CodeWebhookDeliveryReplayed),
+		Success:  true,
+	})
+}
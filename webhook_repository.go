@@ -0,0 +1,197 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"errors"
+	"fmt"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Webhook collection names
+const WebhooksCollection string = "webhooks"
+const WebhookDeliveriesCollection string = "webhookDeliveries"
+
+func NewWebhookRepositoryFactory() IWebhookRepositoryFactory {
+	return &WebhookRepositoryFactory{}
+}
+
+type WebhookRepositoryFactory struct{}
+
+func (factory *WebhookRepositoryFactory) New(db domain.IDatabase, organizationID string) IWebhookRepository {
+	return &WebhookRepository{db, organizationID}
+}
+
+type WebhookRepository struct {
+	DB             domain.IDatabase
+	OrganizationID string
+}
+
+// scope restricts the query to webhooks of the repository's organization, if any
+func (repo *WebhookRepository) scope(q domain.Query) domain.Query {
+	if repo.OrganizationID != "" {
+		q["organizationId"] = repo.OrganizationID
+	}
+	return q
+}
+
+// CreateWebhook Insert new webhook document into the database
+func (repo *WebhookRepository) CreateWebhook(_webhook IWebhook) error {
+	webhook := _webhook.(*Webhook)
+	webhook.ID = bson.NewObjectId()
+	webhook.OrganizationID = repo.OrganizationID
+	webhook.CreatedDate = time.Now()
+	webhook.LastModifiedDate = time.Now()
+	return repo.DB.Insert(WebhooksCollection, webhook)
+}
+
+// FilterWebhooks Get list of webhooks
+func (repo *WebhookRepository) FilterWebhooks(lastID string, limit int) IWebhooks {
+	webhooks := Webhooks{}
+	q := repo.scope(domain.Query{})
+	sort := paginateByID(q, lastID, "-_id")
+	err := repo.DB.FindAll(WebhooksCollection, q, &webhooks, pageLimit(limit), sort)
+	if err != nil {
+		return &Webhooks{}
+	}
+	return &webhooks
+}
+
+// FindWebhooksForEvent Get list of active webhooks subscribed to the event type,
+// registered globally or within the given organization
+func (repo *WebhookRepository) FindWebhooksForEvent(eventType string, organizationID string) IWebhooks {
+	webhooks := Webhooks{}
+	organizations := []string{""}
+	if organizationID != "" {
+		organizations = append(organizations, organizationID)
+	}
+	q := domain.Query{
+		"active":         true,
+		"events":         domain.Query{"$in": []string{eventType, WebhookAllEvents}},
+		"organizationId": domain.Query{"$in": organizations},
+	}
+	err := repo.DB.FindAll(WebhooksCollection, q, &webhooks, 0, "_id")
+	if err != nil {
+		return &Webhooks{}
+	}
+	return &webhooks
+}
+
+// GetWebhookById Get webhook specified by the id
+func (repo *WebhookRepository) GetWebhookById(id string) (IWebhook, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	var webhook Webhook
+	err := repo.DB.FindOne(WebhooksCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)}), &webhook)
+	return &webhook, err
+}
+
+// UpdateWebhook Update webhook specified by the id
+func (repo *WebhookRepository) UpdateWebhook(id string, _inWebhook IWebhook) (IWebhook, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+
+	inWebhook := _inWebhook.(*Webhook)
+
+	// serialize to a sub-set of allowed Webhook fields to update
+	update := domain.Query{
+		"lastModifiedDate": time.Now(),
+		"active":           inWebhook.Active,
+	}
+	if inWebhook.URL != "" {
+		update["url"] = inWebhook.URL
+	}
+	if inWebhook.Secret != "" {
+		update["secret"] = inWebhook.Secret
+	}
+	if len(inWebhook.Events) > 0 {
+		update["events"] = inWebhook.Events
+	}
+
+	query := repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)})
+	change := domain.Change{
+		Update:    domain.Query{"$set": update},
+		ReturnNew: true,
+	}
+	var changedWebhook Webhook
+	err := repo.DB.Update(WebhooksCollection, query, change, &changedWebhook)
+	return &changedWebhook, err
+}
+
+// DeleteWebhook deletes webhook specified by the id
+func (repo *WebhookRepository) DeleteWebhook(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	return repo.DB.RemoveOne(WebhooksCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)}))
+}
+
+// CreateDelivery Insert new delivery document into the database
+func (repo *WebhookRepository) CreateDelivery(_delivery IWebhookDelivery) error {
+	delivery := _delivery.(*WebhookDelivery)
+	delivery.ID = bson.NewObjectId()
+	delivery.CreatedDate = time.Now()
+	return repo.DB.Insert(WebhookDeliveriesCollection, delivery)
+}
+
+// GetDeliveryById Get delivery specified by the id
+func (repo *WebhookRepository) GetDeliveryById(id string) (IWebhookDelivery, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New(fmt.Sprintf("Invalid ObjectId: `%v`", id))
+	}
+	var delivery WebhookDelivery
+	err := repo.DB.FindOne(WebhookDeliveriesCollection, repo.scope(domain.Query{"_id": bson.ObjectIdHex(id)}), &delivery)
+	return &delivery, err
+}
+
+// SaveDelivery Update the state of a delivery after an attempt
+func (repo *WebhookRepository) SaveDelivery(_delivery IWebhookDelivery) error {
+	delivery := _delivery.(*WebhookDelivery)
+	query := domain.Query{"_id": delivery.ID}
+	change := domain.Change{
+		Update: domain.Query{"$set": domain.Query{
+			"status":          delivery.Status,
+			"attempts":        delivery.Attempts,
+			"responseStatus":  delivery.ResponseStatus,
+			"lastError":       delivery.LastError,
+			"nextAttemptDate": delivery.NextAttemptDate,
+			"deliveredDate":   delivery.DeliveredDate,
+		}},
+		ReturnNew: true,
+	}
+	var changedDelivery WebhookDelivery
+	return repo.DB.Update(WebhookDeliveriesCollection, query, change, &changedDelivery)
+}
+
+// FilterDeliveries Get list of deliveries of a webhook, optionally filtered by status
+func (repo *WebhookRepository) FilterDeliveries(webhookID string, status string, lastID string, limit int) IWebhookDeliveries {
+	deliveries := WebhookDeliveries{}
+	q := repo.scope(domain.Query{"webhookId": webhookID})
+	if status != "" {
+		q["status"] = status
+	}
+	sort := paginateByID(q, lastID, "-_id")
+	err := repo.DB.FindAll(WebhookDeliveriesCollection, q, &deliveries, pageLimit(limit), sort)
+	if err != nil {
+		return &WebhookDeliveries{}
+	}
+	return &deliveries
+}
+
+// DueDeliveries Get list of deliveries awaiting a retry
+func (repo *WebhookRepository) DueDeliveries(now time.Time, limit int) IWebhookDeliveries {
+	deliveries := WebhookDeliveries{}
+	q := repo.scope(domain.Query{
+		"status":          WebhookDeliveryPending,
+		"nextAttemptDate": domain.Query{"$lte": now},
+	})
+	err := repo.DB.FindAll(WebhookDeliveriesCollection, q, &deliveries, limit, "_id")
+	if err != nil {
+		return &WebhookDeliveries{}
+	}
+	return &deliveries
+}
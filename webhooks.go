@@ -0,0 +1,399 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WebhookAllEvents subscribes a webhook to every event type
+const WebhookAllEvents = "*"
+
+// Webhook delivery statuses
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryDead      = "dead"
+)
+
+// Webhook request headers
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Webhook model struct implements IWebhook
+type Webhook struct {
+	ID               bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	URL              string        `json:"url,omitempty" bson:"url"`
+	Secret           string        `json:"-" bson:"secret"`
+	Events           []string      `json:"events,omitempty" bson:"events"`
+	Active           bool          `json:"active" bson:"active"`
+	OrganizationID   string        `json:"organizationId,omitempty" bson:"organizationId"`
+	LastModifiedDate time.Time     `json:"lastModifiedDate" bson:"lastModifiedDate"`
+	CreatedDate      time.Time     `json:"createdDate,omitempty" bson:"createdDate"`
+}
+
+// Webhooks struct
+type Webhooks []Webhook
+
+func (webhook *Webhook) GetID() string {
+	return webhook.ID.Hex()
+}
+
+// IsValid Ensures that the webhook object is valid,
+// and that its URL is not a private destination, see WebhookOptions.AllowPrivateDestinations
+func (webhook *Webhook) IsValid() bool {
+	return webhook.isValid(false)
+}
+
+func (webhook *Webhook) isValid(allowPrivateDestinations bool) bool {
+	u, err := url.Parse(webhook.URL)
+	return err == nil &&
+		(u.Scheme == "http" || u.Scheme == "https") &&
+		u.Hostname() != "" &&
+		(allowPrivateDestinations || !isPrivateWebhookHost(u.Hostname())) &&
+		len(webhook.Secret) > 0 &&
+		len(webhook.Events) > 0
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), used by some cloud metadata services
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPrivateWebhookIP returns true for loopback, link-local, private (RFC 1918, RFC 4193),
+// shared and unspecified addresses, which webhooks must not reach unless allowed
+func isPrivateWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// isPrivateWebhookHost returns true for private IP addresses and `localhost` names.
+// Other names are checked when connecting, since they may resolve to different addresses by then.
+func isPrivateWebhookHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return isPrivateWebhookIP(ip)
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// checkWebhookDestination is a net.Dialer.Control rejecting connections to private addresses
+func checkWebhookDestination(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateWebhookIP(ip) {
+		return errors.New(fmt.Sprintf("Webhook destination `%v` is not allowed", host))
+	}
+	return nil
+}
+
+// WebhookDelivery records the delivery of an event to a webhook. WebhookDelivery implements IWebhookDelivery
+type WebhookDelivery struct {
+	ID              bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	WebhookID       string        `json:"webhookId" bson:"webhookId"`
+	OrganizationID  string        `json:"organizationId,omitempty" bson:"organizationId"`
+	Event           EventType     `json:"event" bson:"event"`
+	Payload         string        `json:"payload" bson:"payload"`
+	Status          string        `json:"status" bson:"status"`
+	Attempts        int           `json:"attempts" bson:"attempts"`
+	ResponseStatus  int           `json:"responseStatus,omitempty" bson:"responseStatus"`
+	LastError       string        `json:"lastError,omitempty" bson:"lastError"`
+	NextAttemptDate time.Time     `json:"nextAttemptDate,omitempty" bson:"nextAttemptDate"`
+	DeliveredDate   time.Time     `json:"deliveredDate,omitempty" bson:"deliveredDate"`
+	CreatedDate     time.Time     `json:"createdDate" bson:"createdDate"`
+}
+
+// WebhookDeliveries struct
+type WebhookDeliveries []WebhookDelivery
+
+func (delivery *WebhookDelivery) GetID() string {
+	return delivery.ID.Hex()
+}
+
+// SignWebhookPayload returns the signature of a webhook request:
+// hex-encoded HMAC-SHA256 of `<timestamp>.<body>` keyed with the webhook secret
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the signature of a webhook request received by a subscriber
+func VerifyWebhookSignature(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhookPayload(secret, timestamp, body)), []byte(signature))
+}
+
+type WebhookOptions struct {
+	// Client sends webhook requests, defaults to a client with a 10 seconds timeout.
+	// Unless AllowPrivateDestinations is set, connections of its transport to private addresses fail,
+	// so the transport of a custom client must be nil or an *http.Transport.
+	Client *http.Client
+	// AllowPrivateDestinations allows webhooks to loopback, link-local and private network addresses,
+	// for eg: to receivers within the same network. Off by default to prevent server-side request forgery.
+	AllowPrivateDestinations bool
+	// MaxAttempts before a delivery is moved to the dead-letter queue, defaults to 8
+	MaxAttempts int
+	// InitialBackoff is doubled after every failed attempt, defaults to 1 second
+	InitialBackoff time.Duration
+	// MaxBackoff defaults to 1 hour
+	MaxBackoff time.Duration
+}
+
+// WebhookDispatcher delivers user lifecycle events to registered webhooks.
+// The JSON-encoded Event is posted as the request body.
+// A delivery is attempted as soon as the event is published; failed attempts are retried
+// with exponential backoff until MaxAttempts, after which the delivery is marked `dead`.
+type WebhookDispatcher struct {
+	resource *Resource
+	options  WebhookOptions
+	timers   sync.WaitGroup
+}
+
+func NewWebhookDispatcher(resource *Resource, options *WebhookOptions) *WebhookDispatcher {
+	dispatcher := &WebhookDispatcher{resource: resource}
+	if options != nil {
+		dispatcher.options = *options
+	}
+	if dispatcher.options.Client == nil {
+		dispatcher.options.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if !dispatcher.options.AllowPrivateDestinations {
+		dispatcher.options.Client = guardWebhookClient(dispatcher.options.Client)
+	}
+	if dispatcher.options.MaxAttempts <= 0 {
+		dispatcher.options.MaxAttempts = 8
+	}
+	if dispatcher.options.InitialBackoff <= 0 {
+		dispatcher.options.InitialBackoff = time.Second
+	}
+	if dispatcher.options.MaxBackoff <= 0 {
+		dispatcher.options.MaxBackoff = time.Hour
+	}
+	return dispatcher
+}
+
+// guardWebhookClient returns a copy of the client whose connections to private addresses fail.
+// The address is checked once resolved, so that names resolving to private addresses are rejected too.
+// Proxies are not used, since they would connect on behalf of the client.
+func guardWebhookClient(client *http.Client) *http.Client {
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = nil
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		panic("users.WebhookOptions.Client must have an *http.Transport unless AllowPrivateDestinations is set")
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkWebhookDestination,
+	}
+	dial := transport.DialContext
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if dial == nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		// a custom dial may not use the guarded dialer, check the address it connected to
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || isPrivateWebhookIP(tcpAddr.IP) {
+			conn.Close()
+			return nil, errors.New(fmt.Sprintf("Webhook destination `%v` is not allowed", conn.RemoteAddr()))
+		}
+		return conn, nil
+	}
+	guarded := *client
+	guarded.Transport = transport
+	return &guarded
+}
+
+// IsValidWebhook Ensures that the webhook object is valid,
+// allowing private destinations if WebhookOptions.AllowPrivateDestinations is set
+func (dispatcher *WebhookDispatcher) IsValidWebhook(webhook *Webhook) bool {
+	return webhook.isValid(dispatcher.options.AllowPrivateDestinations)
+}
+
+// repository returns an unscoped webhook repository, deliveries are not made within a request
+func (dispatcher *WebhookDispatcher) repository() IWebhookRepository {
+	return dispatcher.resource.WebhookRepositoryFactory.New(dispatcher.resource.Database, "")
+}
+
+// HandleEvent is subscribed to the event bus for asynchronous delivery
+func (dispatcher *WebhookDispatcher) HandleEvent(resource *Resource, event *Event) error {
+	repo := dispatcher.repository()
+	webhooks := *repo.FindWebhooksForEvent(string(event.Type), event.OrganizationID).(*Webhooks)
+	if len(webhooks) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	for i := range webhooks {
+		webhook := &webhooks[i]
+		delivery := &WebhookDelivery{
+			WebhookID:      webhook.ID.Hex(),
+			OrganizationID: webhook.OrganizationID,
+			Event:          event.Type,
+			Payload:        string(payload),
+			Status:         WebhookDeliveryPending,
+		}
+		err = repo.CreateDelivery(delivery)
+		if err != nil {
+			dispatcher.resource.Logger.Error("users: webhook delivery creation failed", "webhook_id", webhook.ID.Hex(), "event", event.Type, "error", err.Error())
+			continue
+		}
+		dispatcher.Attempt(webhook, delivery)
+	}
+	return nil
+}
+
+// Attempt sends the delivery to the webhook and records the outcome.
+// Failed attempts are scheduled for a retry, until MaxAttempts.
+func (dispatcher *WebhookDispatcher) Attempt(webhook *Webhook, delivery *WebhookDelivery) {
+	delivery.Attempts++
+	status, err := dispatcher.send(webhook, delivery)
+	delivery.ResponseStatus = status
+	if err == nil {
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredDate = time.Now()
+		delivery.NextAttemptDate = time.Time{}
+	} else if delivery.Attempts >= dispatcher.options.MaxAttempts {
+		// move to dead-letter queue
+		delivery.Status = WebhookDeliveryDead
+		delivery.LastError = err.Error()
+		delivery.NextAttemptDate = time.Time{}
+	} else {
+		delivery.Status = WebhookDeliveryPending
+		delivery.LastError = err.Error()
+		delivery.NextAttemptDate = time.Now().Add(dispatcher.Backoff(delivery.Attempts))
+	}
+
+	saveErr := dispatcher.repository().SaveDelivery(delivery)
+	if saveErr != nil {
+		dispatcher.resource.Logger.Error("users: webhook delivery save failed", "delivery_id", delivery.ID.Hex(), "error", saveErr.Error())
+	}
+	if delivery.Status == WebhookDeliveryPending {
+		dispatcher.scheduleRetry(delivery.ID.Hex(), delivery.NextAttemptDate.Sub(time.Now()))
+	}
+}
+
+// Backoff returns the delay before retrying a delivery that failed the given number of attempts
+func (dispatcher *WebhookDispatcher) Backoff(attempts int) time.Duration {
+	return exponentialBackoff(dispatcher.options.InitialBackoff, dispatcher.options.MaxBackoff, attempts)
+}
+
+func (dispatcher *WebhookDispatcher) scheduleRetry(deliveryID string, delay time.Duration) {
+	dispatcher.timers.Add(1)
+	time.AfterFunc(delay, func() {
+		defer dispatcher.timers.Done()
+		dispatcher.Retry(deliveryID)
+	})
+}
+
+// Retry re-attempts a pending delivery, for eg: scheduled after a failed attempt
+func (dispatcher *WebhookDispatcher) Retry(deliveryID string) {
+	repo := dispatcher.repository()
+	_delivery, err := repo.GetDeliveryById(deliveryID)
+	if err != nil {
+		dispatcher.resource.Logger.Error("users: webhook delivery lookup failed", "delivery_id", deliveryID, "error", err.Error())
+		return
+	}
+	delivery := _delivery.(*WebhookDelivery)
+	if delivery.Status != WebhookDeliveryPending {
+		return
+	}
+	_webhook, err := repo.GetWebhookById(delivery.WebhookID)
+	if err != nil {
+		delivery.Status = WebhookDeliveryDead
+		delivery.LastError = "Webhook not found"
+		repo.SaveDelivery(delivery)
+		return
+	}
+	dispatcher.Attempt(_webhook.(*Webhook), delivery)
+}
+
+// RetryDue re-attempts pending deliveries that are due, for eg: retries lost on a restart.
+// Host apps are expected to call it periodically.
+func (dispatcher *WebhookDispatcher) RetryDue(limit int) {
+	deliveries := *dispatcher.repository().DueDeliveries(time.Now(), limit).(*WebhookDeliveries)
+	for _, delivery := range deliveries {
+		dispatcher.Retry(delivery.ID.Hex())
+	}
+}
+
+// Replay resets a delivery, for eg: from the dead-letter queue, and attempts it again
+func (dispatcher *WebhookDispatcher) Replay(webhook *Webhook, delivery *WebhookDelivery) {
+	delivery.Attempts = 0
+	delivery.Status = WebhookDeliveryPending
+	dispatcher.Attempt(webhook, delivery)
+}
+
+// Wait blocks until scheduled retries have run
+func (dispatcher *WebhookDispatcher) Wait() {
+	dispatcher.timers.Wait()
+}
+
+// send posts the signed payload to the webhook, any non-2xx response is a failure
+func (dispatcher *WebhookDispatcher) send(webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(delivery.Event))
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID.Hex())
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, timestamp, body))
+
+	res, err := dispatcher.options.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, errors.New(fmt.Sprintf("Webhook responded with status %v", res.StatusCode))
+	}
+	return res.StatusCode, nil
+}
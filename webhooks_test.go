@@ -0,0 +1,421 @@
+package users
+
+import (
+	. "github.com/sogko/slumber-users/domain"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sogko/slumber/domain"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryWebhookRepository is an in-memory IWebhookRepository
+type memoryWebhookRepository struct {
+	mutex      sync.Mutex
+	webhooks   map[string]Webhook
+	deliveries map[string]WebhookDelivery
+}
+
+func newMemoryWebhookRepository(webhooks ...Webhook) *memoryWebhookRepository {
+	repo := &memoryWebhookRepository{
+		webhooks:   map[string]Webhook{},
+		deliveries: map[string]WebhookDelivery{},
+	}
+	for _, webhook := range webhooks {
+		repo.CreateWebhook(&webhook)
+	}
+	return repo
+}
+
+func (repo *memoryWebhookRepository) New(db domain.IDatabase, organizationID string) IWebhookRepository {
+	return repo
+}
+
+func (repo *memoryWebhookRepository) CreateWebhook(_webhook IWebhook) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	webhook := _webhook.(*Webhook)
+	webhook.ID = bson.NewObjectId()
+	repo.webhooks[webhook.ID.Hex()] = *webhook
+	return nil
+}
+
+func (repo *memoryWebhookRepository) FilterWebhooks(lastID string, limit int) IWebhooks {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	webhooks := Webhooks{}
+	for _, webhook := range repo.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	return &webhooks
+}
+
+func (repo *memoryWebhookRepository) FindWebhooksForEvent(eventType string, organizationID string) IWebhooks {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	webhooks := Webhooks{}
+	for _, webhook := range repo.webhooks {
+		if webhook.Active && (containsString(webhook.Events, eventType) || containsString(webhook.Events, WebhookAllEvents)) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return &webhooks
+}
+
+func (repo *memoryWebhookRepository) GetWebhookById(id string) (IWebhook, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	webhook, ok := repo.webhooks[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &webhook, nil
+}
+
+func (repo *memoryWebhookRepository) UpdateWebhook(id string, inWebhook IWebhook) (IWebhook, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	webhook := *inWebhook.(*Webhook)
+	repo.webhooks[id] = webhook
+	return &webhook, nil
+}
+
+func (repo *memoryWebhookRepository) DeleteWebhook(id string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	delete(repo.webhooks, id)
+	return nil
+}
+
+func (repo *memoryWebhookRepository) CreateDelivery(_delivery IWebhookDelivery) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	delivery := _delivery.(*WebhookDelivery)
+	delivery.ID = bson.NewObjectId()
+	repo.deliveries[delivery.ID.Hex()] = *delivery
+	return nil
+}
+
+func (repo *memoryWebhookRepository) GetDeliveryById(id string) (IWebhookDelivery, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	delivery, ok := repo.deliveries[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &delivery, nil
+}
+
+func (repo *memoryWebhookRepository) SaveDelivery(_delivery IWebhookDelivery) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	delivery := _delivery.(*WebhookDelivery)
+	repo.deliveries[delivery.ID.Hex()] = *delivery
+	return nil
+}
+
+func (repo *memoryWebhookRepository) FilterDeliveries(webhookID string, status string, lastID string, limit int) IWebhookDeliveries {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	deliveries := WebhookDeliveries{}
+	for _, delivery := range repo.deliveries {
+		if (webhookID == "" || delivery.WebhookID == webhookID) && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return &deliveries
+}
+
+func (repo *memoryWebhookRepository) DueDeliveries(now time.Time, limit int) IWebhookDeliveries {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	deliveries := WebhookDeliveries{}
+	for _, delivery := range repo.deliveries {
+		if delivery.Status == WebhookDeliveryPending && !delivery.NextAttemptDate.After(now) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return &deliveries
+}
+
+// onlyDelivery returns the single delivery recorded by the repository
+func (repo *memoryWebhookRepository) onlyDelivery(t *testing.T) WebhookDelivery {
+	deliveries := *repo.FilterDeliveries("", "", "", 0).(*WebhookDeliveries)
+	if len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery, got %v", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+// webhookReceiver is an httptest server answering webhook requests with the given status codes in turn,
+// then 200
+type webhookReceiver struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		receiver.requests = append(receiver.requests, req)
+		receiver.bodies = append(receiver.bodies, body)
+		status := http.StatusOK
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return receiver
+}
+
+func (receiver *webhookReceiver) received() int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return len(receiver.requests)
+}
+
+func newTestWebhookDispatcher(repo *memoryWebhookRepository, options *WebhookOptions) *WebhookDispatcher {
+	resource := &Resource{
+		ctx:                      newTestContext(),
+		Logger:                   NewLogger(nil, LogLevelError),
+		WebhookRepositoryFactory: repo,
+	}
+	resource.WebhookDispatcher = NewWebhookDispatcher(resource, options)
+	return resource.WebhookDispatcher
+}
+
+func newTestWebhook(url string) Webhook {
+	return Webhook{
+		URL:    url,
+		Secret: "s3cr3t",
+		Events: []string{string(EventUserCreated)},
+		Active: true,
+	}
+}
+
+func TestWebhookDeliverySignature(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+	repo := newMemoryWebhookRepository(newTestWebhook(receiver.URL))
+	dispatcher := newTestWebhookDispatcher(repo, &WebhookOptions{AllowPrivateDestinations: true})
+
+	event := &Event{Type: EventUserCreated, User: newTestUser(StatusPending)}
+	err := dispatcher.HandleEvent(dispatcher.resource, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.received() != 1 {
+		t.Fatalf("expected 1 request, got %v", receiver.received())
+	}
+	delivery := repo.onlyDelivery(t)
+	if delivery.Status != WebhookDeliveryDelivered || delivery.Attempts != 1 || delivery.ResponseStatus != http.StatusOK {
+		t.Errorf("expected a delivery on the first attempt, got %+v", delivery)
+	}
+
+	req, body := receiver.requests[0], receiver.bodies[0]
+	if req.Header.Get(WebhookEventHeader) != string(EventUserCreated) {
+		t.Errorf("expected the `%v` event header, got `%v`", EventUserCreated, req.Header.Get(WebhookEventHeader))
+	}
+	if req.Header.Get(WebhookDeliveryHeader) != delivery.ID.Hex() {
+		t.Errorf("expected the delivery header `%v`, got `%v`", delivery.ID.Hex(), req.Header.Get(WebhookDeliveryHeader))
+	}
+	timestamp := req.Header.Get(WebhookTimestampHeader)
+	signature := req.Header.Get(WebhookSignatureHeader)
+	if !VerifyWebhookSignature("s3cr3t", timestamp, body, signature) {
+		t.Errorf("expected a valid signature, got `%v`", signature)
+	}
+	if VerifyWebhookSignature("other", timestamp, body, signature) {
+		t.Error("expected the signature not to verify with another secret")
+	}
+	if VerifyWebhookSignature("s3cr3t", timestamp, append(body, ' '), signature) {
+		t.Error("expected the signature not to verify with another body")
+	}
+	var received Event
+	if err := json.Unmarshal(body, &received); err != nil || received.Type != EventUserCreated || received.User == nil {
+		t.Errorf("expected the event as body, got %s (%v)", body, err)
+	}
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer receiver.Close()
+	repo := newMemoryWebhookRepository(newTestWebhook(receiver.URL))
+	dispatcher := newTestWebhookDispatcher(repo, &WebhookOptions{
+		AllowPrivateDestinations: true,
+		InitialBackoff:           5 * time.Millisecond,
+		MaxBackoff:               20 * time.Millisecond,
+	})
+
+	dispatcher.HandleEvent(dispatcher.resource, &Event{Type: EventUserCreated})
+	delivery := repo.onlyDelivery(t)
+	if delivery.Status != WebhookDeliveryPending || delivery.ResponseStatus != http.StatusServiceUnavailable || delivery.LastError == "" {
+		t.Errorf("expected a pending delivery after a failed attempt, got %+v", delivery)
+	}
+	dispatcher.Wait()
+
+	delivery = repo.onlyDelivery(t)
+	if delivery.Status != WebhookDeliveryDelivered || delivery.Attempts != 3 || delivery.LastError != "" {
+		t.Errorf("expected a delivery on the third attempt, got %+v", delivery)
+	}
+	if receiver.received() != 3 {
+		t.Errorf("expected 3 requests, got %v", receiver.received())
+	}
+	// retries are sent as the same delivery
+	if receiver.requests[0].Header.Get(WebhookDeliveryHeader) != receiver.requests[2].Header.Get(WebhookDeliveryHeader) {
+		t.Error("expected retries to have the delivery header of the first attempt")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	dispatcher := newTestWebhookDispatcher(newMemoryWebhookRepository(), &WebhookOptions{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+	})
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, backoff := range expected {
+		if result := dispatcher.Backoff(i + 1); result != backoff {
+			t.Errorf("expected a backoff of %v after %v attempts, got %v", backoff, i+1, result)
+		}
+	}
+}
+
+func TestWebhookDeadLetterAndReplay(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusInternalServerError, http.StatusInternalServerError)
+	defer receiver.Close()
+	repo := newMemoryWebhookRepository(newTestWebhook(receiver.URL))
+	dispatcher := newTestWebhookDispatcher(repo, &WebhookOptions{
+		AllowPrivateDestinations: true,
+		MaxAttempts:              2,
+		InitialBackoff:           time.Millisecond,
+	})
+
+	dispatcher.HandleEvent(dispatcher.resource, &Event{Type: EventUserCreated})
+	dispatcher.Wait()
+	delivery := repo.onlyDelivery(t)
+	if delivery.Status != WebhookDeliveryDead || delivery.Attempts != 2 || delivery.ResponseStatus != http.StatusInternalServerError {
+		t.Fatalf("expected a dead delivery after MaxAttempts, got %+v", delivery)
+	}
+	if !strings.Contains(delivery.LastError, "500") || !delivery.NextAttemptDate.IsZero() {
+		t.Errorf("expected the last error and no next attempt, got %+v", delivery)
+	}
+	// dead deliveries are not retried
+	dispatcher.Retry(delivery.ID.Hex())
+	dispatcher.RetryDue(10)
+	if receiver.received() != 2 {
+		t.Errorf("expected no retry of a dead delivery, got %v requests", receiver.received())
+	}
+
+	_webhook, _ := repo.GetWebhookById(delivery.WebhookID)
+	dispatcher.Replay(_webhook.(*Webhook), &delivery)
+	delivery = repo.onlyDelivery(t)
+	if delivery.Status != WebhookDeliveryDelivered || delivery.Attempts != 1 {
+		t.Errorf("expected the replayed delivery to be delivered, got %+v", delivery)
+	}
+	if receiver.received() != 3 {
+		t.Errorf("expected 3 requests, got %v", receiver.received())
+	}
+	if receiver.bodies[0] == nil || string(receiver.bodies[2]) != string(receiver.bodies[0]) {
+		t.Error("expected the replay to send the original payload")
+	}
+}
+
+func TestWebhookIsValid(t *testing.T) {
+	tests := []struct {
+		url     string
+		valid   bool
+		private bool
+	}{
+		{"https://example.com/hooks", true, false},
+		{"http://93.184.216.34:8080/hooks", true, false},
+		{"ftp://example.com/hooks", false, false},
+		{"https:///hooks", false, false},
+		{"http://127.0.0.1/hooks", false, true},
+		{"http://127.1.2.3:9000/hooks", false, true},
+		{"http://localhost:8080/hooks", false, true},
+		{"http://api.localhost/hooks", false, true},
+		{"http://[::1]/hooks", false, true},
+		{"http://0.0.0.0/hooks", false, true},
+		{"http://10.0.0.5/hooks", false, true},
+		{"http://172.16.3.4/hooks", false, true},
+		{"http://192.168.1.1/hooks", false, true},
+		{"http://169.254.169.254/latest/meta-data", false, true},
+		{"http://100.100.100.200/hooks", false, true},
+		{"http://[fd00::1]/hooks", false, true},
+		{"http://[fe80::1]/hooks", false, true},
+		{"http://[::ffff:127.0.0.1]/hooks", false, true},
+	}
+	strict := newTestWebhookDispatcher(newMemoryWebhookRepository(), nil)
+	permissive := newTestWebhookDispatcher(newMemoryWebhookRepository(), &WebhookOptions{AllowPrivateDestinations: true})
+	for _, test := range tests {
+		webhook := newTestWebhook(test.url)
+		if webhook.IsValid() != test.valid {
+			t.Errorf("expected `%v` to be valid: %v", test.url, test.valid)
+		}
+		if strict.IsValidWebhook(&webhook) != test.valid {
+			t.Errorf("expected `%v` to be valid by default: %v", test.url, test.valid)
+		}
+		if permissive.IsValidWebhook(&webhook) != (test.valid || test.private) {
+			t.Errorf("expected `%v` to be valid with private destinations: %v", test.url, test.valid || test.private)
+		}
+	}
+	webhook := newTestWebhook("https://example.com/hooks")
+	webhook.Secret = ""
+	if webhook.IsValid() {
+		t.Error("expected webhooks without secret to be invalid")
+	}
+}
+
+func TestWebhookDeliveryRejectsPrivateDestinations(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	// the webhook is stored as is, for eg: registered before private destinations were disallowed,
+	// or with a name resolving to a private address
+	repo := newMemoryWebhookRepository(newTestWebhook(receiver.URL))
+	dispatcher := newTestWebhookDispatcher(repo, &WebhookOptions{MaxAttempts: 1})
+	dispatcher.HandleEvent(dispatcher.resource, &Event{Type: EventUserCreated})
+	delivery := repo.onlyDelivery(t)
+	if delivery.Status != WebhookDeliveryDead || !strings.Contains(delivery.LastError, "not allowed") {
+		t.Errorf("expected the delivery to fail, got %+v", delivery)
+	}
+
+	// custom clients are guarded too, including those with their own dial
+	dialer := &net.Dialer{}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}}
+	repo = newMemoryWebhookRepository(newTestWebhook(receiver.URL))
+	dispatcher = newTestWebhookDispatcher(repo, &WebhookOptions{MaxAttempts: 1, Client: client})
+	dispatcher.HandleEvent(dispatcher.resource, &Event{Type: EventUserCreated})
+	delivery = repo.onlyDelivery(t)
+	if delivery.Status != WebhookDeliveryDead || !strings.Contains(delivery.LastError, "not allowed") {
+		t.Errorf("expected the delivery of a custom client to fail, got %+v", delivery)
+	}
+	if receiver.received() != 0 {
+		t.Errorf("expected no request to reach the private destination, got %v", receiver.received())
+	}
+
+	repo = newMemoryWebhookRepository(newTestWebhook(receiver.URL))
+	dispatcher = newTestWebhookDispatcher(repo, &WebhookOptions{MaxAttempts: 1, Client: client, AllowPrivateDestinations: true})
+	dispatcher.HandleEvent(dispatcher.resource, &Event{Type: EventUserCreated})
+	if delivery := repo.onlyDelivery(t); delivery.Status != WebhookDeliveryDelivered {
+		t.Errorf("expected the delivery to private destinations once allowed, got %+v", delivery)
+	}
+}